@@ -8,4 +8,16 @@ require (
 	golang.org/x/time v0.11.0
 )
 
-require github.com/google/uuid v1.6.0
+require (
+	github.com/fxamacker/cbor/v2 v2.9.2
+	github.com/golang-jwt/jwt/v5 v5.3.1
+	github.com/google/uuid v1.6.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/sys v0.32.0 // indirect
+)
@@ -0,0 +1,366 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+var (
+	// ErrNotConnected is returned by Send while no connection is established
+	ErrNotConnected = errors.New("client not connected")
+	// ErrConnectionClosed wraps errors from the underlying websocket read. Once
+	// it is returned, no further messages can be read from the connection.
+	ErrConnectionClosed = errors.New("connection closed")
+	// ErrMaxAttempts is returned by Run when reconnecting gave up
+	ErrMaxAttempts = errors.New("maximum reconnect attempts reached")
+	// ErrClientClosed is returned when using a closed client
+	ErrClientClosed = errors.New("client closed")
+)
+
+// Client is a reconnecting websocket client. It runs the same interceptor
+// chain as the server (built from an interceptor.Registry), so protocols like
+// encrypt, pingpong and room work symmetrically from the client side. On every
+// new connection the chain is bound again and Init is rerun.
+type Client struct {
+	id          string
+	url         string
+	settings    *settings
+	registry    *interceptor.Registry
+	interceptor interceptor.Interceptor
+	handler     Handler
+	onState     []StateHandler
+	connection  *interceptor.Conn  // current connection; nil while disconnected
+	writer      interceptor.Writer // fully intercepted writer of the current connection
+	state       State
+	running     bool
+	closed      bool
+	done        chan struct{} // closed when Run returns
+	mux         sync.RWMutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// CreateClient constructs a client that connects to url once Run is called.
+// The id is passed to the interceptor factories and used as this side's
+// sender ID by the interceptors.
+func CreateClient(ctx context.Context, id string, url string, options ...Option) (*Client, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	client := &Client{
+		id:       id,
+		url:      url,
+		settings: &settings{},
+		handler:  noOpHandler{},
+		state:    StateDisconnected,
+		done:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	if err := registerDefaultSettings(client.settings); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	for _, option := range options {
+		if err := option(client); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	if client.handler == nil {
+		client.handler = noOpHandler{}
+	}
+
+	if client.registry == nil {
+		client.interceptor = &interceptor.NoOpInterceptor{}
+	} else {
+		chain, err := client.registry.Build(ctx, id)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		client.interceptor = chain
+	}
+
+	return client, nil
+}
+
+// Run connects and keeps the client connected until the context is cancelled
+// or Close is called, reconnecting with exponential backoff and jitter after
+// every failure. It returns nil on a requested stop and ErrMaxAttempts when
+// the configured number of consecutive attempts failed.
+func (client *Client) Run() error {
+	client.mux.Lock()
+	if client.running || client.closed {
+		client.mux.Unlock()
+		return ErrClientClosed
+	}
+	client.running = true
+	client.mux.Unlock()
+
+	defer close(client.done)
+
+	attempt := 0
+	for {
+		if client.ctx.Err() != nil {
+			return nil
+		}
+
+		client.setState(StateConnecting, nil)
+
+		established, err := client.connect()
+		if established {
+			attempt = 0
+		}
+
+		if client.ctx.Err() != nil {
+			return nil
+		}
+
+		client.setState(StateDisconnected, err)
+
+		attempt++
+		if client.settings.MaxAttempts > 0 && attempt >= client.settings.MaxAttempts {
+			return fmt.Errorf("%w: %w", ErrMaxAttempts, err)
+		}
+
+		select {
+		case <-client.ctx.Done():
+			return nil
+		case <-time.After(client.backoff(attempt)):
+		}
+	}
+}
+
+// connect dials a single connection, binds the interceptor chain, runs Init
+// and reads from the connection until it ends. It reports whether the
+// connection was fully established before it ended.
+func (client *Client) connect() (bool, error) {
+	options := websocket.DialOptions{}
+	if client.settings.DialOptions != nil {
+		options = *client.settings.DialOptions
+	}
+	if len(client.settings.Codecs) > 0 {
+		// Subprotocols of the dial options are kept, in front of the codecs
+		options.Subprotocols = slices.Clone(options.Subprotocols)
+		for _, name := range message.CodecNames(client.settings.Codecs...) {
+			if !slices.Contains(options.Subprotocols, name) {
+				options.Subprotocols = append(options.Subprotocols, name)
+			}
+		}
+	}
+
+	dialCtx, cancel := context.WithTimeout(client.ctx, client.settings.DialTimeout)
+	conn, _, err := websocket.Dial(dialCtx, client.url, &options)
+	cancel()
+	if err != nil {
+		return false, fmt.Errorf("error while dialing %s: %w", client.url, err)
+	}
+	defer func() { _ = conn.CloseNow() }()
+
+	connection := interceptor.WrapConn(conn, nil)
+
+	if client.settings.MessageSizeLimit > 0 {
+		connection.SetReadLimit(client.settings.MessageSizeLimit)
+	}
+
+	if _, _, err := client.interceptor.BindSocketConnection(connection, client, client); err != nil {
+		// Interceptors bound before the failing one keep their state otherwise
+		client.interceptor.UnBindSocketConnection(connection)
+		return false, fmt.Errorf("error while binding connection: %w", err)
+	}
+
+	writer := client.interceptor.InterceptSocketWriter(client)
+	reader := client.interceptor.InterceptSocketReader(client)
+
+	defer func() {
+		client.mux.Lock()
+		client.connection = nil
+		client.writer = nil
+		client.mux.Unlock()
+
+		client.interceptor.UnBindSocketConnection(connection)
+		client.interceptor.UnInterceptSocketReader(reader)
+		client.interceptor.UnInterceptSocketWriter(writer)
+	}()
+
+	// The read loop has to be running before Init, as interceptors like encrypt
+	// block in Init until their handshake messages are read from the connection.
+	done := make(chan error, 1)
+	go func() {
+		done <- client.loop(connection, reader)
+	}()
+
+	if err := client.interceptor.Init(connection); err != nil {
+		_ = connection.Close(websocket.StatusInternalError, "initialisation failed")
+		<-done
+		return false, fmt.Errorf("error while initialising connection: %w", err)
+	}
+
+	client.mux.Lock()
+	client.connection = connection
+	client.writer = writer
+	client.mux.Unlock()
+
+	client.setState(StateConnected, nil)
+
+	return true, <-done
+}
+
+// loop reads messages from the fully intercepted reader until the connection
+// closes, handing every application message to the registered handler.
+func (client *Client) loop(connection *interceptor.Conn, reader interceptor.Reader) error {
+	for {
+		messageType, msg, err := reader.Read(connection)
+		if err != nil {
+			if errors.Is(err, interceptor.ErrMessageConsumed) {
+				continue
+			}
+
+			if !errors.Is(err, ErrConnectionClosed) {
+				fmt.Println("error while reading message:", err.Error())
+				continue
+			}
+
+			if websocket.CloseStatus(err) == websocket.StatusNormalClosure || client.ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		if err := client.handler.Handle(connection, messageType, msg); err != nil {
+			fmt.Println("error while handling message:", err.Error())
+		}
+	}
+}
+
+// backoff returns the delay before the given reconnect attempt: exponential
+// in the attempt number, capped at MaxBackoff, with the upper half jittered
+func (client *Client) backoff(attempt int) time.Duration {
+	delay := client.settings.InitialBackoff
+	for i := 1; i < attempt && delay < client.settings.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > client.settings.MaxBackoff {
+		delay = client.settings.MaxBackoff
+	}
+
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+func (client *Client) setState(state State, err error) {
+	client.mux.Lock()
+	if client.state == state && err == nil {
+		client.mux.Unlock()
+		return
+	}
+	client.state = state
+	handlers := client.onState
+	client.mux.Unlock()
+
+	for _, handler := range handlers {
+		handler(state, err)
+	}
+}
+
+// State returns the current connection state
+func (client *Client) State() State {
+	client.mux.RLock()
+	defer client.mux.RUnlock()
+
+	return client.state
+}
+
+// Send writes the message through the full interceptor chain of the current
+// connection. It fails with ErrNotConnected while reconnecting; messages are
+// not queued.
+func (client *Client) Send(message message.Message) error {
+	client.mux.RLock()
+	connection, writer := client.connection, client.writer
+	client.mux.RUnlock()
+
+	if connection == nil {
+		return ErrNotConnected
+	}
+
+	return writer.Write(connection, websocket.MessageText, message)
+}
+
+// Close stops reconnecting, closes the current connection with a normal
+// closure and shuts down the interceptor chain.
+func (client *Client) Close() error {
+	client.mux.Lock()
+	if client.closed {
+		client.mux.Unlock()
+		return ErrClientClosed
+	}
+	client.closed = true
+	running := client.running
+	connection := client.connection
+	client.mux.Unlock()
+
+	if connection != nil {
+		_ = connection.Close(websocket.StatusNormalClosure, "client closed")
+	}
+	client.cancel()
+
+	if running {
+		<-client.done
+	}
+
+	err := client.interceptor.Close()
+	client.setState(StateClosed, nil)
+
+	return err
+}
+
+// Write is the base writer of the interceptor chain. It encodes the message
+// with the connection's codec and writes it to the connection, in a binary
+// frame for binary codecs.
+func (client *Client) Write(connection interceptor.Connection, messageType websocket.MessageType, msg message.Message) error {
+	ctx, cancel := context.WithTimeout(client.ctx, client.settings.WriteWait)
+	defer cancel()
+
+	codec := interceptor.CodecOf(connection)
+	if codec.Binary() {
+		messageType = websocket.MessageBinary
+	}
+
+	data, err := message.Encode(codec, msg)
+	if err != nil {
+		return err
+	}
+
+	return connection.Write(ctx, messageType, data)
+}
+
+// Read is the base reader of the interceptor chain. It blocks until the next
+// message arrives and decodes it into a message.BaseMessage with the
+// connection's codec.
+func (client *Client) Read(connection interceptor.Connection) (websocket.MessageType, message.Message, error) {
+	messageType, data, err := connection.Read(client.ctx)
+	if err != nil {
+		return websocket.MessageText, nil, fmt.Errorf("%w: %w", ErrConnectionClosed, err)
+	}
+
+	msg, err := message.Decode(interceptor.CodecOf(connection), data)
+	if err != nil {
+		return websocket.MessageText, nil, err
+	}
+
+	return messageType, msg, nil
+}
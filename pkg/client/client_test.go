@@ -0,0 +1,273 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// binder is an interceptor recording the connections bound to, initialised
+// and unbound from it. Binding fails with fail when set.
+type binder struct {
+	interceptor.NoOpInterceptor
+	fail    error
+	bound   chan interceptor.Connection
+	unbound chan interceptor.Connection
+	inits   chan interceptor.Connection
+}
+
+func newBinder(fail error) *binder {
+	return &binder{
+		fail:    fail,
+		bound:   make(chan interceptor.Connection, 16),
+		unbound: make(chan interceptor.Connection, 16),
+		inits:   make(chan interceptor.Connection, 16),
+	}
+}
+
+func (b *binder) NewInterceptor(_ context.Context, _ string) (interceptor.Interceptor, error) {
+	return b, nil
+}
+
+func (b *binder) BindSocketConnection(connection interceptor.Connection, writer interceptor.Writer, reader interceptor.Reader) (interceptor.Writer, interceptor.Reader, error) {
+	if b.fail != nil {
+		return nil, nil, b.fail
+	}
+
+	b.bound <- connection
+	return writer, reader, nil
+}
+
+func (b *binder) Init(connection interceptor.Connection) error {
+	b.inits <- connection
+	return nil
+}
+
+func (b *binder) UnBindSocketConnection(connection interceptor.Connection) {
+	b.unbound <- connection
+}
+
+func registryOf(factories ...interceptor.Factory) *interceptor.Registry {
+	registry := &interceptor.Registry{}
+	for _, factory := range factories {
+		registry.Register(factory)
+	}
+
+	return registry
+}
+
+// serve starts a websocket server handing every accepted connection to
+// accept, and returns its URL. Connections are closed once accept returns.
+func serve(t *testing.T, accept func(conn *websocket.Conn, r *http.Request)) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{"cbor", "json"}})
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.CloseNow() }()
+
+		accept(conn, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// run creates the client and runs it until the test ends. Run's result is
+// delivered on the returned channel.
+func run(t *testing.T, url string, options ...Option) (*Client, chan error) {
+	t.Helper()
+
+	c, err := CreateClient(context.Background(), "client", url, options...)
+	if err != nil {
+		t.Fatalf("CreateClient failed: %v", err)
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- c.Run() }()
+	t.Cleanup(func() { _ = c.Close() })
+
+	return c, result
+}
+
+func receive[T any](t *testing.T, values chan T) T {
+	t.Helper()
+
+	select {
+	case value := <-values:
+		return value
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	var zero T
+	return zero
+}
+
+func TestClient_Dispatch(t *testing.T) {
+	url := serve(t, func(conn *websocket.Conn, _ *http.Request) {
+		data, _ := message.Encode(message.JSON, message.CreateMessageFromData("server", "client", "app", nil))
+		_ = conn.Write(context.Background(), websocket.MessageText, data)
+		_, _, _ = conn.Read(context.Background())
+	})
+
+	messages := make(chan message.Message, 1)
+	handler := HandlerFunc(func(_ interceptor.Connection, _ websocket.MessageType, msg message.Message) error {
+		messages <- msg
+		return nil
+	})
+
+	b := newBinder(nil)
+	c, _ := run(t, url, WithInterceptorRegistry(registryOf(b)), WithHandler(handler))
+
+	bound := receive(t, b.bound)
+	if msg := receive(t, messages); msg.Message().SenderID != "server" {
+		t.Errorf("sender mismatch: got %q, want %q", msg.Message().SenderID, "server")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if unbound := receive(t, b.unbound); unbound != bound {
+		t.Errorf("unbound connection mismatch: got %v, want %v", unbound, bound)
+	}
+	if state := c.State(); state != StateClosed {
+		t.Errorf("state mismatch: got %v, want %v", state, StateClosed)
+	}
+}
+
+func TestClient_BindFailure(t *testing.T) {
+	url := serve(t, func(conn *websocket.Conn, _ *http.Request) {
+		_, _, _ = conn.Read(context.Background())
+	})
+
+	first, failing := newBinder(nil), newBinder(errors.New("rejected"))
+	_, result := run(t, url, WithInterceptorRegistry(registryOf(first, failing)), WithMaxAttempts(1))
+
+	if err := receive(t, result); !errors.Is(err, ErrMaxAttempts) {
+		t.Errorf("expected ErrMaxAttempts, got %v", err)
+	}
+
+	// Interceptors bound before the failing one are unbound again
+	bound := receive(t, first.bound)
+	if unbound := receive(t, first.unbound); unbound != bound {
+		t.Errorf("unbound connection mismatch: got %v, want %v", unbound, bound)
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	// The server drops the first connections right away
+	var accepted atomic.Int32
+	url := serve(t, func(conn *websocket.Conn, _ *http.Request) {
+		if accepted.Add(1) < 3 {
+			return
+		}
+		_, _, _ = conn.Read(context.Background())
+	})
+
+	connected := make(chan struct{}, 8)
+	b := newBinder(nil)
+	c, _ := run(t, url,
+		WithInterceptorRegistry(registryOf(b)),
+		WithBackoff(time.Millisecond, 5*time.Millisecond),
+		WithStateHandler(func(state State, _ error) {
+			if state == StateConnected {
+				connected <- struct{}{}
+			}
+		}),
+	)
+
+	// Init is rerun on every connection
+	seen := make(map[interceptor.Connection]bool)
+	for range 3 {
+		seen[receive(t, b.inits)] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Init ran on %d distinct connections, want 3", len(seen))
+	}
+
+	receive(t, connected)
+	if err := c.Send(message.CreateMessageFromData("client", "server", "app", nil)); err != nil {
+		t.Errorf("Send failed: %v", err)
+	}
+}
+
+func TestClient_MaxAttempts(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	server.Close()
+
+	var attempts atomic.Int32
+	c, result := run(t, url,
+		WithMaxAttempts(3),
+		WithBackoff(time.Millisecond, 2*time.Millisecond),
+		WithStateHandler(func(state State, _ error) {
+			if state == StateConnecting {
+				attempts.Add(1)
+			}
+		}),
+	)
+
+	if err := receive(t, result); !errors.Is(err, ErrMaxAttempts) {
+		t.Errorf("expected ErrMaxAttempts, got %v", err)
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("attempts mismatch: got %d, want 3", n)
+	}
+	if err := c.Send(message.CreateMessageFromData("client", "server", "app", nil)); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected, got %v", err)
+	}
+}
+
+func TestClient_Backoff(t *testing.T) {
+	c, err := CreateClient(context.Background(), "client", "ws://localhost", WithBackoff(100*time.Millisecond, time.Second))
+	if err != nil {
+		t.Fatalf("CreateClient failed: %v", err)
+	}
+
+	for attempt, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		9: time.Second,
+	} {
+		for range 20 {
+			if delay := c.backoff(attempt); delay < want/2 || delay > want {
+				t.Errorf("backoff of attempt %d out of range: got %v, want between %v and %v", attempt, delay, want/2, want)
+			}
+		}
+	}
+}
+
+func TestClient_Subprotocols(t *testing.T) {
+	offered := make(chan []string, 1)
+	url := serve(t, func(conn *websocket.Conn, r *http.Request) {
+		offered <- strings.Split(strings.ReplaceAll(r.Header.Get("Sec-WebSocket-Protocol"), " ", ""), ",")
+		_, _, _ = conn.Read(context.Background())
+	})
+
+	options := &websocket.DialOptions{Subprotocols: []string{"custom"}}
+	run(t, url, WithDialOptions(options), WithCodecs(message.CBOR, message.JSON))
+
+	want := []string{"custom", "cbor", "json"}
+	if got := receive(t, offered); !slices.Equal(got, want) {
+		t.Errorf("subprotocols mismatch: got %v, want %v", got, want)
+	}
+	if !slices.Equal(options.Subprotocols, []string{"custom"}) {
+		t.Errorf("dial options modified: got %v", options.Subprotocols)
+	}
+}
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// Option defines a function type that configures a Client instance
+type Option = func(*Client) error
+
+type settings struct {
+	// Dialing
+	DialOptions *websocket.DialOptions
+	DialTimeout time.Duration
+
+	// Reconnects
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxAttempts    int // consecutive failed attempts before giving up; 0 retries forever
+
+	// WebSocket specific
+	WriteWait        time.Duration
+	MessageSizeLimit int64
+	Codecs           []message.Codec // Codecs requested through subprotocol negotiation
+}
+
+func registerDefaultSettings(settings *settings) error {
+	settings.DialOptions = &websocket.DialOptions{}
+	settings.DialTimeout = 10 * time.Second
+	settings.InitialBackoff = 500 * time.Millisecond
+	settings.MaxBackoff = 30 * time.Second
+	settings.WriteWait = 10 * time.Second
+
+	return nil
+}
+
+// WithInterceptorRegistry sets the registry the client's interceptor chain is
+// built from. Use the same factories as the server endpoint to run the
+// encrypt, pingpong or room protocols from the client side.
+func WithInterceptorRegistry(registry *interceptor.Registry) Option {
+	return func(client *Client) error {
+		client.registry = registry
+		return nil
+	}
+}
+
+// WithHandler registers the handler receiving every application message
+func WithHandler(handler Handler) Option {
+	return func(client *Client) error {
+		client.handler = handler
+		return nil
+	}
+}
+
+// WithStateHandler registers a callback notified on every state change
+func WithStateHandler(handler StateHandler) Option {
+	return func(client *Client) error {
+		client.onState = append(client.onState, handler)
+		return nil
+	}
+}
+
+// WithDialOptions sets the options (headers, subprotocols, compression, HTTP
+// client) used for every dial
+func WithDialOptions(options *websocket.DialOptions) Option {
+	return func(client *Client) error {
+		client.settings.DialOptions = options
+		return nil
+	}
+}
+
+// WithCodecs requests the codecs, in order of preference, through the
+// WebSocket subprotocol. They are offered after the subprotocols set through
+// WithDialOptions. The connection uses the codec the server selected, or JSON
+// when it selected none.
+func WithCodecs(codecs ...message.Codec) Option {
+	return func(client *Client) error {
+		for _, codec := range codecs {
+			if err := message.RegisterCodec(codec); err != nil {
+				return err
+			}
+		}
+		client.settings.Codecs = codecs
+		return nil
+	}
+}
+
+// WithDialTimeout bounds a single dial attempt
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(client *Client) error {
+		client.settings.DialTimeout = timeout
+		return nil
+	}
+}
+
+// WithBackoff sets the exponential backoff between reconnect attempts. The
+// delay starts at initial, doubles after every failed attempt up to max and
+// is jittered randomly.
+func WithBackoff(initial, max time.Duration) Option {
+	return func(client *Client) error {
+		if initial <= 0 || max < initial {
+			return errors.New("invalid backoff")
+		}
+		client.settings.InitialBackoff = initial
+		client.settings.MaxBackoff = max
+		return nil
+	}
+}
+
+// WithMaxAttempts gives up reconnecting after attempts consecutive failures.
+// Zero retries forever.
+func WithMaxAttempts(attempts int) Option {
+	return func(client *Client) error {
+		client.settings.MaxAttempts = attempts
+		return nil
+	}
+}
+
+// WithWriteWait bounds the time a single write may take
+func WithWriteWait(wait time.Duration) Option {
+	return func(client *Client) error {
+		if wait <= 0 {
+			return errors.New("write wait must be positive")
+		}
+		client.settings.WriteWait = wait
+		return nil
+	}
+}
+
+// WithMessageSizeLimit sets the maximum size in bytes of a single inbound message
+func WithMessageSizeLimit(limit int64) Option {
+	return func(client *Client) error {
+		client.settings.MessageSizeLimit = limit
+		return nil
+	}
+}
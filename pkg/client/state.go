@@ -0,0 +1,35 @@
+package client
+
+// State describes where a Client is in its connection lifecycle
+type State int
+
+const (
+	// StateDisconnected is the state before Run and between reconnect attempts
+	StateDisconnected State = iota
+	// StateConnecting is entered when a dial attempt starts
+	StateConnecting
+	// StateConnected is entered once the dial succeeded and Init completed on
+	// every interceptor
+	StateConnected
+	// StateClosed is final; the client does not reconnect anymore
+	StateClosed
+)
+
+func (state State) String() string {
+	switch state {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// StateHandler is notified on every state change. err carries the reason for
+// entering StateDisconnected or StateClosed, and is nil otherwise.
+type StateHandler = func(state State, err error)
@@ -1 +1,190 @@
 package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"time"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+)
+
+// Option defines a function type that configures an Interceptor instance
+type Option = func(*Interceptor) error
+
+// InterceptorFactory creates auth interceptors with a predefined set of options.
+// It implements the interceptor.Factory interface.
+type InterceptorFactory struct {
+	opts []Option
+}
+
+// WithHMACSecret accepts HS256 tokens signed with secret
+func WithHMACSecret(secret []byte) Option {
+	return func(interceptor *Interceptor) error {
+		if len(secret) == 0 {
+			return errors.New("empty hmac secret")
+		}
+		interceptor.keys.add(key{value: secret})
+		return nil
+	}
+}
+
+// WithRSAPublicKey accepts RS256 tokens signed with the matching private key
+func WithRSAPublicKey(publicKey *rsa.PublicKey) Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.keys.add(key{value: publicKey})
+		return nil
+	}
+}
+
+// WithEd25519PublicKey accepts EdDSA tokens signed with the matching private key
+func WithEd25519PublicKey(publicKey ed25519.PublicKey) Option {
+	return func(interceptor *Interceptor) error {
+		if len(publicKey) != ed25519.PublicKeySize {
+			return errors.New("invalid ed25519 public key")
+		}
+		interceptor.keys.add(key{value: publicKey})
+		return nil
+	}
+}
+
+// WithJWKSFile accepts tokens signed with the keys of a JWKS document on disk.
+// The file is read when the interceptor is created.
+func WithJWKSFile(path string) Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.keys.sources = append(interceptor.keys.sources, jwksSource{path: path})
+		return nil
+	}
+}
+
+// WithJWKSURL accepts tokens signed with the keys of a JWKS document served
+// over HTTP, such as the local endpoint of an identity provider. The document
+// is fetched when the interceptor is created and then every refresh interval;
+// zero disables refreshing.
+func WithJWKSURL(url string, refresh time.Duration) Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.keys.sources = append(interceptor.keys.sources, jwksSource{url: url, refresh: refresh})
+		return nil
+	}
+}
+
+// WithAudience requires tokens to be issued for audience
+func WithAudience(audience string) Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.audience = audience
+		return nil
+	}
+}
+
+// WithIssuer requires tokens to be issued by issuer
+func WithIssuer(issuer string) Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.issuer = issuer
+		return nil
+	}
+}
+
+// WithLeeway tolerates clock skew when checking exp and nbf
+func WithLeeway(leeway time.Duration) Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.leeway = leeway
+		return nil
+	}
+}
+
+// WithRoleClaims sets the claims whose values are granted as roles to the
+// token's subject, replacing the default "roles" and "groups"
+func WithRoleClaims(names ...string) Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.roleClaims = names
+		return nil
+	}
+}
+
+// WithAuthorizationHeader reads the token from the "Authorization: Bearer"
+// header of the upgrade request
+func WithAuthorizationHeader() Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.sources = append(interceptor.sources, fromHeader)
+		return nil
+	}
+}
+
+// WithQueryParameter reads the token from the named query parameter of the
+// upgrade request, for clients such as browsers that cannot set headers
+func WithQueryParameter(name string) Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.sources = append(interceptor.sources, fromQuery(name))
+		return nil
+	}
+}
+
+// WithFirstMessage lets clients without a token in the upgrade request
+// authenticate with an Authenticate frame as their first message, within
+// timeout. Any other first message rejects the connection.
+func WithFirstMessage(timeout time.Duration) Option {
+	return func(interceptor *Interceptor) error {
+		if timeout <= 0 {
+			return errors.New("first message timeout must be positive")
+		}
+		interceptor.firstMessage = timeout
+		return nil
+	}
+}
+
+// WithToken makes the interceptor authenticate this side of the connection
+// instead of verifying the peer: Init sends the token in an Authenticate frame
+// and waits for the server to confirm it. Use it on the client together with a
+// server accepting first message authentication.
+func WithToken(token string, timeout time.Duration) Option {
+	return func(interceptor *Interceptor) error {
+		if token == "" || timeout <= 0 {
+			return errors.New("invalid token or timeout")
+		}
+		interceptor.token = token
+		interceptor.firstMessage = timeout
+		return nil
+	}
+}
+
+// CreateInterceptorFactory constructs a new factory that will create auth
+// interceptors with the provided options. Without any of WithAuthorizationHeader,
+// WithQueryParameter or WithFirstMessage, tokens are read from the Authorization
+// header and the "access_token" query parameter.
+func CreateInterceptorFactory(options ...Option) *InterceptorFactory {
+	return &InterceptorFactory{
+		opts: options,
+	}
+}
+
+// NewInterceptor creates and configures a new auth interceptor instance and
+// loads its JWKS documents. This method implements the interceptor.Factory
+// interface.
+func (factory *InterceptorFactory) NewInterceptor(ctx context.Context, id string) (interceptor.Interceptor, error) {
+	authInterceptor := &Interceptor{
+		NoOpInterceptor: interceptor.NoOpInterceptor{
+			ID:  id,
+			Ctx: ctx,
+		},
+		states:     make(map[interceptor.Connection]*state),
+		keys:       &keySet{},
+		roleClaims: []string{"roles", "groups"},
+	}
+
+	for _, option := range factory.opts {
+		if err := option(authInterceptor); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(authInterceptor.sources) == 0 && authInterceptor.firstMessage == 0 {
+		authInterceptor.sources = []source{fromHeader, fromQuery("access_token")}
+	}
+
+	if err := authInterceptor.keys.load(ctx); err != nil {
+		return nil, err
+	}
+
+	return authInterceptor, nil
+}
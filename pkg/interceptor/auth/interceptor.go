@@ -1,19 +1,381 @@
 package auth
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/coder/websocket"
+	"github.com/golang-jwt/jwt/v5"
 
 	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+var (
+	ErrMissingToken       = errors.New("missing bearer token")
+	ErrInvalidToken       = errors.New("invalid bearer token")
+	ErrUnauthenticated    = errors.New("connection not authenticated")
+	ErrAuthTimeout        = errors.New("authentication timed out")
+	ErrConnectionNotFound = errors.New("connection not registered")
+	ErrInvalidInterceptor = errors.New("inappropriate interceptor for the payload")
 )
 
+// claimsKey is the connection attribute key of the verified claims
+type claimsKey struct{}
+
+// ClaimsOf returns the verified JWT claims of the peer of an authenticated
+// connection
+func ClaimsOf(connection interceptor.Connection) (jwt.MapClaims, bool) {
+	value, exists := interceptor.AttributeOf(connection, claimsKey{})
+	if !exists {
+		return nil, false
+	}
+
+	claims, ok := value.(jwt.MapClaims)
+	return claims, ok
+}
+
+// rolesOf collects the roles granted by the named claims, each either a
+// single string or an array of strings
+func rolesOf(claims jwt.MapClaims, names []string) []string {
+	var roles []string
+	for _, name := range names {
+		switch value := claims[name].(type) {
+		case string:
+			roles = append(roles, value)
+		case []any:
+			for _, role := range value {
+				if role, ok := role.(string); ok {
+					roles = append(roles, role)
+				}
+			}
+		}
+	}
+
+	return roles
+}
+
+// source extracts a bearer token from the upgrade request
+type source func(*http.Request) string
+
+func fromHeader(request *http.Request) string {
+	scheme, token, found := strings.Cut(request.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(token)
+}
+
+func fromQuery(name string) source {
+	return func(request *http.Request) string {
+		return request.URL.Query().Get(name)
+	}
+}
+
+// state tracks the authentication of a single connection
+type state struct {
+	*interceptor.Outcome
+	writer interceptor.Writer
+	expiry *time.Timer // closes the connection when the token expires
+}
+
+// Interceptor authenticates connections with JWT bearer tokens signed with
+// HS256, RS256 or EdDSA. Tokens are taken from the upgrade request when the
+// connection is bound, so that invalid tokens are rejected before any
+// interceptor runs Init, or from the first message, which Init waits for.
+// Register it first, so that no other interceptor initialises an
+// unauthenticated connection. The token's subject is bound as the connection's
+// identity (see interceptor.IdentityOf), its "roles" and "groups" claims are
+// granted as roles (see interceptor.RolesOf) and the verified claims are
+// available through ClaimsOf.
 type Interceptor struct {
 	interceptor.NoOpInterceptor
+	states       map[interceptor.Connection]*state
+	keys         *keySet
+	sources      []source
+	audience     string
+	issuer       string
+	leeway       time.Duration
+	roleClaims   []string      // Claims granting roles to the subject
+	firstMessage time.Duration // Zero disables first message authentication
+	token        string        // Token sent to the peer; set on the client side
 }
 
-func (auth *Interceptor) BindSocketConnection(connection *websocket.Conn) error {
+func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, writer interceptor.Writer, reader interceptor.Reader) (interceptor.Writer, interceptor.Reader, error) {
+	state := &state{
+		writer:  writer,
+		Outcome: interceptor.NewOutcome(),
+	}
+
+	i.Mutex.Lock()
+	if _, exists := i.states[connection]; exists {
+		i.Mutex.Unlock()
+		return nil, nil, errors.New("connection already exists")
+	}
+	i.states[connection] = state
+	i.Mutex.Unlock()
+
+	if i.token != "" {
+		return writer, reader, nil
+	}
+
+	token := ""
+	if request, ok := interceptor.RequestOf(connection); ok {
+		for _, source := range i.sources {
+			if token = source(request); token != "" {
+				break
+			}
+		}
+	}
+
+	if token == "" {
+		if i.firstMessage > 0 {
+			return writer, reader, nil
+		}
+		state.Complete(ErrMissingToken)
+	} else {
+		state.Complete(i.authenticate(connection, state, token))
+	}
+
+	if _, err := state.Result(); err != nil {
+		// Rejected connections are not bound
+		i.Mutex.Lock()
+		delete(i.states, connection)
+		i.Mutex.Unlock()
+
+		interceptor.Reject(connection, err)
+		return nil, nil, err
+	}
+
+	return writer, reader, nil
+}
+
+// Init sends this side's token when configured with WithToken. Otherwise it
+// waits for first message authentication to complete and closes the
+// connection with StatusPolicyViolation when it fails.
+func (i *Interceptor) Init(connection interceptor.Connection) error {
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	if i.token != "" {
+		msg, err := message.CreateMessage(i.ID, "unknown", &Authenticate{Token: i.token})
+		if err != nil {
+			return err
+		}
+		if err := state.writer.Write(connection, websocket.MessageText, msg); err != nil {
+			return err
+		}
+	}
+
+	timer := time.NewTimer(i.firstMessage)
+	defer timer.Stop()
+
+	select {
+	case <-state.Done():
+	case <-timer.C:
+		state.Complete(ErrAuthTimeout)
+	case <-i.Ctx.Done():
+		state.Complete(i.Ctx.Err())
+	}
+
+	if _, err := state.Result(); err != nil {
+		if i.token == "" {
+			interceptor.Reject(connection, err)
+		}
+		return err
+	}
+
 	return nil
 }
 
-func (auth *Interceptor) Close() error {
+func (i *Interceptor) InterceptSocketReader(reader interceptor.Reader) interceptor.Reader {
+	return interceptor.ReaderFunc(func(conn interceptor.Connection) (messageType websocket.MessageType, m message.Message, err error) {
+		messageType, m, err = reader.Read(conn)
+		if err != nil {
+			return messageType, m, err
+		}
+
+		state, err := i.getState(conn)
+		if err != nil {
+			return messageType, m, nil
+		}
+
+		payload, err := interceptor.Decode(protocolMap, m)
+		if err == nil {
+			if err := payload.Process(i, conn); err != nil {
+				fmt.Println("error while processing auth message:", err.Error())
+			}
+			return messageType, m, interceptor.ErrMessageConsumed
+		}
+
+		completed, authErr := state.Result()
+		if completed && authErr == nil {
+			return messageType, m, nil
+		}
+
+		// Nothing but the token may be read from an unauthenticated peer
+		state.Complete(ErrUnauthenticated)
+		return messageType, m, interceptor.ErrMessageConsumed
+	})
+}
+
+func (i *Interceptor) UnBindSocketConnection(connection interceptor.Connection) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	if state, exists := i.states[connection]; exists {
+		state.Complete(ErrUnauthenticated)
+		if state.expiry != nil {
+			state.expiry.Stop()
+		}
+		delete(i.states, connection)
+	}
+}
+
+func (i *Interceptor) Close() error {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	for _, state := range i.states {
+		state.Complete(ErrUnauthenticated)
+		if state.expiry != nil {
+			state.expiry.Stop()
+		}
+	}
+	i.states = make(map[interceptor.Connection]*state)
+
+	return nil
+}
+
+func (i *Interceptor) getState(connection interceptor.Connection) (*state, error) {
+	i.Mutex.RLock()
+	defer i.Mutex.RUnlock()
+
+	state, exists := i.states[connection]
+	if !exists {
+		return nil, ErrConnectionNotFound
+	}
+
+	return state, nil
+}
+
+// authenticate verifies the token, attaches its claims to the connection and
+// arms a timer closing the connection once the token expires
+func (i *Interceptor) authenticate(connection interceptor.Connection, state *state, token string) error {
+	claims, err := i.verify(token)
+	if err != nil {
+		return err
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return fmt.Errorf("%w: missing sub claim", ErrInvalidToken)
+	}
+
+	// The subject becomes the fixed principal of the connection
+	if err := interceptor.BindIdentity(connection, subject); err != nil {
+		return err
+	}
+	if err := interceptor.BindRoles(connection, rolesOf(claims, i.roleClaims)...); err != nil {
+		return err
+	}
+	interceptor.SetAttribute(connection, claimsKey{}, claims)
+
+	if expiry, err := claims.GetExpirationTime(); err == nil && expiry != nil {
+		i.Mutex.Lock()
+		state.expiry = time.AfterFunc(time.Until(expiry.Time)+i.leeway, func() {
+			interceptor.Reject(connection, errors.New("token expired"))
+		})
+		i.Mutex.Unlock()
+	}
+
+	return nil
+}
+
+func (i *Interceptor) verify(token string) (jwt.MapClaims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(i.leeway),
+	}
+	if i.audience != "" {
+		options = append(options, jwt.WithAudience(i.audience))
+	}
+	if i.issuer != "" {
+		options = append(options, jwt.WithIssuer(i.issuer))
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, i.keys.keyfunc, options...); err != nil {
+		if errors.Is(err, ErrInvalidToken) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	return claims, nil
+}
+
+func (payload *Authenticate) Process(i interceptor.Interceptor, connection interceptor.Connection) error {
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
+	auth, ok := i.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	state, err := auth.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	// Only the first token of a connection is considered
+	if completed, _ := state.Result(); completed || auth.token != "" || auth.firstMessage == 0 {
+		return nil
+	}
+
+	if err := auth.authenticate(connection, state, payload.Token); err != nil {
+		state.Complete(err)
+		return err
+	}
+
+	principal, _ := interceptor.IdentityOf(connection)
+	msg, err := message.CreateMessage(auth.ID, principal, &Authenticated{Subject: principal})
+	if err != nil {
+		state.Complete(err)
+		return err
+	}
+	if err := state.writer.Write(connection, websocket.MessageText, msg); err != nil {
+		state.Complete(err)
+		return err
+	}
+
+	state.Complete(nil)
+	return nil
+}
+
+func (payload *Authenticated) Process(i interceptor.Interceptor, connection interceptor.Connection) error {
+	auth, ok := i.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	state, err := auth.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	if auth.token != "" {
+		state.Complete(nil)
+	}
+
 	return nil
 }
@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/client"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/interceptortest"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+	"github.com/harshabose/skyline_sonata/serve/pkg/socket"
+)
+
+func create(t *testing.T, options ...Option) *Interceptor {
+	t.Helper()
+
+	i, err := CreateInterceptorFactory(options...).NewInterceptor(context.Background(), "server")
+	if err != nil {
+		t.Fatalf("NewInterceptor failed: %v", err)
+	}
+
+	return i.(*Interceptor)
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key any, claims jwt.MapClaims, kid string) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString failed: %v", err)
+	}
+
+	return signed
+}
+
+func claims(modify func(jwt.MapClaims)) jwt.MapClaims {
+	c := jwt.MapClaims{
+		"sub": "alice",
+		"aud": "serve",
+		"iss": "issuer",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"nbf": time.Now().Add(-time.Minute).Unix(),
+	}
+	if modify != nil {
+		modify(c)
+	}
+
+	return c
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	i := create(t,
+		WithHMACSecret(secret),
+		WithRSAPublicKey(&rsaKey.PublicKey),
+		WithEd25519PublicKey(edPublic),
+		WithAudience("serve"),
+		WithIssuer("issuer"),
+	)
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"HS256", sign(t, jwt.SigningMethodHS256, secret, claims(nil), ""), true},
+		{"RS256", sign(t, jwt.SigningMethodRS256, rsaKey, claims(nil), ""), true},
+		{"EdDSA", sign(t, jwt.SigningMethodEdDSA, edPrivate, claims(nil), ""), true},
+		{"wrong secret", sign(t, jwt.SigningMethodHS256, []byte("other"), claims(nil), ""), false},
+		{"expired", sign(t, jwt.SigningMethodHS256, secret, claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }), ""), false},
+		{"missing exp", sign(t, jwt.SigningMethodHS256, secret, claims(func(c jwt.MapClaims) { delete(c, "exp") }), ""), false},
+		{"not yet valid", sign(t, jwt.SigningMethodHS256, secret, claims(func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(time.Hour).Unix() }), ""), false},
+		{"wrong audience", sign(t, jwt.SigningMethodHS256, secret, claims(func(c jwt.MapClaims) { c["aud"] = "other" }), ""), false},
+		{"wrong issuer", sign(t, jwt.SigningMethodHS256, secret, claims(func(c jwt.MapClaims) { c["iss"] = "other" }), ""), false},
+		{"none", sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims(nil), ""), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := i.verify(test.token)
+			if test.valid && err != nil {
+				t.Errorf("expected valid token, got %v", err)
+			}
+			if !test.valid && !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("expected ErrInvalidToken, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerify_JWKSFile(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": encode(edPublic)},
+		{"kty": "EC", "kid": "ec", "crv": "P-256"},
+	}})
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	i := create(t, WithJWKSFile(path))
+
+	if _, err := i.verify(sign(t, jwt.SigningMethodRS256, rsaKey, claims(nil), "rsa")); err != nil {
+		t.Errorf("RS256 token with kid rejected: %v", err)
+	}
+	if _, err := i.verify(sign(t, jwt.SigningMethodEdDSA, edPrivate, claims(nil), "ed")); err != nil {
+		t.Errorf("EdDSA token with kid rejected: %v", err)
+	}
+	if _, err := i.verify(sign(t, jwt.SigningMethodRS256, rsaKey, claims(nil), "unknown")); err == nil {
+		t.Error("token with unknown kid accepted")
+	}
+}
+
+func TestRolesOf(t *testing.T) {
+	c := claims(func(c jwt.MapClaims) {
+		c["roles"] = "operator"
+		c["groups"] = []any{"group-x", 42, "group-y"}
+	})
+
+	want := []string{"operator", "group-x", "group-y"}
+	if roles := rolesOf(c, []string{"roles", "groups", "missing"}); !slices.Equal(roles, want) {
+		t.Errorf("roles mismatch: got %v, want %v", roles, want)
+	}
+}
+
+// serve starts a socket running the auth interceptor and returns its URL
+// together with a channel receiving the subject of every application message
+func serve(t *testing.T, options ...Option) (string, chan string) {
+	t.Helper()
+
+	registry := &interceptor.Registry{}
+	registry.Register(CreateInterceptorFactory(options...))
+
+	subjects := make(chan string, 1)
+	url := interceptortest.Serve(t, registry, socket.WithHandler(socket.HandlerFunc(func(connection interceptor.Connection, _ websocket.MessageType, _ message.Message) error {
+		claims, _ := ClaimsOf(connection)
+		sub, _ := claims.GetSubject()
+		subjects <- sub
+		return nil
+	})))
+
+	return url, subjects
+}
+
+func TestAuthenticate_Header(t *testing.T) {
+	secret := []byte("secret")
+	url, subjects := serve(t, WithHMACSecret(secret))
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+sign(t, jwt.SigningMethodHS256, secret, claims(nil), ""))
+
+	if _, err := interceptortest.Dial(t, url, "client", client.WithDialOptions(&websocket.DialOptions{HTTPHeader: header})); err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	if sub := <-subjects; sub != "alice" {
+		t.Errorf("subject mismatch: got %q, want %q", sub, "alice")
+	}
+
+	conn, _, err := websocket.Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = conn.CloseNow() }()
+
+	if _, _, err := conn.Read(context.Background()); websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Errorf("expected StatusPolicyViolation for missing token, got %v", err)
+	}
+}
+
+// upgrade is a connection known by its upgrade request only
+type upgrade struct{ request *http.Request }
+
+func (u *upgrade) Write(_ context.Context, _ websocket.MessageType, _ []byte) error { return nil }
+
+func (u *upgrade) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	<-ctx.Done()
+	return websocket.MessageText, nil, ctx.Err()
+}
+
+func (u *upgrade) Request() *http.Request { return u.request }
+
+func TestAuthenticate_Rejected(t *testing.T) {
+	secret := []byte("secret")
+	i := create(t, WithHMACSecret(secret))
+
+	for name, token := range map[string]string{
+		"missing token": "",
+		"invalid token": sign(t, jwt.SigningMethodHS256, []byte("other"), claims(nil), ""),
+	} {
+		request, _ := http.NewRequest(http.MethodGet, "/", nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		if _, _, err := i.BindSocketConnection(&upgrade{request: request}, nil, nil); err == nil {
+			t.Errorf("upgrade with %s accepted", name)
+		}
+	}
+
+	// Rejected upgrades leave no state behind
+	if len(i.states) != 0 {
+		t.Errorf("states mismatch: got %d, want 0", len(i.states))
+	}
+}
+
+func TestAuthenticate_FirstMessage(t *testing.T) {
+	secret := []byte("secret")
+	url, subjects := serve(t, WithHMACSecret(secret), WithFirstMessage(time.Second))
+
+	token := sign(t, jwt.SigningMethodHS256, secret, claims(nil), "")
+	registry := &interceptor.Registry{}
+	registry.Register(CreateInterceptorFactory(WithToken(token, time.Second)))
+
+	if _, err := interceptortest.Dial(t, url, "client", client.WithInterceptorRegistry(registry)); err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	if sub := <-subjects; sub != "alice" {
+		t.Errorf("subject mismatch: got %q, want %q", sub, "alice")
+	}
+
+	invalid := &interceptor.Registry{}
+	invalid.Register(CreateInterceptorFactory(WithToken(sign(t, jwt.SigningMethodHS256, []byte("other"), claims(nil), ""), time.Second)))
+
+	if _, err := interceptortest.Dial(t, url, "client", client.WithInterceptorRegistry(invalid)); err == nil {
+		t.Error("connection with invalid token accepted")
+	}
+}
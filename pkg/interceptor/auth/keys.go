@@ -0,0 +1,256 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// key is a verification key, optionally identified by the JWK key ID
+type key struct {
+	id    string
+	value any // []byte for HS256, *rsa.PublicKey for RS256, ed25519.PublicKey for EdDSA
+}
+
+func (k key) supports(method jwt.SigningMethod) bool {
+	switch k.value.(type) {
+	case []byte:
+		return method == jwt.SigningMethodHS256
+	case *rsa.PublicKey:
+		return method == jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		return method == jwt.SigningMethodEdDSA
+	default:
+		return false
+	}
+}
+
+// keySet holds the configured keys and the keys loaded from JWKS sources,
+// which are replaced as a whole on every refresh
+type keySet struct {
+	static  []key
+	sources []jwksSource
+	jwks    map[jwksSource][]key
+	mux     sync.RWMutex
+}
+
+func (set *keySet) add(k key) {
+	set.mux.Lock()
+	defer set.mux.Unlock()
+
+	set.static = append(set.static, k)
+}
+
+// keyfunc selects the keys a token may be signed with: the keys matching its
+// algorithm and, when the token names one, its key ID
+func (set *keySet) keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	set.mux.RLock()
+	defer set.mux.RUnlock()
+
+	candidates := make([]jwt.VerificationKey, 0)
+	consider := func(keys []key) {
+		for _, k := range keys {
+			if !k.supports(token.Method) || (kid != "" && k.id != "" && k.id != kid) {
+				continue
+			}
+			candidates = append(candidates, k.value)
+		}
+	}
+
+	consider(set.static)
+	for _, keys := range set.jwks {
+		consider(keys)
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("%w: no key for alg %s and kid %q", ErrInvalidToken, token.Method.Alg(), kid)
+	case 1:
+		return candidates[0], nil
+	default:
+		return jwt.VerificationKeySet{Keys: candidates}, nil
+	}
+}
+
+// load fetches every JWKS source once and, for sources with a refresh
+// interval, keeps refreshing them until ctx is done
+func (set *keySet) load(ctx context.Context) error {
+	for _, source := range set.sources {
+		keys, err := source.fetch(ctx)
+		if err != nil {
+			return err
+		}
+		set.store(source, keys)
+
+		if source.refresh > 0 {
+			go set.refresh(ctx, source)
+		}
+	}
+
+	return nil
+}
+
+func (set *keySet) refresh(ctx context.Context, source jwksSource) {
+	ticker := time.NewTicker(source.refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			keys, err := source.fetch(ctx)
+			if err != nil {
+				fmt.Println("error while refreshing jwks:", err.Error())
+				continue
+			}
+			set.store(source, keys)
+		}
+	}
+}
+
+func (set *keySet) store(source jwksSource, keys []key) {
+	set.mux.Lock()
+	defer set.mux.Unlock()
+
+	if set.jwks == nil {
+		set.jwks = make(map[jwksSource][]key)
+	}
+	set.jwks[source] = keys
+}
+
+// jwksSource is a JSON Web Key Set read from a file or fetched over HTTP
+type jwksSource struct {
+	path    string
+	url     string
+	refresh time.Duration
+}
+
+func (source jwksSource) fetch(ctx context.Context) ([]key, error) {
+	var (
+		data []byte
+		err  error
+	)
+
+	if source.path != "" {
+		data, err = os.ReadFile(source.path)
+	} else {
+		data, err = fetchURL(ctx, source.url)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while loading jwks: %w", err)
+	}
+
+	return parseJWKS(data)
+}
+
+func fetchURL(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", response.Status, url)
+	}
+
+	return io.ReadAll(io.LimitReader(response.Body, 1<<20))
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	K   string `json:"k"`
+}
+
+// parseJWKS parses the signature keys of a JWKS document. Key types other
+// than RSA, Ed25519 and symmetric keys are skipped.
+func parseJWKS(data []byte) ([]key, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("error while parsing jwks: %w", err)
+	}
+
+	keys := make([]key, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		value, err := k.value()
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing jwk %q: %w", k.Kid, err)
+		}
+		if value == nil {
+			continue
+		}
+
+		keys = append(keys, key{id: k.Kid, value: value})
+	}
+
+	return keys, nil
+}
+
+func (k jwk) value() (any, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch {
+	case k.Kty == "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	case k.Kty == "oct":
+		return decode(k.K)
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"encoding/json"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+var (
+	ProtocolAuthenticate  message.Protocol = "auth_token"
+	ProtocolAuthenticated message.Protocol = "auth_ok"
+)
+
+var protocolMap = message.CreateProtocolRegistry()
+
+func init() {
+	message.MustRegister[Authenticate](protocolMap)
+	message.MustRegister[Authenticated](protocolMap)
+}
+
+// Authenticate carries the bearer token of a client that authenticates with
+// its first message instead of the upgrade request
+type Authenticate struct {
+	message.BaseMessage        // NOTE: EMPTY PAYLOAD
+	Token               string `json:"token"`
+}
+
+func (payload *Authenticate) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *Authenticate) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+func (payload *Authenticate) Protocol() message.Protocol {
+	return ProtocolAuthenticate
+}
+
+func (payload *Authenticate) Validate() error {
+	if payload.Token == "" {
+		return message.ErrorNotValid
+	}
+	return nil
+}
+
+// Authenticated confirms a successful first message authentication
+type Authenticated struct {
+	message.BaseMessage        // NOTE: EMPTY PAYLOAD
+	Subject             string `json:"subject"`
+}
+
+func (payload *Authenticated) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *Authenticated) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+func (payload *Authenticated) Protocol() message.Protocol {
+	return ProtocolAuthenticated
+}
+
+func (payload *Authenticated) Validate() error {
+	return nil
+}
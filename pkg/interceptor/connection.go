@@ -0,0 +1,95 @@
+package interceptor
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/coder/websocket"
+)
+
+// Conn is the Connection handed to interceptors by the socket and the client.
+// It wraps the websocket connection with the HTTP request that opened it and
+// a set of attributes, through which interceptors share per-connection data
+// such as the verified identity of the peer. Interceptors should not rely on
+// the concrete type; use RequestOf, AttributeOf and SetAttribute instead.
+type Conn struct {
+	*websocket.Conn
+	request    *http.Request
+	attributes sync.Map
+}
+
+// WrapConn wraps a websocket connection. The request is the upgrade request on
+// the server side and nil on the client side.
+func WrapConn(connection *websocket.Conn, request *http.Request) *Conn {
+	return &Conn{
+		Conn:    connection,
+		request: request,
+	}
+}
+
+// Request returns the HTTP upgrade request of the connection, if known
+func (conn *Conn) Request() *http.Request {
+	return conn.request
+}
+
+// Attribute returns the attribute stored under key
+func (conn *Conn) Attribute(key any) (any, bool) {
+	return conn.attributes.Load(key)
+}
+
+// SetAttribute stores an attribute under key. Use unexported key types to
+// avoid collisions between packages, as with context values.
+func (conn *Conn) SetAttribute(key, value any) {
+	conn.attributes.Store(key, value)
+}
+
+// LoadOrStoreAttribute returns the attribute stored under key if present.
+// Otherwise it stores and returns value.
+func (conn *Conn) LoadOrStoreAttribute(key, value any) (any, bool) {
+	return conn.attributes.LoadOrStore(key, value)
+}
+
+// RequestOf returns the HTTP upgrade request of the connection, if known
+func RequestOf(connection Connection) (*http.Request, bool) {
+	conn, ok := connection.(interface{ Request() *http.Request })
+	if !ok || conn.Request() == nil {
+		return nil, false
+	}
+
+	return conn.Request(), true
+}
+
+// AttributeOf returns the attribute stored under key on the connection
+func AttributeOf(connection Connection, key any) (any, bool) {
+	conn, ok := connection.(interface{ Attribute(any) (any, bool) })
+	if !ok {
+		return nil, false
+	}
+
+	return conn.Attribute(key)
+}
+
+// SetAttribute stores an attribute on the connection. It reports false when
+// the connection does not support attributes.
+func SetAttribute(connection Connection, key, value any) bool {
+	conn, ok := connection.(interface{ SetAttribute(any, any) })
+	if !ok {
+		return false
+	}
+
+	conn.SetAttribute(key, value)
+	return true
+}
+
+// Reject closes the connection with StatusPolicyViolation, giving reason as
+// the close reason. Connections that cannot be closed are left alone.
+func Reject(connection Connection, reason error) {
+	conn, ok := connection.(interface {
+		Close(websocket.StatusCode, string) error
+	})
+	if !ok {
+		return
+	}
+
+	_ = conn.Close(websocket.StatusPolicyViolation, reason.Error())
+}
@@ -0,0 +1,98 @@
+package device
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"time"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+)
+
+// Option defines a function type that configures an Interceptor instance
+type Option = func(*Interceptor) error
+
+// InterceptorFactory creates device authentication interceptors with a
+// predefined set of options. It implements the interceptor.Factory interface.
+type InterceptorFactory struct {
+	opts []Option
+}
+
+// WithTrustStore verifies devices against store. Every reload interval the
+// store is reloaded and connections of devices no longer trusted are closed;
+// zero disables reloading, leaving revocations through TrustStore.Revoke to
+// take effect on the next message of the device.
+func WithTrustStore(store *TrustStore, reload time.Duration) Option {
+	return func(interceptor *Interceptor) error {
+		if store == nil || reload < 0 {
+			return errors.New("invalid trust store or reload interval")
+		}
+		interceptor.store = store
+		interceptor.reload = reload
+		return nil
+	}
+}
+
+// WithDeviceKey makes the interceptor authenticate this side of the connection
+// as the device instead of verifying the peer. Use it on the device.
+func WithDeviceKey(id string, privateKey ed25519.PrivateKey) Option {
+	return func(interceptor *Interceptor) error {
+		if id == "" || len(privateKey) != ed25519.PrivateKeySize {
+			return errors.New("invalid device id or key")
+		}
+		interceptor.deviceID = id
+		interceptor.privateKey = privateKey
+		return nil
+	}
+}
+
+// WithTimeout sets how long Init waits for the authentication to complete.
+// The default is 10 seconds.
+func WithTimeout(timeout time.Duration) Option {
+	return func(interceptor *Interceptor) error {
+		if timeout <= 0 {
+			return errors.New("timeout must be positive")
+		}
+		interceptor.timeout = timeout
+		return nil
+	}
+}
+
+// CreateInterceptorFactory constructs a new factory that will create device
+// authentication interceptors with the provided options. One of
+// WithTrustStore or WithDeviceKey is required.
+func CreateInterceptorFactory(options ...Option) *InterceptorFactory {
+	return &InterceptorFactory{
+		opts: options,
+	}
+}
+
+// NewInterceptor creates and configures a new device authentication
+// interceptor instance. This method implements the interceptor.Factory
+// interface.
+func (factory *InterceptorFactory) NewInterceptor(ctx context.Context, id string) (interceptor.Interceptor, error) {
+	deviceInterceptor := &Interceptor{
+		NoOpInterceptor: interceptor.NoOpInterceptor{
+			ID:  id,
+			Ctx: ctx,
+		},
+		states:  make(map[interceptor.Connection]*state),
+		timeout: 10 * time.Second,
+	}
+
+	for _, option := range factory.opts {
+		if err := option(deviceInterceptor); err != nil {
+			return nil, err
+		}
+	}
+
+	if (deviceInterceptor.store == nil) == (deviceInterceptor.privateKey == nil) {
+		return nil, errors.New("exactly one of a trust store or a device key is required")
+	}
+
+	if deviceInterceptor.reload > 0 {
+		go deviceInterceptor.watch()
+	}
+
+	return deviceInterceptor, nil
+}
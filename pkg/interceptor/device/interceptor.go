@@ -0,0 +1,372 @@
+package device
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+var (
+	ErrUnknownDevice      = errors.New("device not trusted")
+	ErrInvalidSignature   = errors.New("device signature verification failed")
+	ErrRevoked            = errors.New("device revoked")
+	ErrUnauthenticated    = errors.New("device not authenticated")
+	ErrAuthTimeout        = errors.New("device authentication timed out")
+	ErrConnectionNotFound = errors.New("connection not registered")
+	ErrInvalidInterceptor = errors.New("inappropriate interceptor for the payload")
+)
+
+// state tracks the authentication of a single connection
+type state struct {
+	*interceptor.Outcome
+	writer    interceptor.Writer
+	nonce     []byte            // Outstanding challenge; guarded by the interceptor lock
+	device    string            // Authenticated device; guarded by the interceptor lock
+	publicKey ed25519.PublicKey // Key the device authenticated with
+}
+
+// Interceptor authenticates devices holding an ed25519 key with a challenge
+// and response: Init sends a random nonce, which the device signs with its
+// key, and the signature is verified against the key the trust store holds
+// for the device. The device ID is bound as the connection's identity (see
+// interceptor.IdentityOf). Connections of devices that stop being trusted,
+// because they were removed from the store or revoked, are closed with
+// StatusPolicyViolation. Register it first, like the auth interceptor.
+type Interceptor struct {
+	interceptor.NoOpInterceptor
+	states     map[interceptor.Connection]*state
+	store      *TrustStore        // Verifies peers; set on the server side
+	reload     time.Duration      // Zero disables reloading the store
+	deviceID   string             // Device this side authenticates as; set on the device
+	privateKey ed25519.PrivateKey // Key of deviceID
+	timeout    time.Duration
+}
+
+func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, writer interceptor.Writer, reader interceptor.Reader) (interceptor.Writer, interceptor.Reader, error) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	if _, exists := i.states[connection]; exists {
+		return nil, nil, errors.New("connection already exists")
+	}
+
+	i.states[connection] = &state{
+		writer:  writer,
+		Outcome: interceptor.NewOutcome(),
+	}
+
+	return writer, reader, nil
+}
+
+// Init challenges the peer on the server side and waits for the
+// authentication to complete on both sides. The server closes the connection
+// with StatusPolicyViolation when the authentication fails.
+func (i *Interceptor) Init(connection interceptor.Connection) error {
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	if i.store != nil {
+		if err := i.challenge(connection, state); err != nil {
+			state.Complete(err)
+		}
+	}
+
+	timer := time.NewTimer(i.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-state.Done():
+	case <-timer.C:
+		state.Complete(ErrAuthTimeout)
+	case <-i.Ctx.Done():
+		state.Complete(i.Ctx.Err())
+	}
+
+	if _, err := state.Result(); err != nil {
+		if i.store != nil {
+			interceptor.Reject(connection, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// challenge sends a fresh nonce to the peer
+func (i *Interceptor) challenge(connection interceptor.Connection, state *state) error {
+	nonce := make([]byte, NonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	i.Mutex.Lock()
+	state.nonce = nonce
+	i.Mutex.Unlock()
+
+	msg, err := message.CreateMessage(i.ID, "unknown", &Challenge{Nonce: nonce})
+	if err != nil {
+		return err
+	}
+
+	return state.writer.Write(connection, websocket.MessageText, msg)
+}
+
+func (i *Interceptor) InterceptSocketReader(reader interceptor.Reader) interceptor.Reader {
+	return interceptor.ReaderFunc(func(conn interceptor.Connection) (messageType websocket.MessageType, m message.Message, err error) {
+		messageType, m, err = reader.Read(conn)
+		if err != nil {
+			return messageType, m, err
+		}
+
+		state, err := i.getState(conn)
+		if err != nil {
+			return messageType, m, nil
+		}
+
+		payload, err := interceptor.Decode(protocolMap, m)
+		if err == nil {
+			if err := payload.Process(i, conn); err != nil {
+				fmt.Println("error while processing device message:", err.Error())
+			}
+			return messageType, m, interceptor.ErrMessageConsumed
+		}
+
+		completed, authErr := state.Result()
+		if !completed || authErr != nil {
+			// Nothing but the challenge and response may be read before
+			// the device is authenticated
+			state.Complete(ErrUnauthenticated)
+			return messageType, m, interceptor.ErrMessageConsumed
+		}
+
+		if i.store != nil && !i.trusted(state) {
+			interceptor.Reject(conn, ErrRevoked)
+			return messageType, nil, ErrRevoked
+		}
+
+		return messageType, m, nil
+	})
+}
+
+// trusted reports whether the device of the connection is still trusted
+func (i *Interceptor) trusted(state *state) bool {
+	i.Mutex.RLock()
+	device, publicKey := state.device, state.publicKey
+	i.Mutex.RUnlock()
+
+	return i.store.Trusted(device, publicKey)
+}
+
+// watch reloads the trust store every reload interval and closes the
+// connections of devices no longer trusted, until the interceptor's context
+// is done
+func (i *Interceptor) watch() {
+	ticker := time.NewTicker(i.reload)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-i.Ctx.Done():
+			return
+		case <-ticker.C:
+			if err := i.store.Reload(); err != nil {
+				fmt.Println("error while reloading trust store:", err.Error())
+			}
+			i.Enforce()
+		}
+	}
+}
+
+// Enforce closes the connections of devices that are no longer trusted. It
+// runs after every reload of the trust store and can be called right after
+// TrustStore.Revoke to disconnect a device without waiting for it.
+func (i *Interceptor) Enforce() {
+	var revoked []interceptor.Connection
+
+	i.Mutex.RLock()
+	for connection, state := range i.states {
+		if state.device != "" && !i.store.Trusted(state.device, state.publicKey) {
+			revoked = append(revoked, connection)
+		}
+	}
+	i.Mutex.RUnlock()
+
+	for _, connection := range revoked {
+		interceptor.Reject(connection, ErrRevoked)
+	}
+}
+
+func (i *Interceptor) UnBindSocketConnection(connection interceptor.Connection) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	if state, exists := i.states[connection]; exists {
+		state.Complete(ErrUnauthenticated)
+		delete(i.states, connection)
+	}
+}
+
+func (i *Interceptor) Close() error {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	for _, state := range i.states {
+		state.Complete(ErrUnauthenticated)
+	}
+	i.states = make(map[interceptor.Connection]*state)
+
+	return nil
+}
+
+func (i *Interceptor) getState(connection interceptor.Connection) (*state, error) {
+	i.Mutex.RLock()
+	defer i.Mutex.RUnlock()
+
+	state, exists := i.states[connection]
+	if !exists {
+		return nil, ErrConnectionNotFound
+	}
+
+	return state, nil
+}
+
+// Process signs the nonce on the device
+func (payload *Challenge) Process(i interceptor.Interceptor, connection interceptor.Connection) error {
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
+	device, ok := i.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	if device.privateKey == nil {
+		return errors.New("unexpected device challenge")
+	}
+
+	state, err := device.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	msg, err := message.CreateMessage(device.deviceID, payload.SenderID, &Response{
+		DeviceID:  device.deviceID,
+		Signature: ed25519.Sign(device.privateKey, signed(payload.Nonce, device.deviceID)),
+	})
+	if err != nil {
+		state.Complete(err)
+		return err
+	}
+
+	if err := state.writer.Write(connection, websocket.MessageText, msg); err != nil {
+		state.Complete(err)
+		return err
+	}
+
+	return nil
+}
+
+// Process verifies the signature of the device on the server. Only the first
+// response to a challenge is considered.
+func (payload *Response) Process(i interceptor.Interceptor, connection interceptor.Connection) error {
+	device, ok := i.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	if device.store == nil {
+		return errors.New("unexpected device response")
+	}
+
+	state, err := device.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	device.Mutex.Lock()
+	nonce := state.nonce
+	state.nonce = nil
+	device.Mutex.Unlock()
+
+	if nonce == nil {
+		return errors.New("device response without challenge")
+	}
+
+	if err := device.verify(connection, state, payload, nonce); err != nil {
+		state.Complete(err)
+		return err
+	}
+
+	msg, err := message.CreateMessage(device.ID, payload.DeviceID, &Accepted{DeviceID: payload.DeviceID})
+	if err != nil {
+		state.Complete(err)
+		return err
+	}
+	if err := state.writer.Write(connection, websocket.MessageText, msg); err != nil {
+		state.Complete(err)
+		return err
+	}
+
+	state.Complete(nil)
+	return nil
+}
+
+// verify checks the response against the trusted key of the device and binds
+// the device as the connection's identity
+func (i *Interceptor) verify(connection interceptor.Connection, state *state, payload *Response, nonce []byte) error {
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
+	trusted, exists := i.store.Lookup(payload.DeviceID)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUnknownDevice, payload.DeviceID)
+	}
+
+	if !ed25519.Verify(trusted.PublicKey, signed(nonce, payload.DeviceID), payload.Signature) {
+		return ErrInvalidSignature
+	}
+
+	if err := interceptor.BindIdentity(connection, trusted.ID); err != nil {
+		return err
+	}
+	if err := interceptor.BindRoles(connection, trusted.Roles...); err != nil {
+		return err
+	}
+
+	i.Mutex.Lock()
+	state.device, state.publicKey = trusted.ID, trusted.PublicKey
+	i.Mutex.Unlock()
+
+	return nil
+}
+
+// Process completes the authentication on the device
+func (payload *Accepted) Process(i interceptor.Interceptor, connection interceptor.Connection) error {
+	device, ok := i.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	state, err := device.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	if device.privateKey != nil && payload.DeviceID == device.deviceID {
+		state.Complete(nil)
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package device
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/client"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/interceptortest"
+)
+
+func generate(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	return publicKey, privateKey
+}
+
+func writePEM(t *testing.T, path string, publicKey ed25519.PublicKey) {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey failed: %v", err)
+	}
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+}
+
+func TestTrustStore(t *testing.T) {
+	dir := t.TempDir()
+	drone1, _ := generate(t)
+	drone2, _ := generate(t)
+	drone3, _ := generate(t)
+
+	writePEM(t, filepath.Join(dir, "drone-1.pem"), drone1)
+
+	document := `{"devices": [
+		{"id": "drone-2", "public_key": "` + base64.StdEncoding.EncodeToString(drone2) + `", "roles": ["drone"]},
+		{"id": "drone-3", "public_key": "` + base64.StdEncoding.EncodeToString(drone3) + `", "revoked": true}
+	]}`
+	path := filepath.Join(t.TempDir(), "devices.json")
+	if err := os.WriteFile(path, []byte(document), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	store, err := CreateTrustStore(WithPEMDir(dir), WithJSONFile(path))
+	if err != nil {
+		t.Fatalf("CreateTrustStore failed: %v", err)
+	}
+
+	if !store.Trusted("drone-1", drone1) {
+		t.Error("drone-1 from PEM directory not trusted")
+	}
+	if device, ok := store.Lookup("drone-2"); !ok || !device.PublicKey.Equal(drone2) || !slices.Equal(device.Roles, []string{"drone"}) {
+		t.Errorf("drone-2 mismatch: got %+v, %v", device, ok)
+	}
+	if store.Trusted("drone-2", drone1) {
+		t.Error("drone-2 trusted with another key")
+	}
+	if _, ok := store.Lookup("drone-3"); ok {
+		t.Error("revoked drone-3 trusted")
+	}
+
+	if err := os.Remove(filepath.Join(dir, "drone-1.pem")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if _, ok := store.Lookup("drone-1"); ok {
+		t.Error("removed drone-1 still trusted")
+	}
+
+	store.Revoke("drone-2")
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if _, ok := store.Lookup("drone-2"); ok {
+		t.Error("revoked drone-2 trusted after reload")
+	}
+}
+
+// serve starts a socket authenticating devices against store and returns its
+// URL together with a channel receiving the identity of every application
+// message
+func serve(t *testing.T, store *TrustStore) (string, chan string) {
+	t.Helper()
+
+	registry := &interceptor.Registry{}
+	registry.Register(CreateInterceptorFactory(WithTrustStore(store, 20*time.Millisecond), WithTimeout(time.Second)))
+
+	handler, identities := interceptortest.Identities()
+	return interceptortest.Serve(t, registry, handler), identities
+}
+
+// dial connects a device and sends a single application message. It returns
+// a channel that receives once the device is disconnected.
+func dial(t *testing.T, url, id string, privateKey ed25519.PrivateKey) (chan struct{}, error) {
+	t.Helper()
+
+	registry := &interceptor.Registry{}
+	registry.Register(CreateInterceptorFactory(WithDeviceKey(id, privateKey), WithTimeout(time.Second)))
+
+	return interceptortest.Dial(t, url, id, client.WithInterceptorRegistry(registry))
+}
+
+func TestAuthenticate(t *testing.T) {
+	dir := t.TempDir()
+	publicKey, privateKey := generate(t)
+	writePEM(t, filepath.Join(dir, "drone-1.pem"), publicKey)
+
+	store, err := CreateTrustStore(WithPEMDir(dir))
+	if err != nil {
+		t.Fatalf("CreateTrustStore failed: %v", err)
+	}
+	url, identities := serve(t, store)
+
+	_, impostor := generate(t)
+	if _, err := dial(t, url, "drone-1", impostor); err == nil {
+		t.Error("device with untrusted key accepted")
+	}
+
+	disconnected, err := dial(t, url, "drone-1", privateKey)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	if identity := <-identities; identity != "drone-1" {
+		t.Errorf("identity mismatch: got %q, want %q", identity, "drone-1")
+	}
+
+	// Removing the key revokes the device without restarting the server
+	if err := os.Remove(filepath.Join(dir, "drone-1.pem")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("revoked device not disconnected")
+	}
+}
@@ -0,0 +1,112 @@
+package device
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+var (
+	ProtocolChallenge message.Protocol = "device_challenge"
+	ProtocolResponse  message.Protocol = "device_response"
+	ProtocolAccepted  message.Protocol = "device_accepted"
+)
+
+// NonceSize is the size of the nonces issued by the server
+const NonceSize = 32
+
+// signingContext separates device authentication signatures from any other
+// use of the device key
+const signingContext = "skyline-device-auth-v1"
+
+var protocolMap = message.CreateProtocolRegistry()
+
+func init() {
+	message.MustRegister[Challenge](protocolMap)
+	message.MustRegister[Response](protocolMap)
+	message.MustRegister[Accepted](protocolMap)
+}
+
+// Challenge carries the random nonce the device has to sign
+type Challenge struct {
+	message.BaseMessage        // NOTE: EMPTY PAYLOAD
+	Nonce               []byte `json:"nonce"`
+}
+
+func (payload *Challenge) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *Challenge) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+func (payload *Challenge) Protocol() message.Protocol {
+	return ProtocolChallenge
+}
+
+func (payload *Challenge) Validate() error {
+	if len(payload.Nonce) != NonceSize {
+		return message.ErrorNotValid
+	}
+	return nil
+}
+
+// Response carries the device's signature over the nonce
+type Response struct {
+	message.BaseMessage        // NOTE: EMPTY PAYLOAD
+	DeviceID            string `json:"device_id"`
+	Signature           []byte `json:"signature"`
+}
+
+func (payload *Response) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *Response) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+func (payload *Response) Protocol() message.Protocol {
+	return ProtocolResponse
+}
+
+func (payload *Response) Validate() error {
+	if payload.DeviceID == "" || len(payload.Signature) != ed25519.SignatureSize {
+		return message.ErrorNotValid
+	}
+	return nil
+}
+
+// Accepted confirms a successful device authentication
+type Accepted struct {
+	message.BaseMessage        // NOTE: EMPTY PAYLOAD
+	DeviceID            string `json:"device_id"`
+}
+
+func (payload *Accepted) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *Accepted) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+func (payload *Accepted) Protocol() message.Protocol {
+	return ProtocolAccepted
+}
+
+func (payload *Accepted) Validate() error {
+	return nil
+}
+
+// signed returns the data a device signs to answer the challenge: the nonce
+// bound to the device ID, under a context specific to device authentication
+func signed(nonce []byte, deviceID string) []byte {
+	data := make([]byte, 0, len(signingContext)+1+len(nonce)+len(deviceID))
+	data = append(data, signingContext...)
+	data = append(data, 0)
+	data = append(data, nonce...)
+	return append(data, deviceID...)
+}
@@ -0,0 +1,245 @@
+package device
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Device is a device trusted to authenticate with its ed25519 key
+type Device struct {
+	ID        string
+	PublicKey ed25519.PublicKey
+	Roles     []string // Granted to the device's connections, see interceptor.RolesOf
+}
+
+// TrustOption defines a function type that configures a TrustStore instance
+type TrustOption = func(*TrustStore) error
+
+// TrustStore is the registry of trusted device keys. Its sources are read
+// again on Reload, so that adding or removing a key on disk takes effect
+// without restarting the server.
+type TrustStore struct {
+	static  map[string]Device
+	dirs    []string
+	files   []string
+	devices map[string]Device   // loaded devices by ID; guarded by mux
+	revoked map[string]struct{} // devices revoked through Revoke; guarded by mux
+	mux     sync.RWMutex
+}
+
+// WithPEMDir trusts the keys of a directory of PEM encoded ed25519 public keys
+// ("PUBLIC KEY" blocks), one per device, named after the device ID:
+// <device-id>.pem. Revoke a device by removing its file.
+func WithPEMDir(dir string) TrustOption {
+	return func(store *TrustStore) error {
+		store.dirs = append(store.dirs, dir)
+		return nil
+	}
+}
+
+// WithJSONFile trusts the devices of a JSON trust store of the form
+//
+//	{"devices": [{"id": "drone-1", "public_key": "...", "roles": ["drone"], "revoked": false}]}
+//
+// where public_key is either a PEM block or the base64 encoded raw key. Revoke
+// a device by removing it or setting revoked.
+func WithJSONFile(path string) TrustOption {
+	return func(store *TrustStore) error {
+		store.files = append(store.files, path)
+		return nil
+	}
+}
+
+// WithDevice trusts a single device
+func WithDevice(id string, publicKey ed25519.PublicKey, roles ...string) TrustOption {
+	return func(store *TrustStore) error {
+		if id == "" || len(publicKey) != ed25519.PublicKeySize {
+			return errors.New("invalid device")
+		}
+		store.static[id] = Device{ID: id, PublicKey: publicKey, Roles: roles}
+		return nil
+	}
+}
+
+// CreateTrustStore creates a trust store and loads its sources
+func CreateTrustStore(options ...TrustOption) (*TrustStore, error) {
+	store := &TrustStore{
+		static:  make(map[string]Device),
+		devices: make(map[string]Device),
+		revoked: make(map[string]struct{}),
+	}
+
+	for _, option := range options {
+		if err := option(store); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Reload reads the sources of the store again. If any of them fails to load,
+// the store keeps its current devices.
+func (store *TrustStore) Reload() error {
+	devices := make(map[string]Device, len(store.static))
+	for id, device := range store.static {
+		devices[id] = device
+	}
+
+	for _, dir := range store.dirs {
+		if err := loadPEMDir(dir, devices); err != nil {
+			return fmt.Errorf("error while loading trusted keys from %s: %w", dir, err)
+		}
+	}
+
+	for _, path := range store.files {
+		if err := loadJSONFile(path, devices); err != nil {
+			return fmt.Errorf("error while loading trust store %s: %w", path, err)
+		}
+	}
+
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	store.devices = devices
+	return nil
+}
+
+// Lookup returns the trusted device with the given ID
+func (store *TrustStore) Lookup(id string) (Device, bool) {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+
+	if _, revoked := store.revoked[id]; revoked {
+		return Device{}, false
+	}
+
+	device, exists := store.devices[id]
+	return device, exists
+}
+
+// Trusted reports whether the device is still trusted with the given key
+func (store *TrustStore) Trusted(id string, publicKey ed25519.PublicKey) bool {
+	device, exists := store.Lookup(id)
+	return exists && device.PublicKey.Equal(publicKey)
+}
+
+// Revoke stops trusting a device, whatever its sources say, until the
+// process restarts
+func (store *TrustStore) Revoke(id string) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	store.revoked[id] = struct{}{}
+}
+
+func loadPEMDir(dir string, devices map[string]Device) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".pem" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		publicKey, err := parsePublicKey(string(data))
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+
+		id := strings.TrimSuffix(entry.Name(), ".pem")
+		devices[id] = Device{ID: id, PublicKey: publicKey}
+	}
+
+	return nil
+}
+
+func loadJSONFile(path string, devices map[string]Device) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var document struct {
+		Devices []struct {
+			ID        string   `json:"id"`
+			PublicKey string   `json:"public_key"`
+			Roles     []string `json:"roles,omitempty"`
+			Revoked   bool     `json:"revoked,omitempty"`
+		} `json:"devices"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return err
+	}
+
+	for _, entry := range document.Devices {
+		if entry.ID == "" {
+			return errors.New("device without id")
+		}
+		if entry.Revoked {
+			delete(devices, entry.ID)
+			continue
+		}
+
+		publicKey, err := parsePublicKey(entry.PublicKey)
+		if err != nil {
+			return fmt.Errorf("device %s: %w", entry.ID, err)
+		}
+
+		devices[entry.ID] = Device{ID: entry.ID, PublicKey: publicKey, Roles: slices.Clone(entry.Roles)}
+	}
+
+	return nil
+}
+
+// parsePublicKey parses a PEM encoded or base64 encoded raw ed25519 public key
+func parsePublicKey(value string) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode([]byte(value)); block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("not an ed25519 public key")
+		}
+
+		return publicKey, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key size")
+	}
+
+	return ed25519.PublicKey(raw), nil
+}
@@ -0,0 +1,91 @@
+package e2e
+
+import "github.com/harshabose/skyline_sonata/serve/pkg/interceptor/encrypt"
+
+// maxOneTimePreKeys bounds the private one-time pre-keys a client keeps for
+// peers that fetched them. The oldest are forgotten first.
+const maxOneTimePreKeys = 1000
+
+// preKeyPair is the signed pre-key of a client
+type preKeyPair struct {
+	id        uint32
+	private   encrypt.PrivateKey
+	public    encrypt.PublicKey
+	signature []byte
+}
+
+// bundle returns the bundle of the client with fresh one-time pre-keys. The
+// keys published before stay usable, as peers may have fetched them already.
+func (i *Interceptor) bundle() (Bundle, error) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	preKeys := make([]PreKey, 0, i.preKeys)
+	for range i.preKeys {
+		private, public, err := generateKey()
+		if err != nil {
+			return Bundle{}, err
+		}
+		i.nextPreKeyID++
+		i.oneTimePreKeys[i.nextPreKeyID] = private
+		preKeys = append(preKeys, PreKey{ID: i.nextPreKeyID, Key: public})
+	}
+
+	for id := range i.oneTimePreKeys {
+		if id+maxOneTimePreKeys <= i.nextPreKeyID {
+			delete(i.oneTimePreKeys, id)
+		}
+	}
+
+	return Bundle{
+		Identity:       i.identity.public,
+		SignedPreKey:   PreKey{ID: i.signedPreKey.id, Key: i.signedPreKey.public},
+		Signature:      i.signedPreKey.signature,
+		OneTimePreKeys: preKeys,
+	}, nil
+}
+
+// publish stores the bundle of the peer on the server, replacing the one
+// published before. Bundles with an identity key other than the one pinned
+// for the peer are refused.
+func (i *Interceptor) publish(peerID string, bundle Bundle) error {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	if err := i.trust.Verify(peerID, bundle.Identity.Key, i.onSecurityEvent...); err != nil {
+		return err
+	}
+
+	bundle.PeerID = peerID
+	i.bundles[peerID] = &bundle
+	return nil
+}
+
+// lookup returns the bundles of the peers on the server, each with the next
+// of their one-time pre-keys, and the peers without bundle
+func (i *Interceptor) lookup(peerIDs []string) ([]Bundle, []string) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	var (
+		bundles []Bundle
+		missing []string
+	)
+	for _, peerID := range peerIDs {
+		stored, exists := i.bundles[peerID]
+		if !exists {
+			missing = append(missing, peerID)
+			continue
+		}
+
+		bundle := *stored
+		bundle.OneTimePreKeys = nil
+		if len(stored.OneTimePreKeys) > 0 {
+			bundle.OneTimePreKeys = stored.OneTimePreKeys[:1]
+			stored.OneTimePreKeys = stored.OneTimePreKeys[1:]
+		}
+		bundles = append(bundles, bundle)
+	}
+
+	return bundles, missing
+}
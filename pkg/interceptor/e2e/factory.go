@@ -0,0 +1,167 @@
+package e2e
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/encrypt"
+)
+
+// defaultOneTimePreKeys is the number of one-time pre-keys published per
+// connection
+const defaultOneTimePreKeys = 20
+
+// Option defines a function type that configures an Interceptor instance
+type Option = func(*Interceptor) error
+
+// WithServer makes the interceptor the pre-key directory of the server. It
+// does not take part in the encryption and relays chat messages untouched.
+func WithServer(interceptor *Interceptor) error {
+	interceptor.isServer = true
+	return nil
+}
+
+// WithIdentity sets the long-term key of the client, which peers pin and
+// which signs its pre-keys. It is required on clients and should be kept
+// across restarts, or peers pinning it reject the client.
+func WithIdentity(key ed25519.PrivateKey) Option {
+	return func(interceptor *Interceptor) error {
+		if len(key) != ed25519.PrivateKeySize {
+			return errors.New("invalid ed25519 identity key")
+		}
+
+		identity, err := newIdentity(key)
+		if err != nil {
+			return err
+		}
+		interceptor.identity = identity
+		return nil
+	}
+}
+
+// WithOneTimePreKeys sets how many one-time pre-keys the client publishes on
+// every connection. Sessions set up once the server handed them all out do
+// without, losing their protection against replays of the first message.
+// Defaults to 20.
+func WithOneTimePreKeys(count int) Option {
+	return func(interceptor *Interceptor) error {
+		if count < 0 || count > maxOneTimePreKeys {
+			return errors.New("invalid number of one-time pre-keys")
+		}
+		interceptor.preKeys = count
+		return nil
+	}
+}
+
+// WithTrustStore pins the identity keys of peers in the store. Clients pin
+// the keys of the peers they set up sessions with; servers pin the keys of
+// the clients publishing bundles, so that no other client can replace them.
+// Both default to a store kept in memory trusting peers on first use.
+func WithTrustStore(store *encrypt.TrustStore) Option {
+	return func(interceptor *Interceptor) error {
+		if store == nil {
+			return errors.New("nil trust store")
+		}
+		interceptor.trust = store
+		return nil
+	}
+}
+
+// WithSecurityEventHandler registers a handler notified of peer keys pinned,
+// changed or unknown. Handlers are called from the reader of the connection,
+// with the interceptor locked.
+func WithSecurityEventHandler(handler encrypt.SecurityEventHandler) Option {
+	return func(interceptor *Interceptor) error {
+		if handler == nil {
+			return errors.New("nil security event handler")
+		}
+		interceptor.onSecurityEvent = append(interceptor.onSecurityEvent, handler)
+		return nil
+	}
+}
+
+// InterceptorFactory creates end-to-end encryption interceptors with
+// configured options
+type InterceptorFactory struct {
+	opts []Option
+}
+
+// CreateInterceptorFactory constructs a new factory with the provided options
+func CreateInterceptorFactory(options ...Option) *InterceptorFactory {
+	return &InterceptorFactory{
+		opts: options,
+	}
+}
+
+// NewInterceptor creates and configures a new end-to-end encryption
+// interceptor
+// Implements the interceptor.Factory interface
+func (factory *InterceptorFactory) NewInterceptor(ctx context.Context, id string) (interceptor.Interceptor, error) {
+	_interceptor := &Interceptor{
+		NoOpInterceptor: interceptor.NoOpInterceptor{
+			ID:  id,
+			Ctx: ctx,
+		},
+		states:         make(map[interceptor.Connection]*state),
+		bundles:        make(map[string]*Bundle),
+		preKeys:        defaultOneTimePreKeys,
+		oneTimePreKeys: make(map[uint32]encrypt.PrivateKey),
+		outbound:       make(map[string]*outbound),
+		inbound:        make(map[encrypt.PublicKey]*inbound),
+		groups:         make(map[string]*group),
+	}
+
+	// Apply all configured options
+	for _, option := range factory.opts {
+		if err := option(_interceptor); err != nil {
+			return nil, err
+		}
+	}
+
+	if _interceptor.trust == nil {
+		_interceptor.trust = encrypt.NewTrustStore(true)
+	}
+
+	if _interceptor.isServer {
+		return _interceptor, nil
+	}
+
+	if _interceptor.identity == nil {
+		return nil, errors.New("e2e client requires an identity key")
+	}
+
+	signedPreKey, err := newSignedPreKey(_interceptor.identity)
+	if err != nil {
+		return nil, err
+	}
+	_interceptor.signedPreKey = signedPreKey
+
+	return _interceptor, nil
+}
+
+// newSignedPreKey generates the signed pre-key of the client, under a random
+// ID so that peers with sessions set up before a restart fail recognisably
+func newSignedPreKey(identity *identity) (*preKeyPair, error) {
+	var id [4]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, err
+	}
+
+	private, public, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	preKey := PreKey{ID: binary.BigEndian.Uint32(id[:]), Key: public}
+	return &preKeyPair{
+		id:        preKey.ID,
+		private:   private,
+		public:    public,
+		signature: ed25519.Sign(identity.signing, signedPreKey(preKey)),
+	}, nil
+}
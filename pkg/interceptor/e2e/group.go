@@ -0,0 +1,234 @@
+package e2e
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// senderKey is the key a client encrypts its messages to a room with. It is
+// distributed to the other members over the pairwise sessions and replaced
+// once a member left. Members joining get it at its current index, which
+// keeps the messages sent before out of their reach.
+type senderKey struct {
+	id      uint32
+	chain   chain
+	signing ed25519.PrivateKey
+	shared  map[string]bool // Members the key was distributed to
+	stale   bool            // Set when a member left; replaced before the next message
+}
+
+func newSenderKey() (*senderKey, error) {
+	var id [4]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		return nil, err
+	}
+
+	key := &senderKey{id: binary.BigEndian.Uint32(id[:]), shared: make(map[string]bool)}
+	if _, err := io.ReadFull(rand.Reader, key.chain.key[:]); err != nil {
+		return nil, err
+	}
+
+	_, signing, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	key.signing = signing
+
+	return key, nil
+}
+
+// distribution returns the key at its current index, for distributing it
+func (key *senderKey) distribution(roomID string) *senderKeyDistribution {
+	return &senderKeyDistribution{
+		RoomID:     roomID,
+		KeyID:      key.id,
+		Index:      key.chain.index,
+		ChainKey:   slices.Clone(key.chain.key[:]),
+		SigningKey: key.signing.Public().(ed25519.PublicKey),
+	}
+}
+
+// groupReceiver decrypts the messages a member sends to a room
+type groupReceiver struct {
+	id       uint32
+	verify   ed25519.PublicKey
+	receiver *receiver
+}
+
+// group is what a client knows of a room it is in
+type group struct {
+	members   map[string]bool // Other members of the room
+	own       *senderKey
+	receivers map[string]*groupReceiver // Sender keys by member ID, own included
+}
+
+// groupOf returns the group of the room, creating it. Callers hold the lock.
+func (i *Interceptor) groupOf(roomID string) *group {
+	g, exists := i.groups[roomID]
+	if !exists {
+		g = &group{members: make(map[string]bool), receivers: make(map[string]*groupReceiver)}
+		i.groups[roomID] = g
+	}
+
+	return g
+}
+
+// distribute returns the messages distributing the sender key of the room
+// to the members it did not reach yet, creating or replacing the key first
+// as needed. Callers hold the lock.
+func (i *Interceptor) distribute(senderID, receiverID, roomID string, g *group) ([]*pending, *senderKey, error) {
+	if g.own == nil || g.own.stale {
+		key, err := newSenderKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		g.own = key
+
+		// The room echoes messages to their sender too
+		g.receivers[i.ID] = &groupReceiver{
+			id:       key.id,
+			verify:   key.signing.Public().(ed25519.PublicKey),
+			receiver: newReceiver(key.chain.key, key.chain.index),
+		}
+	}
+
+	var messages []*pending
+	for _, memberID := range slices.Sorted(maps.Keys(g.members)) {
+		if g.own.shared[memberID] {
+			continue
+		}
+		g.own.shared[memberID] = true
+
+		distribution, err := json.Marshal(plaintext{SenderKey: g.own.distribution(roomID)})
+		if err != nil {
+			return nil, nil, err
+		}
+		messages = append(messages, newPending(senderID, receiverID, roomID, []string{memberID}, distribution))
+	}
+
+	return messages, g.own, nil
+}
+
+// acceptSenderKey installs the sender key a member distributed, replacing
+// the one before. Members are only learned from the room's ClientJoined
+// notifications; keys of other senders are refused, so that no client can
+// make itself a member to receive the sender key. Callers hold the lock.
+func (i *Interceptor) acceptSenderKey(senderID string, distribution *senderKeyDistribution) (*group, error) {
+	if distribution.RoomID == "" || len(distribution.ChainKey) != 32 || len(distribution.SigningKey) != ed25519.PublicKeySize {
+		return nil, message.ErrorNotValid
+	}
+
+	g, exists := i.groups[distribution.RoomID]
+	if !exists || !g.members[senderID] {
+		return nil, fmt.Errorf("%w: %q in room %q", ErrNotMember, senderID, distribution.RoomID)
+	}
+
+	g.receivers[senderID] = &groupReceiver{
+		id:       distribution.KeyID,
+		verify:   distribution.SigningKey,
+		receiver: newReceiver([32]byte(distribution.ChainKey), distribution.Index),
+	}
+
+	return g, nil
+}
+
+// sealGroup encrypts content to the room with the sender key. Callers hold
+// the lock.
+func (i *Interceptor) sealGroup(roomID, messageID string, key *senderKey, content []byte) (*GroupMessage, error) {
+	messageKey, index := key.chain.next()
+	ad := groupData(roomID, messageID, i.ID, key.id, index)
+
+	ciphertext, err := seal(messageKey, content, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupMessage{
+		KeyID:      key.id,
+		Index:      index,
+		Ciphertext: ciphertext,
+		Signature:  ed25519.Sign(key.signing, slices.Concat(ad, ciphertext)),
+	}, nil
+}
+
+// openGroup decrypts a message the member sent to the room. Callers hold the
+// lock.
+func (i *Interceptor) openGroup(senderID, roomID, messageID string, m *GroupMessage) ([]byte, error) {
+	g, exists := i.groups[roomID]
+	if !exists {
+		return nil, ErrNoSenderKey
+	}
+
+	sender, exists := g.receivers[senderID]
+	if !exists || sender.id != m.KeyID {
+		return nil, ErrNoSenderKey
+	}
+
+	ad := groupData(roomID, messageID, senderID, m.KeyID, m.Index)
+	if !ed25519.Verify(sender.verify, slices.Concat(ad, m.Ciphertext), m.Signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	receiver := sender.receiver.clone()
+	messageKey, err := receiver.messageKey(m.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := open(messageKey, m.Ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	sender.receiver = receiver
+	return content, nil
+}
+
+// joined distributes the sender key of the room to the member who joined.
+// Callers hold the lock.
+func (i *Interceptor) joined(senderID, receiverID, roomID, memberID string) ([]*pending, error) {
+	if memberID == i.ID {
+		return nil, nil
+	}
+
+	g := i.groupOf(roomID)
+	g.members[memberID] = true
+
+	messages, _, err := i.distribute(senderID, receiverID, roomID, g)
+	return messages, err
+}
+
+// left forgets the member who left the room, and the room once this client
+// left it. The sender key is replaced before the next message, as the member
+// knows it. Callers hold the lock.
+func (i *Interceptor) left(roomID, memberID string) {
+	if memberID == i.ID {
+		delete(i.groups, roomID)
+		return
+	}
+
+	g, exists := i.groups[roomID]
+	if !exists {
+		return
+	}
+
+	delete(g.members, memberID)
+	delete(g.receivers, memberID)
+	if g.own != nil {
+		g.own.stale = true
+	}
+}
+
+// groupData returns the data a message to a room is bound to
+func groupData(roomID, messageID, senderID string, keyID, index uint32) []byte {
+	return associatedData([]byte("group"), []byte(roomID), []byte(messageID), []byte(senderID),
+		binary.BigEndian.AppendUint32(nil, keyID), binary.BigEndian.AppendUint32(nil, index))
+}
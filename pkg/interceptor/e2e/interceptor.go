@@ -0,0 +1,317 @@
+package e2e
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/encrypt"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/room"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// Interceptor encrypts the content of room chat messages end to end, so that
+// the server relays ciphertext it cannot read. Clients publish a bundle of
+// pre-keys to the server in Init and set up a session with every peer they
+// write to from its bundle, following X3DH. Direct messages are sealed for
+// each recipient with these sessions; messages to the whole room are
+// encrypted once under the sender key of the client for the room, which is
+// handed to the other members over the sessions and replaced once a member
+// left. Identity keys of peers are pinned in a trust store.
+//
+// On the server, the interceptor is the pre-key directory and must be in the
+// chain of the room interceptor. Hop-by-hop encryption with the encrypt
+// interceptor is independent of it and registered before it.
+type Interceptor struct {
+	interceptor.NoOpInterceptor
+	states   map[interceptor.Connection]*state
+	isServer bool
+
+	// Pre-key directory on the server, by peer ID
+	bundles map[string]*Bundle
+
+	// Keys and sessions of the client. Sessions outlive connections, so that
+	// they survive reconnects.
+	identity       *identity
+	signedPreKey   *preKeyPair
+	preKeys        int // One-time pre-keys published per connection
+	oneTimePreKeys map[uint32]encrypt.PrivateKey
+	nextPreKeyID   uint32
+	outbound       map[string]*outbound           // By peer ID
+	inbound        map[encrypt.PublicKey]*inbound // By ephemeral key of the peer
+	groups         map[string]*group              // By room ID
+
+	trust           *encrypt.TrustStore
+	onSecurityEvent []encrypt.SecurityEventHandler
+}
+
+func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, writer interceptor.Writer, reader interceptor.Reader) (interceptor.Writer, interceptor.Reader, error) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	if _, exists := i.states[connection]; exists {
+		return nil, nil, errors.New("connection already exists")
+	}
+
+	i.states[connection] = &state{
+		peerID:    "unknown", // unknown until the first message of the server
+		requested: make(map[string]bool),
+		writer:    writer, // full-stack writer, as the outbox is written from the reader too
+	}
+
+	return writer, reader, nil
+}
+
+// Init publishes the bundle of the client with fresh one-time pre-keys
+func (i *Interceptor) Init(connection interceptor.Connection) error {
+	if i.isServer {
+		return nil
+	}
+
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := i.bundle()
+	if err != nil {
+		return err
+	}
+
+	peerID := state.peer()
+	msg, err := message.CreateMessage(i.ID, peerID, NewPublishPreKeysMessage(i.ID, peerID, bundle))
+	if err != nil {
+		return err
+	}
+
+	return state.writer.Write(connection, websocket.MessageText, msg)
+}
+
+func (i *Interceptor) InterceptSocketWriter(writer interceptor.Writer) interceptor.Writer {
+	return interceptor.WriterFunc(func(connection interceptor.Connection, messageType websocket.MessageType, m message.Message) error {
+		if i.isServer || m.Message().Header.Protocol != room.ProtocolChatSource {
+			return writer.Write(connection, messageType, m)
+		}
+
+		state, err := i.getState(connection)
+		if err != nil {
+			return writer.Write(connection, messageType, m)
+		}
+
+		payload, err := interceptor.Decode(roomProtocols, m)
+		if err != nil {
+			return err
+		}
+		source, ok := payload.(*room.ChatSource)
+		if !ok {
+			return message.ErrorNotValid
+		}
+
+		// Messages leaving the outbox are sealed already
+		if isEnvelope(source.Content) {
+			return writer.Write(connection, messageType, m)
+		}
+
+		if err := source.Validate(); err != nil {
+			return err
+		}
+
+		return i.send(connection, state, source)
+	})
+}
+
+func (i *Interceptor) InterceptSocketReader(reader interceptor.Reader) interceptor.Reader {
+	return interceptor.ReaderFunc(func(connection interceptor.Connection) (websocket.MessageType, message.Message, error) {
+		messageType, m, err := reader.Read(connection)
+		if err != nil {
+			return messageType, m, err
+		}
+
+		state, err := i.getState(connection)
+		if err != nil {
+			return messageType, m, nil
+		}
+
+		header := m.Message().Header
+		if protocolMap.Has(header.Protocol) {
+			payload, err := interceptor.Decode(protocolMap, m)
+			if err != nil {
+				return messageType, nil, err
+			}
+
+			if !i.isServer {
+				state.setPeer(header.SenderID)
+			}
+			if err := payload.Process(i, connection); err != nil {
+				fmt.Println("error while processing e2e message:", err.Error())
+			}
+
+			// Pre-key messages are internal to this interceptor
+			return messageType, m, interceptor.ErrMessageConsumed
+		}
+
+		if i.isServer || !roomProtocols.Has(header.Protocol) {
+			return messageType, m, nil
+		}
+
+		payload, err := interceptor.Decode(roomProtocols, m)
+		if err != nil {
+			return messageType, m, nil
+		}
+
+		switch payload := payload.(type) {
+		case *room.ChatDest:
+			return i.receive(connection, state, messageType, payload)
+		case *room.ClientJoined:
+			if err := i.join(connection, state, payload.RoomID, payload.ClientID); err != nil {
+				fmt.Println("error while distributing sender key:", err.Error())
+			}
+		case *room.ClientLeft:
+			i.Mutex.Lock()
+			i.left(payload.RoomID, payload.ClientID)
+			i.Mutex.Unlock()
+		}
+
+		return messageType, m, nil
+	})
+}
+
+func (i *Interceptor) UnBindSocketConnection(connection interceptor.Connection) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	delete(i.states, connection)
+}
+
+func (i *Interceptor) Close() error {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	i.states = make(map[interceptor.Connection]*state)
+	return nil
+}
+
+// join hands the sender key of the room to the member who joined it
+func (i *Interceptor) join(connection interceptor.Connection, state *state, roomID, memberID string) error {
+	i.Mutex.Lock()
+	messages, err := i.joined(i.ID, state.peer(), roomID, memberID)
+	if err != nil {
+		i.Mutex.Unlock()
+		return err
+	}
+	peerIDs, err := i.queue(state, messages...)
+	i.Mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return i.dispatch(connection, state, peerIDs)
+}
+
+// receive replaces the envelope of a chat message with the content it
+// decrypts to. Sender key distributions are consumed.
+func (i *Interceptor) receive(connection interceptor.Connection, state *state, messageType websocket.MessageType, dest *room.ChatDest) (websocket.MessageType, message.Message, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(dest.Content, &envelope); err != nil || envelope.Version != envelopeVersion {
+		return messageType, nil, ErrNotEncrypted
+	}
+
+	header := dest.Message().Header
+	content, err := i.open(connection, state, header.SenderID, dest, &envelope)
+	if err != nil {
+		return messageType, nil, fmt.Errorf("error while decrypting message %s from %q: %w", dest.MessageID, header.SenderID, err)
+	}
+	if content == nil {
+		return messageType, dest, interceptor.ErrMessageConsumed
+	}
+
+	msg, err := message.CreateMessage(header.SenderID, header.ReceiverID, &room.ChatDest{
+		RoomID:    dest.RoomID,
+		MessageID: dest.MessageID,
+		Content:   content,
+		Timestamp: dest.Timestamp,
+	})
+	if err != nil {
+		return messageType, nil, err
+	}
+
+	return messageType, msg, nil
+}
+
+// open decrypts the envelope of the sender. Sender keys distributed in it
+// are installed, returning no content; members receiving this client's
+// sender key for the first time this way get theirs in return.
+func (i *Interceptor) open(connection interceptor.Connection, state *state, senderID string, dest *room.ChatDest, envelope *Envelope) (json.RawMessage, error) {
+	i.Mutex.Lock()
+
+	if envelope.Group != nil {
+		content, err := i.openGroup(senderID, dest.RoomID, dest.MessageID, envelope.Group)
+		i.Mutex.Unlock()
+		return content, err
+	}
+
+	sealed, exists := envelope.Sealed[i.ID]
+	if !exists {
+		i.Mutex.Unlock()
+		return nil, ErrNotAddressed
+	}
+
+	data, err := i.openFrom(senderID, dest.RoomID, dest.MessageID, envelope.Identity, sealed)
+	if err != nil {
+		i.Mutex.Unlock()
+		return nil, err
+	}
+
+	var plain plaintext
+	if err := json.Unmarshal(data, &plain); err != nil {
+		i.Mutex.Unlock()
+		return nil, err
+	}
+
+	if plain.SenderKey == nil {
+		i.Mutex.Unlock()
+		if plain.Content == nil {
+			return nil, message.ErrorNotValid
+		}
+		return plain.Content, nil
+	}
+
+	g, err := i.acceptSenderKey(senderID, plain.SenderKey)
+	if err != nil || g.own == nil || g.own.stale {
+		i.Mutex.Unlock()
+		return nil, err
+	}
+
+	messages, _, err := i.distribute(i.ID, state.peer(), plain.SenderKey.RoomID, g)
+	if err != nil {
+		i.Mutex.Unlock()
+		return nil, err
+	}
+	peerIDs, err := i.queue(state, messages...)
+	i.Mutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := i.dispatch(connection, state, peerIDs); err != nil {
+		fmt.Println("error while distributing sender key:", err.Error())
+	}
+	return nil, nil
+}
+
+func (i *Interceptor) getState(connection interceptor.Connection) (*state, error) {
+	i.Mutex.RLock()
+	defer i.Mutex.RUnlock()
+
+	state, exists := i.states[connection]
+	if !exists {
+		return nil, ErrConnectionNotFound
+	}
+
+	return state, nil
+}
@@ -0,0 +1,470 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/google/uuid"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/encrypt"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/interceptortest"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/room"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// hub is a server relaying rooms, with the e2e interceptor as its pre-key
+// directory
+type hub struct {
+	server *Interceptor
+	chain  *interceptor.Chain
+	mux    sync.Mutex
+	ends   []*interceptortest.End
+}
+
+func newHub(t *testing.T) *hub {
+	t.Helper()
+
+	rooms, err := room.CreateInterceptorFactory().NewInterceptor(context.Background(), "server")
+	if err != nil {
+		t.Fatalf("NewInterceptor failed: %v", err)
+	}
+	server := create(t, "server", WithServer)
+
+	return &hub{server: server, chain: interceptor.CreateChain([]interceptor.Interceptor{rooms, server})}
+}
+
+// relayed reports whether the server read data in any frame
+func (h *hub) relayed(data string) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	for _, end := range h.ends {
+		for _, frame := range end.Conn.Frames() {
+			if bytes.Contains(frame, []byte(data)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// peer is a client connected to the hub
+type peer struct {
+	*Interceptor
+	*interceptortest.End
+	hub *interceptortest.End // the hub's end of the connection
+}
+
+// connect connects the client to the hub and waits for the client to publish
+// its bundle
+func (h *hub) connect(t *testing.T, client *Interceptor) *peer {
+	t.Helper()
+
+	server, end := interceptortest.Connect(t, h.chain, client)
+	h.mux.Lock()
+	h.ends = append(h.ends, server)
+	h.mux.Unlock()
+
+	// Nothing reads what the hub hands on
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case <-server.Received:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := client.Init(end.Conn); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	waitFor(t, "bundle of "+client.ID, func() bool {
+		h.server.Mutex.RLock()
+		defer h.server.Mutex.RUnlock()
+
+		_, exists := h.server.bundles[client.ID]
+		return exists
+	})
+
+	return &peer{Interceptor: client, End: end, hub: server}
+}
+
+func create(t *testing.T, id string, options ...Option) *Interceptor {
+	t.Helper()
+
+	i, err := CreateInterceptorFactory(options...).NewInterceptor(context.Background(), id)
+	if err != nil {
+		t.Fatalf("NewInterceptor failed: %v", err)
+	}
+
+	return i.(*Interceptor)
+}
+
+func client(t *testing.T, id string, options ...Option) *Interceptor {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	return create(t, id, append(options, WithIdentity(key))...)
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (p *peer) write(t *testing.T, payload message.Message) {
+	t.Helper()
+
+	msg, err := message.CreateMessage(p.ID, "server", payload)
+	if err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+	if err := p.Writer.Write(p.Conn, websocket.MessageText, msg); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func (p *peer) chat(t *testing.T, roomID, content string, recipients ...string) {
+	t.Helper()
+
+	p.write(t, &room.ChatSource{RoomID: roomID, MessageID: uuid.NewString(), RecipientID: recipients, Content: json.RawMessage(content), Timestamp: time.Now()})
+}
+
+// expect waits for the chat message from the sender, skipping other messages
+func (p *peer) expect(t *testing.T, senderID, content string) {
+	t.Helper()
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case m := <-p.Received:
+			if m.Message().Header.Protocol != room.ProtocolChatDest || m.Message().Header.SenderID != senderID {
+				continue
+			}
+			var dest room.ChatDest
+			if err := m.Message().DecodePayload(&dest); err != nil {
+				t.Fatalf("DecodePayload failed: %v", err)
+			}
+			if string(dest.Content) != content {
+				t.Fatalf("content mismatch: got %s, want %s", dest.Content, content)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("%s: no message %s from %s", p.ID, content, senderID)
+		}
+	}
+}
+
+// holds reports whether the client holds the sender keys of the members
+func (p *peer) holds(roomID string, memberIDs ...string) bool {
+	p.Mutex.RLock()
+	defer p.Mutex.RUnlock()
+
+	g, exists := p.groups[roomID]
+	if !exists {
+		return false
+	}
+	for _, memberID := range memberIDs {
+		if _, exists := g.receivers[memberID]; !exists {
+			return false
+		}
+	}
+	return true
+}
+
+// ownKey returns the ID of the sender key of the client for the room and the
+// members it was distributed to
+func (p *peer) ownKey(roomID string) (uint32, map[string]bool) {
+	p.Mutex.RLock()
+	defer p.Mutex.RUnlock()
+
+	own := p.groups[roomID].own
+	shared := make(map[string]bool, len(own.shared))
+	for memberID := range own.shared {
+		shared[memberID] = true
+	}
+	return own.id, shared
+}
+
+// openRoom creates the room with the first client and joins the others one
+// by one, each once it holds the sender keys of the members before it. The
+// server reads connections concurrently, so joins racing ahead of the room
+// are sent again.
+func openRoom(t *testing.T, roomID string, peers ...*peer) {
+	t.Helper()
+
+	var allowed []string
+	for _, p := range peers {
+		allowed = append(allowed, p.ID)
+	}
+
+	peers[0].write(t, &room.CreateRoom{RoomID: roomID, ClientsToAllow: allowed})
+	for n, p := range peers[1:] {
+		var last time.Time
+		waitFor(t, p.ID+" to join", func() bool {
+			if time.Since(last) > 100*time.Millisecond {
+				p.write(t, &room.JoinRoom{RoomID: roomID})
+				last = time.Now()
+			}
+			return p.holds(roomID, allowed[:n+1]...)
+		})
+	}
+}
+
+func TestDirectMessage(t *testing.T) {
+	h := newHub(t)
+	alice := h.connect(t, client(t, "alice"))
+	bob := h.connect(t, client(t, "bob"))
+	openRoom(t, "lobby", alice, bob)
+
+	alice.chat(t, "lobby", `{"text":"for bob only"}`, "bob")
+	bob.expect(t, "alice", `{"text":"for bob only"}`)
+
+	bob.chat(t, "lobby", `{"text":"for alice only"}`, "alice")
+	alice.expect(t, "bob", `{"text":"for alice only"}`)
+
+	if h.relayed("only") {
+		t.Error("server read the plaintext")
+	}
+}
+
+func TestRoomMessage(t *testing.T) {
+	h := newHub(t)
+	alice := h.connect(t, client(t, "alice"))
+	bob := h.connect(t, client(t, "bob"))
+	carol := h.connect(t, client(t, "carol"))
+	openRoom(t, "lobby", alice, bob, carol)
+	waitFor(t, "sender keys of carol", func() bool { return carol.holds("lobby", "alice", "bob") })
+
+	alice.chat(t, "lobby", `{"text":"hello room"}`)
+	for _, p := range []*peer{alice, bob, carol} {
+		p.expect(t, "alice", `{"text":"hello room"}`)
+	}
+
+	carol.chat(t, "lobby", `{"text":"hello from carol"}`)
+	for _, p := range []*peer{alice, bob} {
+		p.expect(t, "carol", `{"text":"hello from carol"}`)
+	}
+
+	if h.relayed("hello") {
+		t.Error("server read the plaintext")
+	}
+
+	// The sender key known to carol is replaced once she left
+	before, _ := alice.ownKey("lobby")
+	carol.write(t, &room.LeaveRoom{RoomID: "lobby"})
+	waitFor(t, "carol to leave", func() bool {
+		alice.Mutex.RLock()
+		defer alice.Mutex.RUnlock()
+
+		return !alice.groups["lobby"].members["carol"]
+	})
+
+	alice.chat(t, "lobby", `{"text":"carol is gone"}`)
+	bob.expect(t, "alice", `{"text":"carol is gone"}`)
+
+	after, shared := alice.ownKey("lobby")
+	if after == before {
+		t.Error("sender key not replaced after a member left")
+	}
+	if !shared["bob"] || shared["carol"] {
+		t.Errorf("sender key shared with %v, want bob only", shared)
+	}
+}
+
+func TestRoomMessage_Disconnect(t *testing.T) {
+	h := newHub(t)
+	alice := h.connect(t, client(t, "alice"))
+	bob := h.connect(t, client(t, "bob"))
+	carol := h.connect(t, client(t, "carol"))
+	openRoom(t, "lobby", alice, bob, carol)
+	waitFor(t, "sender keys of carol", func() bool { return carol.holds("lobby", "alice", "bob") })
+
+	alice.chat(t, "lobby", `{"text":"hello room"}`)
+	for _, p := range []*peer{bob, carol} {
+		p.expect(t, "alice", `{"text":"hello room"}`)
+	}
+
+	// The sender key known to carol is replaced once she disconnected
+	before, _ := alice.ownKey("lobby")
+	h.chain.UnBindSocketConnection(carol.hub.Conn)
+	waitFor(t, "carol to be gone", func() bool {
+		alice.Mutex.RLock()
+		defer alice.Mutex.RUnlock()
+
+		return !alice.groups["lobby"].members["carol"]
+	})
+
+	alice.chat(t, "lobby", `{"text":"carol is gone"}`)
+	bob.expect(t, "alice", `{"text":"carol is gone"}`)
+
+	after, shared := alice.ownKey("lobby")
+	if after == before {
+		t.Error("sender key not replaced after a member disconnected")
+	}
+	if !shared["bob"] || shared["carol"] {
+		t.Errorf("sender key shared with %v, want bob only", shared)
+	}
+}
+
+func TestDirectMessage_KeyMismatch(t *testing.T) {
+	// Alice pinned another key for bob than the one he publishes
+	_, impostor, _ := ed25519.GenerateKey(rand.Reader)
+	store := encrypt.NewTrustStore(true)
+	if err := store.Pin("bob", impostor.Public().(ed25519.PublicKey)); err != nil {
+		t.Fatalf("Pin failed: %v", err)
+	}
+	events := make(chan encrypt.SecurityEvent, 8)
+	handler := func(event encrypt.SecurityEvent) { events <- event }
+
+	h := newHub(t)
+	alice := h.connect(t, client(t, "alice", WithTrustStore(store), WithSecurityEventHandler(handler)))
+	h.connect(t, client(t, "bob"))
+	alice.write(t, &room.CreateRoom{RoomID: "lobby", ClientsToAllow: []string{"alice", "bob"}})
+
+	alice.chat(t, "lobby", `{"text":"for bob only"}`, "bob")
+	select {
+	case event := <-events:
+		if event.Kind != encrypt.SecurityEventKeyMismatch || event.PeerID != "bob" {
+			t.Errorf("event mismatch: got %v for %q, want %v for bob", event.Kind, event.PeerID, encrypt.SecurityEventKeyMismatch)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no security event")
+	}
+
+	alice.Mutex.RLock()
+	_, exists := alice.outbound["bob"]
+	alice.Mutex.RUnlock()
+	if exists {
+		t.Error("session set up with a peer with a mismatching key")
+	}
+	if h.relayed("only") {
+		t.Error("server read the plaintext")
+	}
+}
+
+func TestPublish_IdentityChange(t *testing.T) {
+	events := make(chan encrypt.SecurityEvent, 8)
+	server := create(t, "server", WithServer, WithSecurityEventHandler(func(event encrypt.SecurityEvent) { events <- event }))
+
+	bob, err := client(t, "bob").bundle()
+	if err != nil {
+		t.Fatalf("bundle failed: %v", err)
+	}
+	impostor, err := client(t, "mallory").bundle()
+	if err != nil {
+		t.Fatalf("bundle failed: %v", err)
+	}
+
+	if err := server.publish("bob", bob); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+
+	// Another client cannot replace the bundle under another identity key
+	if err := server.publish("bob", impostor); !errors.Is(err, encrypt.ErrKeyMismatch) {
+		t.Errorf("expected ErrKeyMismatch, got %v", err)
+	}
+	if published := server.bundles["bob"]; !published.Identity.Key.Equal(bob.Identity.Key) {
+		t.Error("bundle replaced by one with another identity key")
+	}
+
+	for _, want := range []encrypt.SecurityEventKind{encrypt.SecurityEventKeyPinned, encrypt.SecurityEventKeyMismatch} {
+		if event := <-events; event.Kind != want || event.PeerID != "bob" {
+			t.Errorf("event mismatch: got %v for %q, want %v for bob", event.Kind, event.PeerID, want)
+		}
+	}
+}
+
+func TestAcceptSenderKey(t *testing.T) {
+	alice := client(t, "alice")
+
+	key, err := newSenderKey()
+	if err != nil {
+		t.Fatalf("newSenderKey failed: %v", err)
+	}
+	distribution := key.distribution("lobby")
+
+	// A distribution does not make its sender a member of the room
+	if _, err := alice.acceptSenderKey("mallory", distribution); !errors.Is(err, ErrNotMember) {
+		t.Errorf("expected ErrNotMember, got %v", err)
+	}
+	if _, exists := alice.groups["lobby"]; exists {
+		t.Error("room created from a distribution")
+	}
+
+	if _, err := alice.joined("alice", "server", "lobby", "bob"); err != nil {
+		t.Fatalf("joined failed: %v", err)
+	}
+	if _, err := alice.acceptSenderKey("mallory", distribution); !errors.Is(err, ErrNotMember) {
+		t.Errorf("expected ErrNotMember, got %v", err)
+	}
+	if _, err := alice.acceptSenderKey("bob", distribution); err != nil {
+		t.Errorf("sender key of a member refused: %v", err)
+	}
+
+	g := alice.groups["lobby"]
+	if g.members["mallory"] || g.receivers["mallory"] != nil || g.own.shared["mallory"] {
+		t.Error("sender key exchanged with a client not in the room")
+	}
+}
+
+func TestNewInterceptor(t *testing.T) {
+	if _, err := CreateInterceptorFactory().NewInterceptor(context.Background(), "client"); err == nil {
+		t.Error("expected an error for a client without identity key")
+	}
+	if _, err := CreateInterceptorFactory(WithIdentity(ed25519.PrivateKey{1})).NewInterceptor(context.Background(), "client"); err == nil {
+		t.Error("expected an error for an invalid identity key")
+	}
+	if _, err := CreateInterceptorFactory(WithServer).NewInterceptor(context.Background(), "server"); err != nil {
+		t.Errorf("NewInterceptor failed: %v", err)
+	}
+}
+
+func TestReceiver(t *testing.T) {
+	var sender chain
+	keys := make([][32]byte, 4)
+	for n := range keys {
+		keys[n], _ = sender.next()
+	}
+
+	r := newReceiver([32]byte{}, 0)
+	for _, index := range []uint32{2, 0, 3, 1} {
+		key, err := r.messageKey(index)
+		if err != nil {
+			t.Fatalf("messageKey(%d) failed: %v", index, err)
+		}
+		if key != keys[index] {
+			t.Errorf("key %d mismatch: got %x, want %x", index, key, keys[index])
+		}
+	}
+
+	if _, err := r.messageKey(2); !errors.Is(err, ErrReplayed) {
+		t.Errorf("expected ErrReplayed, got %v", err)
+	}
+	if _, err := r.messageKey(4 + maxSkip + 1); !errors.Is(err, ErrTooFarAhead) {
+		t.Errorf("expected ErrTooFarAhead, got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package e2e
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/encrypt"
+)
+
+// kdfInfo binds the keys derived by this package to its protocol
+const kdfInfo = "skyline-sonata-e2e-v1"
+
+// maxSkip bounds the message keys kept for messages of a chain that are yet
+// to arrive, and how far ahead of its chain a message may be
+const maxSkip = 1000
+
+var (
+	ErrInvalidSignature = errors.New("signature verification failed")
+	ErrReplayed         = errors.New("message key already used")
+	ErrTooFarAhead      = errors.New("message too far ahead of its chain")
+)
+
+// generateKey generates an X25519 key pair
+func generateKey() (encrypt.PrivateKey, encrypt.PublicKey, error) {
+	var private encrypt.PrivateKey
+	if _, err := io.ReadFull(rand.Reader, private[:]); err != nil {
+		return encrypt.PrivateKey{}, encrypt.PublicKey{}, err
+	}
+
+	return private, private.Public(), nil
+}
+
+// dh computes the X25519 shared secret, rejecting low-order public keys
+func dh(private encrypt.PrivateKey, public encrypt.PublicKey) ([]byte, error) {
+	return curve25519.X25519(private[:], public[:])
+}
+
+// identity holds the long-term keys of a client: the ed25519 key peers pin
+// and sign with, and the X25519 key taking part in X3DH, which is derived
+// from the ed25519 seed so that it survives restarts
+type identity struct {
+	signing ed25519.PrivateKey
+	dh      encrypt.PrivateKey
+	public  Identity
+}
+
+func newIdentity(signing ed25519.PrivateKey) (*identity, error) {
+	var private encrypt.PrivateKey
+	reader := hkdf.New(sha256.New, signing.Seed(), nil, []byte(kdfInfo+"\x00identity"))
+	if _, err := io.ReadFull(reader, private[:]); err != nil {
+		return nil, err
+	}
+
+	key := private.Public()
+	return &identity{
+		signing: signing,
+		dh:      private,
+		public: Identity{
+			Key:       signing.Public().(ed25519.PublicKey),
+			DH:        key,
+			Signature: ed25519.Sign(signing, signedIdentity(key)),
+		},
+	}, nil
+}
+
+// signedIdentity returns the data the ed25519 identity key signs to vouch
+// for the X25519 identity key
+func signedIdentity(key encrypt.PublicKey) []byte {
+	return associatedData([]byte("identity"), key[:])
+}
+
+// signedPreKey returns the data the identity key signs in a bundle
+func signedPreKey(preKey PreKey) []byte {
+	return associatedData([]byte("prekey"), binary.BigEndian.AppendUint32(nil, preKey.ID), preKey.Key[:])
+}
+
+// x3dh derives the chain key of a session from the X3DH key agreement of
+// the key pairs, given in the order of its specification
+func x3dh(privates []encrypt.PrivateKey, publics []encrypt.PublicKey) ([32]byte, error) {
+	material := make([]byte, 32, 32+32*len(privates))
+	for n := range material {
+		material[n] = 0xFF
+	}
+	for n := range privates {
+		secret, err := dh(privates[n], publics[n])
+		if err != nil {
+			return [32]byte{}, err
+		}
+		material = append(material, secret...)
+	}
+
+	var chainKey [32]byte
+	reader := hkdf.New(sha256.New, material, make([]byte, 32), []byte(kdfInfo+"\x00x3dh"))
+	if _, err := io.ReadFull(reader, chainKey[:]); err != nil {
+		return [32]byte{}, err
+	}
+
+	return chainKey, nil
+}
+
+// chain is a symmetric ratchet: every message key is derived from the chain
+// key, which is replaced in the same step, so that the keys of earlier
+// messages cannot be recovered from it
+type chain struct {
+	key   [32]byte
+	index uint32 // Index of the next message key
+}
+
+func (c *chain) next() ([32]byte, uint32) {
+	var messageKey [32]byte
+	mac := hmac.New(sha256.New, c.key[:])
+	mac.Write([]byte{0x01})
+	mac.Sum(messageKey[:0])
+
+	mac = hmac.New(sha256.New, c.key[:])
+	mac.Write([]byte{0x02})
+	mac.Sum(c.key[:0])
+
+	index := c.index
+	c.index++
+	return messageKey, index
+}
+
+// receiver is the receiving side of a chain. Keys of messages skipped by a
+// later one are kept until they arrive; every key is handed out once.
+type receiver struct {
+	chain   chain
+	skipped map[uint32][32]byte
+}
+
+func newReceiver(key [32]byte, index uint32) *receiver {
+	return &receiver{chain: chain{key: key, index: index}, skipped: make(map[uint32][32]byte)}
+}
+
+// clone copies the receiver, for consuming keys only once a message
+// authenticated
+func (r *receiver) clone() *receiver {
+	clone := newReceiver(r.chain.key, r.chain.index)
+	for index, messageKey := range r.skipped {
+		clone.skipped[index] = messageKey
+	}
+	return clone
+}
+
+// messageKey returns the key of the message at index
+func (r *receiver) messageKey(index uint32) ([32]byte, error) {
+	if index < r.chain.index {
+		messageKey, ok := r.skipped[index]
+		if !ok {
+			return [32]byte{}, ErrReplayed
+		}
+		delete(r.skipped, index)
+		return messageKey, nil
+	}
+	if index-r.chain.index > maxSkip {
+		return [32]byte{}, ErrTooFarAhead
+	}
+
+	for r.chain.index < index {
+		messageKey, skipped := r.chain.next()
+		r.skipped[skipped] = messageKey
+	}
+	// Forget the oldest skipped keys; their messages are considered lost
+	for len(r.skipped) > maxSkip {
+		oldest := index
+		for skipped := range r.skipped {
+			oldest = min(oldest, skipped)
+		}
+		delete(r.skipped, oldest)
+	}
+
+	messageKey, _ := r.chain.next()
+	return messageKey, nil
+}
+
+// messageCipher expands a message key into the key and nonce of its single
+// use with ChaCha20-Poly1305
+func messageCipher(messageKey [32]byte) ([]byte, []byte, error) {
+	material := make([]byte, chacha20poly1305.KeySize+chacha20poly1305.NonceSize)
+	reader := hkdf.New(sha256.New, messageKey[:], nil, []byte(kdfInfo+"\x00message"))
+	if _, err := io.ReadFull(reader, material); err != nil {
+		return nil, nil, err
+	}
+
+	return material[:chacha20poly1305.KeySize], material[chacha20poly1305.KeySize:], nil
+}
+
+func seal(messageKey [32]byte, plaintext, additionalData []byte) ([]byte, error) {
+	key, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+func open(messageKey [32]byte, ciphertext, additionalData []byte) ([]byte, error) {
+	key, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// associatedData joins the fields a signature or ciphertext is bound to,
+// each prefixed with its length
+func associatedData(fields ...[]byte) []byte {
+	data := []byte(kdfInfo)
+	for _, field := range fields {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(field)))
+		data = append(data, field...)
+	}
+	return data
+}
@@ -0,0 +1,363 @@
+package e2e
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/encrypt"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/room"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+	"github.com/harshabose/skyline_sonata/serve/pkg/utils"
+)
+
+var (
+	ProtocolPublishPreKeys  message.Protocol = "e2e-publish-prekeys"
+	ProtocolPreKeyRequest   message.Protocol = "e2e-prekey-request"
+	ProtocolPreKeyResponse  message.Protocol = "e2e-prekey-response"
+	ErrInvalidInterceptor                    = errors.New("inappropriate interceptor for the payload")
+	ErrConnectionNotFound                    = errors.New("connection not registered")
+	ErrInvalidServerRequest                  = errors.New("invalid request to server")
+)
+
+var protocolMap = message.CreateProtocolRegistry()
+
+// roomProtocols decodes the room messages end-to-end encryption applies to.
+// They are handled here without being processed; the room interceptor on the
+// server processes them.
+var roomProtocols = message.CreateProtocolRegistry()
+
+func init() {
+	message.MustRegister[PublishPreKeys](protocolMap)
+	message.MustRegister[PreKeyRequest](protocolMap)
+	message.MustRegister[PreKeyResponse](protocolMap)
+
+	message.MustRegister[room.ChatSource](roomProtocols)
+	message.MustRegister[room.ChatDest](roomProtocols)
+	message.MustRegister[room.ClientJoined](roomProtocols)
+	message.MustRegister[room.ClientLeft](roomProtocols)
+}
+
+// envelopeVersion marks chat content encrypted end to end
+const envelopeVersion = 1
+
+// Identity is the public identity of a client: its ed25519 key, which peers
+// pin, and its X25519 identity key signed by it
+type Identity struct {
+	Key       ed25519.PublicKey `json:"key"`
+	DH        encrypt.PublicKey `json:"dh"`
+	Signature []byte            `json:"signature"`
+}
+
+func (identity *Identity) Verify() error {
+	if len(identity.Key) != ed25519.PublicKeySize {
+		return message.ErrorNotValid
+	}
+	if !ed25519.Verify(identity.Key, signedIdentity(identity.DH), identity.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// PreKey is a numbered X25519 pre-key
+type PreKey struct {
+	ID  uint32            `json:"id"`
+	Key encrypt.PublicKey `json:"key"`
+}
+
+// Bundle is what a client publishes for peers to set up sessions with it
+// while it is away: its identity, a signed pre-key and one-time pre-keys.
+// The server hands out every one-time pre-key once.
+type Bundle struct {
+	PeerID         string   `json:"peer_id,omitempty"` // Set by the server
+	Identity       Identity `json:"identity"`
+	SignedPreKey   PreKey   `json:"signed_prekey"`
+	Signature      []byte   `json:"signature"` // Identity key over the signed pre-key
+	OneTimePreKeys []PreKey `json:"one_time_prekeys,omitempty"`
+}
+
+func (bundle *Bundle) Verify() error {
+	if err := bundle.Identity.Verify(); err != nil {
+		return err
+	}
+	if !ed25519.Verify(bundle.Identity.Key, signedPreKey(bundle.SignedPreKey), bundle.Signature) {
+		return ErrInvalidSignature
+	}
+	for _, preKey := range bundle.OneTimePreKeys {
+		if preKey.ID == 0 {
+			return message.ErrorNotValid
+		}
+	}
+	return nil
+}
+
+// Envelope replaces the content of chat messages encrypted end to end. It
+// holds either a ciphertext per recipient, sealed with the pairwise session
+// of the sender with each, or a single ciphertext under the sender key of
+// the sender for the room.
+type Envelope struct {
+	Version  int               `json:"e2e"`
+	Identity *Identity         `json:"identity,omitempty"` // Sender identity, for recipients setting up a session
+	Sealed   map[string]Sealed `json:"sealed,omitempty"`   // Ciphertext per recipient ID
+	Group    *GroupMessage     `json:"group,omitempty"`
+}
+
+// isEnvelope reports whether the chat content is an envelope already
+func isEnvelope(content json.RawMessage) bool {
+	var envelope struct {
+		Version int `json:"e2e"`
+	}
+	return json.Unmarshal(content, &envelope) == nil && envelope.Version == envelopeVersion
+}
+
+// Sealed is a ciphertext for a single recipient. It repeats the X3DH values
+// of the session, so that the recipient sets up its side from whichever
+// message arrives first.
+type Sealed struct {
+	Ephemeral     encrypt.PublicKey `json:"ephemeral"`
+	SignedPreKey  uint32            `json:"signed_prekey"`
+	OneTimePreKey uint32            `json:"one_time_prekey,omitempty"` // Zero if none was left
+	Index         uint32            `json:"index"`
+	Ciphertext    []byte            `json:"ciphertext"`
+}
+
+// GroupMessage is a ciphertext under a sender key, signed with its signing
+// key so that other members cannot forge messages of the sender
+type GroupMessage struct {
+	KeyID      uint32 `json:"key_id"`
+	Index      uint32 `json:"index"`
+	Ciphertext []byte `json:"ciphertext"`
+	Signature  []byte `json:"signature"`
+}
+
+// plaintext is what the pairwise ciphertexts of an envelope decrypt to
+type plaintext struct {
+	Content   json.RawMessage        `json:"content,omitempty"`
+	SenderKey *senderKeyDistribution `json:"sender_key,omitempty"`
+}
+
+// senderKeyDistribution hands a sender key, at its current index, to a
+// member of the room
+type senderKeyDistribution struct {
+	RoomID     string            `json:"room_id"`
+	KeyID      uint32            `json:"key_id"`
+	Index      uint32            `json:"index"`
+	ChainKey   []byte            `json:"chain_key"`
+	SigningKey ed25519.PublicKey `json:"signing_key"`
+}
+
+// ================================================================================================================== //
+// ================================================================================================================== //
+
+// PublishPreKeys is sent by clients to publish their bundle on the server,
+// replacing the one published before
+type PublishPreKeys struct {
+	message.BaseMessage        // NOTE: EMPTY PAYLOAD
+	Bundle              Bundle `json:"bundle"`
+}
+
+func NewPublishPreKeysMessage(senderID, receiverID string, bundle Bundle) *PublishPreKeys {
+	return &PublishPreKeys{
+		BaseMessage: message.BaseMessage{
+			Header: message.Header{
+				SenderID:   senderID,
+				ReceiverID: receiverID,
+				Protocol:   message.NoneProtocol,
+			},
+			Payload: nil,
+		},
+		Bundle: bundle,
+	}
+}
+
+func (payload *PublishPreKeys) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *PublishPreKeys) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+func (payload *PublishPreKeys) Validate() error {
+	return payload.Bundle.Verify()
+}
+
+func (payload *PublishPreKeys) Protocol() message.Protocol {
+	return ProtocolPublishPreKeys
+}
+
+// Process stores the bundle under the identity of the sender
+func (payload *PublishPreKeys) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+	i, ok := _interceptor.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	if !i.isServer {
+		return ErrInvalidServerRequest
+	}
+
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
+	return i.publish(interceptor.SenderOf(connection, payload), payload.Bundle)
+}
+
+// PreKeyRequest is sent by clients to fetch the bundles of peers
+type PreKeyRequest struct {
+	message.BaseMessage          // NOTE: EMPTY PAYLOAD
+	PeerIDs             []string `json:"peer_ids"`
+}
+
+func NewPreKeyRequestMessage(senderID, receiverID string, peerIDs []string) *PreKeyRequest {
+	return &PreKeyRequest{
+		BaseMessage: message.BaseMessage{
+			Header: message.Header{
+				SenderID:   senderID,
+				ReceiverID: receiverID,
+				Protocol:   message.NoneProtocol,
+			},
+			Payload: nil,
+		},
+		PeerIDs: peerIDs,
+	}
+}
+
+func (payload *PreKeyRequest) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *PreKeyRequest) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+func (payload *PreKeyRequest) Validate() error {
+	if len(payload.PeerIDs) == 0 {
+		return message.ErrorNotValid
+	}
+	return nil
+}
+
+func (payload *PreKeyRequest) Protocol() message.Protocol {
+	return ProtocolPreKeyRequest
+}
+
+// Process answers with the bundles of the requested peers, each with one of
+// their one-time pre-keys
+func (payload *PreKeyRequest) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+	i, ok := _interceptor.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	if !i.isServer {
+		return ErrInvalidServerRequest
+	}
+
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	bundles, missing := i.lookup(payload.PeerIDs)
+
+	peerID := interceptor.SenderOf(connection, payload)
+	msg, err := message.CreateMessage(i.ID, peerID, NewPreKeyResponseMessage(i.ID, peerID, bundles, missing))
+	if err != nil {
+		return err
+	}
+
+	return state.writer.Write(connection, websocket.MessageText, msg)
+}
+
+// PreKeyResponse answers a PreKeyRequest. Missing lists the requested peers
+// without published bundle.
+type PreKeyResponse struct {
+	message.BaseMessage          // NOTE: EMPTY PAYLOAD
+	Bundles             []Bundle `json:"bundles,omitempty"`
+	Missing             []string `json:"missing,omitempty"`
+}
+
+func NewPreKeyResponseMessage(senderID, receiverID string, bundles []Bundle, missing []string) *PreKeyResponse {
+	return &PreKeyResponse{
+		BaseMessage: message.BaseMessage{
+			Header: message.Header{
+				SenderID:   senderID,
+				ReceiverID: receiverID,
+				Protocol:   message.NoneProtocol,
+			},
+			Payload: nil,
+		},
+		Bundles: bundles,
+		Missing: missing,
+	}
+}
+
+func (payload *PreKeyResponse) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *PreKeyResponse) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+func (payload *PreKeyResponse) Validate() error {
+	for _, bundle := range payload.Bundles {
+		if bundle.PeerID == "" {
+			return message.ErrorNotValid
+		}
+	}
+	return nil
+}
+
+func (payload *PreKeyResponse) Protocol() message.Protocol {
+	return ProtocolPreKeyResponse
+}
+
+// Process sets up sessions with the peers from their bundles and writes the
+// messages that waited for them. Peers without bundle, or whose bundle is
+// rejected, are left out of these messages.
+func (payload *PreKeyResponse) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+	i, ok := _interceptor.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	if i.isServer {
+		return errors.New("pre-key response received by server")
+	}
+
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	merr := utils.NewMultiError()
+	i.Mutex.Lock()
+	for _, bundle := range payload.Bundles {
+		delete(state.requested, bundle.PeerID)
+		if err := i.initiate(bundle); err != nil {
+			merr.Add(fmt.Errorf("no session with peer %q: %w", bundle.PeerID, err))
+		}
+	}
+	for _, peerID := range payload.Missing {
+		delete(state.requested, peerID)
+	}
+	i.Mutex.Unlock()
+
+	merr.Add(i.flush(connection, state))
+	return merr.ErrorOrNil()
+}
@@ -0,0 +1,217 @@
+package e2e
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/google/uuid"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/room"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+	"github.com/harshabose/skyline_sonata/serve/pkg/utils"
+)
+
+// maxOutbox bounds the chat messages waiting per connection for the bundles
+// of their recipients
+const maxOutbox = 256
+
+var ErrOutboxFull = errors.New("too many chat messages waiting for pre-keys")
+
+// pending is a chat message in the outbox. Messages are sealed when they
+// leave it, in order, so that the sender key indexes follow the order they
+// were written in.
+type pending struct {
+	senderID   string
+	receiverID string
+	roomID     string
+	messageID  string
+	timestamp  time.Time
+	recipients []string   // Pairwise recipients, none for messages to the room
+	key        *senderKey // Sender key of messages to the room
+	data       []byte     // Marshalled plaintext, or the content of messages to the room
+}
+
+// newPending returns a pairwise message, used for distributing sender keys
+func newPending(senderID, receiverID, roomID string, recipients []string, data []byte) *pending {
+	return &pending{
+		senderID:   senderID,
+		receiverID: receiverID,
+		roomID:     roomID,
+		messageID:  uuid.NewString(),
+		timestamp:  time.Now(),
+		recipients: recipients,
+		data:       data,
+	}
+}
+
+// send puts a chat message written by the application into the outbox and
+// writes what the outbox is ready to
+func (i *Interceptor) send(connection interceptor.Connection, state *state, source *room.ChatSource) error {
+	header := source.Message().Header
+	chat := &pending{
+		senderID:   header.SenderID,
+		receiverID: header.ReceiverID,
+		roomID:     source.RoomID,
+		messageID:  source.MessageID,
+		timestamp:  source.Timestamp,
+	}
+
+	i.Mutex.Lock()
+	var messages []*pending
+	if len(source.RecipientID) > 0 {
+		data, err := json.Marshal(plaintext{Content: source.Content})
+		if err != nil {
+			i.Mutex.Unlock()
+			return err
+		}
+		for _, recipientID := range source.RecipientID {
+			if recipientID != i.ID {
+				chat.recipients = append(chat.recipients, recipientID)
+			}
+		}
+		chat.data = data
+	} else {
+		distributions, key, err := i.distribute(header.SenderID, header.ReceiverID, source.RoomID, i.groupOf(source.RoomID))
+		if err != nil {
+			i.Mutex.Unlock()
+			return err
+		}
+		messages = distributions
+		chat.key, chat.data = key, source.Content
+	}
+	peerIDs, err := i.queue(state, append(messages, chat)...)
+	i.Mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return i.dispatch(connection, state, peerIDs)
+}
+
+// queue appends messages to the outbox and returns the peers whose bundles
+// are to be requested for them. Callers hold the lock.
+func (i *Interceptor) queue(state *state, messages ...*pending) ([]string, error) {
+	if len(state.outbox)+len(messages) > maxOutbox {
+		return nil, ErrOutboxFull
+	}
+
+	var peerIDs []string
+	for _, m := range messages {
+		for _, peerID := range m.recipients {
+			if _, exists := i.outbound[peerID]; exists || state.requested[peerID] {
+				continue
+			}
+			state.requested[peerID] = true
+			peerIDs = append(peerIDs, peerID)
+		}
+	}
+	state.outbox = append(state.outbox, messages...)
+
+	return peerIDs, nil
+}
+
+// dispatch requests the bundles of the peers and writes what the outbox is
+// ready to
+func (i *Interceptor) dispatch(connection interceptor.Connection, state *state, peerIDs []string) error {
+	if len(peerIDs) > 0 {
+		peerID := state.peer()
+		msg, err := message.CreateMessage(i.ID, peerID, NewPreKeyRequestMessage(i.ID, peerID, peerIDs))
+		if err != nil {
+			return err
+		}
+		if err := state.writer.Write(connection, websocket.MessageText, msg); err != nil {
+			return err
+		}
+	}
+
+	return i.flush(connection, state)
+}
+
+// flush seals and writes the messages of the outbox in order, until one
+// waits for a requested bundle. Recipients without bundle on the server are
+// left out of their messages.
+func (i *Interceptor) flush(connection interceptor.Connection, state *state) error {
+	state.flushMux.Lock()
+	defer state.flushMux.Unlock()
+
+	var merr = utils.NewMultiError()
+	for {
+		i.Mutex.Lock()
+		if len(state.outbox) == 0 || i.waiting(state, state.outbox[0]) {
+			i.Mutex.Unlock()
+			return merr.ErrorOrNil()
+		}
+		next := state.outbox[0]
+		state.outbox = state.outbox[1:]
+		msg, err := i.seal(next)
+		i.Mutex.Unlock()
+
+		merr.Add(err)
+		if msg != nil {
+			merr.Add(state.writer.Write(connection, websocket.MessageText, msg))
+		}
+	}
+}
+
+// waiting reports whether a recipient of the message has no session yet
+// and its bundle was requested. Callers hold the lock.
+func (i *Interceptor) waiting(state *state, m *pending) bool {
+	for _, peerID := range m.recipients {
+		if _, exists := i.outbound[peerID]; !exists && state.requested[peerID] {
+			return true
+		}
+	}
+	return false
+}
+
+// seal encrypts the message into a chat message carrying its envelope. A
+// message is returned along with the error if only some recipients could
+// not be sealed for. Callers hold the lock.
+func (i *Interceptor) seal(m *pending) (message.Message, error) {
+	var (
+		merr     = utils.NewMultiError()
+		envelope = Envelope{Version: envelopeVersion}
+		sealed   []string
+	)
+
+	if m.key != nil {
+		groupMessage, err := i.sealGroup(m.roomID, m.messageID, m.key, m.data)
+		if err != nil {
+			return nil, err
+		}
+		envelope.Group = groupMessage
+	} else {
+		envelope.Identity = &i.identity.public
+		envelope.Sealed = make(map[string]Sealed, len(m.recipients))
+		for _, peerID := range m.recipients {
+			ciphertext, err := i.sealFor(peerID, m.roomID, m.messageID, m.data)
+			if err != nil {
+				merr.Add(fmt.Errorf("message %s not sent to %q: %w", m.messageID, peerID, err))
+				continue
+			}
+			envelope.Sealed[peerID] = ciphertext
+			sealed = append(sealed, peerID)
+		}
+		if len(sealed) == 0 {
+			return nil, merr.ErrorOrNil()
+		}
+	}
+
+	content, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &room.ChatSource{RoomID: m.roomID, MessageID: m.messageID, RecipientID: sealed, Content: content, Timestamp: m.timestamp}
+	msg, err := message.CreateMessage(m.senderID, m.receiverID, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, merr.ErrorOrNil()
+}
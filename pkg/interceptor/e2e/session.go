@@ -0,0 +1,192 @@
+package e2e
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/encrypt"
+)
+
+var (
+	ErrNoSession     = errors.New("no session with peer")
+	ErrUnknownPreKey = errors.New("unknown or used pre-key")
+	ErrSessionMoved  = errors.New("session belongs to another peer")
+	ErrNotEncrypted  = errors.New("chat message not encrypted end to end")
+	ErrNotAddressed  = errors.New("chat message holds no ciphertext for this client")
+	ErrNoSenderKey   = errors.New("no sender key of the sender")
+	ErrNotMember     = errors.New("sender key of a client not in the room")
+)
+
+// outbound is the session messages to a peer are sealed with, set up with
+// X3DH from the bundle of the peer. Sessions are one-way: the peer seals its
+// messages with the session it set up from our bundle.
+type outbound struct {
+	peerKey       ed25519.PublicKey
+	ephemeral     encrypt.PublicKey
+	signedPreKey  uint32
+	oneTimePreKey uint32
+	ad            []byte // Identity keys of the sender and the recipient
+	chain         chain
+}
+
+// inbound is the receiving side of a session set up by a peer, looked up by
+// the ephemeral key of the peer
+type inbound struct {
+	peerID   string
+	ad       []byte
+	receiver *receiver
+}
+
+// initiate sets up the session with the peer of the bundle, unless one is
+// set up already. Callers hold the lock.
+func (i *Interceptor) initiate(bundle Bundle) error {
+	if _, exists := i.outbound[bundle.PeerID]; exists {
+		return nil
+	}
+
+	if err := bundle.Verify(); err != nil {
+		return err
+	}
+	if err := i.trust.Verify(bundle.PeerID, bundle.Identity.Key, i.onSecurityEvent...); err != nil {
+		return err
+	}
+
+	private, public, err := generateKey()
+	if err != nil {
+		return err
+	}
+
+	// DH1 = DH(IKa, SPKb), DH2 = DH(EKa, IKb), DH3 = DH(EKa, SPKb), DH4 = DH(EKa, OPKb)
+	privates := []encrypt.PrivateKey{i.identity.dh, private, private}
+	publics := []encrypt.PublicKey{bundle.SignedPreKey.Key, bundle.Identity.DH, bundle.SignedPreKey.Key}
+	session := &outbound{
+		peerKey:      bundle.Identity.Key,
+		ephemeral:    public,
+		signedPreKey: bundle.SignedPreKey.ID,
+		ad:           slices.Concat(i.identity.public.Key, bundle.Identity.Key),
+	}
+	if len(bundle.OneTimePreKeys) > 0 {
+		privates = append(privates, private)
+		publics = append(publics, bundle.OneTimePreKeys[0].Key)
+		session.oneTimePreKey = bundle.OneTimePreKeys[0].ID
+	}
+
+	if session.chain.key, err = x3dh(privates, publics); err != nil {
+		return err
+	}
+
+	i.outbound[bundle.PeerID] = session
+	return nil
+}
+
+// respond sets up the receiving side of a session from the first message
+// of the peer. The one-time pre-key it used is left to the caller to delete
+// once the message decrypted. Callers hold the lock.
+func (i *Interceptor) respond(peerID string, sender *Identity, sealed Sealed) (*inbound, error) {
+	if sender == nil {
+		return nil, fmt.Errorf("%w: no sender identity", ErrNoSession)
+	}
+	if err := sender.Verify(); err != nil {
+		return nil, err
+	}
+	if err := i.trust.Verify(peerID, sender.Key, i.onSecurityEvent...); err != nil {
+		return nil, err
+	}
+
+	if sealed.SignedPreKey != i.signedPreKey.id {
+		return nil, fmt.Errorf("%w: signed pre-key %d", ErrUnknownPreKey, sealed.SignedPreKey)
+	}
+
+	// DH1 = DH(SPKb, IKa), DH2 = DH(IKb, EKa), DH3 = DH(SPKb, EKa), DH4 = DH(OPKb, EKa)
+	privates := []encrypt.PrivateKey{i.signedPreKey.private, i.identity.dh, i.signedPreKey.private}
+	publics := []encrypt.PublicKey{sender.DH, sealed.Ephemeral, sealed.Ephemeral}
+	if sealed.OneTimePreKey != 0 {
+		private, exists := i.oneTimePreKeys[sealed.OneTimePreKey]
+		if !exists {
+			return nil, fmt.Errorf("%w: one-time pre-key %d", ErrUnknownPreKey, sealed.OneTimePreKey)
+		}
+		privates = append(privates, private)
+		publics = append(publics, sealed.Ephemeral)
+	}
+
+	chainKey, err := x3dh(privates, publics)
+	if err != nil {
+		return nil, err
+	}
+
+	return &inbound{
+		peerID:   peerID,
+		ad:       slices.Concat(sender.Key, i.identity.public.Key),
+		receiver: newReceiver(chainKey, 0),
+	}, nil
+}
+
+// sealFor seals data for the peer with the session set up with it, bound to
+// the chat message it travels in. Callers hold the lock.
+func (i *Interceptor) sealFor(peerID, roomID, messageID string, data []byte) (Sealed, error) {
+	session, exists := i.outbound[peerID]
+	if !exists {
+		return Sealed{}, fmt.Errorf("%w %q", ErrNoSession, peerID)
+	}
+
+	messageKey, index := session.chain.next()
+	ciphertext, err := seal(messageKey, data, pairwiseData(session.ad, roomID, messageID, i.ID, peerID))
+	if err != nil {
+		return Sealed{}, err
+	}
+
+	return Sealed{
+		Ephemeral:     session.ephemeral,
+		SignedPreKey:  session.signedPreKey,
+		OneTimePreKey: session.oneTimePreKey,
+		Index:         index,
+		Ciphertext:    ciphertext,
+	}, nil
+}
+
+// openFrom opens the ciphertext the peer sealed for this client, setting up
+// the receiving side of the session with its first message. Callers hold the
+// lock.
+func (i *Interceptor) openFrom(peerID, roomID, messageID string, sender *Identity, sealed Sealed) ([]byte, error) {
+	session, exists := i.inbound[sealed.Ephemeral]
+	if exists && session.peerID != peerID {
+		return nil, ErrSessionMoved
+	}
+
+	if !exists {
+		created, err := i.respond(peerID, sender, sealed)
+		if err != nil {
+			return nil, err
+		}
+		session = created
+	}
+
+	// Keys are only consumed once the message authenticated, so that forged
+	// messages cannot advance the chain
+	receiver := session.receiver.clone()
+
+	messageKey, err := receiver.messageKey(sealed.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := open(messageKey, sealed.Ciphertext, pairwiseData(session.ad, roomID, messageID, peerID, i.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	session.receiver = receiver
+	if !exists {
+		i.inbound[sealed.Ephemeral] = session
+		delete(i.oneTimePreKeys, sealed.OneTimePreKey)
+	}
+
+	return data, nil
+}
+
+// pairwiseData returns the data a pairwise ciphertext is bound to
+func pairwiseData(ad []byte, roomID, messageID, senderID, recipientID string) []byte {
+	return associatedData([]byte("pairwise"), ad, []byte(roomID), []byte(messageID), []byte(senderID), []byte(recipientID))
+}
@@ -0,0 +1,32 @@
+package e2e
+
+import (
+	"sync"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+)
+
+// state maintains the connection-specific state. Sessions and sender keys
+// belong to the interceptor, as they outlive reconnections.
+type state struct {
+	peerID    string          // Server ID, learned from its first message
+	outbox    []*pending      // Guarded by the interceptor mutex
+	requested map[string]bool // Peers whose bundles were requested; guarded by the interceptor mutex
+	flushMux  sync.Mutex      // Serialises sealing and writing the outbox
+	writer    interceptor.Writer
+	mux       sync.RWMutex
+}
+
+func (state *state) peer() string {
+	state.mux.RLock()
+	defer state.mux.RUnlock()
+
+	return state.peerID
+}
+
+func (state *state) setPeer(id string) {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+
+	state.peerID = id
+}
@@ -7,9 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"sync"
 	"time"
 
+	"golang.org/x/crypto/chacha20poly1305"
+
 	"github.com/harshabose/skyline_sonata/serve/pkg/message"
 )
 
@@ -18,6 +21,11 @@ var (
 	ErrEncryptionNotReady = errors.New("encryption not ready")
 	ErrInvalidKey         = errors.New("invalid encryption key")
 	ErrInvalidNonce       = errors.New("invalid nonce")
+	ErrUnsupportedCipher  = errors.New("unsupported cipher")
+	ErrNoCommonCipher     = errors.New("no cipher supported by both peers")
+	ErrReplayedMessage    = errors.New("replayed or outdated message")
+	ErrClockSkew          = errors.New("message timestamp outside the allowed clock skew")
+	ErrKeyExpired         = errors.New("message under keys replaced by a rekey after the grace period")
 )
 
 // Encryptor defines the interface for message encryption and decryption
@@ -28,10 +36,27 @@ type Encryptor interface {
 	// SetSessionID sets the session identifier for this encryption session
 	SetSessionID(id SessionID)
 
-	// Encrypt encrypts a message between sender and receiver
-	Encrypt(senderID, receiverID string, message message.Message) (*EncryptedMessage, error)
+	// Sequence returns the sequence number of the last message encrypted
+	Sequence() uint64
+
+	// RekeySend switches the keys and session ID used to encrypt the
+	// following messages
+	RekeySend(encryptKey key, id SessionID) error
+
+	// RekeyReceive switches the keys and session ID used to decrypt messages
+	// numbered from cutover on. Older messages are decrypted with the previous
+	// keys until grace elapsed.
+	RekeyReceive(decryptKey key, id SessionID, cutover uint64, grace time.Duration) error
 
-	// Decrypt decrypts an encrypted message in-place
+	// Encrypt encrypts a message between sender and receiver. The message is
+	// encoded with the codec of the connection before encryption. Each message
+	// is numbered with the next sequence number of the session, which is
+	// authenticated together with the header and timestamp.
+	Encrypt(senderID, receiverID string, codec message.Codec, message message.Message) (*EncryptedMessage, error)
+
+	// Decrypt authenticates and decrypts an encrypted message in-place. Messages
+	// whose sequence number was already received or fell out of the replay
+	// window are rejected with ErrReplayedMessage.
 	Decrypt(*EncryptedMessage) error
 
 	// Ready checks if the encryptor is properly initialized and ready to use
@@ -43,83 +68,197 @@ type Encryptor interface {
 
 type EncryptorFactory func() (Encryptor, error)
 
+// Cipher names an AEAD construction supported by the key exchange
+type Cipher string
+
+const (
+	CipherAES256GCM         Cipher = "aes-256-gcm"
+	CipherChaCha20Poly1305  Cipher = "chacha20-poly1305"
+	CipherXChaCha20Poly1305 Cipher = "xchacha20-poly1305"
+)
+
+// encryptors maps each supported cipher to its implementation
+var encryptors = map[Cipher]EncryptorFactory{
+	CipherAES256GCM:         NewAES256,
+	CipherChaCha20Poly1305:  NewChaCha20Poly1305,
+	CipherXChaCha20Poly1305: NewXChaCha20Poly1305,
+}
+
+// defaultCiphers are the ciphers offered and accepted when none are
+// configured, in order of preference
+var defaultCiphers = []Cipher{CipherAES256GCM, CipherXChaCha20Poly1305, CipherChaCha20Poly1305}
+
+// newEncryptor creates the encryptor implementing the named cipher
+func newEncryptor(name Cipher) (Encryptor, error) {
+	factory, ok := encryptors[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedCipher, name)
+	}
+
+	return factory()
+}
+
+// negotiate returns the first of the preferred ciphers that is offered
+func negotiate(preferred, offered []Cipher) (Cipher, error) {
+	for _, name := range preferred {
+		if slices.Contains(offered, name) {
+			return name, nil
+		}
+	}
+
+	return "", ErrNoCommonCipher
+}
+
 // AES256 implements the encryptor interface using AES-256-GCM
 type AES256 struct {
-	encryptor cipher.AEAD
-	decryptor cipher.AEAD
-	sessionID SessionID
-	mux       sync.RWMutex
+	aeadEncryptor
 }
 
 func NewAES256() (Encryptor, error) {
-	return &AES256{}, nil
+	return &AES256{aeadEncryptor{create: newAESGCM}}, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// ChaCha20Poly1305 implements the encryptor interface using
+// ChaCha20-Poly1305, which is fast on hardware without AES instructions
+type ChaCha20Poly1305 struct {
+	aeadEncryptor
+}
+
+func NewChaCha20Poly1305() (Encryptor, error) {
+	return &ChaCha20Poly1305{aeadEncryptor{create: chacha20poly1305.New}}, nil
+}
+
+// XChaCha20Poly1305 implements the encryptor interface using
+// XChaCha20-Poly1305. Its 24-byte nonces make random nonce collisions
+// negligible even on long-lived sessions.
+type XChaCha20Poly1305 struct {
+	aeadEncryptor
+}
+
+func NewXChaCha20Poly1305() (Encryptor, error) {
+	return &XChaCha20Poly1305{aeadEncryptor{create: chacha20poly1305.NewX}}, nil
+}
+
+// aeadEncryptor implements the encryptor interface on top of an AEAD created
+// from each key by create, using random nonces of the AEAD's nonce size.
+// Sequence numbers restart with every new pair of keys set by SetKeys and
+// continue across rekeys.
+type aeadEncryptor struct {
+	create   func(key []byte) (cipher.AEAD, error)
+	send     direction
+	receive  direction
+	previous direction    // Receive keys replaced by the last rekey
+	cutover  uint64       // First sequence number received under the receive keys
+	expires  time.Time    // End of the grace period of the previous keys
+	sequence uint64       // Last sequence number sent
+	window   replayWindow // Sequence numbers received
+	mux      sync.RWMutex
+}
+
+// direction holds the keys protecting the messages of one direction
+type direction struct {
+	aead      cipher.AEAD
+	sessionID SessionID
 }
 
 // SetKeys configures the encryption and decryption keys
-func (a *AES256) SetKeys(encryptKey key, decryptKey key) error {
+func (a *aeadEncryptor) SetKeys(encryptKey key, decryptKey key) error {
 	a.mux.Lock()
 	defer a.mux.Unlock()
 
-	// Setup encryption AEAD
-	encBlock, err := aes.NewCipher(encryptKey[:])
+	encryptor, err := a.create(encryptKey[:])
 	if err != nil {
 		return ErrInvalidKey
 	}
 
-	encGCM, err := cipher.NewGCM(encBlock)
+	decryptor, err := a.create(decryptKey[:])
 	if err != nil {
 		return ErrInvalidKey
 	}
 
-	// Setup decryption AEAD
-	decBlock, err := aes.NewCipher(decryptKey[:])
-	if err != nil {
-		return ErrInvalidKey
-	}
+	a.send.aead = encryptor
+	a.receive.aead = decryptor
+	a.previous = direction{}
+	a.sequence = 0
+	a.window = replayWindow{}
+
+	return nil
+}
+
+// SetSessionID sets the session identifier for this encryption session
+func (a *aeadEncryptor) SetSessionID(id SessionID) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
 
-	decGCM, err := cipher.NewGCM(decBlock)
+	a.send.sessionID = id
+	a.receive.sessionID = id
+}
+
+// Sequence returns the sequence number of the last message encrypted
+func (a *aeadEncryptor) Sequence() uint64 {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+
+	return a.sequence
+}
+
+// RekeySend encrypts the messages following the ones already encrypted with
+// encryptKey, under the session ID id
+func (a *aeadEncryptor) RekeySend(encryptKey key, id SessionID) error {
+	encryptor, err := a.create(encryptKey[:])
 	if err != nil {
 		return ErrInvalidKey
 	}
 
-	a.encryptor = encGCM
-	a.decryptor = decGCM
+	a.mux.Lock()
+	defer a.mux.Unlock()
 
+	a.send = direction{aead: encryptor, sessionID: id}
 	return nil
 }
 
-// SetSessionID sets the session identifier for this encryption session
-func (a *AES256) SetSessionID(id SessionID) {
+// RekeyReceive decrypts the messages numbered from cutover on with
+// decryptKey, under the session ID id. Messages numbered below cutover are
+// still decrypted with the current keys until grace elapsed.
+func (a *aeadEncryptor) RekeyReceive(decryptKey key, id SessionID, cutover uint64, grace time.Duration) error {
+	decryptor, err := a.create(decryptKey[:])
+	if err != nil {
+		return ErrInvalidKey
+	}
+
 	a.mux.Lock()
 	defer a.mux.Unlock()
 
-	a.sessionID = id
+	a.previous = a.receive
+	a.receive = direction{aead: decryptor, sessionID: id}
+	a.cutover = cutover
+	a.expires = time.Now().Add(grace)
+	return nil
 }
 
 // Encrypt encrypts a message between sender and receiver
-func (a *AES256) Encrypt(senderID, receiverID string, m message.Message) (*EncryptedMessage, error) {
+func (a *aeadEncryptor) Encrypt(senderID, receiverID string, codec message.Codec, m message.Message) (*EncryptedMessage, error) {
 	if !a.Ready() {
 		return nil, ErrEncryptionNotReady
 	}
 
-	// Generate random nonce
-	nonce := make([]byte, 12)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
-	}
-
 	// Marshal the original message
-	data, err := m.Marshal()
+	data, err := message.Encode(codec, m)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	// Lock only for encryption operation
-	a.mux.RLock()
-	encryptedData := a.encryptor.Seal(nil, nonce, data, a.sessionID[:])
-	a.mux.RUnlock()
-
-	// Create encrypted message wrapper
+	// Create encrypted message wrapper. The header is the one the message
+	// carries on the wire, so that it can be authenticated.
 	encryptedMsg := &EncryptedMessage{
 		BaseMessage: message.BaseMessage{
 			Header: message.Header{
@@ -127,56 +266,85 @@ func (a *AES256) Encrypt(senderID, receiverID string, m message.Message) (*Encry
 				ReceiverID: receiverID,
 				Protocol:   ProtocolMessage,
 			},
-			Payload: encryptedData,
+			Payload: nil,
 		},
-		Nonce:     nonce,
 		Timestamp: time.Now(),
 	}
 
+	// Lock only for encryption operation
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	// Generate random nonce
+	nonce := make([]byte, a.send.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	a.sequence++
+	encryptedMsg.Sequence = a.sequence
+	encryptedMsg.Nonce = nonce
+	encryptedMsg.Data = a.send.aead.Seal(nil, nonce, data, encryptedMsg.additionalData(a.send.sessionID))
+
 	return encryptedMsg, nil
 }
 
 // Decrypt decrypts an encrypted message in-place
-func (a *AES256) Decrypt(m *EncryptedMessage) error {
+func (a *aeadEncryptor) Decrypt(m *EncryptedMessage) error {
 	if !a.Ready() {
 		return ErrEncryptionNotReady
 	}
 
-	if m.Nonce == nil || len(m.Nonce) == 0 {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	// Messages sent before the last rekey use the previous keys
+	keys := a.receive
+	if a.previous.aead != nil && m.Sequence < a.cutover {
+		if time.Now().After(a.expires) {
+			a.previous = direction{}
+			return ErrKeyExpired
+		}
+		keys = a.previous
+	}
+
+	if len(m.Nonce) != keys.aead.NonceSize() {
 		return ErrInvalidNonce
 	}
 
-	a.mux.RLock()
-	defer a.mux.RUnlock()
+	if !a.window.check(m.Sequence) {
+		return ErrReplayedMessage
+	}
 
 	// Decrypt the payload
-	data, err := a.decryptor.Open(nil, m.Nonce, m.Payload, a.sessionID[:])
+	data, err := keys.aead.Open(nil, m.Nonce, m.Data, m.additionalData(keys.sessionID))
 	if err != nil {
 		return fmt.Errorf("decryption failed: %w", err)
 	}
+	a.window.accept(m.Sequence)
 
-	// Replace encrypted payload with decrypted payload
-	m.Payload = data
+	// Replace encrypted data with decrypted frame
+	m.Data = data
 
 	return nil
 }
 
 // Ready checks if the encryptor is properly initialized and ready to use
-func (a *AES256) Ready() bool {
+func (a *aeadEncryptor) Ready() bool {
 	a.mux.RLock()
 	defer a.mux.RUnlock()
 
-	return a.encryptor != nil && a.decryptor != nil && !IsZero(a.sessionID)
+	return a.send.aead != nil && a.receive.aead != nil && !IsZero(a.send.sessionID)
 }
 
 // Close releases resources used by the encryptor
-func (a *AES256) Close() error {
+func (a *aeadEncryptor) Close() error {
 	a.mux.Lock()
 	defer a.mux.Unlock()
 
-	a.sessionID = SessionID{}
-	a.encryptor = nil
-	a.decryptor = nil
+	a.send = direction{}
+	a.receive = direction{}
+	a.previous = direction{}
 
 	return nil
 }
@@ -0,0 +1,148 @@
+package encrypt
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+func TestEncryptors(t *testing.T) {
+	var k1, k2 key
+	_, _ = rand.Read(k1[:])
+	_, _ = rand.Read(k2[:])
+	sessionID := SessionID{1}
+
+	nonceSizes := map[Cipher]int{
+		CipherAES256GCM:         12,
+		CipherChaCha20Poly1305:  12,
+		CipherXChaCha20Poly1305: 24,
+	}
+
+	for name, nonceSize := range nonceSizes {
+		sender, err := newEncryptor(name)
+		if err != nil {
+			t.Fatalf("%s: newEncryptor failed: %v", name, err)
+		}
+		receiver, _ := newEncryptor(name)
+
+		if sender.Ready() {
+			t.Errorf("%s: encryptor ready without keys", name)
+		}
+
+		if err := sender.SetKeys(k1, k2); err != nil {
+			t.Fatalf("%s: SetKeys failed: %v", name, err)
+		}
+		if err := receiver.SetKeys(k2, k1); err != nil {
+			t.Fatalf("%s: SetKeys failed: %v", name, err)
+		}
+		sender.SetSessionID(sessionID)
+		receiver.SetSessionID(sessionID)
+
+		frame := message.CreateMessageFromData("a", "b", "app", []byte(`{"n":1}`))
+		encrypted, err := sender.Encrypt("a", "b", message.JSON, frame)
+		if err != nil {
+			t.Fatalf("%s: Encrypt failed: %v", name, err)
+		}
+		if len(encrypted.Nonce) != nonceSize {
+			t.Errorf("%s: nonce size mismatch: got %d, want %d", name, len(encrypted.Nonce), nonceSize)
+		}
+
+		truncated := *encrypted
+		truncated.Nonce = encrypted.Nonce[:8]
+		if err := receiver.Decrypt(&truncated); !errors.Is(err, ErrInvalidNonce) {
+			t.Errorf("%s: expected ErrInvalidNonce, got %v", name, err)
+		}
+
+		tampered := *encrypted
+		tampered.Data = append([]byte(nil), encrypted.Data...)
+		tampered.Header.ReceiverID = "c"
+		if err := receiver.Decrypt(&tampered); err == nil {
+			t.Errorf("%s: message with tampered header decrypted", name)
+		}
+
+		if err := receiver.Decrypt(encrypted); err != nil {
+			t.Fatalf("%s: Decrypt failed: %v", name, err)
+		}
+
+		replayed := *encrypted
+		if err := receiver.Decrypt(&replayed); !errors.Is(err, ErrReplayedMessage) {
+			t.Errorf("%s: expected ErrReplayedMessage, got %v", name, err)
+		}
+		decoded, err := encrypted.Frame()
+		if err != nil {
+			t.Fatalf("%s: Frame failed: %v", name, err)
+		}
+		if string(decoded.Payload) != `{"n":1}` {
+			t.Errorf("%s: payload mismatch: got %s, want %s", name, decoded.Payload, `{"n":1}`)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	chosen, err := negotiate([]Cipher{CipherChaCha20Poly1305, CipherAES256GCM}, defaultCiphers)
+	if err != nil || chosen != CipherChaCha20Poly1305 {
+		t.Errorf("cipher mismatch: got %q (%v), want %q", chosen, err, CipherChaCha20Poly1305)
+	}
+
+	if _, err := negotiate([]Cipher{CipherChaCha20Poly1305}, []Cipher{CipherAES256GCM}); !errors.Is(err, ErrNoCommonCipher) {
+		t.Errorf("expected ErrNoCommonCipher, got %v", err)
+	}
+
+	if _, err := CreateInterceptorFactory(WithCiphers("rot13")).NewInterceptor(context.Background(), "test"); !errors.Is(err, ErrUnsupportedCipher) {
+		t.Errorf("expected ErrUnsupportedCipher, got %v", err)
+	}
+}
+
+func TestEncryptors_Rekey(t *testing.T) {
+	var oldKey, newKey key
+	_, _ = rand.Read(oldKey[:])
+	_, _ = rand.Read(newKey[:])
+
+	for _, grace := range []time.Duration{time.Minute, 0} {
+		sender, _ := newEncryptor(CipherAES256GCM)
+		receiver, _ := newEncryptor(CipherAES256GCM)
+		_ = sender.SetKeys(oldKey, oldKey)
+		_ = receiver.SetKeys(oldKey, oldKey)
+		sender.SetSessionID(SessionID{1})
+		receiver.SetSessionID(SessionID{1})
+
+		frame := message.CreateMessageFromData("a", "b", "app", []byte(`{}`))
+		encrypt := func() *EncryptedMessage {
+			encrypted, err := sender.Encrypt("a", "b", message.JSON, frame)
+			if err != nil {
+				t.Fatalf("Encrypt failed: %v", err)
+			}
+			return encrypted
+		}
+
+		inFlight := encrypt()
+		if err := sender.RekeySend(newKey, SessionID{2}); err != nil {
+			t.Fatalf("RekeySend failed: %v", err)
+		}
+		rekeyed := encrypt()
+		if rekeyed.Sequence != inFlight.Sequence+1 {
+			t.Errorf("sequence mismatch: got %d, want %d", rekeyed.Sequence, inFlight.Sequence+1)
+		}
+
+		if err := receiver.RekeyReceive(newKey, SessionID{2}, rekeyed.Sequence, grace); err != nil {
+			t.Fatalf("RekeyReceive failed: %v", err)
+		}
+		if err := receiver.Decrypt(rekeyed); err != nil {
+			t.Errorf("message under the new keys: Decrypt failed: %v", err)
+		}
+
+		// Messages sent before the cutover decrypt with the previous keys
+		// during the grace period only
+		err := receiver.Decrypt(inFlight)
+		if grace > 0 && err != nil {
+			t.Errorf("in-flight message: Decrypt failed: %v", err)
+		}
+		if grace == 0 && !errors.Is(err, ErrKeyExpired) {
+			t.Errorf("expected ErrKeyExpired, got %v", err)
+		}
+	}
+}
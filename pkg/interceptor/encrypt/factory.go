@@ -2,6 +2,11 @@ package encrypt
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
 
 	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
 )
@@ -9,13 +14,31 @@ import (
 // Option defines a function type that configures an Interceptor instance
 type Option = func(*Interceptor) error
 
-// WithAES256 configures the interceptor to use AES-256 encryption
+// WithAES256 configures the interceptor to use AES-256 encryption only
 func WithAES256(interceptor *Interceptor) error {
-	// Initialize the encryptor with AES-256 implementation for new connections
-	interceptor.encryptorFactor = NewAES256
+	interceptor.ciphers = []Cipher{CipherAES256GCM}
 	return nil
 }
 
+// WithCiphers sets the ciphers the interceptor supports, in order of
+// preference. The server offers them in the key exchange and the client picks
+// the first of its own ciphers that the server offers, so clients without AES
+// hardware can prefer ChaCha20-Poly1305 while the server supports both.
+func WithCiphers(ciphers ...Cipher) Option {
+	return func(interceptor *Interceptor) error {
+		if len(ciphers) == 0 {
+			return errors.New("no ciphers")
+		}
+		for _, name := range ciphers {
+			if _, ok := encryptors[name]; !ok {
+				return fmt.Errorf("%w: %q", ErrUnsupportedCipher, name)
+			}
+		}
+		interceptor.ciphers = slices.Clone(ciphers)
+		return nil
+	}
+}
+
 // WithServer marks this interceptor as a server-side interceptor
 // Server-side interceptors have different behavior for session handling
 func WithServer(interceptor *Interceptor) error {
@@ -23,6 +46,187 @@ func WithServer(interceptor *Interceptor) error {
 	return nil
 }
 
+// WithKeyProvider sets the provider of the keys authenticating the server in
+// the key exchange. It is required on both sides, unless clients pin the
+// server key in a trust store: the server signs with the provider's signing
+// key, clients verify against its verification keys.
+func WithKeyProvider(provider KeyProvider) Option {
+	return func(interceptor *Interceptor) error {
+		if provider == nil {
+			return errors.New("nil key provider")
+		}
+		interceptor.keys = provider
+		return nil
+	}
+}
+
+// WithTrustStore pins the identity keys of peers in the store, so that a peer
+// presenting another key than before fails the key exchange. Clients pin the
+// signing key of the server, which makes their KeyProvider optional; servers
+// pin the identity keys of clients, which must then set one with
+// WithIdentityKey.
+func WithTrustStore(store *TrustStore) Option {
+	return func(interceptor *Interceptor) error {
+		if store == nil {
+			return errors.New("nil trust store")
+		}
+		interceptor.trust = store
+		return nil
+	}
+}
+
+// WithIdentityKey sets the long-term key the client authenticates with in
+// the key exchange. Servers authenticate with the signing key of their
+// KeyProvider instead.
+func WithIdentityKey(key ed25519.PrivateKey) Option {
+	return func(interceptor *Interceptor) error {
+		if len(key) != ed25519.PrivateKeySize {
+			return errors.New("invalid ed25519 identity key")
+		}
+		interceptor.identity = key
+		return nil
+	}
+}
+
+// WithSecurityEventHandler registers a handler notified of peer keys pinned,
+// changed or unknown, see SecurityEvent. Handlers are called from the reader
+// of the connection.
+func WithSecurityEventHandler(handler SecurityEventHandler) Option {
+	return func(interceptor *Interceptor) error {
+		if handler == nil {
+			return errors.New("nil security event handler")
+		}
+		interceptor.onSecurityEvent = append(interceptor.onSecurityEvent, handler)
+		return nil
+	}
+}
+
+// WithMaxClockSkew sets how far the timestamp of received messages may be off
+// from the local clock; messages outside it are rejected. Zero disables the
+// check. Defaults to 30 seconds.
+func WithMaxClockSkew(skew time.Duration) Option {
+	return func(interceptor *Interceptor) error {
+		if skew < 0 {
+			return errors.New("negative clock skew")
+		}
+		interceptor.maxClockSkew = skew
+		return nil
+	}
+}
+
+// WithPolicy sets what happens to application messages that cannot be
+// encrypted and to those received in the clear, see Policy. Defaults to
+// PolicyPermissive.
+func WithPolicy(policy Policy) Option {
+	return func(interceptor *Interceptor) error {
+		if policy < PolicyPermissive || policy > PolicyStrict {
+			return fmt.Errorf("unknown encryption policy %d", policy)
+		}
+		interceptor.policy = policy
+		return nil
+	}
+}
+
+// WithRekeyAfterMessages makes the server rekey a connection once messages
+// encrypted messages were sent or received under the current keys. Zero
+// disables the limit, which is the default.
+func WithRekeyAfterMessages(messages uint64) Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.rekeyMessages = messages
+		return nil
+	}
+}
+
+// WithRekeyAfterBytes makes the server rekey a connection once bytes of
+// ciphertext were sent or received under the current keys. Zero disables the
+// limit, which is the default.
+func WithRekeyAfterBytes(bytes uint64) Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.rekeyBytes = bytes
+		return nil
+	}
+}
+
+// WithRekeyInterval makes the server rekey a connection every interval. Zero
+// disables periodic rekeying. Defaults to an hour.
+func WithRekeyInterval(interval time.Duration) Option {
+	return func(interceptor *Interceptor) error {
+		if interval < 0 {
+			return errors.New("negative rekey interval")
+		}
+		interceptor.rekeyInterval = interval
+		return nil
+	}
+}
+
+// WithRekeyGrace sets how long messages sent before a rekey are still
+// decrypted with the replaced keys. Defaults to 10 seconds.
+func WithRekeyGrace(grace time.Duration) Option {
+	return func(interceptor *Interceptor) error {
+		if grace < 0 {
+			return errors.New("negative rekey grace period")
+		}
+		interceptor.rekeyGrace = grace
+		return nil
+	}
+}
+
+// WithHybridKEM enables the hybrid key exchange, which derives the session
+// keys from both X25519 and ML-KEM-768 so that they stay secret even if
+// X25519 is broken by a quantum computer later on. Servers offer it in Init;
+// clients accept it whenever offered and, with this option, reject servers
+// that do not offer it. Rekeys of hybrid sessions encapsulate a fresh secret
+// to a fresh ML-KEM key as well.
+func WithHybridKEM(interceptor *Interceptor) error {
+	interceptor.hybrid = true
+	return nil
+}
+
+// WithNoise replaces the signed key exchange with a Noise handshake of the
+// given pattern, in which both sides authenticate with their static X25519
+// key instead of a KeyProvider. The client proposes the first of its ciphers,
+// which the server must support. Peers are checked by the verifier set with
+// WithPeerVerifier.
+func WithNoise(pattern NoisePattern, static PrivateKey) Option {
+	return func(interceptor *Interceptor) error {
+		if _, ok := noisePatterns[pattern]; !ok {
+			return fmt.Errorf("%w: %q", ErrUnsupportedPattern, pattern)
+		}
+		if IsZero(static) {
+			return errors.New("zero noise static key")
+		}
+		interceptor.noisePattern = pattern
+		interceptor.noiseStatic = static
+		return nil
+	}
+}
+
+// WithNoiseServerKey sets the static key of the server on the client. Clients
+// of NoiseIK handshakes must know it in advance; with NoiseXX, the server
+// must authenticate with it.
+func WithNoiseServerKey(key PublicKey) Option {
+	return func(interceptor *Interceptor) error {
+		if IsZero(key) {
+			return errors.New("zero noise server key")
+		}
+		interceptor.noiseServerKey = &key
+		return nil
+	}
+}
+
+// WithPeerVerifier sets the verifier of the static keys peers authenticate
+// with in Noise handshakes. It is required unless the client is configured
+// with the server key.
+func WithPeerVerifier(verifier PeerVerifier) Option {
+	return func(interceptor *Interceptor) error {
+		if verifier == nil {
+			return errors.New("nil peer verifier")
+		}
+		interceptor.verifyPeer = verifier
+		return nil
+	}
+}
+
 // InterceptorFactory creates encryption interceptors with configured options
 type InterceptorFactory struct {
 	opts []Option
@@ -38,15 +242,17 @@ func CreateInterceptorFactory(options ...Option) *InterceptorFactory {
 // NewInterceptor creates and configures a new encryption interceptor
 // Implements the interceptor.Factory interface
 func (factory *InterceptorFactory) NewInterceptor(ctx context.Context, id string) (interceptor.Interceptor, error) {
-	// initialiseKeyExchange() // TODO: For some reason, this function is hidden
 	_interceptor := &Interceptor{
 		NoOpInterceptor: interceptor.NoOpInterceptor{
 			ID:  id,
 			Ctx: ctx,
 		},
-		states:          make(map[interceptor.Connection]*state),
-		isServer:        false,
-		encryptorFactor: NewAES256,
+		states:        make(map[interceptor.Connection]*state),
+		isServer:      false,
+		ciphers:       defaultCiphers,
+		maxClockSkew:  30 * time.Second,
+		rekeyInterval: time.Hour,
+		rekeyGrace:    10 * time.Second,
 	}
 
 	// Apply all configured options
@@ -56,5 +262,42 @@ func (factory *InterceptorFactory) NewInterceptor(ctx context.Context, id string
 		}
 	}
 
+	if _interceptor.noisePattern != "" {
+		if _interceptor.hybrid {
+			return nil, errors.New("hybrid key exchange is not supported with noise handshakes")
+		}
+		if _interceptor.trust != nil {
+			return nil, errors.New("trust store is not supported with noise handshakes, use a peer verifier")
+		}
+		if err := _interceptor.validateNoise(); err != nil {
+			return nil, err
+		}
+		return _interceptor, nil
+	}
+
+	if _interceptor.keys == nil && (_interceptor.isServer || _interceptor.trust == nil) {
+		return nil, errors.New("encrypt interceptor requires a key provider")
+	}
+
+	if _interceptor.isServer {
+		if _, err := _interceptor.keys.SigningKey(); err != nil {
+			return nil, err
+		}
+	}
+
 	return _interceptor, nil
 }
+
+// validateNoise checks that the keys required by the Noise pattern are set
+func (i *Interceptor) validateNoise() error {
+	knowsServer := !i.isServer && i.noiseServerKey != nil
+
+	if i.noisePattern == NoiseIK && !i.isServer && !knowsServer {
+		return errors.New("noise IK handshake requires the server key")
+	}
+	if i.verifyPeer == nil && !knowsServer {
+		return errors.New("noise handshake requires a peer verifier")
+	}
+
+	return nil
+}
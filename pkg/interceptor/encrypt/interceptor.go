@@ -2,16 +2,17 @@ package encrypt
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/mlkem"
 	"crypto/rand"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"time"
 
 	"github.com/coder/websocket"
 	"golang.org/x/crypto/curve25519"
-	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/hkdf"
 
 	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
@@ -35,26 +36,45 @@ type (
 	key        [32]byte
 )
 
-var (
-	// ServerPublicKey holds the public key for server verification
-	// Loaded from environment variable
-	ServerPublicKey []byte
-)
-
-// init loads the server keys from environment variables and validates them
-func init() {
-	ServerPublicKey = []byte(os.Getenv("SERVER_ENCRYPT_PUB_KEY"))
-	if len(ServerPublicKey) == 0 {
-		fmt.Println("WARNING: SERVER_ENCRYPT_PUB_KEY environment variable not set")
-	}
-}
-
-// Interceptor implements the encryption interceptor
+// kdfInfo binds the keys derived by the key exchange to this protocol
+const kdfInfo = "skyline-sonata-encrypt-v1"
+
+// Interceptor implements the encryption interceptor. The server initiates the
+// key exchange in Init, signing its ephemeral key with the signing key of its
+// KeyProvider; clients verify the signature against the verification keys of
+// theirs before answering, and Init returns on both sides once the keys are
+// in place. The cipher is negotiated in the same exchange: the server offers
+// its ciphers in Init and the client answers with its choice. Established
+// sessions are rekeyed by the server, see rekeyLoop. With WithTrustStore, the
+// identity keys of peers are pinned in both directions. With WithNoise, a
+// Noise handshake started by the client replaces the signed key exchange.
 type Interceptor struct {
 	interceptor.NoOpInterceptor
-	states          map[interceptor.Connection]*state
-	encryptorFactor EncryptorFactory
-	isServer        bool
+	states       map[interceptor.Connection]*state
+	ciphers      []Cipher // Supported ciphers, most preferred first
+	keys         KeyProvider
+	maxClockSkew time.Duration // Zero disables the timestamp check
+	policy       Policy
+
+	// Rekey triggers on the server, zero disables them; see rekeyLoop
+	rekeyMessages uint64
+	rekeyBytes    uint64
+	rekeyInterval time.Duration
+	rekeyGrace    time.Duration
+	isServer      bool
+	hybrid        bool // See WithHybridKEM
+
+	// Peer key pinning; see TrustStore
+	trust           *TrustStore
+	identity        ed25519.PrivateKey // Key clients authenticate with
+	onSecurityEvent []SecurityEventHandler
+
+	// Noise handshake replacing the signed key exchange when the pattern is
+	// set; see WithNoise
+	noisePattern   NoisePattern
+	noiseStatic    PrivateKey
+	noiseServerKey *PublicKey
+	verifyPeer     PeerVerifier
 }
 
 func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, writer interceptor.Writer, reader interceptor.Reader) (interceptor.Writer, interceptor.Reader, error) {
@@ -66,8 +86,9 @@ func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, wr
 		return nil, nil, errors.New("connection already exists")
 	}
 
+	// Placeholder until the key exchange negotiated the cipher
 	ctx, cancel := context.WithCancel(i.Ctx)
-	encryptor, err := i.encryptorFactor()
+	encryptor, err := newEncryptor(i.ciphers[0])
 	if err != nil {
 		cancel()
 		return nil, nil, err
@@ -76,6 +97,8 @@ func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, wr
 	i.states[connection] = &state{
 		peerID:    "unknown",
 		encryptor: encryptor,
+		initDone:  make(chan struct{}),
+		rekeyNow:  make(chan struct{}, 1),
 		writer:    writer,
 		reader:    reader,
 		cancel:    cancel,
@@ -85,25 +108,44 @@ func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, wr
 	return writer, reader, nil
 }
 
+// Init starts the key exchange on the server, or the Noise handshake on the
+// client, and waits for it to complete on both sides
 func (i *Interceptor) Init(connection interceptor.Connection) error {
-	i.Mutex.Lock()
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
+	}
 
-	state, exists := i.states[connection]
-	if !exists {
-		i.Mutex.Unlock()
-		return errors.New("connection not registered")
+	switch {
+	case i.noisePattern != "":
+		if !i.isServer {
+			if err := i.initiateNoise(connection, state); err != nil {
+				return fmt.Errorf("noise handshake failed: %w", err)
+			}
+		}
+	case i.isServer:
+		if err := i.initialiseKeyExchange(connection, state); err != nil {
+			return fmt.Errorf("encryption initialization failed: %w", err)
+		}
 	}
 
-	// Start the key exchange process
-	err := i.initialiseKeyExchange(connection)
-	i.Mutex.Unlock() // Unlock before waiting for initialization to avoid deadlock
+	// Wait for the key exchange to complete
+	if err := state.waitUntilInit(); err != nil {
+		state.discard()
+		return err
+	}
 
-	if err != nil {
-		return fmt.Errorf("encryption initialization failed: %w", err)
+	if i.policy == PolicyQueue {
+		if err := i.flush(connection, state); err != nil {
+			fmt.Println("error while writing queued messages:", err.Error())
+		}
 	}
 
-	// Wait for the key exchange to complete
-	return state.waitUntilInit()
+	if i.isServer && (i.rekeyMessages > 0 || i.rekeyBytes > 0 || i.rekeyInterval > 0) {
+		go i.rekeyLoop(connection, state)
+	}
+
+	return nil
 }
 
 func (i *Interceptor) InterceptSocketWriter(writer interceptor.Writer) interceptor.Writer {
@@ -113,17 +155,19 @@ func (i *Interceptor) InterceptSocketWriter(writer interceptor.Writer) intercept
 			return writer.Write(connection, messageType, m)
 		}
 
-		// Only encrypt if encryption is ready
-		if state.encryptor.Ready() {
-			encrypted, err := state.encryptor.Encrypt(m.Message().SenderID, m.Message().ReceiverID, m)
-			if err != nil {
-				return writer.Write(connection, messageType, m)
+		// Key exchange messages always travel in the clear
+		if unencrypted(m.Message().Header.Protocol) {
+			return writer.Write(connection, messageType, m)
+		}
+
+		// Hold messages back until the key exchange completed
+		if i.policy == PolicyQueue {
+			if queued, err := state.enqueue(writer, messageType, m); queued || err != nil {
+				return err
 			}
-			return writer.Write(connection, messageType, encrypted)
 		}
 
-		// Pass through unencrypted if encryption not ready // TODO: Is this what I want? Should I pass through
-		return writer.Write(connection, messageType, m)
+		return i.writeEncrypted(connection, state, writer, messageType, m)
 	})
 }
 
@@ -134,28 +178,80 @@ func (i *Interceptor) InterceptSocketReader(reader interceptor.Reader) intercept
 			return messageType, m, err
 		}
 
-		if _, err := i.getState(connection); err != nil {
+		state, err := i.getState(connection)
+		if err != nil {
+			return messageType, m, nil
+		}
+
+		// Application messages received in the clear
+		if !protocolMap.Has(m.Message().Header.Protocol) {
+			if err := i.acceptClear(state); err != nil {
+				state.plaintext.Add(1)
+				return messageType, nil, err
+			}
 			return messageType, m, nil
 		}
 
 		// Process encrypted messages and protocol messages
-		payload, err := message.ProtocolUnmarshal(protocolMap, m.Message().Header.Protocol, m.Message().Payload)
+		payload, err := interceptor.Decode(protocolMap, m)
 		if err != nil {
+			if i.policy != PolicyPermissive {
+				state.invalid.Add(1)
+				return messageType, nil, err
+			}
 			return messageType, m, nil
 		}
 
+		// Rekey messages are only accepted encrypted
+		if !unencrypted(payload.Protocol()) {
+			return messageType, nil, ErrUnencryptedRekey
+		}
+
 		if err := payload.Process(i, connection); err != nil {
 			fmt.Println("error while processing Encryptor m:", err.Error())
+			if payload.Protocol() == ProtocolMessage {
+				return messageType, nil, err
+			}
+		}
+
+		// Key exchange messages are internal to this interceptor
+		encrypted, ok := payload.(*EncryptedMessage)
+		if !ok {
+			return messageType, m, interceptor.ErrMessageConsumed
 		}
 
-		return messageType, payload.Message(), nil
+		frame, err := encrypted.Frame()
+		if err != nil {
+			return messageType, nil, err
+		}
+
+		// Rekey messages travel encrypted
+		if protocolMap.Has(frame.Header.Protocol) {
+			inner, err := interceptor.Decode(protocolMap, frame)
+			if err != nil {
+				return messageType, nil, err
+			}
+			if unencrypted(inner.Protocol()) {
+				return messageType, nil, message.ErrorNotValid
+			}
+			if err := inner.Process(i, connection); err != nil {
+				fmt.Println("error while processing Encryptor m:", err.Error())
+				return messageType, nil, err
+			}
+			return messageType, frame, interceptor.ErrMessageConsumed
+		}
+
+		return messageType, frame, nil
 	})
 }
 
 func (i *Interceptor) UnBindSocketConnection(connection interceptor.Connection) {
-	state, err := i.getState(connection)
-	if err != nil {
-		fmt.Println("Failed to get encryption state:", err.Error())
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	// Connections whose binding failed before this interceptor have no state
+	state, exists := i.states[connection]
+	if !exists {
 		return
 	}
 
@@ -189,52 +285,121 @@ func (i *Interceptor) Close() error {
 	return merr.ErrorOrNil()
 }
 
-func (i *Interceptor) initialiseKeyExchange(connection interceptor.Connection) error {
+// initialiseKeyExchange sends the server's signed ephemeral key to the client.
+// The lock is not held while writing, as the write passes through this
+// interceptor's writer.
+func (i *Interceptor) initialiseKeyExchange(connection interceptor.Connection, state *state) error {
 	var (
+		privKey   PrivateKey
 		pubKey    PublicKey
+		salt      Salt
 		sessionID SessionID
 	)
 
-	i.Mutex.Lock()
-	defer i.Mutex.Unlock()
+	signingKey, err := i.keys.SigningKey()
+	if err != nil {
+		return err
+	}
 
-	state, exists := i.states[connection]
-	if !exists {
-		return errors.New("connection not registered")
+	// Generate private key and calculate public key from it
+	if _, err := io.ReadFull(rand.Reader, privKey[:]); err != nil {
+		return err
 	}
+	curve25519.ScalarBaseMult((*[32]byte)(&pubKey), (*[32]byte)(&privKey))
 
-	// Generate private key
-	if _, err := io.ReadFull(rand.Reader, state.privKey[:]); err != nil {
+	// Generate random salt for key derivation and the session ID
+	if _, err := io.ReadFull(rand.Reader, salt[:]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rand.Reader, sessionID[:]); err != nil {
 		return err
 	}
 
-	// Calculate public key from private key
-	curve25519.ScalarBaseMult((*[32]byte)(&pubKey), (*[32]byte)(&state.privKey))
+	// Offer the hybrid key exchange with a fresh ML-KEM key
+	var (
+		kem              KEM
+		kemKey           []byte
+		decapsulationKey *mlkem.DecapsulationKey768
+	)
+	if i.hybrid {
+		if decapsulationKey, err = mlkem.GenerateKey768(); err != nil {
+			return err
+		}
+		kem, kemKey = KEMMLKEM768, decapsulationKey.EncapsulationKey().Bytes()
+	}
 
-	// Generate random salt for key derivation
-	if _, err := io.ReadFull(rand.Reader, state.salt[:]); err != nil {
+	i.Mutex.Lock()
+	state.privKey = privKey
+	state.salt = salt
+	state.sessionID = sessionID
+	state.kemKey = decapsulationKey
+	peerID := state.peerID
+	i.Mutex.Unlock()
+
+	// Generate signature for authentication, covering the offered ciphers so
+	// they cannot be downgraded
+	sign := ed25519.Sign(signingKey, signedInit(pubKey, salt, sessionID, i.ciphers, kem, kemKey))
+
+	// Send initialization message
+	msg, err := message.CreateMessage(i.ID, peerID, NewInitMessage(i.ID, peerID, pubKey, sign, salt, sessionID, i.ciphers, kem, kemKey, signingKey.Public().(ed25519.PublicKey)))
+	if err != nil {
 		return err
 	}
 
-	// Load server private key for signing
-	// NOTE: SECURITY RISK MAYBE. NOT A GOOD IDEA TO GET PRIV KEY FROM ENV VARS.
-	// NOTE: THEY MAYBE EASILY ACCESSIBLE FROM REMOTE PROCESS INSPECTION TOOLS.
-	serverPrivKey := []byte(os.Getenv("SERVER_ENCRYPT_PRIV_KEY"))
-	if len(serverPrivKey) == 0 && i.isServer {
-		return errors.New("server private key not available")
+	return state.writer.Write(connection, websocket.MessageText, msg)
+}
+
+// Stats returns the message counters of the connection
+func (i *Interceptor) Stats(connection interceptor.Connection) (Stats, error) {
+	state, err := i.getState(connection)
+	if err != nil {
+		return Stats{}, err
 	}
 
-	// Generate signature for authentication
-	sign := ed25519.Sign(serverPrivKey, append(pubKey[:], state.salt[:]...))
+	return state.snapshot(), nil
+}
 
-	// Generate session ID
-	if _, err := io.ReadFull(rand.Reader, sessionID[:]); err != nil {
+// unencrypted reports whether messages of the protocol travel unencrypted: the key
+// exchange messages, which precede the keys, and the encrypted messages
+// themselves
+func unencrypted(protocol message.Protocol) bool {
+	switch protocol {
+	case ProtocolMessage, ProtocolInit, ProtocolResponse, ProtocolInitDone, ProtocolNoiseHandshake:
+		return true
+	default:
+		return false
+	}
+}
+
+// encryptorOf returns the encryptor of the connection, which is replaced once
+// the key exchange negotiated the cipher
+func (i *Interceptor) encryptorOf(state *state) Encryptor {
+	i.Mutex.RLock()
+	defer i.Mutex.RUnlock()
+
+	return state.encryptor
+}
+
+// useEncryptor sets up an encryptor for the negotiated cipher with the
+// derived keys and makes it the encryptor of the connection
+func (i *Interceptor) useEncryptor(state *state, name Cipher, encKey, decKey key, sessionID SessionID) error {
+	encryptor, err := newEncryptor(name)
+	if err != nil {
 		return err
 	}
-	state.encryptor.SetSessionID(sessionID)
 
-	// Send initialization message
-	return state.writer.Write(connection, websocket.MessageText, NewInitMessage(i.ID, state.peerID, pubKey, sign, state.salt, sessionID))
+	if err := encryptor.SetKeys(encKey, decKey); err != nil {
+		return err
+	}
+	encryptor.SetSessionID(sessionID)
+
+	i.Mutex.Lock()
+	previous := state.encryptor
+	state.encryptor = encryptor
+	state.cipher = name
+	i.Mutex.Unlock()
+
+	return previous.Close()
 }
 
 func (i *Interceptor) getState(connection interceptor.Connection) (*state, error) {
@@ -243,14 +408,16 @@ func (i *Interceptor) getState(connection interceptor.Connection) (*state, error
 
 	state, exists := i.states[connection]
 	if !exists {
-		return nil, errors.New("connection not registered")
+		return nil, ErrConnectionNotFound
 	}
 
 	return state, nil
 }
 
-// derive generates encryption keys from shared secret
-func derive(shared []byte, salt Salt, info string) (key, key, error) {
+// derive generates encryption keys from shared secret. The keys are bound to
+// the negotiated cipher.
+func derive(shared []byte, salt Salt, name Cipher) (key, key, error) {
+	info := kdfInfo + "\x00" + string(name)
 	hkdfReader := hkdf.New(sha256.New, shared, salt[:], []byte(info))
 
 	key1 := key{}
@@ -265,3 +432,38 @@ func derive(shared []byte, salt Salt, info string) (key, key, error) {
 
 	return key1, key2, nil
 }
+
+// signedInit returns the data the server signs in the Init message
+func signedInit(pubKey PublicKey, salt Salt, sessionID SessionID, ciphers []Cipher, kem KEM, kemKey []byte) []byte {
+	data := make([]byte, 0, len(pubKey)+len(salt)+len(sessionID))
+	data = append(data, pubKey[:]...)
+	data = append(data, salt[:]...)
+	data = append(data, sessionID[:]...)
+	for _, name := range ciphers {
+		data = append(data, name...)
+		data = append(data, 0)
+	}
+	// An empty cipher name separates the hybrid key exchange offer
+	if kem != "" {
+		data = append(data, 0)
+		data = append(data, kem...)
+		data = append(data, 0)
+		data = append(data, kemKey...)
+	}
+	return data
+}
+
+// signedResponse returns the data the client signs in the InitResponse
+// message with its identity key, binding its ephemeral key to the Init it
+// answers
+func signedResponse(pubKey, serverKey PublicKey, sessionID SessionID, name Cipher, kemCiphertext []byte) []byte {
+	data := make([]byte, 0, 128+len(kemCiphertext))
+	data = append(data, kdfInfo+"\x00response\x00"...)
+	data = append(data, pubKey[:]...)
+	data = append(data, serverKey[:]...)
+	data = append(data, sessionID[:]...)
+	data = append(data, name...)
+	data = append(data, 0)
+	data = append(data, kemCiphertext...)
+	return data
+}
@@ -0,0 +1,433 @@
+package encrypt
+
+import (
+	"context"
+	"crypto/mlkem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/interceptortest"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+func create(t *testing.T, options ...Option) *Interceptor {
+	t.Helper()
+
+	i, err := CreateInterceptorFactory(options...).NewInterceptor(context.Background(), "test")
+	if err != nil {
+		t.Fatalf("NewInterceptor failed: %v", err)
+	}
+
+	return i.(*Interceptor)
+}
+
+// handshake runs Init on both ends concurrently
+func handshake(server, client *Interceptor, s, c *interceptortest.End) (error, error) {
+	errs := make(chan error, 1)
+	go func() { errs <- server.Init(s.Conn) }()
+
+	clientErr := client.Init(c.Conn)
+	return <-errs, clientErr
+}
+
+func drain(e *interceptortest.End) {
+	for {
+		select {
+		case <-e.Wire:
+		default:
+			return
+		}
+	}
+}
+
+// roundTrip sends an application frame from the server and checks the client
+// receives it decrypted
+func roundTrip(t *testing.T, s, c *interceptortest.End) {
+	t.Helper()
+
+	drain(s)
+
+	sent := message.CreateMessageFromData("server", "client", "app", []byte(`{"hello":"world"}`))
+	if err := s.Writer.Write(s.Conn, websocket.MessageText, sent); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	if wire := <-s.Wire; wire.Message().Header.Protocol != ProtocolMessage {
+		t.Errorf("wire protocol mismatch: got %q, want %q", wire.Message().Header.Protocol, ProtocolMessage)
+	}
+
+	select {
+	case received := <-c.Received:
+		if received.Message().Header.Protocol != "app" || string(received.Message().Payload) != `{"hello":"world"}` {
+			t.Errorf("decrypted frame mismatch: got %+v", received.Message())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("encrypted message not received")
+	}
+}
+
+func TestKeyExchange(t *testing.T) {
+	signing := generate(t)
+
+	server := create(t, WithServer, WithKeyProvider(NewMemoryKeyProvider(signing)))
+	client := create(t, WithKeyProvider(NewMemoryKeyProvider(nil, public(signing))))
+	s, c := interceptortest.Connect(t, server, client)
+
+	serverErr, clientErr := handshake(server, client, s, c)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+
+	roundTrip(t, s, c)
+}
+
+func TestKeyExchange_CipherNegotiation(t *testing.T) {
+	signing := generate(t)
+
+	tests := []struct {
+		name   string
+		server []Option
+		client []Option
+		cipher Cipher
+	}{
+		{name: "defaults", cipher: CipherAES256GCM},
+		{name: "client preference", client: []Option{WithCiphers(CipherChaCha20Poly1305, CipherAES256GCM)}, cipher: CipherChaCha20Poly1305},
+		{name: "server restriction", server: []Option{WithCiphers(CipherXChaCha20Poly1305)}, cipher: CipherXChaCha20Poly1305},
+		{name: "aes only", server: []Option{WithAES256}, client: []Option{WithCiphers(CipherXChaCha20Poly1305, CipherAES256GCM)}, cipher: CipherAES256GCM},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := create(t, append(tt.server, WithServer, WithKeyProvider(NewMemoryKeyProvider(signing)))...)
+			client := create(t, append(tt.client, WithKeyProvider(NewMemoryKeyProvider(nil, public(signing))))...)
+			s, c := interceptortest.Connect(t, server, client)
+
+			if serverErr, clientErr := handshake(server, client, s, c); serverErr != nil || clientErr != nil {
+				t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+			}
+
+			for _, side := range []struct {
+				i    *Interceptor
+				conn *interceptortest.Pipe
+			}{{server, s.Conn}, {client, c.Conn}} {
+				state, _ := side.i.getState(side.conn)
+				if state.cipher != tt.cipher {
+					t.Errorf("cipher mismatch: got %q, want %q", state.cipher, tt.cipher)
+				}
+			}
+
+			roundTrip(t, s, c)
+		})
+	}
+}
+
+func TestKeyExchange_NoCommonCipher(t *testing.T) {
+	signing := generate(t)
+
+	server := create(t, WithServer, WithKeyProvider(NewMemoryKeyProvider(signing)), WithAES256)
+	client := create(t, WithKeyProvider(NewMemoryKeyProvider(nil, public(signing))), WithCiphers(CipherChaCha20Poly1305))
+	s, c := interceptortest.Connect(t, server, client)
+
+	// The server waits for the answer the client refused to give
+	serverErr, clientErr := handshake(server, client, s, c)
+	if !errors.Is(clientErr, ErrNoCommonCipher) || !errors.Is(serverErr, ErrInitializationTimeout) {
+		t.Errorf("expected ErrNoCommonCipher and a server timeout, got server %v, client %v", serverErr, clientErr)
+	}
+}
+
+func TestKeyExchange_Hybrid(t *testing.T) {
+	signing := generate(t)
+
+	tests := []struct {
+		name   string
+		server []Option
+		client []Option
+		hybrid bool
+		err    error
+	}{
+		{name: "both", server: []Option{WithHybridKEM}, client: []Option{WithHybridKEM}, hybrid: true},
+		{name: "offered", server: []Option{WithHybridKEM}, hybrid: true},
+		{name: "not offered", client: []Option{WithHybridKEM}, err: ErrHybridRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := create(t, append(tt.server, WithServer, WithKeyProvider(NewMemoryKeyProvider(signing)))...)
+			client := create(t, append(tt.client, WithKeyProvider(NewMemoryKeyProvider(nil, public(signing))))...)
+			s, c := interceptortest.Connect(t, server, client)
+
+			// The server waits for the answer the client refused to give
+			serverWant := tt.err
+			if tt.err != nil {
+				serverWant = ErrInitializationTimeout
+			}
+
+			serverErr, clientErr := handshake(server, client, s, c)
+			if !errors.Is(serverErr, serverWant) || !errors.Is(clientErr, tt.err) {
+				t.Fatalf("handshake error mismatch: got server %v, client %v, want %v, %v", serverErr, clientErr, serverWant, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+
+			for _, side := range []struct {
+				i    *Interceptor
+				conn *interceptortest.Pipe
+			}{{server, s.Conn}, {client, c.Conn}} {
+				state, _ := side.i.getState(side.conn)
+				if state.hybrid != tt.hybrid {
+					t.Errorf("hybrid mismatch: got %v, want %v", state.hybrid, tt.hybrid)
+				}
+			}
+
+			roundTrip(t, s, c)
+		})
+	}
+}
+
+// waitStats waits for the stats of the connection to reach want
+func waitStats(t *testing.T, i *Interceptor, conn *interceptortest.Pipe, want Stats) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats, err := i.Stats(conn)
+		if err != nil {
+			t.Fatalf("Stats failed: %v", err)
+		}
+		if stats == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stats mismatch: got %+v, want %+v", stats, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEncryptedMessage_Rejections(t *testing.T) {
+	signing := generate(t)
+
+	server := create(t, WithServer, WithKeyProvider(NewMemoryKeyProvider(signing)))
+	client := create(t, WithKeyProvider(NewMemoryKeyProvider(nil, public(signing))))
+	s, c := interceptortest.Connect(t, server, client)
+
+	if serverErr, clientErr := handshake(server, client, s, c); serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+	roundTrip(t, s, c)
+
+	// Capture the next encrypted frame and inject it a second time
+	drain(s)
+	sent := message.CreateMessageFromData("server", "client", "app", []byte(`{}`))
+	if err := s.Writer.Write(s.Conn, websocket.MessageText, sent); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	data, err := message.Encode(message.JSON, <-s.Wire)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	<-c.Received
+	c.Conn.Inject(data)
+
+	waitStats(t, client, c.Conn, Stats{Decrypted: 2, Replayed: 1})
+
+	// A message outside the allowed clock skew is rejected as well
+	client.maxClockSkew = time.Nanosecond
+	if err := s.Writer.Write(s.Conn, websocket.MessageText, sent); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	waitStats(t, client, c.Conn, Stats{Decrypted: 2, Replayed: 1, Skewed: 1})
+
+	select {
+	case m := <-c.Received:
+		t.Errorf("rejected message delivered: %+v", m.Message())
+	default:
+	}
+}
+
+// waitRekeys waits for both ends to complete the same number of rekeys, at
+// least atLeast
+func waitRekeys(t *testing.T, server, client *Interceptor, s, c *interceptortest.End, atLeast uint64) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		serverStats, _ := server.Stats(s.Conn)
+		clientStats, _ := client.Stats(c.Conn)
+		if serverStats.Rekeys >= atLeast && serverStats.Rekeys == clientStats.Rekeys {
+			for _, stats := range []Stats{serverStats, clientStats} {
+				if stats.Invalid != 0 || stats.Replayed != 0 || stats.Skewed != 0 {
+					t.Errorf("rejected messages: %+v", stats)
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rekeys mismatch: server %+v, client %+v", serverStats, clientStats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	signing := generate(t)
+
+	server := create(t, WithServer, WithKeyProvider(NewMemoryKeyProvider(signing)), WithRekeyAfterMessages(4), WithCiphers(CipherXChaCha20Poly1305))
+	client := create(t, WithKeyProvider(NewMemoryKeyProvider(nil, public(signing))))
+	s, c := interceptortest.Connect(t, server, client)
+
+	if serverErr, clientErr := handshake(server, client, s, c); serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+
+	// Keep the traffic going until several rekeys happened; requests are
+	// skipped while a rekey is in progress
+	deadline := time.Now().Add(2 * time.Second)
+	for stats, _ := server.Stats(s.Conn); stats.Rekeys < 3; stats, _ = server.Stats(s.Conn) {
+		if time.Now().After(deadline) {
+			t.Fatalf("rekeys mismatch: got %d, want 3", stats.Rekeys)
+		}
+		roundTrip(t, s, c)
+		roundTrip(t, c, s)
+	}
+
+	waitRekeys(t, server, client, s, c, 3)
+
+	// Messages keep flowing under the new keys
+	roundTrip(t, s, c)
+	roundTrip(t, c, s)
+}
+
+func TestRekey_Interval(t *testing.T) {
+	signing := generate(t)
+
+	server := create(t, WithServer, WithKeyProvider(NewMemoryKeyProvider(signing)), WithRekeyInterval(20*time.Millisecond))
+	client := create(t, WithKeyProvider(NewMemoryKeyProvider(nil, public(signing))))
+	s, c := interceptortest.Connect(t, server, client)
+
+	if serverErr, clientErr := handshake(server, client, s, c); serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+
+	waitRekeys(t, server, client, s, c, 3)
+	roundTrip(t, s, c)
+	roundTrip(t, c, s)
+}
+
+func TestRekey_Hybrid(t *testing.T) {
+	signing := generate(t)
+
+	server := create(t, WithServer, WithKeyProvider(NewMemoryKeyProvider(signing)), WithHybridKEM)
+	client := create(t, WithKeyProvider(NewMemoryKeyProvider(nil, public(signing))))
+	s, c := interceptortest.Connect(t, server, client)
+
+	if serverErr, clientErr := handshake(server, client, s, c); serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+
+	state, _ := server.getState(s.Conn)
+	if err := server.startRekey(s.Conn, state); err != nil {
+		t.Fatalf("startRekey failed: %v", err)
+	}
+	waitRekeys(t, server, client, s, c, 1)
+	roundTrip(t, s, c)
+	roundTrip(t, c, s)
+
+	// Neither side accepts a rekey dropping the ML-KEM secret
+	request := NewUpdateSessionMessage("server", "client", staticKey(t).Public(), Salt{}, SessionID{1}, "", nil)
+	if err := request.Process(client, c.Conn); !errors.Is(err, ErrMissingKEM) {
+		t.Errorf("expected ErrMissingKEM from the client, got %v", err)
+	}
+
+	kemKey, err := mlkem.GenerateKey768()
+	if err != nil {
+		t.Fatalf("GenerateKey768 failed: %v", err)
+	}
+	server.Mutex.Lock()
+	state.rekey = &rekey{kemKey: kemKey, started: time.Now()}
+	server.Mutex.Unlock()
+
+	response := NewUpdateSessionResponseMessage("client", "server", staticKey(t).Public(), nil, 1)
+	if err := response.Process(server, s.Conn); !errors.Is(err, ErrMissingKEM) {
+		t.Errorf("expected ErrMissingKEM from the server, got %v", err)
+	}
+}
+
+func TestRekey_Unencrypted(t *testing.T) {
+	signing := generate(t)
+
+	server := create(t, WithServer, WithKeyProvider(NewMemoryKeyProvider(signing)))
+	client := create(t, WithKeyProvider(NewMemoryKeyProvider(nil, public(signing))))
+	s, c := interceptortest.Connect(t, server, client)
+
+	if serverErr, clientErr := handshake(server, client, s, c); serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+
+	msg, err := message.CreateMessage("server", "client", NewUpdateSessionMessage("server", "client", PublicKey{1}, Salt{}, SessionID{1}, "", nil))
+	if err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+	data, err := message.Encode(message.JSON, msg)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	c.Conn.Inject(data)
+
+	// The forged request is dropped without starting a rekey
+	roundTrip(t, s, c)
+	client.Mutex.RLock()
+	pending := client.states[c.Conn].rekey
+	client.Mutex.RUnlock()
+	if pending != nil {
+		t.Error("unencrypted rekey request processed")
+	}
+}
+
+func TestKeyExchange_UntrustedServer(t *testing.T) {
+	server := create(t, WithServer, WithKeyProvider(NewMemoryKeyProvider(generate(t))))
+	client := create(t, WithKeyProvider(NewMemoryKeyProvider(nil, public(generate(t)))))
+	s, c := interceptortest.Connect(t, server, client)
+
+	serverErr, clientErr := handshake(server, client, s, c)
+	if !errors.Is(clientErr, ErrInvalidSignature) || !errors.Is(serverErr, ErrInitializationTimeout) {
+		t.Errorf("expected ErrInvalidSignature and a server timeout, got server %v, client %v", serverErr, clientErr)
+	}
+}
+
+func TestKeyExchange_Rotation(t *testing.T) {
+	previous, next := generate(t), generate(t)
+	keys := NewMemoryKeyProvider(previous)
+
+	server := create(t, WithServer, WithKeyProvider(keys))
+	keys.Rotate(next)
+
+	// New connections are signed with the rotated key without recreating the
+	// interceptor
+	client := create(t, WithKeyProvider(NewMemoryKeyProvider(nil, public(next))))
+	s, c := interceptortest.Connect(t, server, client)
+
+	if serverErr, clientErr := handshake(server, client, s, c); serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake with rotated key failed: server %v, client %v", serverErr, clientErr)
+	}
+
+	verification, _ := keys.VerificationKeys()
+	if !contains(verification, public(previous)) {
+		t.Error("previous key dropped on rotation")
+	}
+}
+
+func TestNewInterceptor_KeyProvider(t *testing.T) {
+	if _, err := CreateInterceptorFactory().NewInterceptor(context.Background(), "test"); err == nil {
+		t.Error("interceptor without key provider created")
+	}
+
+	if _, err := CreateInterceptorFactory(WithServer, WithKeyProvider(NewMemoryKeyProvider(nil, public(generate(t))))).NewInterceptor(context.Background(), "test"); !errors.Is(err, ErrNoSigningKey) {
+		t.Errorf("expected ErrNoSigningKey, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package encrypt
+
+import (
+	"crypto/mlkem"
+	"errors"
+	"fmt"
+)
+
+// KEM names a post-quantum key encapsulation mechanism combined with X25519
+// in the hybrid key exchange, see WithHybridKEM
+type KEM string
+
+// KEMMLKEM768 is ML-KEM-768 as specified in NIST FIPS 203
+const KEMMLKEM768 KEM = "mlkem768"
+
+var (
+	ErrHybridRequired = errors.New("server did not offer the hybrid key exchange")
+	ErrUnexpectedKEM  = errors.New("unexpected key encapsulation")
+	ErrMissingKEM     = errors.New("rekey of a hybrid session without key encapsulation")
+)
+
+// supportedKEM reports whether the KEM offered in Init is supported
+func supportedKEM(kem KEM) bool {
+	return kem == KEMMLKEM768
+}
+
+// encapsulate generates a shared secret and its encapsulation to the
+// encapsulation key of the server
+func encapsulate(kem KEM, encapsulationKey []byte) (shared, ciphertext []byte, err error) {
+	if !supportedKEM(kem) {
+		return nil, nil, fmt.Errorf("%w: %q", ErrUnexpectedKEM, kem)
+	}
+
+	key, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shared, ciphertext = key.Encapsulate()
+	return shared, ciphertext, nil
+}
+
+// hybridSecret combines the ML-KEM and X25519 shared secrets into the input
+// of derive, in the order of the X25519MLKEM768 key exchange of TLS. The keys
+// stay secret as long as either of them does.
+func hybridSecret(kemShared, shared []byte) []byte {
+	secret := make([]byte, 0, len(kemShared)+len(shared))
+	secret = append(secret, kemShared...)
+	return append(secret, shared...)
+}
@@ -0,0 +1,335 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrNoSigningKey is returned by providers that only verify the server,
+	// such as the ones used on clients
+	ErrNoSigningKey = errors.New("no server signing key")
+	// ErrNoVerificationKey is returned by providers without server public keys
+	ErrNoVerificationKey = errors.New("no server verification key")
+)
+
+// KeyProvider supplies the ed25519 keys authenticating the server during the
+// key exchange: the server signs its ephemeral key with SigningKey and clients
+// accept signatures by any of VerificationKeys. Providers are queried on every
+// key exchange, so a rotated key takes effect on the next connection; keeping
+// the previous public key among the verification keys lets clients that have
+// not picked up the new key yet keep connecting.
+type KeyProvider interface {
+	SigningKey() (ed25519.PrivateKey, error)
+	VerificationKeys() ([]ed25519.PublicKey, error)
+}
+
+// MemoryKeyProvider holds keys in memory. It is meant for tests and for
+// applications managing keys themselves.
+type MemoryKeyProvider struct {
+	signing      ed25519.PrivateKey
+	previous     ed25519.PrivateKey // signing key before the last rotation
+	verification []ed25519.PublicKey
+	mux          sync.RWMutex
+}
+
+// NewMemoryKeyProvider creates a provider signing with signing, which may be
+// nil on clients, and accepting its public key and the verification keys
+func NewMemoryKeyProvider(signing ed25519.PrivateKey, verification ...ed25519.PublicKey) *MemoryKeyProvider {
+	return &MemoryKeyProvider{signing: signing, verification: slices.Clone(verification)}
+}
+
+func (provider *MemoryKeyProvider) SigningKey() (ed25519.PrivateKey, error) {
+	provider.mux.RLock()
+	defer provider.mux.RUnlock()
+
+	if provider.signing == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	return provider.signing, nil
+}
+
+func (provider *MemoryKeyProvider) VerificationKeys() ([]ed25519.PublicKey, error) {
+	provider.mux.RLock()
+	defer provider.mux.RUnlock()
+
+	keys := slices.Clone(provider.verification)
+	for _, key := range []ed25519.PrivateKey{provider.signing, provider.previous} {
+		if key != nil {
+			keys = addKey(keys, key.Public().(ed25519.PublicKey))
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoVerificationKey
+	}
+
+	return keys, nil
+}
+
+// Rotate signs with next from now on and keeps the previous signing key for
+// verification; older signing keys are no longer accepted
+func (provider *MemoryKeyProvider) Rotate(next ed25519.PrivateKey) {
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+
+	provider.signing, provider.previous = next, provider.signing
+}
+
+// FileKeyProvider reads keys from files: the signing key from a PEM (PKCS #8)
+// or unencrypted OpenSSH private key file, and verification keys from PEM
+// ("PUBLIC KEY") or OpenSSH authorized_keys files, which may hold several keys
+// each. Files are read again when they change on disk, so replacing the key
+// file rotates the key without a restart.
+type FileKeyProvider struct {
+	signing      *watched
+	verification []*watched
+	mux          sync.Mutex
+}
+
+// watched is a key file together with what was last read from it
+type watched struct {
+	path    string
+	modTime time.Time
+	size    int64
+	keys    []ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+// NewFileKeyProvider creates a provider signing with the key of signingFile,
+// which is empty on clients, and accepting its public key and the keys of the
+// verification files
+func NewFileKeyProvider(signingFile string, verificationFiles ...string) (*FileKeyProvider, error) {
+	provider := &FileKeyProvider{}
+	if signingFile != "" {
+		provider.signing = &watched{path: signingFile}
+	}
+	for _, path := range verificationFiles {
+		provider.verification = append(provider.verification, &watched{path: path})
+	}
+
+	if err := provider.refresh(); err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+func (provider *FileKeyProvider) SigningKey() (ed25519.PrivateKey, error) {
+	if provider.signing == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	if err := provider.refresh(); err != nil {
+		return nil, err
+	}
+
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+
+	return provider.signing.private, nil
+}
+
+func (provider *FileKeyProvider) VerificationKeys() ([]ed25519.PublicKey, error) {
+	if err := provider.refresh(); err != nil {
+		return nil, err
+	}
+
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+
+	var keys []ed25519.PublicKey
+	if provider.signing != nil {
+		keys = addKey(keys, provider.signing.keys...)
+	}
+	for _, file := range provider.verification {
+		keys = addKey(keys, file.keys...)
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoVerificationKey
+	}
+
+	return keys, nil
+}
+
+// refresh reads the files that changed since they were last read. Files that
+// fail to reload keep their previous keys; the error is printed.
+func (provider *FileKeyProvider) refresh() error {
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+
+	if provider.signing != nil {
+		if err := provider.signing.refresh(func(data []byte, file *watched) error {
+			private, err := parsePrivateKey(data)
+			if err != nil {
+				return err
+			}
+			file.private, file.keys = private, []ed25519.PublicKey{private.Public().(ed25519.PublicKey)}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range provider.verification {
+		if err := file.refresh(func(data []byte, file *watched) error {
+			keys, err := parsePublicKeys(data)
+			if err != nil {
+				return err
+			}
+			file.keys = keys
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// refresh parses the file again with parse when it changed on disk
+func (file *watched) refresh(parse func([]byte, *watched) error) error {
+	info, err := os.Stat(file.path)
+	if err != nil {
+		if file.keys != nil {
+			fmt.Println("error while checking key file:", err.Error())
+			return nil
+		}
+		return err
+	}
+
+	if info.ModTime().Equal(file.modTime) && info.Size() == file.size && file.keys != nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(file.path)
+	if err == nil {
+		err = parse(data, file)
+	}
+	if err != nil {
+		if file.keys != nil {
+			fmt.Println("error while reloading key file:", err.Error())
+			return nil
+		}
+		return fmt.Errorf("error while loading key file %s: %w", file.path, err)
+	}
+
+	file.modTime, file.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// parsePrivateKey parses a PKCS #8 PEM or OpenSSH ed25519 private key
+func parsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var (
+		key any
+		err error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "OPENSSH PRIVATE KEY":
+		key, err = ssh.ParseRawPrivateKey(data)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch private := key.(type) {
+	case ed25519.PrivateKey:
+		return private, nil
+	case *ed25519.PrivateKey:
+		return *private, nil
+	default:
+		return nil, errors.New("not an ed25519 private key")
+	}
+}
+
+// parsePublicKeys parses every ed25519 key of PEM ("PUBLIC KEY") blocks or
+// OpenSSH authorized_keys lines
+func parsePublicKeys(data []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "PUBLIC KEY" {
+				return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+			}
+
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			public, ok := key.(ed25519.PublicKey)
+			if !ok {
+				return nil, errors.New("not an ed25519 public key")
+			}
+			keys = append(keys, public)
+		}
+	} else {
+		for len(bytes.TrimSpace(data)) > 0 {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				return nil, err
+			}
+			data = rest
+
+			crypto, ok := key.(ssh.CryptoPublicKey)
+			if !ok {
+				return nil, errors.New("unsupported ssh public key")
+			}
+			public, ok := crypto.CryptoPublicKey().(ed25519.PublicKey)
+			if !ok {
+				return nil, errors.New("not an ed25519 public key")
+			}
+			keys = append(keys, public)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no public key found")
+	}
+
+	return keys, nil
+}
+
+// addKey appends the keys that are not present yet
+func addKey(keys []ed25519.PublicKey, add ...ed25519.PublicKey) []ed25519.PublicKey {
+	for _, key := range add {
+		if !slices.ContainsFunc(keys, func(existing ed25519.PublicKey) bool { return existing.Equal(key) }) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// verify reports whether signature is a valid signature of data by any of keys
+func verify(keys []ed25519.PublicKey, data, signature []byte) bool {
+	return slices.ContainsFunc(keys, func(key ed25519.PublicKey) bool {
+		return ed25519.Verify(key, data, signature)
+	})
+}
@@ -0,0 +1,213 @@
+package encrypt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func generate(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	return private
+}
+
+func public(key ed25519.PrivateKey) ed25519.PublicKey {
+	return key.Public().(ed25519.PublicKey)
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	// Make sure the change is noticed on filesystems with coarse timestamps
+	modTime := time.Now().Add(time.Duration(len(data)) * time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+}
+
+func pkcs8(t *testing.T, key ed25519.PrivateKey) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey failed: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func openssh(t *testing.T, key ed25519.PrivateKey) []byte {
+	t.Helper()
+
+	block, err := ssh.MarshalPrivateKey(key, "server")
+	if err != nil {
+		t.Fatalf("MarshalPrivateKey failed: %v", err)
+	}
+
+	return pem.EncodeToMemory(block)
+}
+
+func authorizedKey(t *testing.T, key ed25519.PublicKey) []byte {
+	t.Helper()
+
+	sshKey, err := ssh.NewPublicKey(key)
+	if err != nil {
+		t.Fatalf("NewPublicKey failed: %v", err)
+	}
+
+	return ssh.MarshalAuthorizedKey(sshKey)
+}
+
+func contains(keys []ed25519.PublicKey, key ed25519.PublicKey) bool {
+	for _, k := range keys {
+		if k.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMemoryKeyProvider(t *testing.T) {
+	first, second, third, other := generate(t), generate(t), generate(t), generate(t)
+	provider := NewMemoryKeyProvider(first, public(other))
+
+	provider.Rotate(second)
+	provider.Rotate(third)
+
+	signing, err := provider.SigningKey()
+	if err != nil {
+		t.Fatalf("SigningKey failed: %v", err)
+	}
+	if !signing.Equal(third) {
+		t.Error("signing key mismatch after rotation")
+	}
+
+	// The current and previous signing keys are accepted, older ones are retired
+	keys, err := provider.VerificationKeys()
+	if err != nil {
+		t.Fatalf("VerificationKeys failed: %v", err)
+	}
+	if len(keys) != 3 || !contains(keys, public(third)) || !contains(keys, public(second)) || !contains(keys, public(other)) {
+		t.Errorf("verification keys mismatch: got %d keys", len(keys))
+	}
+	if contains(keys, public(first)) {
+		t.Error("retired signing key still accepted")
+	}
+
+	if _, err := NewMemoryKeyProvider(nil).VerificationKeys(); !errors.Is(err, ErrNoVerificationKey) {
+		t.Errorf("expected ErrNoVerificationKey, got %v", err)
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	dir := t.TempDir()
+	current, previous, other := generate(t), generate(t), generate(t)
+
+	signing := filepath.Join(dir, "server.pem")
+	writeFile(t, signing, pkcs8(t, current))
+
+	trusted := filepath.Join(dir, "authorized_keys")
+	writeFile(t, trusted, append(authorizedKey(t, public(previous)), authorizedKey(t, public(other))...))
+
+	provider, err := NewFileKeyProvider(signing, trusted)
+	if err != nil {
+		t.Fatalf("NewFileKeyProvider failed: %v", err)
+	}
+
+	key, err := provider.SigningKey()
+	if err != nil || !key.Equal(current) {
+		t.Fatalf("signing key mismatch: %v", err)
+	}
+
+	keys, err := provider.VerificationKeys()
+	if err != nil {
+		t.Fatalf("VerificationKeys failed: %v", err)
+	}
+	for _, key := range []ed25519.PrivateKey{current, previous, other} {
+		if !contains(keys, public(key)) {
+			t.Errorf("verification key missing: %x", public(key))
+		}
+	}
+
+	// Replacing the key file rotates the key
+	next := generate(t)
+	writeFile(t, signing, openssh(t, next))
+	if key, err := provider.SigningKey(); err != nil || !key.Equal(next) {
+		t.Errorf("rotated signing key mismatch: %v", err)
+	}
+
+	// A broken key file keeps the last key
+	writeFile(t, signing, []byte("garbage"))
+	if key, err := provider.SigningKey(); err != nil || !key.Equal(next) {
+		t.Errorf("signing key lost on broken file: %v", err)
+	}
+
+	client, err := NewFileKeyProvider("", trusted)
+	if err != nil {
+		t.Fatalf("NewFileKeyProvider failed: %v", err)
+	}
+	if _, err := client.SigningKey(); !errors.Is(err, ErrNoSigningKey) {
+		t.Errorf("expected ErrNoSigningKey, got %v", err)
+	}
+}
+
+func TestKeystoreKeyProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.keystore")
+	passphrase := []byte("correct horse battery staple")
+	first := generate(t)
+
+	if err := CreateKeystore(path, passphrase, first); err != nil {
+		t.Fatalf("CreateKeystore failed: %v", err)
+	}
+
+	if _, err := OpenKeystore(path, []byte("wrong")); !errors.Is(err, ErrInvalidPassphrase) {
+		t.Errorf("expected ErrInvalidPassphrase, got %v", err)
+	}
+
+	provider, err := OpenKeystore(path, passphrase)
+	if err != nil {
+		t.Fatalf("OpenKeystore failed: %v", err)
+	}
+	if key, err := provider.SigningKey(); err != nil || !key.Equal(first) {
+		t.Fatalf("signing key mismatch: %v", err)
+	}
+
+	second := generate(t)
+	if err := provider.Rotate(second); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if key, err := provider.SigningKey(); err != nil || !key.Equal(second) {
+		t.Errorf("rotated signing key mismatch: %v", err)
+	}
+
+	// The rotation is persisted, keeping the previous key for verification
+	reopened, err := OpenKeystore(path, passphrase)
+	if err != nil {
+		t.Fatalf("OpenKeystore failed: %v", err)
+	}
+	keys, err := reopened.VerificationKeys()
+	if err != nil {
+		t.Fatalf("VerificationKeys failed: %v", err)
+	}
+	if len(keys) != 2 || !keys[0].Equal(public(second)) || !keys[1].Equal(public(first)) {
+		t.Errorf("verification keys mismatch after rotation: got %d keys", len(keys))
+	}
+}
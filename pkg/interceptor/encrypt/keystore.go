@@ -0,0 +1,256 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrInvalidPassphrase is returned when a keystore cannot be decrypted
+var ErrInvalidPassphrase = errors.New("invalid keystore passphrase")
+
+// keystoreFile is the on-disk format of a keystore: the seeds of its keys,
+// encrypted with AES-256-GCM under a key derived from the passphrase with
+// scrypt
+type keystoreFile struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// keystoreContent is the plaintext of a keystore
+type keystoreContent struct {
+	Seeds [][]byte `json:"seeds"` // Current key first
+}
+
+// KeystoreKeyProvider reads keys from a passphrase encrypted keystore file.
+// The first key of the keystore signs, all of them verify. Rotate adds a new
+// signing key to the keystore; the file is read again when it changes on
+// disk, so rotating it from another process takes effect without a restart
+// as well.
+type KeystoreKeyProvider struct {
+	path       string
+	passphrase []byte
+	modTime    time.Time
+	size       int64
+	keys       []ed25519.PrivateKey // Current key first; guarded by mux
+	mux        sync.Mutex
+}
+
+// CreateKeystore writes a new keystore holding keys, the first of which signs
+func CreateKeystore(path string, passphrase []byte, keys ...ed25519.PrivateKey) error {
+	if len(keys) == 0 {
+		return errors.New("no keys to store")
+	}
+
+	return writeKeystore(path, passphrase, keys)
+}
+
+// OpenKeystore creates a provider reading the keystore at path
+func OpenKeystore(path string, passphrase []byte) (*KeystoreKeyProvider, error) {
+	provider := &KeystoreKeyProvider{path: path, passphrase: passphrase}
+	if err := provider.refresh(); err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+func (provider *KeystoreKeyProvider) SigningKey() (ed25519.PrivateKey, error) {
+	if err := provider.refresh(); err != nil {
+		return nil, err
+	}
+
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+
+	return provider.keys[0], nil
+}
+
+func (provider *KeystoreKeyProvider) VerificationKeys() ([]ed25519.PublicKey, error) {
+	if err := provider.refresh(); err != nil {
+		return nil, err
+	}
+
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+
+	keys := make([]ed25519.PublicKey, 0, len(provider.keys))
+	for _, key := range provider.keys {
+		keys = append(keys, key.Public().(ed25519.PublicKey))
+	}
+
+	return keys, nil
+}
+
+// Rotate makes next the signing key and keeps the previous signing key for
+// verification; older keys are dropped from the keystore
+func (provider *KeystoreKeyProvider) Rotate(next ed25519.PrivateKey) error {
+	if err := provider.refresh(); err != nil {
+		return err
+	}
+
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+
+	keys := []ed25519.PrivateKey{next, provider.keys[0]}
+	if err := writeKeystore(provider.path, provider.passphrase, keys); err != nil {
+		return err
+	}
+	provider.keys = keys
+
+	return nil
+}
+
+// refresh reads the keystore again when it changed on disk. Once read, a
+// keystore that fails to reload keeps its previous keys; the error is printed.
+func (provider *KeystoreKeyProvider) refresh() error {
+	provider.mux.Lock()
+	defer provider.mux.Unlock()
+
+	info, err := os.Stat(provider.path)
+	if err == nil && info.ModTime().Equal(provider.modTime) && info.Size() == provider.size {
+		return nil
+	}
+
+	var keys []ed25519.PrivateKey
+	if err == nil {
+		keys, err = readKeystore(provider.path, provider.passphrase)
+	}
+	if err != nil {
+		if provider.keys != nil {
+			fmt.Println("error while reloading keystore:", err.Error())
+			return nil
+		}
+		return fmt.Errorf("error while loading keystore %s: %w", provider.path, err)
+	}
+
+	provider.keys = keys
+	provider.modTime, provider.size = info.ModTime(), info.Size()
+
+	return nil
+}
+
+func readKeystore(path string, passphrase []byte) ([]ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &keystoreFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, err
+	}
+	if file.Version != 1 {
+		return nil, fmt.Errorf("unsupported keystore version %d", file.Version)
+	}
+
+	aead, err := keystoreCipher(passphrase, file)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrInvalidPassphrase
+	}
+
+	content := &keystoreContent{}
+	if err := json.Unmarshal(plaintext, content); err != nil {
+		return nil, err
+	}
+	if len(content.Seeds) == 0 {
+		return nil, errors.New("empty keystore")
+	}
+
+	keys := make([]ed25519.PrivateKey, 0, len(content.Seeds))
+	for _, seed := range content.Seeds {
+		if len(seed) != ed25519.SeedSize {
+			return nil, errors.New("invalid key in keystore")
+		}
+		keys = append(keys, ed25519.NewKeyFromSeed(seed))
+	}
+
+	return keys, nil
+}
+
+// writeKeystore encrypts keys with a fresh salt and nonce and replaces the
+// keystore atomically
+func writeKeystore(path string, passphrase []byte, keys []ed25519.PrivateKey) error {
+	content := &keystoreContent{}
+	for _, key := range keys {
+		content.Seeds = append(content.Seeds, key.Seed())
+	}
+
+	plaintext, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	file := &keystoreFile{Version: 1, Salt: make([]byte, 16), N: 1 << 15, R: 8, P: 1}
+	if _, err := io.ReadFull(rand.Reader, file.Salt); err != nil {
+		return err
+	}
+
+	aead, err := keystoreCipher(passphrase, file)
+	if err != nil {
+		return err
+	}
+
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, file.Nonce); err != nil {
+		return err
+	}
+	file.Ciphertext = aead.Seal(nil, file.Nonce, plaintext, nil)
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), ".keystore-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(temp.Name()) }()
+
+	if _, err := temp.Write(data); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+// keystoreCipher derives the AEAD protecting a keystore from the passphrase
+func keystoreCipher(passphrase []byte, file *keystoreFile) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, file.Salt, file.N, file.R, file.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -1,15 +1,18 @@
 package encrypt
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"time"
 
 	"github.com/coder/websocket"
 	"golang.org/x/crypto/curve25519"
-	"golang.org/x/crypto/ed25519"
 
 	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
 	"github.com/harshabose/skyline_sonata/serve/pkg/message"
@@ -24,72 +27,151 @@ var (
 	ProtocolInitDone      message.Protocol = "encrypt-done"
 	ProtocolUpdateSession message.Protocol = "encrypt-update-session"
 
+	ProtocolUpdateSessionResponse message.Protocol = "encrypt-update-session-response"
+	ProtocolUpdateSessionAck      message.Protocol = "encrypt-update-session-ack"
+	ProtocolNoiseHandshake        message.Protocol = "encrypt-noise-handshake"
+
 	// Error constants
 	ErrInvalidInterceptor   = errors.New("inappropriate interceptor for the payload")
 	ErrConnectionNotFound   = errors.New("connection not registered")
 	ErrInvalidSignature     = errors.New("signature verification failed")
 	ErrInvalidServerRequest = errors.New("invalid request to server")
-
-	// Protocol registry maps protocol identifiers to message types
-	protocolMap = message.ProtocolRegistry{
-		ProtocolMessage:       &EncryptedMessage{},
-		ProtocolInit:          &Init{},
-		ProtocolResponse:      &InitResponse{},
-		ProtocolInitDone:      &InitDone{},
-		ProtocolUpdateSession: &UpdateSession{},
-	}
+	ErrNoRekey              = errors.New("no rekey in progress")
+	ErrUnencryptedRekey     = errors.New("rekey message received unencrypted")
 )
 
-// EncryptedMessage represents an encrypted payload
+var protocolMap = message.CreateProtocolRegistry()
+
+func init() {
+	message.MustRegister[EncryptedMessage](protocolMap)
+	message.MustRegister[Init](protocolMap)
+	message.MustRegister[InitResponse](protocolMap)
+	message.MustRegister[InitDone](protocolMap)
+	message.MustRegister[UpdateSession](protocolMap)
+	message.MustRegister[UpdateSessionResponse](protocolMap)
+	message.MustRegister[UpdateSessionAck](protocolMap)
+	message.MustRegister[NoiseHandshake](protocolMap)
+}
+
+// EncryptedMessage carries an encrypted frame. Data is the ciphertext of the
+// complete marshalled frame (header and payload) it replaces on the wire.
+// Sequence numbers the messages of each direction of a session; it is
+// authenticated together with the timestamp and header, see additionalData.
 type EncryptedMessage struct {
-	message.BaseMessage
-	Nonce     []byte    `json:"nonce"`
-	Timestamp time.Time `json:"timestamp"`
+	message.BaseMessage           // NOTE: EMPTY PAYLOAD
+	Data                []byte    `json:"data"`
+	Nonce               []byte    `json:"nonce"`
+	Sequence            uint64    `json:"sequence"`
+	Timestamp           time.Time `json:"timestamp"`
+}
+
+func (payload *EncryptedMessage) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *EncryptedMessage) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
 }
 
 // Validate ensures the encrypted message contains valid data
 func (payload *EncryptedMessage) Validate() error {
-	if payload.Nonce == nil || len(payload.Nonce) <= 0 {
+	if len(payload.Nonce) == 0 || len(payload.Data) == 0 || payload.Sequence == 0 || payload.Timestamp.IsZero() {
 		return message.ErrorNotValid
 	}
 
-	return payload.BaseMessage.Validate()
+	return nil
 }
 
-// Process handles decryption of the message
+// Process handles decryption of the message. On success, Data holds the
+// plaintext frame. Replayed messages and messages whose timestamp is off by
+// more than the allowed clock skew are rejected and counted in the stats of
+// the connection.
 func (payload *EncryptedMessage) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
 	i, ok := _interceptor.(*Interceptor)
 	if !ok {
-		return errors.New("inappropriate interceptor for the payload")
+		return ErrInvalidInterceptor
+	}
+
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
 	}
 
-	state, exists := i.states[connection]
-	if !exists {
-		return errors.New("connection not registered")
+	if err := payload.Validate(); err != nil {
+		state.invalid.Add(1)
+		return err
 	}
-	if err := state.encryptor.Decrypt(payload); err != nil {
+
+	size := len(payload.Data)
+	if err := i.encryptorOf(state).Decrypt(payload); err != nil {
+		if errors.Is(err, ErrReplayedMessage) {
+			state.replayed.Add(1)
+		} else {
+			state.invalid.Add(1)
+		}
 		return err
 	}
 
+	// The timestamp is only trusted once authenticated
+	if skew := time.Since(payload.Timestamp).Abs(); i.maxClockSkew > 0 && skew > i.maxClockSkew {
+		state.skewed.Add(1)
+		return fmt.Errorf("%w: %s", ErrClockSkew, skew)
+	}
+
+	state.decrypted.Add(1)
+	i.count(state, size)
 	return nil
 }
 
+// additionalData returns the data authenticated along with the ciphertext:
+// the session ID, the sequence number, the timestamp and the header of the
+// message
+func (payload *EncryptedMessage) additionalData(sessionID SessionID) []byte {
+	header := payload.Message().Header
+
+	data := make([]byte, 0, 64)
+	data = append(data, sessionID[:]...)
+	data = binary.BigEndian.AppendUint64(data, payload.Sequence)
+	data = binary.BigEndian.AppendUint64(data, uint64(payload.Timestamp.UnixNano()))
+	for _, field := range []string{header.SenderID, header.ReceiverID, string(header.Protocol)} {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(field)))
+		data = append(data, field...)
+	}
+
+	return data
+}
+
+// Frame returns the decrypted frame carried by the message. It must only be
+// called after Process succeeded. The frame is encoded with the same codec as
+// the message itself.
+func (payload *EncryptedMessage) Frame() (*message.BaseMessage, error) {
+	return message.Decode(payload.Codec(), payload.Data)
+}
+
 // Protocol returns the message protocol type
 func (payload *EncryptedMessage) Protocol() message.Protocol {
 	return ProtocolMessage
 }
 
-// Init represents the initial key exchange message
+// Init represents the initial key exchange message. Ciphers lists the ciphers
+// the server accepts, in order of preference; servers predating cipher
+// negotiation leave it empty and only support AES-256-GCM. Servers offering
+// the hybrid key exchange set KEM and their encapsulation key. IdentityKey is
+// the public key of the signature, for clients pinning it.
 type Init struct {
 	message.BaseMessage
-	PublicKey PublicKey `json:"public_key"`
-	Signature []byte    `json:"signature"`
-	SessionID SessionID `json:"session_id"`
-	Salt      Salt      `json:"salt"`
+	PublicKey   PublicKey         `json:"public_key"`
+	Signature   []byte            `json:"signature"`
+	SessionID   SessionID         `json:"session_id"`
+	Salt        Salt              `json:"salt"`
+	Ciphers     []Cipher          `json:"ciphers,omitempty"`
+	KEM         KEM               `json:"kem,omitempty"`
+	KEMKey      []byte            `json:"kem_key,omitempty"`
+	IdentityKey ed25519.PublicKey `json:"identity_key,omitempty"`
 }
 
 // NewInitMessage creates a new initialization message for key exchange
-func NewInitMessage(senderID, receiverID string, pubKey PublicKey, sign []byte, salt Salt, sessionID SessionID) *Init {
+func NewInitMessage(senderID, receiverID string, pubKey PublicKey, sign []byte, salt Salt, sessionID SessionID, ciphers []Cipher, kem KEM, kemKey []byte, identityKey ed25519.PublicKey) *Init {
 	return &Init{
 		BaseMessage: message.BaseMessage{
 			Header: message.Header{
@@ -99,10 +181,14 @@ func NewInitMessage(senderID, receiverID string, pubKey PublicKey, sign []byte,
 			},
 			Payload: nil,
 		},
-		PublicKey: pubKey,
-		Signature: sign,
-		SessionID: sessionID,
-		Salt:      salt,
+		PublicKey:   pubKey,
+		Signature:   sign,
+		SessionID:   sessionID,
+		Salt:        salt,
+		Ciphers:     ciphers,
+		KEM:         kem,
+		KEMKey:      kemKey,
+		IdentityKey: identityKey,
 	}
 }
 
@@ -111,7 +197,15 @@ func (payload *Init) Validate() error {
 	if len(payload.Signature) == 0 {
 		return message.ErrorNotValid
 	}
-	return payload.BaseMessage.Validate()
+	return nil
+}
+
+func (payload *Init) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *Init) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
 }
 
 // Protocol returns the message protocol type
@@ -119,69 +213,153 @@ func (payload *Init) Protocol() message.Protocol {
 	return ProtocolInit
 }
 
-// Process handles the initialization message
+// Process handles the initialization message on the client: it verifies the
+// server's signature, picks the cipher, derives the session keys and answers
+// with its own ephemeral key and the chosen cipher. If the server offers the
+// hybrid key exchange, the keys are also derived from a secret encapsulated
+// to the server's ML-KEM key, whose ciphertext is part of the answer.
 func (payload *Init) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
 	i, ok := _interceptor.(*Interceptor)
 	if !ok {
 		return ErrInvalidInterceptor
 	}
 
-	// Verify signature using server public key
-	signature := append(payload.PublicKey[:], payload.Salt[:]...)
-	if !ed25519.Verify(ServerPublicKey, signature, payload.Signature) {
-		return ErrInvalidSignature
+	if i.isServer {
+		return ErrInvalidServerRequest
+	}
+
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
 	}
 
-	i.Mutex.Lock()
-	defer i.Mutex.Unlock()
+	if err := i.answerInit(connection, state, payload); err != nil {
+		state.failInit(err)
+		return err
+	}
+
+	return nil
+}
 
-	state, exists := i.states[connection]
-	if !exists {
-		return errors.New("connection not registered")
+// answerInit runs the client side of the key exchange. Its errors fail Init.
+func (i *Interceptor) answerInit(connection interceptor.Connection, state *state, payload *Init) error {
+	// Verify signature using the server public keys and the key pinned for
+	// the server
+	peerID := interceptor.SenderOf(connection, payload)
+	signed := signedInit(payload.PublicKey, payload.Salt, payload.SessionID, payload.Ciphers, payload.KEM, payload.KEMKey)
+	if i.keys != nil {
+		keys, err := i.keys.VerificationKeys()
+		if err != nil {
+			return err
+		}
+		if !verify(keys, signed, payload.Signature) {
+			return ErrInvalidSignature
+		}
+	}
+	if i.trust != nil {
+		if err := i.verifyIdentity(peerID, payload.IdentityKey, signed, payload.Signature); err != nil {
+			return err
+		}
+	}
+
+	offered := payload.Ciphers
+	if len(offered) == 0 {
+		offered = []Cipher{CipherAES256GCM}
+	}
+	chosen, err := negotiate(i.ciphers, offered)
+	if err != nil {
+		return err
 	}
 
 	// Generate key pair for this connection
-	var pubKey PublicKey
-	if _, err := io.ReadFull(rand.Reader, state.privKey[:]); err != nil {
+	var (
+		privKey PrivateKey
+		pubKey  PublicKey
+	)
+	if _, err := io.ReadFull(rand.Reader, privKey[:]); err != nil {
 		return fmt.Errorf("failed to generate private key: %w", err)
 	}
-	curve25519.ScalarBaseMult((*[32]byte)(&pubKey), (*[32]byte)(&state.privKey))
-
-	// Save peer information
-	state.peerID = payload.SenderID
-	state.salt = payload.Salt
+	curve25519.ScalarBaseMult((*[32]byte)(&pubKey), (*[32]byte)(&privKey))
 
 	// Compute shared secret and derive keys
-	shared, err := curve25519.X25519(state.privKey[:], payload.PublicKey[:])
+	shared, err := curve25519.X25519(privKey[:], payload.PublicKey[:])
 	if err != nil {
 		return fmt.Errorf("failed to compute shared secret: %w", err)
 	}
 
-	// Derive encryption and decryption keys
-	encKey, decKey, err := derive(shared, state.salt, i.ID)
+	var kemCiphertext []byte
+	switch {
+	case supportedKEM(payload.KEM):
+		var kemShared []byte
+		if kemShared, kemCiphertext, err = encapsulate(payload.KEM, payload.KEMKey); err != nil {
+			return fmt.Errorf("failed to encapsulate shared secret: %w", err)
+		}
+		shared = hybridSecret(kemShared, shared)
+	case i.hybrid:
+		return ErrHybridRequired
+	}
+
+	encKey, decKey, err := derive(shared, payload.Salt, chosen)
 	if err != nil {
 		return fmt.Errorf("key derivation failed: %w", err)
 	}
 
+	// Save peer information
+	i.Mutex.Lock()
+	state.peerID = peerID
+	state.privKey = privKey
+	state.salt = payload.Salt
+	i.Mutex.Unlock()
+
 	// Configure encryptor with derived keys
-	if err := state.encryptor.SetKeys(encKey, decKey); err != nil {
+	if err := i.useEncryptor(state, chosen, encKey, decKey, payload.SessionID); err != nil {
 		return err
 	}
-	state.encryptor.SetSessionID(payload.SessionID)
+
+	i.Mutex.Lock()
+	state.hybrid = kemCiphertext != nil
+	i.Mutex.Unlock()
+
+	// Authenticate the response with the identity key, if any
+	var (
+		identityKey ed25519.PublicKey
+		sign        []byte
+	)
+	if i.identity != nil {
+		identityKey = i.identity.Public().(ed25519.PublicKey)
+		sign = ed25519.Sign(i.identity, signedResponse(pubKey, payload.PublicKey, payload.SessionID, chosen, kemCiphertext))
+	}
 
 	// Send response with the public key
-	return state.writer.Write(connection, websocket.MessageText, NewInitResponseMessage(i.ID, state.peerID, pubKey))
+	msg, err := message.CreateMessage(i.ID, peerID, NewInitResponseMessage(i.ID, peerID, pubKey, chosen, kemCiphertext, identityKey, sign))
+	if err != nil {
+		return err
+	}
+
+	return state.writer.Write(connection, websocket.MessageText, msg)
 }
 
-// InitResponse represents the response to an initialization message
+// InitResponse represents the response to an initialization message. Cipher
+// is the cipher chosen by the client among those offered in Init; clients
+// predating cipher negotiation leave it empty and use AES-256-GCM.
+// KEMCiphertext is set when the client accepted the hybrid key exchange.
+// Clients with an identity key sign the response with it, see
+// signedResponse; servers with a trust store require it.
 type InitResponse struct {
 	message.BaseMessage
-	PublicKey PublicKey `json:"public_key"`
-	// NOTE: NO SIGNING HERE. AUTH IS DONE SEPARATELY
+	PublicKey     PublicKey         `json:"public_key"`
+	Cipher        Cipher            `json:"cipher,omitempty"`
+	KEMCiphertext []byte            `json:"kem_ciphertext,omitempty"`
+	IdentityKey   ed25519.PublicKey `json:"identity_key,omitempty"`
+	Signature     []byte            `json:"signature,omitempty"`
 }
 
 // NewInitResponseMessage creates a new response message for key exchange
-func NewInitResponseMessage(senderID, receiverID string, pub PublicKey) *InitResponse {
+func NewInitResponseMessage(senderID, receiverID string, pub PublicKey, cipher Cipher, kemCiphertext []byte, identityKey ed25519.PublicKey, sign []byte) *InitResponse {
 	return &InitResponse{
 		BaseMessage: message.BaseMessage{
 			Header: message.Header{
@@ -191,58 +369,125 @@ func NewInitResponseMessage(senderID, receiverID string, pub PublicKey) *InitRes
 			},
 			Payload: nil,
 		},
-		PublicKey: pub,
+		PublicKey:     pub,
+		Cipher:        cipher,
+		KEMCiphertext: kemCiphertext,
+		IdentityKey:   identityKey,
+		Signature:     sign,
 	}
 }
 
+func (payload *InitResponse) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *InitResponse) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
 func (payload *InitResponse) Protocol() message.Protocol {
 	return ProtocolResponse
 }
 
-// Process handles the initialization response
+// Process handles the initialization response on the server: it checks the
+// chosen cipher was offered, derives the session keys and confirms the key
+// exchange. Clients predating the hybrid key exchange answer without an
+// encapsulated secret; the keys are then derived from X25519 alone.
 func (payload *InitResponse) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
 	i, ok := _interceptor.(*Interceptor)
 	if !ok {
-		return errors.New("invalid interceptor")
+		return ErrInvalidInterceptor
 	}
 
-	i.Mutex.Lock()
-	defer i.Mutex.Unlock()
+	if !i.isServer {
+		return errors.New("unexpected init response")
+	}
 
-	state, exists := i.states[connection]
-	if !exists {
-		return errors.New("connection not registered")
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	if err := i.completeInit(connection, state, payload); err != nil {
+		state.failInit(err)
+		return err
 	}
 
+	return nil
+}
+
+// completeInit runs the server side of the key exchange. Its errors fail
+// Init.
+func (i *Interceptor) completeInit(connection interceptor.Connection, state *state, payload *InitResponse) error {
 	// Save peer ID for future communications
-	state.peerID = payload.SenderID
+	peerID := interceptor.SenderOf(connection, payload)
+	i.Mutex.Lock()
+	state.peerID = peerID
+	privKey, salt, sessionID, kemKey := state.privKey, state.salt, state.sessionID, state.kemKey
+	state.kemKey = nil
+	i.Mutex.Unlock()
+
+	chosen := payload.Cipher
+	if chosen == "" {
+		chosen = CipherAES256GCM
+	}
+	if !slices.Contains(i.ciphers, chosen) {
+		return fmt.Errorf("%w: %q was not offered", ErrNoCommonCipher, chosen)
+	}
+
+	// Authenticate the client against the key pinned for it
+	if i.trust != nil {
+		signed := signedResponse(payload.PublicKey, privKey.Public(), sessionID, chosen, payload.KEMCiphertext)
+		if err := i.verifyIdentity(peerID, payload.IdentityKey, signed, payload.Signature); err != nil {
+			return err
+		}
+	}
 
 	// Compute shared secret using our private key and peer's public key
-	shared, err := curve25519.X25519(state.privKey[:], payload.PublicKey[:])
+	shared, err := curve25519.X25519(privKey[:], payload.PublicKey[:])
 	if err != nil {
 		return err
 	}
 
+	hybrid := len(payload.KEMCiphertext) > 0
+	if hybrid {
+		if kemKey == nil {
+			return ErrUnexpectedKEM
+		}
+		kemShared, err := kemKey.Decapsulate(payload.KEMCiphertext)
+		if err != nil {
+			return err
+		}
+		shared = hybridSecret(kemShared, shared)
+	}
+
 	// For responses, keys are reversed compared to the initiation
-	decKey, encKey, err := derive(shared, state.salt, i.ID) // NOTE: KEY REVERSED
+	decKey, encKey, err := derive(shared, salt, chosen) // NOTE: KEY REVERSED
 	if err != nil {
 		return err
 	}
 
 	// Configure encryptor with derived keys
-	if err := state.encryptor.SetKeys(encKey, decKey); err != nil {
+	if err := i.useEncryptor(state, chosen, encKey, decKey, sessionID); err != nil {
 		return err
 	}
 
-	// Signal that initialization is complete
-	select {
-	case state.initDone <- struct{}{}:
-	default:
-		// Channel already has a value, which is fine
+	i.Mutex.Lock()
+	state.hybrid = hybrid
+	i.Mutex.Unlock()
+
+	// Send acknowledgment, then signal that initialization is complete
+	msg, err := message.CreateMessage(i.ID, peerID, NewInitDoneMessage(i.ID, peerID))
+	if err != nil {
+		return err
 	}
 
-	// Send acknowledgment
-	return state.writer.Write(connection, websocket.MessageText, NewInitDoneMessage(i.ID, state.peerID))
+	if err := state.writer.Write(connection, websocket.MessageText, msg); err != nil {
+		return err
+	}
+
+	state.markInitDone()
+	return nil
 }
 
 // InitDone represents the acknowledgment that key exchange is complete
@@ -264,50 +509,107 @@ func NewInitDoneMessage(senderID, receiverID string) *InitDone {
 	}
 }
 
+func (payload *InitDone) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *InitDone) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
 // Protocol returns the message protocol type
 func (payload *InitDone) Protocol() message.Protocol {
 	return ProtocolInitDone
 }
 
-// Process handles the initialization completion message
+// Process handles the initialization completion message on the client
 func (payload *InitDone) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
 	i, ok := _interceptor.(*Interceptor)
 	if !ok {
-		return errors.New("invalid interceptor")
+		return ErrInvalidInterceptor
 	}
 
-	i.Mutex.Lock()
-	defer i.Mutex.Unlock()
-
-	state, exists := i.states[connection]
-	if !exists {
-		return errors.New("connection not registered")
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
 	}
 
-	// Signal that initialization is complete
-	select {
-	case state.initDone <- struct{}{}:
-	default:
-		// Channel already has a value, which is fine
+	if !i.encryptorOf(state).Ready() {
+		return ErrEncryptionNotReady
 	}
 
-	state.initDone <- struct{}{}
+	// Signal that initialization is complete
+	state.markInitDone()
 
 	return nil
 }
 
-// UpdateSession represents a message to update the session ID
+// UpdateSession starts a rekey of an established session. The server sends
+// it, encrypted under the current keys, with a fresh ephemeral key, salt and
+// session ID. In hybrid sessions, KEM and KEMKey carry a fresh ML-KEM
+// encapsulation key as in Init.
 type UpdateSession struct {
 	message.BaseMessage
-	SessionID   SessionID `json:"session_id"`
-	UpdateAtSeq uint64    `json:"update_at_seq"`
+	PublicKey PublicKey `json:"public_key"`
+	Salt      Salt      `json:"salt"`
+	SessionID SessionID `json:"session_id"`
+	KEM       KEM       `json:"kem,omitempty"`
+	KEMKey    []byte    `json:"kem_key,omitempty"`
+}
+
+// NewUpdateSessionMessage creates a new rekey request
+func NewUpdateSessionMessage(senderID, receiverID string, pubKey PublicKey, salt Salt, sessionID SessionID, kem KEM, kemKey []byte) *UpdateSession {
+	return &UpdateSession{
+		BaseMessage: message.BaseMessage{
+			Header: message.Header{
+				SenderID:   senderID,
+				ReceiverID: receiverID,
+				Protocol:   message.NoneProtocol,
+			},
+			Payload: nil,
+		},
+		PublicKey: pubKey,
+		Salt:      salt,
+		SessionID: sessionID,
+		KEM:       kem,
+		KEMKey:    kemKey,
+	}
 }
 
-// Process handles session update requests
+// Validate checks if the rekey request contains valid data
+func (payload *UpdateSession) Validate() error {
+	if IsZero(payload.PublicKey) || IsZero(payload.SessionID) {
+		return message.ErrorNotValid
+	}
+	return nil
+}
+
+func (payload *UpdateSession) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *UpdateSession) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+// Protocol returns the message protocol type
+func (payload *UpdateSession) Protocol() message.Protocol {
+	return ProtocolUpdateSession
+}
+
+// Process handles a rekey request on the client: it derives the new keys,
+// answers with its own ephemeral key and encrypts everything it sends after
+// the answer with the new keys. Hybrid sessions stay hybrid: the request must
+// carry an encapsulation key, to which a fresh secret is encapsulated. The new keys for receiving take effect at the
+// sequence number announced by the server in UpdateSessionAck.
 func (payload *UpdateSession) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
 	i, ok := _interceptor.(*Interceptor)
 	if !ok {
-		return errors.New("invalid interceptor")
+		return ErrInvalidInterceptor
 	}
 
 	// Only clients should process update session messages
@@ -315,13 +617,329 @@ func (payload *UpdateSession) Process(_interceptor interceptor.Interceptor, conn
 		return ErrInvalidServerRequest
 	}
 
-	state, exists := i.states[connection]
-	if !exists {
-		return ErrConnectionNotFound
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	var (
+		privKey PrivateKey
+		pubKey  PublicKey
+	)
+	if _, err := io.ReadFull(rand.Reader, privKey[:]); err != nil {
+		return fmt.Errorf("failed to generate private key: %w", err)
+	}
+	curve25519.ScalarBaseMult((*[32]byte)(&pubKey), (*[32]byte)(&privKey))
+
+	shared, err := curve25519.X25519(privKey[:], payload.PublicKey[:])
+	if err != nil {
+		return fmt.Errorf("failed to compute shared secret: %w", err)
 	}
 
-	// Update the session ID
-	state.encryptor.SetSessionID(payload.SessionID)
+	i.Mutex.RLock()
+	cipher, hybrid := state.cipher, state.hybrid
+	i.Mutex.RUnlock()
+
+	var kemCiphertext []byte
+	switch {
+	case hybrid && payload.KEM == "":
+		return ErrMissingKEM
+	case hybrid:
+		var kemShared []byte
+		if kemShared, kemCiphertext, err = encapsulate(payload.KEM, payload.KEMKey); err != nil {
+			return fmt.Errorf("failed to encapsulate shared secret: %w", err)
+		}
+		shared = hybridSecret(kemShared, shared)
+	case payload.KEM != "" || len(payload.KEMKey) > 0:
+		return ErrUnexpectedKEM
+	}
+
+	encKey, decKey, err := derive(shared, payload.Salt, cipher)
+	if err != nil {
+		return fmt.Errorf("key derivation failed: %w", err)
+	}
+
+	i.Mutex.Lock()
+	state.rekey = &rekey{sessionID: payload.SessionID, decKey: decKey, started: time.Now()}
+	i.Mutex.Unlock()
+
+	return i.announce(connection, state, func(peerID string, updateAtSeq uint64) message.Message {
+		return NewUpdateSessionResponseMessage(i.ID, peerID, pubKey, kemCiphertext, updateAtSeq)
+	}, encKey, payload.SessionID)
+}
+
+// UpdateSessionResponse answers a rekey request with the client's ephemeral
+// key. KEMCiphertext is the secret encapsulated to the KEMKey of a hybrid
+// session's request. UpdateAtSeq is the sequence number of the first message
+// the client encrypts with the new keys.
+type UpdateSessionResponse struct {
+	message.BaseMessage
+	PublicKey     PublicKey `json:"public_key"`
+	KEMCiphertext []byte    `json:"kem_ciphertext,omitempty"`
+	UpdateAtSeq   uint64    `json:"update_at_seq"`
+}
+
+// NewUpdateSessionResponseMessage creates a new rekey response
+func NewUpdateSessionResponseMessage(senderID, receiverID string, pubKey PublicKey, kemCiphertext []byte, updateAtSeq uint64) *UpdateSessionResponse {
+	return &UpdateSessionResponse{
+		BaseMessage: message.BaseMessage{
+			Header: message.Header{
+				SenderID:   senderID,
+				ReceiverID: receiverID,
+				Protocol:   message.NoneProtocol,
+			},
+			Payload: nil,
+		},
+		PublicKey:     pubKey,
+		KEMCiphertext: kemCiphertext,
+		UpdateAtSeq:   updateAtSeq,
+	}
+}
+
+// Validate checks if the rekey response contains valid data
+func (payload *UpdateSessionResponse) Validate() error {
+	if IsZero(payload.PublicKey) || payload.UpdateAtSeq == 0 {
+		return message.ErrorNotValid
+	}
+	return nil
+}
+
+func (payload *UpdateSessionResponse) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *UpdateSessionResponse) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+// Protocol returns the message protocol type
+func (payload *UpdateSessionResponse) Protocol() message.Protocol {
+	return ProtocolUpdateSessionResponse
+}
+
+// Process handles a rekey response on the server: it derives the new keys,
+// decrypts the client's messages from the announced sequence number on with
+// them and switches its own after announcing the cutover in UpdateSessionAck
+func (payload *UpdateSessionResponse) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
+	i, ok := _interceptor.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	if !i.isServer {
+		return errors.New("unexpected rekey response")
+	}
+
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	i.Mutex.Lock()
+	pending, cipher := state.rekey, state.cipher
+	state.rekey = nil
+	i.Mutex.Unlock()
+
+	if pending == nil {
+		return ErrNoRekey
+	}
+
+	shared, err := curve25519.X25519(pending.privKey[:], payload.PublicKey[:])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case pending.kemKey != nil && len(payload.KEMCiphertext) == 0:
+		return ErrMissingKEM
+	case pending.kemKey != nil:
+		kemShared, err := pending.kemKey.Decapsulate(payload.KEMCiphertext)
+		if err != nil {
+			return err
+		}
+		shared = hybridSecret(kemShared, shared)
+	case len(payload.KEMCiphertext) > 0:
+		return ErrUnexpectedKEM
+	}
+
+	// For responses, keys are reversed compared to the initiation
+	decKey, encKey, err := derive(shared, pending.salt, cipher) // NOTE: KEY REVERSED
+	if err != nil {
+		return err
+	}
+
+	if err := i.encryptorOf(state).RekeyReceive(decKey, pending.sessionID, payload.UpdateAtSeq, i.rekeyGrace); err != nil {
+		return err
+	}
+
+	if err := i.announce(connection, state, func(peerID string, updateAtSeq uint64) message.Message {
+		return NewUpdateSessionAckMessage(i.ID, peerID, updateAtSeq)
+	}, encKey, pending.sessionID); err != nil {
+		return err
+	}
+
+	state.rekeys.Add(1)
+	return nil
+}
+
+// UpdateSessionAck completes a rekey. UpdateAtSeq is the sequence number of
+// the first message the server encrypts with the new keys.
+type UpdateSessionAck struct {
+	message.BaseMessage
+	UpdateAtSeq uint64 `json:"update_at_seq"`
+}
+
+// NewUpdateSessionAckMessage creates a new rekey acknowledgment
+func NewUpdateSessionAckMessage(senderID, receiverID string, updateAtSeq uint64) *UpdateSessionAck {
+	return &UpdateSessionAck{
+		BaseMessage: message.BaseMessage{
+			Header: message.Header{
+				SenderID:   senderID,
+				ReceiverID: receiverID,
+				Protocol:   message.NoneProtocol,
+			},
+			Payload: nil,
+		},
+		UpdateAtSeq: updateAtSeq,
+	}
+}
+
+// Validate checks if the rekey acknowledgment contains valid data
+func (payload *UpdateSessionAck) Validate() error {
+	if payload.UpdateAtSeq == 0 {
+		return message.ErrorNotValid
+	}
+	return nil
+}
+
+func (payload *UpdateSessionAck) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *UpdateSessionAck) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+// Protocol returns the message protocol type
+func (payload *UpdateSessionAck) Protocol() message.Protocol {
+	return ProtocolUpdateSessionAck
+}
+
+// Process handles a rekey acknowledgment on the client: the server's messages
+// from the announced sequence number on are decrypted with the new keys
+func (payload *UpdateSessionAck) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
+	i, ok := _interceptor.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	if i.isServer {
+		return ErrInvalidServerRequest
+	}
+
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	i.Mutex.Lock()
+	pending := state.rekey
+	state.rekey = nil
+	i.Mutex.Unlock()
+
+	if pending == nil {
+		return ErrNoRekey
+	}
+
+	if err := i.encryptorOf(state).RekeyReceive(pending.decKey, pending.sessionID, payload.UpdateAtSeq, i.rekeyGrace); err != nil {
+		return err
+	}
+
+	state.rekeys.Add(1)
+	return nil
+}
+
+// NoiseHandshake carries a message of the Noise handshake replacing the signed
+// key exchange, see WithNoise. The client names the pattern and the transport
+// cipher in the first message.
+type NoiseHandshake struct {
+	message.BaseMessage
+	Pattern NoisePattern `json:"pattern,omitempty"`
+	Cipher  Cipher       `json:"cipher,omitempty"`
+	Data    []byte       `json:"data"`
+}
+
+// NewNoiseHandshakeMessage creates a new Noise handshake message
+func NewNoiseHandshakeMessage(senderID, receiverID string, pattern NoisePattern, cipher Cipher, data []byte) *NoiseHandshake {
+	return &NoiseHandshake{
+		BaseMessage: message.BaseMessage{
+			Header: message.Header{
+				SenderID:   senderID,
+				ReceiverID: receiverID,
+				Protocol:   message.NoneProtocol,
+			},
+			Payload: nil,
+		},
+		Pattern: pattern,
+		Cipher:  cipher,
+		Data:    data,
+	}
+}
+
+// Validate checks if the handshake message carries data
+func (payload *NoiseHandshake) Validate() error {
+	if len(payload.Data) == 0 {
+		return message.ErrorNotValid
+	}
+	return nil
+}
+
+func (payload *NoiseHandshake) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *NoiseHandshake) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+// Protocol returns the message protocol type
+func (payload *NoiseHandshake) Protocol() message.Protocol {
+	return ProtocolNoiseHandshake
+}
+
+// Process advances the Noise handshake of the connection, answering with the
+// next handshake message and installing the keys once it is complete
+func (payload *NoiseHandshake) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
+	i, ok := _interceptor.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	if i.noisePattern == "" {
+		return fmt.Errorf("%w: noise handshake not enabled", ErrNoiseHandshake)
+	}
+
+	state, err := i.getState(connection)
+	if err != nil {
+		return err
+	}
+
+	if err := i.continueNoise(connection, state, payload); err != nil {
+		state.failInit(err)
+		return err
+	}
 
 	return nil
 }
@@ -0,0 +1,612 @@
+package encrypt
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/coder/websocket"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// NoisePattern names a handshake pattern of the Noise Protocol Framework
+// (https://noiseprotocol.org/noise.html) supported by the interceptor. The
+// client is the initiator, the server the responder.
+type NoisePattern string
+
+const (
+	// NoiseXX exchanges both static keys during the handshake, encrypted, so
+	// that neither side needs to know the other in advance. The client only
+	// reveals its identity to a server whose static key it verified.
+	NoiseXX NoisePattern = "XX"
+	// NoiseIK requires the client to know the static key of the server in
+	// advance and saves a round trip. The client's identity is encrypted to
+	// the server's static key.
+	NoiseIK NoisePattern = "IK"
+)
+
+var (
+	ErrNoiseHandshake      = errors.New("noise handshake failed")
+	ErrUnsupportedPattern  = errors.New("unsupported noise pattern")
+	ErrUntrustedPeer       = errors.New("untrusted peer static key")
+	ErrNoiseMessageTooLong = errors.New("noise message exceeds 65535 bytes")
+	ErrNoPeerKey           = errors.New("no peer static key")
+)
+
+// PeerVerifier decides whether the static key a peer authenticated with in a
+// Noise handshake is trusted, returning an error otherwise
+type PeerVerifier func(connection interceptor.Connection, key PublicKey) error
+
+// TrustedPeers returns a PeerVerifier accepting the given static keys only
+func TrustedPeers(keys ...PublicKey) PeerVerifier {
+	trusted := slices.Clone(keys)
+	return func(_ interceptor.Connection, key PublicKey) error {
+		if !slices.Contains(trusted, key) {
+			return fmt.Errorf("%w: %x", ErrUntrustedPeer, key)
+		}
+		return nil
+	}
+}
+
+// noiseToken is a token of a Noise message pattern
+type noiseToken int
+
+const (
+	tokenE noiseToken = iota
+	tokenS
+	tokenEE
+	tokenES
+	tokenSE
+	tokenSS
+)
+
+// noisePattern is a handshake pattern. A responder static pre-message means
+// the initiator knows the responder's static key before the handshake.
+type noisePattern struct {
+	responderStatic bool
+	messages        [][]noiseToken
+}
+
+var noisePatterns = map[NoisePattern]noisePattern{
+	NoiseXX: {
+		messages: [][]noiseToken{
+			{tokenE},
+			{tokenE, tokenEE, tokenS, tokenES},
+			{tokenS, tokenSE},
+		},
+	},
+	NoiseIK: {
+		responderStatic: true,
+		messages: [][]noiseToken{
+			{tokenE, tokenES, tokenS, tokenSS},
+			{tokenE, tokenEE, tokenSE},
+		},
+	},
+}
+
+// noiseCipher is a Noise cipher function
+type noiseCipher struct {
+	name   string
+	create func(key []byte) (cipher.AEAD, error)
+	nonce  func(n uint64) []byte
+}
+
+var (
+	noiseAESGCM = &noiseCipher{
+		name:   "AESGCM",
+		create: newAESGCM,
+		nonce: func(n uint64) []byte {
+			nonce := make([]byte, 12)
+			binary.BigEndian.PutUint64(nonce[4:], n)
+			return nonce
+		},
+	}
+	noiseChaChaPoly = &noiseCipher{
+		name:   "ChaChaPoly",
+		create: chacha20poly1305.New,
+		nonce: func(n uint64) []byte {
+			nonce := make([]byte, 12)
+			binary.LittleEndian.PutUint64(nonce[4:], n)
+			return nonce
+		},
+	}
+)
+
+// noiseCiphers maps the transport ciphers to the cipher function of the
+// handshake. XChaCha20-Poly1305 has no Noise cipher function; handshakes for
+// it use ChaChaPoly.
+var noiseCiphers = map[Cipher]*noiseCipher{
+	CipherAES256GCM:         noiseAESGCM,
+	CipherChaCha20Poly1305:  noiseChaChaPoly,
+	CipherXChaCha20Poly1305: noiseChaChaPoly,
+}
+
+// noiseProtocolName returns the Noise protocol name of a handshake
+func noiseProtocolName(pattern NoisePattern, suite *noiseCipher) string {
+	return "Noise_" + string(pattern) + "_25519_" + suite.name + "_SHA256"
+}
+
+// noiseCipherState is the CipherState of the Noise specification
+type noiseCipherState struct {
+	suite *noiseCipher
+	aead  cipher.AEAD
+	n     uint64
+}
+
+func (cs *noiseCipherState) initializeKey(k []byte) error {
+	aead, err := cs.suite.create(k)
+	if err != nil {
+		return err
+	}
+
+	cs.aead, cs.n = aead, 0
+	return nil
+}
+
+func (cs *noiseCipherState) encryptWithAd(ad, plaintext []byte) []byte {
+	if cs.aead == nil {
+		return append([]byte(nil), plaintext...)
+	}
+
+	ciphertext := cs.aead.Seal(nil, cs.suite.nonce(cs.n), plaintext, ad)
+	cs.n++
+	return ciphertext
+}
+
+func (cs *noiseCipherState) decryptWithAd(ad, ciphertext []byte) ([]byte, error) {
+	if cs.aead == nil {
+		return append([]byte(nil), ciphertext...), nil
+	}
+
+	plaintext, err := cs.aead.Open(nil, cs.suite.nonce(cs.n), ciphertext, ad)
+	if err != nil {
+		return nil, ErrNoiseHandshake
+	}
+	cs.n++
+	return plaintext, nil
+}
+
+// noiseSymmetricState is the SymmetricState of the Noise specification, with
+// SHA-256 as hash function
+type noiseSymmetricState struct {
+	cs noiseCipherState
+	ck [sha256.Size]byte
+	h  [sha256.Size]byte
+}
+
+func (ss *noiseSymmetricState) initializeSymmetric(suite *noiseCipher, protocolName string) {
+	if len(protocolName) <= sha256.Size {
+		copy(ss.h[:], protocolName)
+	} else {
+		ss.h = sha256.Sum256([]byte(protocolName))
+	}
+	ss.ck = ss.h
+	ss.cs = noiseCipherState{suite: suite}
+}
+
+func (ss *noiseSymmetricState) mixKey(ikm []byte) error {
+	ck, k := noiseHKDF(ss.ck[:], ikm)
+	copy(ss.ck[:], ck)
+	return ss.cs.initializeKey(k)
+}
+
+func (ss *noiseSymmetricState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(ss.h[:])
+	hash.Write(data)
+	hash.Sum(ss.h[:0])
+}
+
+func (ss *noiseSymmetricState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := ss.cs.encryptWithAd(ss.h[:], plaintext)
+	ss.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (ss *noiseSymmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := ss.cs.decryptWithAd(ss.h[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the keys of the initiator's and of the responder's messages
+func (ss *noiseSymmetricState) split() (key, key) {
+	var k1, k2 key
+	out1, out2 := noiseHKDF(ss.ck[:], nil)
+	copy(k1[:], out1)
+	copy(k2[:], out2)
+	return k1, k2
+}
+
+// noiseHKDF is the HKDF function of the Noise specification with two outputs
+func noiseHKDF(chainingKey, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainingKey)
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write([]byte{0x01})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write(out1)
+	mac.Write([]byte{0x02})
+	out2 := mac.Sum(nil)
+
+	return out1, out2
+}
+
+// noiseHandshake is the HandshakeState of the Noise specification for the
+// patterns in noisePatterns, with Curve25519 as DH function
+type noiseHandshake struct {
+	noiseSymmetricState
+	pattern   noisePattern
+	initiator bool
+	s         PrivateKey
+	e         PrivateKey
+	rs        PublicKey
+	re        PublicKey
+	hasRS     bool
+	index     int       // Next message of the pattern
+	random    io.Reader // Source of the ephemeral key
+}
+
+// newNoiseHandshake starts a handshake. remoteStatic is the responder's
+// static key, which initiators of patterns with a responder pre-message must
+// know.
+func newNoiseHandshake(pattern NoisePattern, suite *noiseCipher, initiator bool, prologue []byte, static PrivateKey, remoteStatic *PublicKey, random io.Reader) (*noiseHandshake, error) {
+	p, ok := noisePatterns[pattern]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedPattern, pattern)
+	}
+
+	hs := &noiseHandshake{pattern: p, initiator: initiator, s: static, random: random}
+	hs.initializeSymmetric(suite, noiseProtocolName(pattern, suite))
+	hs.mixHash(prologue)
+
+	if p.responderStatic {
+		if initiator {
+			if remoteStatic == nil {
+				return nil, errors.New("noise pattern requires the responder static key")
+			}
+			hs.rs, hs.hasRS = *remoteStatic, true
+			hs.mixHash(hs.rs[:])
+		} else {
+			pub := static.Public()
+			hs.mixHash(pub[:])
+		}
+	}
+
+	return hs, nil
+}
+
+// complete reports whether all messages of the pattern were processed
+func (hs *noiseHandshake) complete() bool {
+	return hs.index >= len(hs.pattern.messages)
+}
+
+// writing reports whether the next message is written by this side
+func (hs *noiseHandshake) writing() bool {
+	return (hs.index%2 == 0) == hs.initiator
+}
+
+func (hs *noiseHandshake) dh(private PrivateKey, public PublicKey) ([]byte, error) {
+	shared, err := curve25519.X25519(private[:], public[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoiseHandshake, err)
+	}
+	return shared, nil
+}
+
+// mixDH mixes the DH of a token into the chaining key, from this side's
+// point of view
+func (hs *noiseHandshake) mixDH(token noiseToken) error {
+	var (
+		private PrivateKey
+		public  PublicKey
+	)
+	switch token {
+	case tokenEE:
+		private, public = hs.e, hs.re
+	case tokenES:
+		if hs.initiator {
+			private, public = hs.e, hs.rs
+		} else {
+			private, public = hs.s, hs.re
+		}
+	case tokenSE:
+		if hs.initiator {
+			private, public = hs.s, hs.re
+		} else {
+			private, public = hs.e, hs.rs
+		}
+	case tokenSS:
+		private, public = hs.s, hs.rs
+	}
+
+	shared, err := hs.dh(private, public)
+	if err != nil {
+		return err
+	}
+	return hs.mixKey(shared)
+}
+
+// writeMessage writes the next handshake message carrying payload
+func (hs *noiseHandshake) writeMessage(payload []byte) ([]byte, error) {
+	if hs.complete() || !hs.writing() {
+		return nil, fmt.Errorf("%w: unexpected message", ErrNoiseHandshake)
+	}
+
+	var message []byte
+	for _, token := range hs.pattern.messages[hs.index] {
+		switch token {
+		case tokenE:
+			if _, err := io.ReadFull(hs.random, hs.e[:]); err != nil {
+				return nil, err
+			}
+			pub := hs.e.Public()
+			message = append(message, pub[:]...)
+			hs.mixHash(pub[:])
+		case tokenS:
+			pub := hs.s.Public()
+			message = append(message, hs.encryptAndHash(pub[:])...)
+		default:
+			if err := hs.mixDH(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	message = append(message, hs.encryptAndHash(payload)...)
+	if len(message) > 65535 {
+		return nil, ErrNoiseMessageTooLong
+	}
+
+	hs.index++
+	return message, nil
+}
+
+// readMessage reads the next handshake message and returns its payload
+func (hs *noiseHandshake) readMessage(message []byte) ([]byte, error) {
+	if hs.complete() || hs.writing() {
+		return nil, fmt.Errorf("%w: unexpected message", ErrNoiseHandshake)
+	}
+	if len(message) > 65535 {
+		return nil, ErrNoiseMessageTooLong
+	}
+
+	for _, token := range hs.pattern.messages[hs.index] {
+		switch token {
+		case tokenE:
+			if len(message) < len(hs.re) {
+				return nil, fmt.Errorf("%w: short message", ErrNoiseHandshake)
+			}
+			copy(hs.re[:], message)
+			message = message[len(hs.re):]
+			hs.mixHash(hs.re[:])
+		case tokenS:
+			size := len(hs.rs)
+			if hs.cs.aead != nil {
+				size += hs.cs.aead.Overhead()
+			}
+			if len(message) < size {
+				return nil, fmt.Errorf("%w: short message", ErrNoiseHandshake)
+			}
+			rs, err := hs.decryptAndHash(message[:size])
+			if err != nil {
+				return nil, err
+			}
+			copy(hs.rs[:], rs)
+			hs.hasRS = true
+			message = message[size:]
+		default:
+			if err := hs.mixDH(token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	payload, err := hs.decryptAndHash(message)
+	if err != nil {
+		return nil, err
+	}
+
+	hs.index++
+	return payload, nil
+}
+
+// keys returns the keys this side encrypts and decrypts with once the
+// handshake is complete
+func (hs *noiseHandshake) keys() (encKey, decKey key) {
+	initiatorKey, responderKey := hs.split()
+	if hs.initiator {
+		return initiatorKey, responderKey
+	}
+	return responderKey, initiatorKey
+}
+
+// Public returns the X25519 public key of the private key
+func (key PrivateKey) Public() PublicKey {
+	var pub PublicKey
+	curve25519.ScalarBaseMult((*[32]byte)(&pub), (*[32]byte)(&key))
+	return pub
+}
+
+// noiseSession is the Noise handshake of a connection in progress
+type noiseSession struct {
+	*noiseHandshake
+	cipher Cipher // Transport cipher chosen by the client
+}
+
+// newNoiseSession starts the handshake of a connection. The prologue binds
+// the handshake to this protocol and to the transport cipher, so that the
+// cipher cannot be downgraded.
+func (i *Interceptor) newNoiseSession(name Cipher, initiator bool) (*noiseSession, error) {
+	suite, ok := noiseCiphers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedCipher, name)
+	}
+
+	prologue := kdfInfo + "\x00noise\x00" + string(name)
+	hs, err := newNoiseHandshake(i.noisePattern, suite, initiator, []byte(prologue), i.noiseStatic, i.noiseServerKey, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &noiseSession{noiseHandshake: hs, cipher: name}, nil
+}
+
+// initiateNoise sends the first handshake message on the client, proposing
+// its most preferred cipher
+func (i *Interceptor) initiateNoise(connection interceptor.Connection, state *state) error {
+	name := i.ciphers[0]
+	session, err := i.newNoiseSession(name, true)
+	if err != nil {
+		return err
+	}
+
+	data, err := session.writeMessage(nil)
+	if err != nil {
+		return err
+	}
+
+	i.Mutex.Lock()
+	state.noise = session
+	peerID := state.peerID
+	i.Mutex.Unlock()
+
+	msg, err := message.CreateMessage(i.ID, peerID, NewNoiseHandshakeMessage(i.ID, peerID, i.noisePattern, name, data))
+	if err != nil {
+		return err
+	}
+
+	return state.writer.Write(connection, websocket.MessageText, msg)
+}
+
+// continueNoise reads a handshake message, verifies the peer's static key as
+// soon as it is known, answers with the next message if it is this side's
+// turn and installs the keys once the handshake is complete. The handshake
+// runs on the reader of the connection, except for the client's first
+// message, which precedes any answer.
+func (i *Interceptor) continueNoise(connection interceptor.Connection, state *state, payload *NoiseHandshake) error {
+	i.Mutex.Lock()
+	session := state.noise
+	// The server answers the first handshake of the connection only
+	if session == nil && i.isServer && state.cipher == "" {
+		if payload.Pattern != i.noisePattern {
+			i.Mutex.Unlock()
+			return fmt.Errorf("%w: %q", ErrUnsupportedPattern, payload.Pattern)
+		}
+		if !slices.Contains(i.ciphers, payload.Cipher) {
+			i.Mutex.Unlock()
+			return fmt.Errorf("%w: %q", ErrUnsupportedCipher, payload.Cipher)
+		}
+
+		var err error
+		if session, err = i.newNoiseSession(payload.Cipher, false); err != nil {
+			i.Mutex.Unlock()
+			return err
+		}
+		state.noise = session
+	}
+	if session != nil {
+		state.peerID = interceptor.SenderOf(connection, payload)
+	}
+	peerID := state.peerID
+	i.Mutex.Unlock()
+
+	if session == nil || session.complete() {
+		return fmt.Errorf("%w: unexpected message", ErrNoiseHandshake)
+	}
+
+	known := session.hasRS
+	if _, err := session.readMessage(payload.Data); err != nil {
+		return err
+	}
+	if session.hasRS && !known {
+		if err := i.verifyNoisePeer(connection, session.rs); err != nil {
+			return err
+		}
+	}
+
+	if !session.complete() {
+		data, err := session.writeMessage(nil)
+		if err != nil {
+			return err
+		}
+
+		msg, err := message.CreateMessage(i.ID, peerID, NewNoiseHandshakeMessage(i.ID, peerID, "", "", data))
+		if err != nil {
+			return err
+		}
+		if err := state.writer.Write(connection, websocket.MessageText, msg); err != nil {
+			return err
+		}
+	}
+
+	if !session.complete() {
+		return nil
+	}
+
+	// The session ID is taken from the handshake hash, which both sides share
+	var sessionID SessionID
+	copy(sessionID[:], session.h[:])
+
+	encKey, decKey := session.keys()
+	if err := i.useEncryptor(state, session.cipher, encKey, decKey, sessionID); err != nil {
+		return err
+	}
+
+	i.Mutex.Lock()
+	state.peerKey = session.rs
+	state.noise = nil
+	i.Mutex.Unlock()
+
+	state.markInitDone()
+	return nil
+}
+
+// verifyNoisePeer checks the static key of the peer: clients configured with
+// the server's static key only accept that one, otherwise the peer verifier
+// decides
+func (i *Interceptor) verifyNoisePeer(connection interceptor.Connection, key PublicKey) error {
+	if !i.isServer && i.noiseServerKey != nil {
+		if key != *i.noiseServerKey {
+			return fmt.Errorf("%w: %x", ErrUntrustedPeer, key)
+		}
+		return nil
+	}
+
+	return i.verifyPeer(connection, key)
+}
+
+// PeerKey returns the static key the peer authenticated with in the Noise
+// handshake of the connection
+func (i *Interceptor) PeerKey(connection interceptor.Connection) (PublicKey, error) {
+	state, err := i.getState(connection)
+	if err != nil {
+		return PublicKey{}, err
+	}
+
+	i.Mutex.RLock()
+	defer i.Mutex.RUnlock()
+
+	if IsZero(state.peerKey) {
+		return PublicKey{}, ErrNoPeerKey
+	}
+	return state.peerKey, nil
+}
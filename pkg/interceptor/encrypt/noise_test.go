@@ -0,0 +1,272 @@
+package encrypt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/interceptortest"
+)
+
+type noiseVector struct {
+	name       string
+	prologue   []byte
+	initStatic PrivateKey
+	respStatic PrivateKey
+	initEph    []byte
+	respEph    []byte
+	payloads   [][]byte
+	ciphertext [][]byte
+}
+
+func readNoiseVectors(t *testing.T) []*noiseVector {
+	t.Helper()
+
+	file, err := os.Open("testdata/noise_vectors.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	var (
+		vectors []*noiseVector
+		vector  *noiseVector
+	)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, "=")
+		data, err := hex.DecodeString(value)
+		if field != "handshake" && err != nil {
+			t.Fatalf("invalid hex in %q: %v", line, err)
+		}
+
+		switch {
+		case field == "handshake":
+			vector = &noiseVector{name: value}
+			vectors = append(vectors, vector)
+		case field == "prologue":
+			vector.prologue = data
+		case field == "init_static":
+			copy(vector.initStatic[:], data)
+		case field == "resp_static":
+			copy(vector.respStatic[:], data)
+		case field == "gen_init_ephemeral":
+			vector.initEph = data
+		case field == "gen_resp_ephemeral":
+			vector.respEph = data
+		case strings.HasSuffix(field, "_payload"):
+			vector.payloads = append(vector.payloads, data)
+		case strings.HasSuffix(field, "_ciphertext"):
+			vector.ciphertext = append(vector.ciphertext, data)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("reading vectors failed: %v", err)
+	}
+
+	return vectors
+}
+
+func TestNoiseVectors(t *testing.T) {
+	vectors := readNoiseVectors(t)
+	if len(vectors) == 0 {
+		t.Fatal("no test vectors")
+	}
+
+	for _, vector := range vectors {
+		parts := strings.Split(vector.name, "_")
+		pattern := NoisePattern(parts[1])
+		suite := noiseAESGCM
+		if parts[3] == noiseChaChaPoly.name {
+			suite = noiseChaChaPoly
+		}
+		if name := noiseProtocolName(pattern, suite); name != vector.name {
+			t.Fatalf("protocol name mismatch: got %v, want %v", name, vector.name)
+		}
+
+		respPub := vector.respStatic.Public()
+		initiator, err := newNoiseHandshake(pattern, suite, true, vector.prologue, vector.initStatic, &respPub, bytes.NewReader(vector.initEph))
+		if err != nil {
+			t.Fatalf("%s: newNoiseHandshake failed: %v", vector.name, err)
+		}
+		responder, err := newNoiseHandshake(pattern, suite, false, vector.prologue, vector.respStatic, nil, bytes.NewReader(vector.respEph))
+		if err != nil {
+			t.Fatalf("%s: newNoiseHandshake failed: %v", vector.name, err)
+		}
+
+		var transport [2][2]noiseCipherState // Per side: initiator's and responder's messages
+		for n, payload := range vector.payloads {
+			var ciphertext []byte
+			if !initiator.complete() {
+				writer, reader := initiator, responder
+				if n%2 == 1 {
+					writer, reader = responder, initiator
+				}
+
+				if ciphertext, err = writer.writeMessage(payload); err != nil {
+					t.Fatalf("%s: message %d: writeMessage failed: %v", vector.name, n, err)
+				}
+				read, err := reader.readMessage(ciphertext)
+				if err != nil || !bytes.Equal(read, payload) {
+					t.Fatalf("%s: message %d: readMessage failed: %v", vector.name, n, err)
+				}
+
+				if initiator.complete() {
+					for side, hs := range []*noiseHandshake{initiator, responder} {
+						k1, k2 := hs.split()
+						transport[side][0] = noiseCipherState{suite: suite}
+						transport[side][1] = noiseCipherState{suite: suite}
+						_ = transport[side][0].initializeKey(k1[:])
+						_ = transport[side][1].initializeKey(k2[:])
+					}
+					if initiator.h != responder.h {
+						t.Fatalf("%s: handshake hash mismatch", vector.name)
+					}
+				}
+			} else {
+				// Transport messages alternate between the two keys, starting
+				// with the initiator's
+				direction := (n - len(initiator.pattern.messages)) % 2
+				ciphertext = transport[direction][direction].encryptWithAd(nil, payload)
+				read, err := transport[1-direction][direction].decryptWithAd(nil, ciphertext)
+				if err != nil || !bytes.Equal(read, payload) {
+					t.Fatalf("%s: message %d: decryptWithAd failed: %v", vector.name, n, err)
+				}
+			}
+
+			if !bytes.Equal(ciphertext, vector.ciphertext[n]) {
+				t.Fatalf("%s: message %d mismatch: got %x, want %x", vector.name, n, ciphertext, vector.ciphertext[n])
+			}
+		}
+	}
+}
+
+func staticKey(t *testing.T) PrivateKey {
+	t.Helper()
+
+	var key PrivateKey
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	return key
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	serverKey, clientKey := staticKey(t), staticKey(t)
+
+	tests := []struct {
+		name   string
+		server []Option
+		client []Option
+		cipher Cipher
+	}{
+		{
+			name:   "XX",
+			server: []Option{WithNoise(NoiseXX, serverKey), WithPeerVerifier(TrustedPeers(clientKey.Public()))},
+			client: []Option{WithNoise(NoiseXX, clientKey), WithPeerVerifier(TrustedPeers(serverKey.Public()))},
+			cipher: CipherAES256GCM,
+		},
+		{
+			name:   "XX with server key",
+			server: []Option{WithNoise(NoiseXX, serverKey), WithPeerVerifier(TrustedPeers(clientKey.Public()))},
+			client: []Option{WithNoise(NoiseXX, clientKey), WithNoiseServerKey(serverKey.Public()), WithCiphers(CipherXChaCha20Poly1305)},
+			cipher: CipherXChaCha20Poly1305,
+		},
+		{
+			name:   "IK",
+			server: []Option{WithNoise(NoiseIK, serverKey), WithPeerVerifier(TrustedPeers(clientKey.Public()))},
+			client: []Option{WithNoise(NoiseIK, clientKey), WithNoiseServerKey(serverKey.Public()), WithCiphers(CipherChaCha20Poly1305)},
+			cipher: CipherChaCha20Poly1305,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := create(t, append(tt.server, WithServer)...)
+			client := create(t, tt.client...)
+			s, c := interceptortest.Connect(t, server, client)
+
+			if serverErr, clientErr := handshake(server, client, s, c); serverErr != nil || clientErr != nil {
+				t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+			}
+
+			if key, err := server.PeerKey(s.Conn); err != nil || key != clientKey.Public() {
+				t.Errorf("client key mismatch: got %x, want %x (%v)", key, clientKey.Public(), err)
+			}
+			if key, err := client.PeerKey(c.Conn); err != nil || key != serverKey.Public() {
+				t.Errorf("server key mismatch: got %x, want %x (%v)", key, serverKey.Public(), err)
+			}
+
+			state, _ := server.getState(s.Conn)
+			if state.cipher != tt.cipher {
+				t.Errorf("cipher mismatch: got %q, want %q", state.cipher, tt.cipher)
+			}
+
+			roundTrip(t, s, c)
+		})
+	}
+}
+
+func TestNoiseHandshake_UntrustedPeer(t *testing.T) {
+	serverKey, clientKey := staticKey(t), staticKey(t)
+
+	// The client rejects the server before sending its static key
+	server := create(t, WithServer, WithNoise(NoiseXX, serverKey), WithPeerVerifier(TrustedPeers(clientKey.Public())))
+	client := create(t, WithNoise(NoiseXX, clientKey), WithNoiseServerKey(staticKey(t).Public()))
+	s, c := interceptortest.Connect(t, server, client)
+
+	// The server waits for the answer the client refused to give
+	serverErr, clientErr := handshake(server, client, s, c)
+	if !errors.Is(clientErr, ErrUntrustedPeer) || !errors.Is(serverErr, ErrInitializationTimeout) {
+		t.Fatalf("expected ErrUntrustedPeer and a server timeout, got server %v, client %v", serverErr, clientErr)
+	}
+	if _, err := server.PeerKey(s.Conn); !errors.Is(err, ErrNoPeerKey) {
+		t.Errorf("expected ErrNoPeerKey, got %v", err)
+	}
+}
+
+func TestNoiseHandshake_UnsupportedPattern(t *testing.T) {
+	serverKey := staticKey(t)
+
+	server := create(t, WithServer, WithNoise(NoiseIK, serverKey), WithPeerVerifier(TrustedPeers()))
+	client := create(t, WithNoise(NoiseXX, staticKey(t)), WithNoiseServerKey(serverKey.Public()))
+	s, c := interceptortest.Connect(t, server, client)
+
+	// The client waits for the answer the server refused to give
+	serverErr, clientErr := handshake(server, client, s, c)
+	if !errors.Is(serverErr, ErrUnsupportedPattern) || !errors.Is(clientErr, ErrInitializationTimeout) {
+		t.Fatalf("expected ErrUnsupportedPattern and a client timeout, got server %v, client %v", serverErr, clientErr)
+	}
+}
+
+func TestNewInterceptor_Noise(t *testing.T) {
+	key := staticKey(t)
+
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{name: "unknown pattern", options: []Option{WithNoise("NN", key)}},
+		{name: "zero static key", options: []Option{WithNoise(NoiseXX, PrivateKey{})}},
+		{name: "no verifier", options: []Option{WithServer, WithNoise(NoiseXX, key)}},
+		{name: "IK without server key", options: []Option{WithNoise(NoiseIK, key), WithPeerVerifier(TrustedPeers())}},
+	}
+
+	for _, tt := range tests {
+		if _, err := CreateInterceptorFactory(tt.options...).NewInterceptor(context.Background(), "test"); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
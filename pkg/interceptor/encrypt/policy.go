@@ -0,0 +1,145 @@
+package encrypt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+	"github.com/harshabose/skyline_sonata/serve/pkg/utils"
+)
+
+// Policy decides what happens to application messages that cannot be
+// encrypted, and whether application messages received in the clear are
+// accepted. Key exchange messages travel in the clear under every policy.
+type Policy int
+
+const (
+	// PolicyPermissive writes messages in the clear while the key exchange
+	// is not complete or when encrypting them fails, and accepts messages
+	// received in the clear. It is the default.
+	PolicyPermissive Policy = iota
+	// PolicyQueue holds messages written before the key exchange completed
+	// back and writes them encrypted, in order, once it did. Messages
+	// received in the clear are rejected once the keys are in place.
+	PolicyQueue
+	// PolicyStrict drops messages that cannot be encrypted with
+	// ErrNotEncrypted and rejects all messages received in the clear.
+	PolicyStrict
+)
+
+// maxQueued bounds the messages held back per connection under PolicyQueue
+const maxQueued = 256
+
+var (
+	ErrNotEncrypted = errors.New("message not encrypted")
+	ErrQueueFull    = errors.New("too many messages queued for the key exchange")
+)
+
+// queued is a message held back until the key exchange completes
+type queued struct {
+	writer      interceptor.Writer
+	messageType websocket.MessageType
+	message     message.Message
+}
+
+// enqueue holds the message back unless the queue was flushed already, and
+// reports whether it did
+func (state *state) enqueue(writer interceptor.Writer, messageType websocket.MessageType, m message.Message) (bool, error) {
+	state.queueMux.Lock()
+	defer state.queueMux.Unlock()
+
+	if state.flushed {
+		return false, nil
+	}
+	if len(state.queue) >= maxQueued {
+		return false, ErrQueueFull
+	}
+
+	state.queue = append(state.queue, queued{writer: writer, messageType: messageType, message: m})
+	return true, nil
+}
+
+// discard drops the messages held back, when the key exchange failed
+func (state *state) discard() {
+	state.queueMux.Lock()
+	defer state.queueMux.Unlock()
+
+	state.queue = nil
+}
+
+// flush writes the messages held back during the key exchange. Messages
+// written meanwhile are queued behind them, so that the order is kept until
+// the queue is empty.
+func (i *Interceptor) flush(connection interceptor.Connection, state *state) error {
+	var merr = utils.NewMultiError()
+	for {
+		state.queueMux.Lock()
+		if len(state.queue) == 0 {
+			state.flushed = true
+			state.queueMux.Unlock()
+			return merr.ErrorOrNil()
+		}
+		next := state.queue[0]
+		state.queue = state.queue[1:]
+		state.queueMux.Unlock()
+
+		if err := i.writeEncrypted(connection, state, next.writer, next.messageType, next.message); err != nil {
+			_ = merr.Add(err)
+		}
+	}
+}
+
+// writeEncrypted encrypts the message and writes it. Messages that cannot be
+// encrypted are written in the clear under PolicyPermissive only.
+func (i *Interceptor) writeEncrypted(connection interceptor.Connection, state *state, writer interceptor.Writer, messageType websocket.MessageType, m message.Message) error {
+	state.writeMux.Lock()
+	defer state.writeMux.Unlock()
+
+	encryptor := i.encryptorOf(state)
+	if !encryptor.Ready() {
+		if i.policy != PolicyPermissive {
+			return fmt.Errorf("%w: %w", ErrNotEncrypted, ErrEncryptionNotReady)
+		}
+		return writer.Write(connection, messageType, m)
+	}
+
+	encrypted, err := encryptor.Encrypt(m.Message().SenderID, m.Message().ReceiverID, interceptor.CodecOf(connection), m)
+	if err != nil {
+		return i.writeUnencrypted(connection, writer, messageType, m, err)
+	}
+
+	msg, err := message.CreateMessage(m.Message().SenderID, m.Message().ReceiverID, encrypted)
+	if err != nil {
+		return i.writeUnencrypted(connection, writer, messageType, m, err)
+	}
+
+	state.encrypted.Add(1)
+	i.count(state, len(encrypted.Data))
+	return writer.Write(connection, messageType, msg)
+}
+
+// writeUnencrypted falls back to writing a message that failed to encrypt in
+// the clear under PolicyPermissive, and drops it otherwise
+func (i *Interceptor) writeUnencrypted(connection interceptor.Connection, writer interceptor.Writer, messageType websocket.MessageType, m message.Message, cause error) error {
+	if i.policy != PolicyPermissive {
+		return fmt.Errorf("%w: %w", ErrNotEncrypted, cause)
+	}
+	return writer.Write(connection, messageType, m)
+}
+
+// acceptClear checks an application message received in the clear against
+// the policy
+func (i *Interceptor) acceptClear(state *state) error {
+	switch i.policy {
+	case PolicyStrict:
+		return ErrNotEncrypted
+	case PolicyQueue:
+		if i.encryptorOf(state).Ready() {
+			return ErrNotEncrypted
+		}
+	}
+	return nil
+}
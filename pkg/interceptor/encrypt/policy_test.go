@@ -0,0 +1,107 @@
+package encrypt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/interceptortest"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// policyPair returns a server and client connected through a pipe, with the
+// policy applied to both
+func policyPair(t *testing.T, policy Policy) (*Interceptor, *Interceptor, *interceptortest.End, *interceptortest.End) {
+	t.Helper()
+
+	signing := generate(t)
+	server := create(t, WithServer, WithPolicy(policy), WithKeyProvider(NewMemoryKeyProvider(signing)))
+	client := create(t, WithPolicy(policy), WithKeyProvider(NewMemoryKeyProvider(nil, public(signing))))
+	s, c := interceptortest.Connect(t, server, client)
+
+	return server, client, s, c
+}
+
+// sendClear writes an application frame on the wire, bypassing the
+// interceptor
+func sendClear(t *testing.T, e *interceptortest.End) {
+	t.Helper()
+
+	data, err := message.Encode(message.JSON, message.CreateMessageFromData("client", "server", "app", []byte(`{"clear":true}`)))
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if err := e.Conn.Write(context.Background(), websocket.MessageText, data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func TestPolicy_Queue(t *testing.T) {
+	server, client, s, c := policyPair(t, PolicyQueue)
+
+	sent := message.CreateMessageFromData("client", "server", "app", []byte(`{"early":true}`))
+	if err := c.Writer.Write(c.Conn, websocket.MessageText, sent); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	if serverErr, clientErr := handshake(server, client, s, c); serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+
+	select {
+	case received := <-s.Received:
+		if string(received.Message().Payload) != `{"early":true}` {
+			t.Errorf("queued frame mismatch: got %+v", received.Message())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued message not received")
+	}
+	waitStats(t, server, s.Conn, Stats{Decrypted: 1})
+
+	sendClear(t, c)
+	waitStats(t, server, s.Conn, Stats{Decrypted: 1, Plaintext: 1})
+}
+
+func TestPolicy_Strict(t *testing.T) {
+	server, client, s, c := policyPair(t, PolicyStrict)
+
+	sent := message.CreateMessageFromData("client", "server", "app", []byte(`{"early":true}`))
+	if err := c.Writer.Write(c.Conn, websocket.MessageText, sent); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("expected ErrNotEncrypted, got %v", err)
+	}
+
+	if serverErr, clientErr := handshake(server, client, s, c); serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+
+	sendClear(t, c)
+	waitStats(t, server, s.Conn, Stats{Plaintext: 1})
+
+	roundTrip(t, s, c)
+	select {
+	case received := <-s.Received:
+		t.Errorf("clear frame delivered: %+v", received.Message())
+	default:
+	}
+}
+
+func TestPolicy_Permissive(t *testing.T) {
+	server, client, s, c := policyPair(t, PolicyPermissive)
+
+	if serverErr, clientErr := handshake(server, client, s, c); serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+
+	sendClear(t, c)
+	select {
+	case received := <-s.Received:
+		if string(received.Message().Payload) != `{"clear":true}` {
+			t.Errorf("clear frame mismatch: got %+v", received.Message())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("clear message not received")
+	}
+}
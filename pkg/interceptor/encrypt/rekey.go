@@ -0,0 +1,184 @@
+package encrypt
+
+import (
+	"crypto/mlkem"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/coder/websocket"
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// rekeyTimeout is how long the server waits for the answer to a rekey request
+// before it starts over
+const rekeyTimeout = 10 * time.Second
+
+// rekey is a rekey in progress. The server keeps its ephemeral key until the
+// client answers; the client keeps its new receive key until the server
+// announces when it switches.
+type rekey struct {
+	privKey   PrivateKey
+	kemKey    *mlkem.DecapsulationKey768 // ML-KEM key offered for a hybrid session
+	salt      Salt
+	sessionID SessionID
+	decKey    key
+	started   time.Time
+}
+
+// Rekeying replaces the keys of an established session with keys from a fresh
+// X25519 exchange, combined with a fresh ML-KEM encapsulation in hybrid
+// sessions, so that keys recovered later do not expose earlier messages. The server starts it once the configured number of messages or
+// bytes went through the connection, or the interval elapsed:
+//
+//  1. the server sends UpdateSession with a fresh ephemeral key, salt and
+//     session ID, and a fresh ML-KEM encapsulation key in hybrid sessions
+//  2. the client derives the new keys and answers with UpdateSessionResponse,
+//     carrying its ephemeral key, the ciphertext of the secret it
+//     encapsulated, if any, and the sequence number from which its messages
+//     use the new keys
+//  3. the server derives the new keys and sends UpdateSessionAck, carrying the
+//     sequence number from which its messages use the new keys
+//
+// All three travel encrypted under the current keys, which authenticate the
+// new ones. Each announcement is the last message its sender encrypts with the
+// current keys; the receiver keeps decrypting messages numbered below the
+// announced sequence number with them for the grace period.
+
+// rekeyLoop starts the rekeys of a server connection until it is unbound
+func (i *Interceptor) rekeyLoop(connection interceptor.Connection, state *state) {
+	var ticks <-chan time.Time
+	if i.rekeyInterval > 0 {
+		ticker := time.NewTicker(i.rekeyInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		select {
+		case <-state.ctx.Done():
+			return
+		case <-ticks:
+		case <-state.rekeyNow:
+		}
+
+		if err := i.startRekey(connection, state); err != nil {
+			fmt.Println("error while rekeying:", err.Error())
+		}
+	}
+}
+
+// startRekey sends a rekey request unless one is already waiting for its
+// answer
+func (i *Interceptor) startRekey(connection interceptor.Connection, state *state) error {
+	pending := &rekey{started: time.Now()}
+	if _, err := io.ReadFull(rand.Reader, pending.privKey[:]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rand.Reader, pending.salt[:]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rand.Reader, pending.sessionID[:]); err != nil {
+		return err
+	}
+
+	var pubKey PublicKey
+	curve25519.ScalarBaseMult((*[32]byte)(&pubKey), (*[32]byte)(&pending.privKey))
+
+	i.Mutex.RLock()
+	hybrid := state.hybrid
+	i.Mutex.RUnlock()
+
+	var (
+		kem    KEM
+		kemKey []byte
+	)
+	if hybrid {
+		var err error
+		if pending.kemKey, err = mlkem.GenerateKey768(); err != nil {
+			return fmt.Errorf("failed to generate ML-KEM key: %w", err)
+		}
+		kem, kemKey = KEMMLKEM768, pending.kemKey.EncapsulationKey().Bytes()
+	}
+
+	i.Mutex.Lock()
+	if state.rekey != nil && time.Since(state.rekey.started) < rekeyTimeout {
+		i.Mutex.Unlock()
+		return nil
+	}
+	state.rekey = pending
+	peerID := state.peerID
+	i.Mutex.Unlock()
+
+	state.messagesSinceRekey.Store(0)
+	state.bytesSinceRekey.Store(0)
+
+	msg, err := message.CreateMessage(i.ID, peerID, NewUpdateSessionMessage(i.ID, peerID, pubKey, pending.salt, pending.sessionID, kem, kemKey))
+	if err != nil {
+		return err
+	}
+
+	// Rekey messages are encrypted by this interceptor's writer
+	return state.writer.Write(connection, websocket.MessageText, msg)
+}
+
+// announce sends the message created by create as the last message encrypted
+// with the current keys and encrypts the following ones with encKey under the
+// session ID sessionID. create receives the sequence number of the first
+// message encrypted with encKey. Holding the write lock of the connection
+// makes sure no other message is encrypted in between.
+func (i *Interceptor) announce(connection interceptor.Connection, state *state, create func(peerID string, updateAtSeq uint64) message.Message, encKey key, sessionID SessionID) error {
+	state.writeMux.Lock()
+	defer state.writeMux.Unlock()
+
+	i.Mutex.RLock()
+	peerID := state.peerID
+	i.Mutex.RUnlock()
+
+	encryptor := i.encryptorOf(state)
+
+	msg, err := message.CreateMessage(i.ID, peerID, create(peerID, encryptor.Sequence()+2))
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := encryptor.Encrypt(i.ID, peerID, interceptor.CodecOf(connection), msg)
+	if err != nil {
+		return err
+	}
+
+	envelope, err := message.CreateMessage(i.ID, peerID, encrypted)
+	if err != nil {
+		return err
+	}
+
+	// Encrypted messages pass this interceptor's writer unchanged
+	if err := state.writer.Write(connection, websocket.MessageText, envelope); err != nil {
+		return err
+	}
+	state.encrypted.Add(1)
+
+	return encryptor.RekeySend(encKey, sessionID)
+}
+
+// count records an encrypted message of size bytes and asks for a rekey on
+// the server once the configured limits are reached
+func (i *Interceptor) count(state *state, size int) {
+	if !i.isServer {
+		return
+	}
+
+	messages := state.messagesSinceRekey.Add(1)
+	bytes := state.bytesSinceRekey.Add(uint64(size))
+
+	if (i.rekeyMessages > 0 && messages >= i.rekeyMessages) || (i.rekeyBytes > 0 && bytes >= i.rekeyBytes) {
+		select {
+		case state.rekeyNow <- struct{}{}:
+		default:
+		}
+	}
+}
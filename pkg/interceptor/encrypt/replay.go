@@ -0,0 +1,50 @@
+package encrypt
+
+// replayWindowSize is the number of sequence numbers below the highest one
+// received that are still accepted, allowing for frames written concurrently
+// to reach the wire slightly out of order
+const replayWindowSize = 64
+
+// replayWindow tracks the sequence numbers received in a session, in the
+// manner of the IPsec anti-replay window: a bitmap of the sequence numbers
+// seen among the last replayWindowSize ones
+type replayWindow struct {
+	highest uint64
+	seen    uint64 // Bit n is set when highest-n was received
+}
+
+// check reports whether sequence was not received yet and is recent enough
+// to be tracked. It does not record the sequence number, which is only done
+// once the frame carrying it is authenticated.
+func (w *replayWindow) check(sequence uint64) bool {
+	if sequence == 0 {
+		return false
+	}
+	if sequence > w.highest {
+		return true
+	}
+
+	offset := w.highest - sequence
+	if offset >= replayWindowSize {
+		return false
+	}
+
+	return w.seen&(1<<offset) == 0
+}
+
+// accept records sequence as received
+func (w *replayWindow) accept(sequence uint64) {
+	if sequence > w.highest {
+		shift := sequence - w.highest
+		if shift >= replayWindowSize {
+			w.seen = 0
+		} else {
+			w.seen <<= shift
+		}
+		w.seen |= 1
+		w.highest = sequence
+		return
+	}
+
+	w.seen |= 1 << (w.highest - sequence)
+}
@@ -0,0 +1,37 @@
+package encrypt
+
+import "testing"
+
+func TestReplayWindow(t *testing.T) {
+	w := &replayWindow{}
+
+	steps := []struct {
+		sequence uint64
+		accepted bool
+	}{
+		{0, false},
+		{1, true},
+		{1, false},
+		{3, true},
+		{2, true},
+		{2, false},
+		{100, true},
+		{40, true},
+		{36, false}, // 64 below the highest
+		{3, false},
+		{100, false},
+		{1000, true},
+		{999, true},
+		{999, false},
+	}
+
+	for _, step := range steps {
+		accepted := w.check(step.sequence)
+		if accepted != step.accepted {
+			t.Errorf("sequence %d: accepted mismatch: got %v, want %v", step.sequence, accepted, step.accepted)
+		}
+		if accepted {
+			w.accept(step.sequence)
+		}
+	}
+}
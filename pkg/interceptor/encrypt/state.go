@@ -2,8 +2,11 @@ package encrypt
 
 import (
 	"context"
+	"crypto/mlkem"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
@@ -15,23 +18,86 @@ var (
 	ErrContextCanceled       = errors.New("operation canceled")
 )
 
+// Stats counts the encrypted messages of a connection
+type Stats struct {
+	Encrypted uint64 // Messages sent encrypted
+	Decrypted uint64 // Messages received and decrypted
+	Replayed  uint64 // Messages rejected as replayed or outside the replay window
+	Skewed    uint64 // Messages rejected for a timestamp off by more than the allowed clock skew
+	Invalid   uint64 // Messages rejected as malformed or failing authentication
+	Rekeys    uint64 // Rekeys completed
+	Plaintext uint64 // Messages received in the clear and rejected by the policy
+}
+
 type stats struct {
+	encrypted atomic.Uint64
+	decrypted atomic.Uint64
+	replayed  atomic.Uint64
+	skewed    atomic.Uint64
+	invalid   atomic.Uint64
+	rekeys    atomic.Uint64
+	plaintext atomic.Uint64
+
+	// Traffic since the last rekey, only counted on the server
+	messagesSinceRekey atomic.Uint64
+	bytesSinceRekey    atomic.Uint64
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		Encrypted: s.encrypted.Load(),
+		Decrypted: s.decrypted.Load(),
+		Replayed:  s.replayed.Load(),
+		Skewed:    s.skewed.Load(),
+		Invalid:   s.invalid.Load(),
+		Rekeys:    s.rekeys.Load(),
+		Plaintext: s.plaintext.Load(),
+	}
 }
 
 // state maintains the connection-specific encryption state
 type state struct {
 	stats
 	peerID    string
-	privKey   PrivateKey // THIS private key (not the peers')
-	salt      Salt       // Salt used for key derivation
-	encryptor Encryptor  // Encryption implementation
-	initDone  chan struct{}
+	privKey   PrivateKey                 // THIS private key (not the peers')
+	salt      Salt                       // Salt used for key derivation
+	sessionID SessionID                  // Session ID announced by the server
+	cipher    Cipher                     // Negotiated cipher, empty until the key exchange completes
+	hybrid    bool                       // Keys derived from the hybrid key exchange
+	kemKey    *mlkem.DecapsulationKey768 // ML-KEM key the server offered in Init
+	encryptor Encryptor                  // Encryption implementation
+	writeMux  sync.Mutex                 // Serialises encrypting and writing messages
+	queueMux  sync.Mutex                 // Guards queue and flushed
+	queue     []queued                   // Messages held back until the key exchange completes
+	flushed   bool                       // Set once the queue was written
+	rekey     *rekey                     // Rekey in progress; guarded by the interceptor mutex
+	noise     *noiseSession              // Noise handshake in progress
+	peerKey   PublicKey                  // Static key the peer authenticated with in the Noise handshake
+	rekeyNow  chan struct{}              // Asks the rekey loop for a rekey
+	initDone  chan struct{}              // closed once the key exchange completed
+	initOnce  sync.Once
+	initErr   error // Set if the key exchange failed, before initDone is closed
 	writer    interceptor.Writer
 	reader    interceptor.Reader
 	cancel    context.CancelFunc
 	ctx       context.Context
 }
 
+// markInitDone signals that the key exchange completed
+func (state *state) markInitDone() {
+	state.initOnce.Do(func() {
+		close(state.initDone)
+	})
+}
+
+// failInit ends the key exchange with err, returned by waitUntilInit
+func (state *state) failInit(err error) {
+	state.initOnce.Do(func() {
+		state.initErr = err
+		close(state.initDone)
+	})
+}
+
 // waitUntilInit blocks until encryption is initialized or times out
 func (state *state) waitUntilInit() error {
 	// Create a timeout context
@@ -40,8 +106,8 @@ func (state *state) waitUntilInit() error {
 
 	select {
 	case <-state.initDone:
-		// Encryption successfully initialized
-		return nil
+		// Encryption initialized, unless the key exchange failed
+		return state.initErr
 	case <-timeout.Done():
 		if errors.Is(timeout.Err(), context.DeadlineExceeded) {
 			return ErrInitializationTimeout
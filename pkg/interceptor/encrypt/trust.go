@@ -0,0 +1,238 @@
+package encrypt
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrKeyMismatch     = errors.New("peer key does not match the pinned key")
+	ErrUnknownPeer     = errors.New("no key pinned for peer")
+	ErrMissingIdentity = errors.New("peer did not authenticate with an identity key")
+)
+
+// SecurityEventKind classifies security events
+type SecurityEventKind string
+
+const (
+	// SecurityEventKeyPinned reports a peer key trusted on first use
+	SecurityEventKeyPinned SecurityEventKind = "key-pinned"
+	// SecurityEventKeyMismatch reports a peer presenting a key other than
+	// the one pinned for it. The connection fails.
+	SecurityEventKeyMismatch SecurityEventKind = "key-mismatch"
+	// SecurityEventUnknownPeer reports a peer without pinned key, rejected
+	// as the trust store does not trust on first use
+	SecurityEventUnknownPeer SecurityEventKind = "unknown-peer"
+)
+
+// SecurityEvent reports the outcome of checking a peer key against the trust
+// store
+type SecurityEvent struct {
+	Kind      SecurityEventKind
+	PeerID    string
+	Pinned    ed25519.PublicKey // Key pinned for the peer, nil if none
+	Presented ed25519.PublicKey // Key the peer authenticated with
+	Time      time.Time
+}
+
+// SecurityEventHandler is notified of security events, see
+// WithSecurityEventHandler
+type SecurityEventHandler = func(event SecurityEvent)
+
+// trustFile is the on-disk format of a trust store
+type trustFile struct {
+	Peers map[string]ed25519.PublicKey `json:"peers"`
+}
+
+// TrustStore pins the long-term ed25519 keys of peers by peer ID. A peer
+// presenting a key other than its pinned one is rejected; unknown peers are
+// trusted on first use and their key pinned when enabled, rejected
+// otherwise. Stores opened with OpenTrustStore write every change to their
+// file.
+type TrustStore struct {
+	path string // Empty for stores kept in memory
+	tofu bool
+	pins map[string]ed25519.PublicKey
+	mux  sync.RWMutex
+}
+
+// NewTrustStore creates a trust store kept in memory, trusting unknown peers
+// on first use if tofu is set
+func NewTrustStore(tofu bool) *TrustStore {
+	return &TrustStore{tofu: tofu, pins: make(map[string]ed25519.PublicKey)}
+}
+
+// OpenTrustStore opens the trust store persisted to path, which is created
+// on the first pin if it does not exist
+func OpenTrustStore(path string, tofu bool) (*TrustStore, error) {
+	store := NewTrustStore(tofu)
+	store.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file trustFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid trust store %s: %w", path, err)
+	}
+	for peerID, key := range file.Peers {
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid key for peer %q in trust store %s", peerID, path)
+		}
+		store.pins[peerID] = key
+	}
+
+	return store, nil
+}
+
+// Lookup returns the key pinned for the peer
+func (store *TrustStore) Lookup(peerID string) (ed25519.PublicKey, bool) {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+
+	key, ok := store.pins[peerID]
+	return key, ok
+}
+
+// Pin pins key for the peer, replacing its pinned key. It is how a key
+// change is accepted deliberately.
+func (store *TrustStore) Pin(peerID string, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid ed25519 public key")
+	}
+
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	return store.update(func(pins map[string]ed25519.PublicKey) {
+		pins[peerID] = key
+	})
+}
+
+// Unpin removes the key pinned for the peer
+func (store *TrustStore) Unpin(peerID string) error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	return store.update(func(pins map[string]ed25519.PublicKey) {
+		delete(pins, peerID)
+	})
+}
+
+// Check checks the key presented by the peer, pinning it on first use. It
+// returns the key pinned before and whether key was pinned now.
+func (store *TrustStore) Check(peerID string, key ed25519.PublicKey) (ed25519.PublicKey, bool, error) {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	pinned, ok := store.pins[peerID]
+	switch {
+	case ok && pinned.Equal(key):
+		return pinned, false, nil
+	case ok:
+		return pinned, false, ErrKeyMismatch
+	case !store.tofu:
+		return nil, false, ErrUnknownPeer
+	}
+
+	if err := store.update(func(pins map[string]ed25519.PublicKey) {
+		pins[peerID] = key
+	}); err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
+
+// Verify checks the key presented by the peer like Check and notifies the
+// handlers of the resulting security event
+func (store *TrustStore) Verify(peerID string, key ed25519.PublicKey, handlers ...SecurityEventHandler) error {
+	pinned, first, err := store.Check(peerID, key)
+
+	event := SecurityEvent{PeerID: peerID, Pinned: pinned, Presented: key, Time: time.Now()}
+	switch {
+	case errors.Is(err, ErrKeyMismatch):
+		event.Kind = SecurityEventKeyMismatch
+	case errors.Is(err, ErrUnknownPeer):
+		event.Kind = SecurityEventUnknownPeer
+	case err == nil && first:
+		event.Kind = SecurityEventKeyPinned
+	default:
+		return err
+	}
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: peer %q", err, peerID)
+	}
+	return nil
+}
+
+// update applies change to the pins and persists them. The pins are left
+// unchanged if they cannot be written. Callers hold the lock.
+func (store *TrustStore) update(change func(pins map[string]ed25519.PublicKey)) error {
+	pins := make(map[string]ed25519.PublicKey, len(store.pins)+1)
+	for peerID, key := range store.pins {
+		pins[peerID] = key
+	}
+	change(pins)
+
+	if store.path != "" {
+		if err := writeTrustFile(store.path, pins); err != nil {
+			return err
+		}
+	}
+
+	store.pins = pins
+	return nil
+}
+
+// writeTrustFile replaces the trust store file at path atomically
+func writeTrustFile(path string, pins map[string]ed25519.PublicKey) error {
+	data, err := json.MarshalIndent(trustFile{Peers: pins}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), ".truststore-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(temp.Name()) }()
+
+	if _, err := temp.Write(data); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+// verifyIdentity checks that the identity key signed data and is trusted for
+// the peer
+func (i *Interceptor) verifyIdentity(peerID string, key ed25519.PublicKey, data, signature []byte) error {
+	if len(key) != ed25519.PublicKeySize || len(signature) == 0 {
+		return ErrMissingIdentity
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return ErrInvalidSignature
+	}
+
+	return i.trust.Verify(peerID, key, i.onSecurityEvent...)
+}
@@ -0,0 +1,166 @@
+package encrypt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/interceptortest"
+)
+
+func TestTrustStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trust.json")
+	first, second := public(generate(t)), public(generate(t))
+
+	store, err := OpenTrustStore(path, true)
+	if err != nil {
+		t.Fatalf("OpenTrustStore failed: %v", err)
+	}
+
+	if _, pinned, err := store.Check("drone", first); err != nil || !pinned {
+		t.Fatalf("first use not pinned: %v", err)
+	}
+	if _, pinned, err := store.Check("drone", first); err != nil || pinned {
+		t.Errorf("pinned key rejected: %v", err)
+	}
+	if _, _, err := store.Check("drone", second); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("expected ErrKeyMismatch, got %v", err)
+	}
+
+	// Pins are persisted
+	reopened, err := OpenTrustStore(path, false)
+	if err != nil {
+		t.Fatalf("OpenTrustStore failed: %v", err)
+	}
+	if key, ok := reopened.Lookup("drone"); !ok || !key.Equal(first) {
+		t.Errorf("persisted key mismatch: got %x, want %x", key, first)
+	}
+	if _, _, err := reopened.Check("other", second); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("expected ErrUnknownPeer, got %v", err)
+	}
+
+	// Accepting a key change deliberately
+	if err := reopened.Pin("drone", second); err != nil {
+		t.Fatalf("Pin failed: %v", err)
+	}
+	if _, _, err := reopened.Check("drone", second); err != nil {
+		t.Errorf("repinned key rejected: %v", err)
+	}
+	if err := reopened.Unpin("drone"); err != nil {
+		t.Fatalf("Unpin failed: %v", err)
+	}
+	if _, ok := reopened.Lookup("drone"); ok {
+		t.Error("unpinned key still pinned")
+	}
+}
+
+func TestTrustStore_Verify(t *testing.T) {
+	first, second := public(generate(t)), public(generate(t))
+	r := &recorder{}
+
+	store := NewTrustStore(true)
+	if err := store.Verify("drone", first, r.handle); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if err := store.Verify("drone", first, r.handle); err != nil {
+		t.Errorf("pinned key rejected: %v", err)
+	}
+	if err := store.Verify("drone", second, r.handle); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("expected ErrKeyMismatch, got %v", err)
+	}
+	if err := NewTrustStore(false).Verify("drone", first, r.handle); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("expected ErrUnknownPeer, got %v", err)
+	}
+
+	// Keys matching their pin raise no event
+	want := []SecurityEventKind{SecurityEventKeyPinned, SecurityEventKeyMismatch, SecurityEventUnknownPeer}
+	if kinds := r.kinds(); !slices.Equal(kinds, want) {
+		t.Errorf("events mismatch: got %v, want %v", kinds, want)
+	}
+}
+
+// recorder collects security events
+type recorder struct {
+	events []SecurityEvent
+	mux    sync.Mutex
+}
+
+func (r *recorder) handle(event SecurityEvent) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) kinds() []SecurityEventKind {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var kinds []SecurityEventKind
+	for _, event := range r.events {
+		kinds = append(kinds, event.Kind)
+	}
+	return kinds
+}
+
+func TestKeyExchange_Pinning(t *testing.T) {
+	signing, identity := generate(t), generate(t)
+	serverEvents, clientEvents := &recorder{}, &recorder{}
+
+	server := create(t, WithServer, WithKeyProvider(NewMemoryKeyProvider(signing)), WithTrustStore(NewTrustStore(true)), WithSecurityEventHandler(serverEvents.handle))
+	clientTrust := NewTrustStore(true)
+	client := create(t, WithTrustStore(clientTrust), WithIdentityKey(identity), WithSecurityEventHandler(clientEvents.handle))
+	s, c := interceptortest.Connect(t, server, client)
+
+	if serverErr, clientErr := handshake(server, client, s, c); serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server %v, client %v", serverErr, clientErr)
+	}
+	if key, ok := clientTrust.Lookup("test"); !ok || !key.Equal(public(signing)) {
+		t.Errorf("server key not pinned: got %x", key)
+	}
+	for _, r := range []*recorder{serverEvents, clientEvents} {
+		if kinds := r.kinds(); len(kinds) != 1 || kinds[0] != SecurityEventKeyPinned {
+			t.Errorf("events mismatch: got %v, want [%s]", kinds, SecurityEventKeyPinned)
+		}
+	}
+	roundTrip(t, s, c)
+
+	// The same client ID with another identity key is refused
+	impostor := create(t, WithTrustStore(NewTrustStore(true)), WithIdentityKey(generate(t)))
+	s2, c2 := interceptortest.Connect(t, server, impostor)
+	t.Cleanup(func() { _ = impostor.Close() })
+
+	go func() { _ = impostor.Init(c2.Conn) }()
+	if err := server.Init(s2.Conn); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("expected ErrKeyMismatch, got %v", err)
+	}
+	if kinds := serverEvents.kinds(); len(kinds) != 2 || kinds[1] != SecurityEventKeyMismatch {
+		t.Errorf("events mismatch: got %v", kinds)
+	}
+	if event := serverEvents.events[1]; !event.Pinned.Equal(public(identity)) || event.PeerID != "test" {
+		t.Errorf("mismatch event: got %+v", event)
+	}
+
+	// Servers pinning clients require an identity key
+	anonymous := create(t, WithKeyProvider(NewMemoryKeyProvider(nil, public(signing))))
+	s3, c3 := interceptortest.Connect(t, server, anonymous)
+	t.Cleanup(func() { _ = anonymous.Close() })
+
+	go func() { _ = anonymous.Init(c3.Conn) }()
+	if err := server.Init(s3.Conn); !errors.Is(err, ErrMissingIdentity) {
+		t.Errorf("expected ErrMissingIdentity, got %v", err)
+	}
+}
+
+func TestNewInterceptor_TrustStore(t *testing.T) {
+	if _, err := CreateInterceptorFactory(WithServer, WithTrustStore(NewTrustStore(true))).NewInterceptor(context.Background(), "test"); err == nil {
+		t.Error("server without key provider accepted")
+	}
+	if _, err := CreateInterceptorFactory(WithIdentityKey(ed25519.PrivateKey{1})).NewInterceptor(context.Background(), "test"); err == nil {
+		t.Error("invalid identity key accepted")
+	}
+}
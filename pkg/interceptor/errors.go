@@ -5,6 +5,12 @@ import (
 	"strings"
 )
 
+// ErrMessageConsumed is returned by a Reader when an interceptor has fully
+// handled an inbound protocol message (a ping, a key exchange step, ...).
+// Outer readers pass it through untouched and the socket's read loop skips
+// the message instead of handing it to the application.
+var ErrMessageConsumed = errors.New("message consumed by interceptor")
+
 func flattenErrs(errs []error) error {
 	var errs2 []error
 	for _, e := range errs {
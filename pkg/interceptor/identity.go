@@ -0,0 +1,127 @@
+package interceptor
+
+import (
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+var (
+	// ErrIdentityFixed is returned when binding a different identity to a
+	// connection whose identity is already fixed
+	ErrIdentityFixed = errors.New("connection identity already bound")
+	// ErrIdentityUnsupported is returned for connections that cannot carry an identity
+	ErrIdentityUnsupported = errors.New("connection does not support identities")
+)
+
+// identityKey is the connection attribute key of the bound identity
+type identityKey struct{}
+
+// identity guards the principal of a connection, which is bound once, and
+// the roles granted to it
+type identity struct {
+	principal string
+	roles     []string
+	mux       sync.Mutex
+}
+
+// identityOf returns the identity attribute of the connection, creating it
+func identityOf(connection Connection) (*identity, error) {
+	conn, ok := connection.(interface {
+		LoadOrStoreAttribute(any, any) (any, bool)
+	})
+	if !ok {
+		return nil, ErrIdentityUnsupported
+	}
+
+	value, _ := conn.LoadOrStoreAttribute(identityKey{}, &identity{})
+	return value.(*identity), nil
+}
+
+// BindIdentity fixes the principal of the connection. It is called by the
+// interceptors authenticating the peer; once bound, the principal cannot be
+// changed for the lifetime of the connection. Binding the same principal
+// again is a no-op.
+func BindIdentity(connection Connection, principal string) error {
+	if principal == "" {
+		return errors.New("empty principal")
+	}
+
+	id, err := identityOf(connection)
+	if err != nil {
+		return err
+	}
+
+	id.mux.Lock()
+	defer id.mux.Unlock()
+
+	if id.principal != "" && id.principal != principal {
+		return ErrIdentityFixed
+	}
+	id.principal = principal
+
+	return nil
+}
+
+// IdentityOf returns the principal bound to the connection by an
+// authenticating interceptor. It is the only trusted source of the peer's
+// identity; Header.SenderID is chosen by the peer and must not be trusted.
+func IdentityOf(connection Connection) (string, bool) {
+	value, exists := AttributeOf(connection, identityKey{})
+	if !exists {
+		return "", false
+	}
+
+	id := value.(*identity)
+	id.mux.Lock()
+	defer id.mux.Unlock()
+
+	return id.principal, id.principal != ""
+}
+
+// BindRoles grants roles, such as the roles or groups claimed by a verified
+// token, to the peer of the connection. Roles are only ever added.
+func BindRoles(connection Connection, roles ...string) error {
+	id, err := identityOf(connection)
+	if err != nil {
+		return err
+	}
+
+	id.mux.Lock()
+	defer id.mux.Unlock()
+
+	for _, role := range roles {
+		if role != "" && !slices.Contains(id.roles, role) {
+			id.roles = append(id.roles, role)
+		}
+	}
+
+	return nil
+}
+
+// RolesOf returns the roles granted to the peer of the connection
+func RolesOf(connection Connection) []string {
+	value, exists := AttributeOf(connection, identityKey{})
+	if !exists {
+		return nil
+	}
+
+	id := value.(*identity)
+	id.mux.Lock()
+	defer id.mux.Unlock()
+
+	return slices.Clone(id.roles)
+}
+
+// SenderOf returns the identity of the sender of a message read from the
+// connection: the bound principal when the connection is authenticated and
+// the claimed Header.SenderID otherwise.
+func SenderOf(connection Connection, msg message.Message) string {
+	if principal, ok := IdentityOf(connection); ok {
+		return principal
+	}
+
+	return msg.Message().SenderID
+}
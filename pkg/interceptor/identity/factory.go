@@ -0,0 +1,62 @@
+package identity
+
+import (
+	"context"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+)
+
+// Option defines a function type that configures an Interceptor instance
+type Option = func(*Interceptor) error
+
+// InterceptorFactory creates identity interceptors with a predefined set of
+// options. It implements the interceptor.Factory interface.
+type InterceptorFactory struct {
+	opts []Option
+}
+
+// WithPolicy sets how messages whose SenderID does not match the connection's
+// identity are handled. The default is PolicyReject.
+func WithPolicy(policy Policy) Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.policy = policy
+		return nil
+	}
+}
+
+// WithRequired rejects every message of connections without a bound
+// identity, for endpoints that must only serve authenticated peers
+func WithRequired() Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.required = true
+		return nil
+	}
+}
+
+// CreateInterceptorFactory constructs a new factory that will create identity
+// interceptors with the provided options
+func CreateInterceptorFactory(options ...Option) *InterceptorFactory {
+	return &InterceptorFactory{
+		opts: options,
+	}
+}
+
+// NewInterceptor creates and configures a new identity interceptor instance.
+// This method implements the interceptor.Factory interface.
+func (factory *InterceptorFactory) NewInterceptor(ctx context.Context, id string) (interceptor.Interceptor, error) {
+	identityInterceptor := &Interceptor{
+		NoOpInterceptor: interceptor.NoOpInterceptor{
+			ID:  id,
+			Ctx: ctx,
+		},
+		policy: PolicyReject,
+	}
+
+	for _, option := range factory.opts {
+		if err := option(identityInterceptor); err != nil {
+			return nil, err
+		}
+	}
+
+	return identityInterceptor, nil
+}
@@ -0,0 +1,74 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+var (
+	// ErrSenderMismatch is returned by the reader for messages whose SenderID
+	// does not match the connection's identity under PolicyReject
+	ErrSenderMismatch = errors.New("sender does not match connection identity")
+	// ErrNoIdentity is returned by the reader for messages of connections
+	// without identity when the identity is required
+	ErrNoIdentity = errors.New("connection has no identity")
+)
+
+// Policy decides what happens to inbound messages whose Header.SenderID does
+// not match the identity bound to their connection
+type Policy int
+
+const (
+	// PolicyReject drops the message; the reader returns ErrSenderMismatch
+	PolicyReject Policy = iota
+	// PolicyRewrite replaces the SenderID with the connection's identity
+	PolicyRewrite
+)
+
+// Interceptor enforces the identity bound to a connection by an authenticating
+// interceptor (see interceptor.BindIdentity) on the SenderID of every inbound
+// message, so that peers cannot speak for somebody else. Register it after the
+// authenticating interceptors and after interceptors unwrapping frames, such
+// as encrypt, so that it checks the frames handed to the application.
+// Interceptors registered before it read the sender through
+// interceptor.SenderOf instead.
+type Interceptor struct {
+	interceptor.NoOpInterceptor
+	policy   Policy
+	required bool
+}
+
+func (i *Interceptor) InterceptSocketReader(reader interceptor.Reader) interceptor.Reader {
+	return interceptor.ReaderFunc(func(conn interceptor.Connection) (messageType websocket.MessageType, m message.Message, err error) {
+		messageType, m, err = reader.Read(conn)
+		if err != nil {
+			return messageType, m, err
+		}
+
+		principal, ok := interceptor.IdentityOf(conn)
+		if !ok {
+			if i.required {
+				return messageType, nil, ErrNoIdentity
+			}
+			return messageType, m, nil
+		}
+
+		header := &m.Message().Header
+		if header.SenderID == principal {
+			return messageType, m, nil
+		}
+
+		switch i.policy {
+		case PolicyRewrite:
+			header.SenderID = principal
+			return messageType, m, nil
+		default:
+			return messageType, nil, fmt.Errorf("%w: %q claimed by %q", ErrSenderMismatch, header.SenderID, principal)
+		}
+	})
+}
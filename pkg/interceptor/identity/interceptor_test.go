@@ -0,0 +1,62 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+func read(t *testing.T, options []Option, conn interceptor.Connection, sender string) (message.Message, error) {
+	t.Helper()
+
+	i, err := CreateInterceptorFactory(options...).NewInterceptor(context.Background(), "server")
+	if err != nil {
+		t.Fatalf("NewInterceptor failed: %v", err)
+	}
+
+	reader := i.InterceptSocketReader(interceptor.ReaderFunc(func(interceptor.Connection) (websocket.MessageType, message.Message, error) {
+		return websocket.MessageText, message.CreateMessageFromData(sender, "server", "test", nil), nil
+	}))
+
+	_, msg, err := reader.Read(conn)
+	return msg, err
+}
+
+func TestInterceptor(t *testing.T) {
+	conn := interceptor.WrapConn(nil, nil)
+	if err := interceptor.BindIdentity(conn, "alice"); err != nil {
+		t.Fatalf("BindIdentity failed: %v", err)
+	}
+
+	if _, err := read(t, nil, conn, "alice"); err != nil {
+		t.Errorf("matching sender rejected: %v", err)
+	}
+
+	if _, err := read(t, nil, conn, "mallory"); !errors.Is(err, ErrSenderMismatch) {
+		t.Errorf("expected ErrSenderMismatch, got %v", err)
+	}
+
+	msg, err := read(t, []Option{WithPolicy(PolicyRewrite)}, conn, "mallory")
+	if err != nil {
+		t.Fatalf("rewrite failed: %v", err)
+	}
+	if msg.Message().SenderID != "alice" {
+		t.Errorf("sender not rewritten: got %q, want %q", msg.Message().SenderID, "alice")
+	}
+}
+
+func TestInterceptor_Required(t *testing.T) {
+	conn := interceptor.WrapConn(nil, nil)
+
+	if _, err := read(t, nil, conn, "mallory"); err != nil {
+		t.Errorf("unauthenticated message rejected without WithRequired: %v", err)
+	}
+	if _, err := read(t, []Option{WithRequired()}, conn, "mallory"); !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("expected ErrNoIdentity, got %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package interceptor
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+func TestBindIdentity(t *testing.T) {
+	conn := WrapConn(nil, nil)
+	frame := message.CreateMessageFromData("mallory", "server", "test", nil)
+
+	if sender := SenderOf(conn, frame); sender != "mallory" {
+		t.Errorf("unauthenticated sender mismatch: got %q, want %q", sender, "mallory")
+	}
+
+	if err := BindIdentity(conn, "alice"); err != nil {
+		t.Fatalf("BindIdentity failed: %v", err)
+	}
+	if err := BindIdentity(conn, "alice"); err != nil {
+		t.Errorf("rebinding the same principal failed: %v", err)
+	}
+	if err := BindIdentity(conn, "bob"); !errors.Is(err, ErrIdentityFixed) {
+		t.Errorf("expected ErrIdentityFixed, got %v", err)
+	}
+
+	if principal, ok := IdentityOf(conn); !ok || principal != "alice" {
+		t.Errorf("identity mismatch: got %q, want %q", principal, "alice")
+	}
+	if sender := SenderOf(conn, frame); sender != "alice" {
+		t.Errorf("authenticated sender mismatch: got %q, want %q", sender, "alice")
+	}
+}
+
+func TestBindRoles(t *testing.T) {
+	conn := WrapConn(nil, nil)
+
+	if roles := RolesOf(conn); len(roles) != 0 {
+		t.Errorf("roles mismatch: got %v, want none", roles)
+	}
+
+	if err := BindRoles(conn, "operator", "group:x"); err != nil {
+		t.Fatalf("BindRoles failed: %v", err)
+	}
+	if err := BindRoles(conn, "operator", ""); err != nil {
+		t.Fatalf("BindRoles failed: %v", err)
+	}
+
+	if roles := RolesOf(conn); !slices.Equal(roles, []string{"operator", "group:x"}) {
+		t.Errorf("roles mismatch: got %v, want %v", roles, []string{"operator", "group:x"})
+	}
+}
@@ -0,0 +1,135 @@
+// Package interceptortest provides the connections the tests of the
+// interceptors run against.
+package interceptortest
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// Pipe is one end of an in-memory connection. Frames written to one end are
+// read from the other.
+type Pipe struct {
+	in     chan []byte
+	out    chan []byte
+	mux    sync.Mutex
+	frames [][]byte // frames read so far
+}
+
+// NewPipe returns both ends of an in-memory connection
+func NewPipe() (*Pipe, *Pipe) {
+	ab, ba := make(chan []byte, 64), make(chan []byte, 64)
+	return &Pipe{in: ba, out: ab}, &Pipe{in: ab, out: ba}
+}
+
+func (p *Pipe) Write(ctx context.Context, _ websocket.MessageType, data []byte) error {
+	select {
+	case p.out <- data:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pipe) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	select {
+	case data := <-p.in:
+		p.mux.Lock()
+		p.frames = append(p.frames, data)
+		p.mux.Unlock()
+		return websocket.MessageText, data, nil
+	case <-ctx.Done():
+		return websocket.MessageText, nil, ctx.Err()
+	}
+}
+
+// Inject hands the frame to the end as if the other end had written it
+func (p *Pipe) Inject(data []byte) {
+	p.in <- data
+}
+
+// Frames returns the frames read from the pipe so far
+func (p *Pipe) Frames() [][]byte {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	return append([][]byte(nil), p.frames...)
+}
+
+// End is one end of a pipe bound to an interceptor
+type End struct {
+	Conn     *Pipe
+	Writer   interceptor.Writer   // writer intercepted by the interceptor
+	Received chan message.Message // messages the interceptor's reader handed on
+	Wire     chan message.Message // messages written on the pipe; dropped once full
+}
+
+// Connect binds the interceptors to both ends of a pipe, encoding messages
+// as JSON, and reads from both ends until the test ends. Init is left to the
+// test.
+func Connect(t testing.TB, a, b interceptor.Interceptor) (*End, *End) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	ac, bc := NewPipe()
+	ends := []*End{
+		{Conn: ac, Received: make(chan message.Message, 64), Wire: make(chan message.Message, 64)},
+		{Conn: bc, Received: make(chan message.Message, 64), Wire: make(chan message.Message, 64)},
+	}
+
+	for n, i := range []interceptor.Interceptor{a, b} {
+		e := ends[n]
+
+		e.Writer = i.InterceptSocketWriter(interceptor.WriterFunc(func(conn interceptor.Connection, _ websocket.MessageType, m message.Message) error {
+			select {
+			case e.Wire <- m:
+			default:
+			}
+			data, err := message.Encode(message.JSON, m)
+			if err != nil {
+				return err
+			}
+			return conn.Write(ctx, websocket.MessageText, data)
+		}))
+		reader := i.InterceptSocketReader(interceptor.ReaderFunc(func(conn interceptor.Connection) (websocket.MessageType, message.Message, error) {
+			messageType, data, err := conn.Read(ctx)
+			if err != nil {
+				return messageType, nil, err
+			}
+			msg, err := message.Decode(message.JSON, data)
+			return messageType, msg, err
+		}))
+
+		if _, _, err := i.BindSocketConnection(e.Conn, e.Writer, reader); err != nil {
+			t.Fatalf("BindSocketConnection failed: %v", err)
+		}
+
+		go func() {
+			for {
+				_, m, err := reader.Read(e.Conn)
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					continue
+				}
+
+				select {
+				case e.Received <- m:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	return ends[0], ends[1]
+}
@@ -0,0 +1,115 @@
+package interceptortest
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/client"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+	"github.com/harshabose/skyline_sonata/serve/pkg/socket"
+)
+
+// Serve starts a socket running the interceptors of the registry and returns
+// its URL. The socket is shut down when the test ends.
+func Serve(t testing.TB, registry *interceptor.Registry, options ...socket.Option) string {
+	t.Helper()
+
+	s, listener := listen(t, registry, options...)
+	go func() { _ = s.Serve(listener) }()
+
+	return "ws://" + listener.Addr().String() + "/"
+}
+
+// ServeTLS is Serve over TLS. The options must carry the TLS configuration.
+func ServeTLS(t testing.TB, registry *interceptor.Registry, options ...socket.Option) string {
+	t.Helper()
+
+	s, listener := listen(t, registry, options...)
+	go func() { _ = s.ServeTLS(listener) }()
+
+	return "wss://" + listener.Addr().String() + "/"
+}
+
+func listen(t testing.TB, registry *interceptor.Registry, options ...socket.Option) (*socket.Socket, net.Listener) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	api, err := socket.CreateAPI(socket.WithInterceptorRegistry(registry))
+	if err != nil {
+		t.Fatalf("CreateAPI failed: %v", err)
+	}
+
+	s, err := api.CreateWebSocket(ctx, "server", options...)
+	if err != nil {
+		t.Fatalf("CreateWebSocket failed: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+
+	return s, listener
+}
+
+// Identities returns a handler sending the identity bound to the connection
+// of every application message to the returned channel
+func Identities() (socket.Option, chan string) {
+	identities := make(chan string, 1)
+	handler := socket.HandlerFunc(func(connection interceptor.Connection, _ websocket.MessageType, _ message.Message) error {
+		principal, _ := interceptor.IdentityOf(connection)
+		identities <- principal
+		return nil
+	})
+
+	return socket.WithHandler(handler), identities
+}
+
+// Dial connects a client and sends a single application message once
+// connected. It returns the error the connection failed with, and otherwise a
+// channel receiving once the client is disconnected. The client is closed
+// when the test ends.
+func Dial(t testing.TB, url, id string, options ...client.Option) (chan struct{}, error) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	connected := make(chan error, 1)
+	disconnected := make(chan struct{}, 1)
+	options = append(options, client.WithMaxAttempts(1), client.WithStateHandler(func(state client.State, err error) {
+		switch state {
+		case client.StateConnected:
+			connected <- nil
+		case client.StateDisconnected:
+			select {
+			case connected <- err:
+			default:
+			}
+			select {
+			case disconnected <- struct{}{}:
+			default:
+			}
+		}
+	}))
+
+	c, err := client.CreateClient(ctx, id, url, options...)
+	if err != nil {
+		t.Fatalf("CreateClient failed: %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	go func() { _ = c.Run() }()
+
+	if err := <-connected; err != nil {
+		return nil, err
+	}
+
+	return disconnected, c.Send(message.CreateMessageFromData(id, "server", "app", nil))
+}
@@ -59,6 +59,8 @@ func (factory *InterceptorFactory) NewInterceptor(ctx context.Context, id string
 			ID:  id,
 			Ctx: ctx,
 		},
+		loggerFactory: CreateLoggerFactory(),
+		states:        make(map[interceptor.Connection]*state),
 	}
 
 	for _, option := range factory.opts {
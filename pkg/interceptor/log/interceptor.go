@@ -9,6 +9,7 @@ import (
 	"github.com/coder/websocket"
 
 	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
 )
 
 type Interceptor struct {
@@ -17,18 +18,18 @@ type Interceptor struct {
 	states        map[interceptor.Connection]*state
 }
 
-func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, _ interceptor.Writer, _ interceptor.Reader) error {
+func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, writer interceptor.Writer, reader interceptor.Reader) (interceptor.Writer, interceptor.Reader, error) {
 	i.Mutex.Lock()
 	defer i.Mutex.Unlock()
 
 	_, exists := i.states[connection]
 	if exists {
-		return errors.New("connection already exists")
+		return nil, nil, errors.New("connection already exists")
 	}
 
 	loggers, err := i.loggerFactory.Create()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	ctx, cancel := context.WithCancel(i.Ctx)
@@ -40,54 +41,47 @@ func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, _
 		cancel:  cancel,
 	}
 
-	return nil
+	return writer, reader, nil
 }
 
 func (i *Interceptor) InterceptSocketWriter(writer interceptor.Writer) interceptor.Writer {
-	return interceptor.WriterFunc(func(connection interceptor.Connection, messageType websocket.MessageType, message interceptor.Message) error {
-		i.Mutex.Lock()
-
-		state, exists := i.states[connection]
-		if !exists {
-			return errors.New("connection does not exists")
+	return interceptor.WriterFunc(func(connection interceptor.Connection, messageType websocket.MessageType, message message.Message) error {
+		state, err := i.getState(connection)
+		if err != nil {
+			return writer.Write(connection, messageType, message)
 		}
 
 		ctx, cancel := context.WithTimeout(state.ctx, time.Second)
+		defer cancel()
 
 		if err := state.log(ctx, message); err != nil {
-			cancel()
 			return err
 		}
 
-		cancel()
-		i.Mutex.Unlock()
 		return writer.Write(connection, messageType, message)
 	})
 }
 
 func (i *Interceptor) InterceptSocketReader(reader interceptor.Reader) interceptor.Reader {
-	return interceptor.ReaderFunc(func(connection interceptor.Connection) (messageType websocket.MessageType, message interceptor.Message, err error) {
+	return interceptor.ReaderFunc(func(connection interceptor.Connection) (messageType websocket.MessageType, message message.Message, err error) {
 		messageType, message, err = reader.Read(connection)
 		if err != nil {
 			return messageType, message, err
 		}
-		i.Mutex.Lock()
 
-		state, exists := i.states[connection]
-		if !exists {
-			return messageType, message, err
+		state, err := i.getState(connection)
+		if err != nil {
+			return messageType, message, nil
 		}
 
 		ctx, cancel := context.WithTimeout(state.ctx, time.Second)
+		defer cancel()
 
 		if err := state.log(ctx, message); err != nil {
-			cancel()
 			return messageType, message, err
 		}
 
-		cancel()
-		i.Mutex.Unlock()
-		return messageType, message, err
+		return messageType, message, nil
 	})
 }
 
@@ -125,3 +119,15 @@ func (i *Interceptor) Close() error {
 
 	return nil
 }
+
+func (i *Interceptor) getState(connection interceptor.Connection) (*state, error) {
+	i.Mutex.RLock()
+	defer i.Mutex.RUnlock()
+
+	state, exists := i.states[connection]
+	if !exists {
+		return nil, errors.New("connection does not exists")
+	}
+
+	return state, nil
+}
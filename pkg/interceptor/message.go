@@ -0,0 +1,54 @@
+package interceptor
+
+import (
+	"errors"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// ErrNotProcessable is returned when a registered protocol message cannot be
+// dispatched to an interceptor
+var ErrNotProcessable = errors.New("protocol message is not processable")
+
+// Message is a protocol message that can be dispatched to an interceptor.
+// It extends the data-only message.Message with the interceptor specific
+// handling, so that the message package never needs to import this one.
+//
+// Implementations embed message.BaseMessage; when decoded through Decode,
+// the embedded header carries the header of the frame the message arrived in.
+type Message interface {
+	message.Message
+	// Process handles the message when it is received on the given connection,
+	// updating the state the interceptor keeps for that connection.
+	Process(Interceptor, Connection) error
+}
+
+// Decode resolves the payload of a frame into the protocol message registered
+// for the frame's protocol and stamps it with the frame's header. Frames of
+// protocols not present in the registry return an error and should be passed
+// on untouched.
+func Decode(registry *message.ProtocolRegistry, frame message.Message) (Message, error) {
+	payload, err := message.ProtocolDecode(registry, frame.Message())
+	if err != nil {
+		return nil, err
+	}
+
+	msg, ok := payload.(Message)
+	if !ok {
+		return nil, ErrNotProcessable
+	}
+
+	return msg, nil
+}
+
+// CodecOf returns the codec negotiated for the connection through its
+// WebSocket subprotocol, defaulting to JSON
+func CodecOf(connection Connection) message.Codec {
+	if conn, ok := connection.(interface{ Subprotocol() string }); ok {
+		if codec, exists := message.LookupCodec(conn.Subprotocol()); exists {
+			return codec
+		}
+	}
+
+	return message.JSON
+}
@@ -0,0 +1,73 @@
+package interceptor
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+const testProtocol message.Protocol = "test"
+
+type testMessage struct {
+	message.BaseMessage
+	Value string `json:"value"`
+}
+
+func (m *testMessage) Marshal() ([]byte, error)              { return json.Marshal(m) }
+func (m *testMessage) Unmarshal(data []byte) error           { return json.Unmarshal(data, m) }
+func (m *testMessage) Protocol() message.Protocol            { return testProtocol }
+func (m *testMessage) Process(Interceptor, Connection) error { return nil }
+
+type dataOnlyMessage struct {
+	message.BaseMessage
+}
+
+func TestDecode(t *testing.T) {
+	registry := message.CreateProtocolRegistry()
+	message.MustRegister[testMessage](registry)
+
+	frame, err := message.CreateMessage("sender", "receiver", &testMessage{Value: "hello"})
+	if err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+
+	decoded, err := Decode(registry, frame)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	msg, ok := decoded.(*testMessage)
+	if !ok {
+		t.Fatalf("unexpected type %T", decoded)
+	}
+	if msg.Value != "hello" {
+		t.Errorf("Value mismatch: got %v, want %v", msg.Value, "hello")
+	}
+	if msg.SenderID != "sender" || msg.ReceiverID != "receiver" || msg.Header.Protocol != testProtocol {
+		t.Errorf("header not stamped from frame: got %+v", msg.Header)
+	}
+}
+
+func TestDecode_UnknownProtocol(t *testing.T) {
+	registry := message.CreateProtocolRegistry()
+	message.MustRegister[testMessage](registry)
+	frame := message.CreateMessageFromData("sender", "receiver", "other", nil)
+
+	if _, err := Decode(registry, frame); err == nil {
+		t.Error("expected error for unregistered protocol")
+	}
+}
+
+func TestDecode_NotProcessable(t *testing.T) {
+	registry := message.CreateProtocolRegistry()
+	if err := registry.Register(testProtocol, func() message.Message { return &dataOnlyMessage{} }); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	frame := message.CreateMessageFromData("sender", "receiver", testProtocol, json.RawMessage(`{}`))
+
+	if _, err := Decode(registry, frame); !errors.Is(err, ErrNotProcessable) {
+		t.Errorf("expected ErrNotProcessable, got %v", err)
+	}
+}
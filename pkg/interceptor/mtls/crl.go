@@ -0,0 +1,99 @@
+package mtls
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// revocations holds the certificate revocation lists loaded from files
+type revocations struct {
+	paths []string
+	lists []*x509.RevocationList // guarded by mux
+	mux   sync.RWMutex
+}
+
+// reload reads every CRL file again. If any of them fails to load, the
+// current lists are kept.
+func (r *revocations) reload() error {
+	lists := make([]*x509.RevocationList, 0, len(r.paths))
+	for _, path := range r.paths {
+		list, err := loadCRL(path)
+		if err != nil {
+			return fmt.Errorf("error while loading CRL %s: %w", path, err)
+		}
+		lists = append(lists, list)
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.lists = lists
+	return nil
+}
+
+// check returns ErrRevoked when any certificate of the verified chain, leaf
+// first, is revoked by a CRL signed by the certificate's issuer, and
+// ErrStaleCRL when such a CRL is past its next update and can no longer tell
+func (r *revocations) check(chain []*x509.Certificate) error {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	now := time.Now()
+	for n := 0; n+1 < len(chain); n++ {
+		certificate, issuer := chain[n], chain[n+1]
+
+		for _, list := range r.lists {
+			if !bytes.Equal(list.RawIssuer, certificate.RawIssuer) || list.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+
+			if stale(list, now) {
+				return ErrStaleCRL
+			}
+
+			for _, entry := range list.RevokedCertificateEntries {
+				if entry.SerialNumber.Cmp(certificate.SerialNumber) == 0 {
+					return ErrRevoked
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// stale reports whether the list is past its next update
+func stale(list *x509.RevocationList, now time.Time) bool {
+	return !list.NextUpdate.IsZero() && now.After(list.NextUpdate)
+}
+
+// loadCRL parses a PEM ("X509 CRL") or DER encoded revocation list
+func loadCRL(path string) (*x509.RevocationList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+		data = block.Bytes
+	}
+
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if stale(list, time.Now()) {
+		return nil, fmt.Errorf("%w: next update was due %s", ErrStaleCRL, list.NextUpdate.Format(time.RFC3339))
+	}
+
+	return list, nil
+}
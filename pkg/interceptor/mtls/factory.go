@@ -0,0 +1,102 @@
+package mtls
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+)
+
+// Option defines a function type that configures an Interceptor instance
+type Option = func(*Interceptor) error
+
+// InterceptorFactory creates mtls interceptors with a predefined set of
+// options. It implements the interceptor.Factory interface.
+type InterceptorFactory struct {
+	opts []Option
+}
+
+// WithSources sets the certificate fields the principal is taken from, in
+// order of preference. The default is SourceSPIFFE, SourceURI and
+// SourceCommonName.
+func WithSources(sources ...Source) Option {
+	return func(interceptor *Interceptor) error {
+		if len(sources) == 0 {
+			return errors.New("no identity sources")
+		}
+		interceptor.sources = sources
+		return nil
+	}
+}
+
+// WithTrustDomain only accepts SPIFFE IDs of the given trust domain
+func WithTrustDomain(domain string) Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.trustDomain = domain
+		return nil
+	}
+}
+
+// WithRequired rejects connections without a verified client certificate,
+// for sockets verifying certificates only if given
+func WithRequired() Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.required = true
+		return nil
+	}
+}
+
+// WithCRLFiles rejects certificates revoked by the PEM or DER encoded CRLs.
+// The files are read again every reload interval and connections whose
+// certificates were revoked in the meantime are closed; zero disables
+// reloading. CRLs past their next update are not loaded, and certificates of
+// an issuer whose CRL went stale are rejected until a current one is loaded.
+func WithCRLFiles(reload time.Duration, paths ...string) Option {
+	return func(interceptor *Interceptor) error {
+		if reload < 0 {
+			return errors.New("negative reload interval")
+		}
+		interceptor.crl = &revocations{paths: paths}
+		interceptor.reload = reload
+		return nil
+	}
+}
+
+// CreateInterceptorFactory constructs a new factory that will create mtls
+// interceptors with the provided options
+func CreateInterceptorFactory(options ...Option) *InterceptorFactory {
+	return &InterceptorFactory{
+		opts: options,
+	}
+}
+
+// NewInterceptor creates and configures a new mtls interceptor instance and
+// loads its CRLs. This method implements the interceptor.Factory interface.
+func (factory *InterceptorFactory) NewInterceptor(ctx context.Context, id string) (interceptor.Interceptor, error) {
+	mtlsInterceptor := &Interceptor{
+		NoOpInterceptor: interceptor.NoOpInterceptor{
+			ID:  id,
+			Ctx: ctx,
+		},
+		states:  make(map[interceptor.Connection]*state),
+		sources: []Source{SourceSPIFFE, SourceURI, SourceCommonName},
+	}
+
+	for _, option := range factory.opts {
+		if err := option(mtlsInterceptor); err != nil {
+			return nil, err
+		}
+	}
+
+	if mtlsInterceptor.crl != nil {
+		if err := mtlsInterceptor.crl.reload(); err != nil {
+			return nil, err
+		}
+		if mtlsInterceptor.reload > 0 {
+			go mtlsInterceptor.watch()
+		}
+	}
+
+	return mtlsInterceptor, nil
+}
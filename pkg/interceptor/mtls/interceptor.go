@@ -0,0 +1,241 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+)
+
+var (
+	ErrNoCertificate = errors.New("no verified client certificate")
+	ErrNoIdentity    = errors.New("client certificate carries no usable identity")
+	ErrRevoked       = errors.New("client certificate revoked")
+	ErrStaleCRL      = errors.New("certificate revocation list past its next update")
+)
+
+// Source is a certificate field a principal can be taken from
+type Source int
+
+const (
+	// SourceSPIFFE takes the SPIFFE ID, the URI SAN with the spiffe scheme
+	SourceSPIFFE Source = iota
+	// SourceURI takes the first URI SAN, whatever its scheme
+	SourceURI
+	// SourceCommonName takes the subject common name
+	SourceCommonName
+)
+
+// certificateKey is the connection attribute key of the client certificate
+type certificateKey struct{}
+
+// CertificateOf returns the verified client certificate of the connection
+func CertificateOf(connection interceptor.Connection) (*x509.Certificate, bool) {
+	value, exists := interceptor.AttributeOf(connection, certificateKey{})
+	if !exists {
+		return nil, false
+	}
+
+	certificate, ok := value.(*x509.Certificate)
+	return certificate, ok
+}
+
+// state keeps the verified chain of a connection, to check it against
+// reloaded CRLs
+type state struct {
+	chain []*x509.Certificate
+}
+
+// Interceptor turns verified TLS client certificates into connection
+// identities: the principal is taken from the first of the configured
+// certificate fields that is set, and bound with interceptor.BindIdentity for
+// the rest of the chain. Certificates are verified by the TLS handshake (see
+// socket.WithClientCertificates); this interceptor only reads connections
+// whose certificates were verified, optionally checking them against CRLs.
+// Connections with a revoked certificate, or a certificate without usable
+// identity, are closed with StatusPolicyViolation. Register it first.
+type Interceptor struct {
+	interceptor.NoOpInterceptor
+	states      map[interceptor.Connection]*state
+	sources     []Source
+	trustDomain string // Required SPIFFE trust domain; empty accepts any
+	required    bool
+	crl         *revocations
+	reload      time.Duration // Zero disables reloading the CRLs
+}
+
+func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, writer interceptor.Writer, reader interceptor.Reader) (interceptor.Writer, interceptor.Reader, error) {
+	chain := verifiedChain(connection)
+	if chain == nil {
+		if i.required {
+			interceptor.Reject(connection, ErrNoCertificate)
+			return nil, nil, ErrNoCertificate
+		}
+		return writer, reader, nil
+	}
+
+	if err := i.authenticate(connection, chain); err != nil {
+		interceptor.Reject(connection, err)
+		return nil, nil, err
+	}
+
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	if _, exists := i.states[connection]; exists {
+		return nil, nil, errors.New("connection already exists")
+	}
+	i.states[connection] = &state{chain: chain}
+
+	return writer, reader, nil
+}
+
+// authenticate checks the chain against the CRLs and binds the principal of
+// its leaf certificate
+func (i *Interceptor) authenticate(connection interceptor.Connection, chain []*x509.Certificate) error {
+	if i.crl != nil {
+		if err := i.crl.check(chain); err != nil {
+			return err
+		}
+	}
+
+	principal, err := i.principal(chain[0])
+	if err != nil {
+		return err
+	}
+
+	if err := interceptor.BindIdentity(connection, principal); err != nil {
+		return err
+	}
+	interceptor.SetAttribute(connection, certificateKey{}, chain[0])
+
+	return nil
+}
+
+// principal returns the identity of the certificate from the first source
+// that is set
+func (i *Interceptor) principal(certificate *x509.Certificate) (string, error) {
+	for _, source := range i.sources {
+		switch source {
+		case SourceSPIFFE:
+			id, err := spiffeID(certificate, i.trustDomain)
+			if err != nil {
+				return "", err
+			}
+			if id != "" {
+				return id, nil
+			}
+		case SourceURI:
+			if len(certificate.URIs) > 0 {
+				return certificate.URIs[0].String(), nil
+			}
+		case SourceCommonName:
+			if certificate.Subject.CommonName != "" {
+				return certificate.Subject.CommonName, nil
+			}
+		}
+	}
+
+	return "", ErrNoIdentity
+}
+
+// spiffeID returns the SPIFFE ID of the certificate, if any. Certificates with
+// several or malformed SPIFFE IDs, or IDs outside trustDomain, are rejected.
+func spiffeID(certificate *x509.Certificate, trustDomain string) (string, error) {
+	var id *url.URL
+	for _, uri := range certificate.URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		if id != nil {
+			return "", fmt.Errorf("%w: multiple SPIFFE IDs", ErrNoIdentity)
+		}
+		id = uri
+	}
+
+	if id == nil {
+		return "", nil
+	}
+
+	if id.Host == "" || id.User != nil || id.Port() != "" || id.RawQuery != "" || id.Fragment != "" {
+		return "", fmt.Errorf("%w: malformed SPIFFE ID %q", ErrNoIdentity, id)
+	}
+	if trustDomain != "" && id.Host != trustDomain {
+		return "", fmt.Errorf("%w: SPIFFE ID %q outside trust domain %q", ErrNoIdentity, id, trustDomain)
+	}
+
+	return id.String(), nil
+}
+
+// verifiedChain returns the first verified certificate chain of the TLS
+// connection the websocket was upgraded from, leaf first
+func verifiedChain(connection interceptor.Connection) []*x509.Certificate {
+	request, ok := interceptor.RequestOf(connection)
+	if !ok || request == nil || request.TLS == nil || len(request.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+
+	chain := request.TLS.VerifiedChains[0]
+	if len(chain) == 0 {
+		return nil
+	}
+
+	return chain
+}
+
+// watch reloads the CRLs every reload interval and closes the connections
+// whose certificates were revoked, until the interceptor's context is done
+func (i *Interceptor) watch() {
+	ticker := time.NewTicker(i.reload)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-i.Ctx.Done():
+			return
+		case <-ticker.C:
+			// The lists kept after a failed reload may have gone stale
+			if err := i.crl.reload(); err != nil {
+				fmt.Println("error while reloading CRLs:", err.Error())
+			}
+			i.enforce()
+		}
+	}
+}
+
+// enforce closes the connections whose certificates are revoked or no longer
+// covered by a current CRL
+func (i *Interceptor) enforce() {
+	rejected := make(map[interceptor.Connection]error)
+
+	i.Mutex.RLock()
+	for connection, state := range i.states {
+		if err := i.crl.check(state.chain); err != nil {
+			rejected[connection] = err
+		}
+	}
+	i.Mutex.RUnlock()
+
+	for connection, err := range rejected {
+		interceptor.Reject(connection, err)
+	}
+}
+
+func (i *Interceptor) UnBindSocketConnection(connection interceptor.Connection) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	delete(i.states, connection)
+}
+
+func (i *Interceptor) Close() error {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	i.states = make(map[interceptor.Connection]*state)
+
+	return nil
+}
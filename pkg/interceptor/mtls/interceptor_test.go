@@ -0,0 +1,331 @@
+package mtls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/interceptortest"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+	"github.com/harshabose/skyline_sonata/serve/pkg/socket"
+)
+
+// authority is a certificate authority generated for a single test
+type authority struct {
+	t           *testing.T
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	serial      int64
+}
+
+func newAuthority(t *testing.T, name string) *authority {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %v", err)
+	}
+
+	return &authority{t: t, certificate: certificate, key: key, serial: 1}
+}
+
+func (ca *authority) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	return pool
+}
+
+// issue signs a leaf certificate; modify customises its template
+func (ca *authority) issue(usage x509.ExtKeyUsage, modify func(*x509.Certificate)) tls.Certificate {
+	ca.t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if modify != nil {
+		modify(template)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatalf("CreateCertificate failed: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.t.Fatalf("ParseCertificate failed: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCRL writes a PEM encoded CRL revoking the given certificates
+func (ca *authority) writeCRL(path string, revoked ...tls.Certificate) {
+	ca.t.Helper()
+
+	ca.writeCRLUntil(path, time.Now().Add(time.Hour), revoked...)
+}
+
+// writeCRLUntil is writeCRL for a CRL due for its next update at nextUpdate
+func (ca *authority) writeCRLUntil(path string, nextUpdate time.Time, revoked ...tls.Certificate) {
+	ca.t.Helper()
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: nextUpdate.Add(-time.Hour - time.Minute),
+		NextUpdate: nextUpdate,
+	}
+	for _, certificate := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   certificate.Leaf.SerialNumber,
+			RevocationTime: time.Now(),
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.certificate, ca.key)
+	if err != nil {
+		ca.t.Fatalf("CreateRevocationList failed: %v", err)
+	}
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600); err != nil {
+		ca.t.Fatalf("WriteFile failed: %v", err)
+	}
+}
+
+func uri(t *testing.T, raw string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	return u
+}
+
+func TestPrincipal(t *testing.T) {
+	i := &Interceptor{sources: []Source{SourceSPIFFE, SourceURI, SourceCommonName}, trustDomain: "example.org"}
+
+	tests := []struct {
+		name      string
+		cn        string
+		uris      []string
+		principal string
+		err       error
+	}{
+		{name: "common name", cn: "drone-1", principal: "drone-1"},
+		{name: "uri", cn: "drone-1", uris: []string{"urn:device:drone-1"}, principal: "urn:device:drone-1"},
+		{name: "spiffe", cn: "drone-1", uris: []string{"urn:device:drone-1", "spiffe://example.org/drone/1"}, principal: "spiffe://example.org/drone/1"},
+		{name: "foreign trust domain", uris: []string{"spiffe://other.org/drone/1"}, err: ErrNoIdentity},
+		{name: "multiple spiffe ids", uris: []string{"spiffe://example.org/a", "spiffe://example.org/b"}, err: ErrNoIdentity},
+		{name: "malformed spiffe id", uris: []string{"spiffe://example.org/a?x=1"}, err: ErrNoIdentity},
+		{name: "no identity", err: ErrNoIdentity},
+	}
+
+	for _, tt := range tests {
+		certificate := &x509.Certificate{Subject: pkix.Name{CommonName: tt.cn}}
+		for _, raw := range tt.uris {
+			certificate.URIs = append(certificate.URIs, uri(t, raw))
+		}
+
+		principal, err := i.principal(certificate)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: error mismatch: got %v, want %v", tt.name, err, tt.err)
+		}
+		if principal != tt.principal {
+			t.Errorf("%s: principal mismatch: got %q, want %q", tt.name, principal, tt.principal)
+		}
+	}
+
+	i.sources = []Source{SourceCommonName}
+	certificate := &x509.Certificate{Subject: pkix.Name{CommonName: "drone-1"}, URIs: []*url.URL{uri(t, "spiffe://example.org/drone/1")}}
+	if principal, _ := i.principal(certificate); principal != "drone-1" {
+		t.Errorf("common name source mismatch: got %q, want %q", principal, "drone-1")
+	}
+}
+
+func TestRevocations(t *testing.T) {
+	ca := newAuthority(t, "ca")
+	other := newAuthority(t, "other")
+
+	revoked := ca.issue(x509.ExtKeyUsageClientAuth, nil)
+	valid := ca.issue(x509.ExtKeyUsageClientAuth, nil)
+
+	dir := t.TempDir()
+	ca.writeCRL(filepath.Join(dir, "ca.crl"), revoked)
+	// A CRL of another authority must not revoke certificates with the same serial
+	other.writeCRL(filepath.Join(dir, "other.crl"), valid)
+
+	crl := &revocations{paths: []string{filepath.Join(dir, "ca.crl"), filepath.Join(dir, "other.crl")}}
+	if err := crl.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	if err := crl.check([]*x509.Certificate{revoked.Leaf, ca.certificate}); !errors.Is(err, ErrRevoked) {
+		t.Errorf("expected ErrRevoked, got %v", err)
+	}
+	if err := crl.check([]*x509.Certificate{valid.Leaf, ca.certificate}); err != nil {
+		t.Errorf("valid certificate rejected by a foreign CRL: %v", err)
+	}
+}
+
+func TestRevocations_Stale(t *testing.T) {
+	ca := newAuthority(t, "ca")
+	valid := ca.issue(x509.ExtKeyUsageClientAuth, nil)
+
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	ca.writeCRLUntil(path, time.Now().Add(-time.Minute))
+
+	// CRLs past their next update are not loaded
+	crl := &revocations{paths: []string{path}}
+	if err := crl.reload(); !errors.Is(err, ErrStaleCRL) {
+		t.Errorf("expected ErrStaleCRL, got %v", err)
+	}
+
+	// Certificates are rejected once the loaded CRL of their issuer went stale
+	ca.writeCRL(path)
+	if err := crl.reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	chain := []*x509.Certificate{valid.Leaf, ca.certificate}
+	if err := crl.check(chain); err != nil {
+		t.Errorf("valid certificate rejected: %v", err)
+	}
+
+	crl.lists[0].NextUpdate = time.Now().Add(-time.Minute)
+	if err := crl.check(chain); !errors.Is(err, ErrStaleCRL) {
+		t.Errorf("expected ErrStaleCRL, got %v", err)
+	}
+}
+
+// serve starts a TLS socket verifying client certificates against ca and
+// returns its URL together with a channel receiving the identity of every
+// application message
+func serve(t *testing.T, ca *authority, options ...Option) (string, chan string) {
+	t.Helper()
+
+	registry := &interceptor.Registry{}
+	registry.Register(CreateInterceptorFactory(options...))
+
+	server := ca.issue(x509.ExtKeyUsageServerAuth, func(template *x509.Certificate) {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	})
+
+	handler, identities := interceptortest.Identities()
+	url := interceptortest.ServeTLS(t, registry,
+		socket.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{server}}),
+		socket.WithClientCertificates(tls.VerifyClientCertIfGiven, ca.pool()),
+		handler,
+	)
+
+	return url, identities
+}
+
+// dial connects to the socket presenting the given client certificates
+func dial(t *testing.T, ca *authority, address string, certificates ...tls.Certificate) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.Dial(context.Background(), address, &websocket.DialOptions{
+		HTTPClient: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      ca.pool(),
+			Certificates: certificates,
+		}}},
+	})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.CloseNow() })
+
+	return conn
+}
+
+func expectRejected(t *testing.T, conn *websocket.Conn, reason string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if _, _, err := conn.Read(ctx); websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Errorf("expected StatusPolicyViolation for %s, got %v", reason, err)
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	ca := newAuthority(t, "ca")
+	crl := filepath.Join(t.TempDir(), "ca.crl")
+	ca.writeCRL(crl)
+
+	address, identities := serve(t, ca, WithRequired(), WithTrustDomain("example.org"), WithCRLFiles(20*time.Millisecond, crl))
+
+	drone := ca.issue(x509.ExtKeyUsageClientAuth, func(template *x509.Certificate) {
+		template.Subject.CommonName = "drone-1"
+		template.URIs = []*url.URL{uri(t, "spiffe://example.org/drone/1")}
+	})
+
+	conn := dial(t, ca, address, drone)
+	frame, err := message.CreateMessageFromData("drone-1", "server", "app", nil).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if err := conn.Write(context.Background(), websocket.MessageText, frame); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if identity := <-identities; identity != "spiffe://example.org/drone/1" {
+		t.Errorf("identity mismatch: got %q, want %q", identity, "spiffe://example.org/drone/1")
+	}
+
+	expectRejected(t, dial(t, ca, address), "missing certificate")
+
+	// Revoking the certificate closes the established connection
+	ca.writeCRL(crl, drone)
+	expectRejected(t, conn, "revoked certificate")
+
+	expectRejected(t, dial(t, ca, address, drone), "revoked certificate")
+}
@@ -0,0 +1,39 @@
+package interceptor
+
+import "sync"
+
+// Outcome records how the authentication of a connection ended. It is
+// completed once, by whichever of the handshake, its timeout or the unbinding
+// of the connection comes first; later completions are ignored.
+type Outcome struct {
+	done chan struct{} // closed once completed
+	err  error
+	once sync.Once
+}
+
+func NewOutcome() *Outcome {
+	return &Outcome{done: make(chan struct{})}
+}
+
+// Complete completes the outcome with err, nil for success
+func (outcome *Outcome) Complete(err error) {
+	outcome.once.Do(func() {
+		outcome.err = err
+		close(outcome.done)
+	})
+}
+
+// Done returns a channel closed once the outcome is completed
+func (outcome *Outcome) Done() <-chan struct{} {
+	return outcome.done
+}
+
+// Result reports whether the outcome is completed, and its error
+func (outcome *Outcome) Result() (bool, error) {
+	select {
+	case <-outcome.done:
+		return true, outcome.err
+	default:
+		return false, nil
+	}
+}
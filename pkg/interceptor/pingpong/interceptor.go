@@ -60,20 +60,21 @@ func (i *Interceptor) Init(connection interceptor.Connection) error {
 
 func (i *Interceptor) InterceptSocketWriter(writer interceptor.Writer) interceptor.Writer {
 	return interceptor.WriterFunc(func(conn interceptor.Connection, messageType websocket.MessageType, m message.Message) error {
-		i.Mutex.Lock()
-		defer i.Mutex.Unlock()
-
-		if _, exists := i.states[conn]; !exists {
+		if m.Message().Header.Protocol != ProtocolPing {
 			return writer.Write(conn, messageType, m)
 		}
 
-		payload, err := message.ProtocolUnmarshal(protocolMap, m.Message().Header.Protocol, m.Message().Payload)
-		if err != nil {
+		i.Mutex.RLock()
+		state, exists := i.states[conn]
+		i.Mutex.RUnlock()
+		if !exists {
 			return writer.Write(conn, messageType, m)
 		}
 
-		if err := payload.Process(i, conn); err != nil {
-			return writer.Write(conn, messageType, m)
+		// Outgoing pings are recorded here; inbound ones are recorded by Process
+		ping := &Ping{}
+		if err := m.Message().DecodePayload(ping); err == nil {
+			state.recordPing(ping)
 		}
 
 		return writer.Write(conn, messageType, m)
@@ -87,32 +88,42 @@ func (i *Interceptor) InterceptSocketReader(reader interceptor.Reader) intercept
 			return messageType, m, err
 		}
 
-		i.Mutex.Lock()
-		defer i.Mutex.Unlock()
-
-		if _, exists := i.states[conn]; !exists {
+		if !i.bound(conn) {
 			return messageType, m, nil
 		}
 
-		payload, err := message.ProtocolUnmarshal(protocolMap, m.Message().Header.Protocol, m.Message().Payload)
+		payload, err := interceptor.Decode(protocolMap, m)
 		if err != nil {
 			return messageType, m, nil
 		}
 
+		// Process acquires the interceptor lock itself (and may write a pong),
+		// so it must not be called while holding it.
 		if err := payload.Process(i, conn); err != nil {
-			return messageType, m, nil
+			fmt.Println("error while processing ping/pong:", err.Error())
 		}
 
-		return messageType, m, nil
+		return messageType, m, interceptor.ErrMessageConsumed
 	})
 }
 
+// bound reports whether the connection has been bound to this interceptor
+func (i *Interceptor) bound(conn interceptor.Connection) bool {
+	i.Mutex.RLock()
+	defer i.Mutex.RUnlock()
+
+	_, exists := i.states[conn]
+	return exists
+}
+
 func (i *Interceptor) UnBindSocketConnection(connection interceptor.Connection) {
 	i.Mutex.Lock()
 	defer i.Mutex.Unlock()
 
-	i.states[connection].cancel()
-	delete(i.states, connection)
+	if state, exists := i.states[connection]; exists {
+		state.cancel()
+		delete(i.states, connection)
+	}
 }
 
 func (i *Interceptor) UnInterceptSocketWriter(_ interceptor.Writer) {
@@ -148,13 +159,20 @@ func (i *Interceptor) loop(ctx context.Context, interval time.Duration, connecti
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
+			i.Mutex.RLock()
 			state, exists := i.states[connection]
+			var peerid string
+			if exists {
+				peerid = state.peerid
+			}
+			i.Mutex.RUnlock()
+
 			if !exists {
 				fmt.Println("error while trying to send iamserver:", errors.New("connection does not exists").Error())
 				continue
 			}
 
-			msg, err := message.CreateMessage(i.ID, state.peerid, NewPing(i.ID, state.peerid))
+			msg, err := message.CreateMessage(i.ID, peerid, NewPing(i.ID, peerid))
 			if err != nil {
 				continue
 			}
@@ -167,22 +185,22 @@ func (i *Interceptor) loop(ctx context.Context, interval time.Duration, connecti
 	}
 }
 
-func (payload *Ping) Process(interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+func (payload *Ping) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
 	if err := payload.Validate(); err != nil {
 		return err
 	}
 
-	i := interceptor.(*Interceptor)
+	i := _interceptor.(*Interceptor)
 
 	i.Mutex.Lock()
-	defer i.Mutex.Unlock()
-
 	state, exists := i.states[connection]
 	if !exists {
+		i.Mutex.Unlock()
 		return errors.New("connection does not exists")
 	}
-	state.peerid = payload.SenderID
+	state.peerid = interceptor.SenderOf(connection, payload)
 	state.recordPing(payload)
+	i.Mutex.Unlock()
 
 	if !i.iamserver {
 		msg, err := message.CreateMessage(i.ID, state.peerid, NewPong(i.ID, payload))
@@ -196,12 +214,12 @@ func (payload *Ping) Process(interceptor interceptor.Interceptor, connection int
 
 }
 
-func (payload *Pong) Process(interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+func (payload *Pong) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
 	if err := payload.Validate(); err != nil {
 		return err
 	}
 
-	i := interceptor.(*Interceptor)
+	i := _interceptor.(*Interceptor)
 
 	i.Mutex.Lock()
 	defer i.Mutex.Unlock()
@@ -211,7 +229,7 @@ func (payload *Pong) Process(interceptor interceptor.Interceptor, connection int
 		return errors.New("connection does not exists")
 	}
 
-	state.peerid = payload.SenderID
+	state.peerid = interceptor.SenderOf(connection, payload)
 	state.recordPong(payload)
 
 	return nil
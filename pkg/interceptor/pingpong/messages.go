@@ -1,6 +1,7 @@
 package pingpong
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -8,12 +9,12 @@ import (
 	"github.com/harshabose/skyline_sonata/serve/pkg/message"
 )
 
-var (
-	protocolMap = map[message.Protocol]message.Message{
-		ProtocolPing: &Ping{},
-		ProtocolPong: &Pong{},
-	}
-)
+var protocolMap = message.CreateProtocolRegistry()
+
+func init() {
+	message.MustRegister[Ping](protocolMap)
+	message.MustRegister[Pong](protocolMap)
+}
 
 // Ping represents a connection health check message sent by the server.
 // Each iamserver contains a unique message ID and a timestamp that can be used
@@ -41,8 +42,17 @@ func NewPing(senderID, receiverID string) *Ping {
 	}
 }
 
+func (payload *Ping) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *Ping) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
 // Validate checks if the iamserver message contains valid data.
-// Currently, this is a placeholder for future validation logic.
+// The header is validated as part of the enclosing frame; this only checks
+// the ping's own fields.
 // Future implementations could validate the message ID format and
 // ensure the timestamp is within an acceptable range.
 //
@@ -52,7 +62,7 @@ func (payload *Ping) Validate() error {
 	if payload.MessageID == "" {
 		return message.ErrorNotValid
 	}
-	return payload.BaseMessage.Validate()
+	return nil
 }
 
 func (payload *Ping) Protocol() message.Protocol {
@@ -91,9 +101,17 @@ func (payload *Pong) Protocol() message.Protocol {
 	return ProtocolPong
 }
 
+func (payload *Pong) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *Pong) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
 func (payload *Pong) Validate() error {
 	if payload.MessageID == "" {
 		return message.ErrorNotValid
 	}
-	return payload.BaseMessage.Validate()
+	return nil
 }
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
 )
 
 func TestPing_MarshalUnmarshal(t *testing.T) {
@@ -102,7 +103,7 @@ func TestMessage_MarshalUnmarshalWithPingPayload(t *testing.T) {
 	senderID := "server"
 	receiverID := "client"
 
-	msg, err := CreateMessage(senderID, receiverID, pingPayload)
+	msg, err := message.CreateMessage(senderID, receiverID, pingPayload)
 	if err != nil {
 		t.Fatalf("CreateMessage failed: %v", err)
 	}
@@ -112,7 +113,7 @@ func TestMessage_MarshalUnmarshalWithPingPayload(t *testing.T) {
 		t.Fatalf("Message Marshal failed: %v", err)
 	}
 
-	var unmarshaledMsg Message
+	var unmarshaledMsg message.BaseMessage
 	err = unmarshaledMsg.Unmarshal(data)
 	if err != nil {
 		t.Fatalf("Message Unmarshal failed: %v", err)
@@ -150,7 +151,7 @@ func TestMessage_MarshalUnmarshalWithPongPayload(t *testing.T) {
 	senderID := "client"
 	receiverID := "server"
 
-	msg, err := CreateMessage(senderID, receiverID, pongPayload)
+	msg, err := message.CreateMessage(senderID, receiverID, pongPayload)
 	if err != nil {
 		t.Fatalf("CreateMessage failed: %v", err)
 	}
@@ -160,7 +161,7 @@ func TestMessage_MarshalUnmarshalWithPongPayload(t *testing.T) {
 		t.Fatalf("Message Marshal failed: %v", err)
 	}
 
-	var unmarshaledMsg Message
+	var unmarshaledMsg message.BaseMessage
 	err = unmarshaledMsg.Unmarshal(data)
 	if err != nil {
 		t.Fatalf("Message Unmarshal failed: %v", err)
@@ -198,7 +199,7 @@ func TestCreateMessage(t *testing.T) {
 	senderID := "test-sender"
 	receiverID := "test-receiver"
 
-	msg, err := CreateMessage(senderID, receiverID, pingPayload)
+	msg, err := message.CreateMessage(senderID, receiverID, pingPayload)
 	if err != nil {
 		t.Fatalf("CreateMessage failed: %v", err)
 	}
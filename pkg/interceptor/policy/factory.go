@@ -0,0 +1,97 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+)
+
+// Option defines a function type that configures an Interceptor instance
+type Option = func(*Interceptor) error
+
+// InterceptorFactory creates policy interceptors with a predefined set of
+// options. It implements the interceptor.Factory interface.
+type InterceptorFactory struct {
+	opts []Option
+}
+
+// WithPolicy enforces a policy built in code. It can be replaced at runtime
+// through Interceptor.SetPolicy.
+func WithPolicy(policy *Policy) Option {
+	return func(interceptor *Interceptor) error {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		interceptor.policy = policy
+		return nil
+	}
+}
+
+// WithPolicyFile enforces the policy of a JSON or YAML file. The file is
+// checked for changes every reload interval and reloaded when modified; a
+// modified file that fails to load leaves the current policy in place. Zero
+// disables reloading.
+func WithPolicyFile(path string, reload time.Duration) Option {
+	return func(interceptor *Interceptor) error {
+		if reload < 0 {
+			return errors.New("negative reload interval")
+		}
+		interceptor.file = &file{path: path}
+		interceptor.reload = reload
+		return nil
+	}
+}
+
+// WithoutDeniedFrames drops denied messages without sending a Denied frame
+// back to the peer
+func WithoutDeniedFrames() Option {
+	return func(interceptor *Interceptor) error {
+		interceptor.silent = true
+		return nil
+	}
+}
+
+// CreateInterceptorFactory constructs a new factory that will create policy
+// interceptors with the provided options. One of WithPolicy or WithPolicyFile
+// is required.
+func CreateInterceptorFactory(options ...Option) *InterceptorFactory {
+	return &InterceptorFactory{
+		opts: options,
+	}
+}
+
+// NewInterceptor creates and configures a new policy interceptor instance,
+// loading its policy file and watching it for changes until ctx is done.
+// This method implements the interceptor.Factory interface.
+func (factory *InterceptorFactory) NewInterceptor(ctx context.Context, id string) (interceptor.Interceptor, error) {
+	policyInterceptor := &Interceptor{
+		NoOpInterceptor: interceptor.NoOpInterceptor{
+			ID:  id,
+			Ctx: ctx,
+		},
+		states: make(map[interceptor.Connection]*state),
+	}
+
+	for _, option := range factory.opts {
+		if err := option(policyInterceptor); err != nil {
+			return nil, err
+		}
+	}
+
+	if policyInterceptor.file != nil {
+		if err := policyInterceptor.Reload(); err != nil {
+			return nil, err
+		}
+		if policyInterceptor.reload > 0 {
+			go policyInterceptor.watch()
+		}
+	}
+
+	if policyInterceptor.policy == nil {
+		return nil, errors.New("no policy configured")
+	}
+
+	return policyInterceptor, nil
+}
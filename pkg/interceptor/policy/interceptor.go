@@ -0,0 +1,281 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+var (
+	// ErrDenied is returned for messages the policy does not allow
+	ErrDenied             = errors.New("denied by policy")
+	ErrConnectionNotFound = errors.New("connection not registered")
+)
+
+// state keeps the writer Denied frames are sent through
+type state struct {
+	writer interceptor.Writer
+}
+
+// file tracks the policy file, to notice modifications
+type file struct {
+	path    string
+	modTime time.Time
+	size    int64
+	mux     sync.Mutex
+}
+
+// changed reports whether the file was modified since the last call
+func (f *file) changed() (bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return false, nil
+	}
+	f.modTime, f.size = info.ModTime(), info.Size()
+
+	return true, nil
+}
+
+// Interceptor authorises every message read from and written to a connection
+// against a role-based policy. The principal is the connection's identity and
+// its roles are those bound by the authenticating interceptor (see
+// interceptor.RolesOf) together with those the policy grants. Denied inbound
+// messages are dropped and answered with a Denied frame; denied outbound
+// messages are not written and the writer returns ErrDenied.
+//
+// Register it after the authenticating interceptors. Only the protocols
+// visible at its position are authorised: registered before encrypt it sees
+// the key exchange but not the frames encrypt unwraps, registered after it
+// the other way round. The same policy can be enforced at both positions.
+type Interceptor struct {
+	interceptor.NoOpInterceptor
+	states map[interceptor.Connection]*state
+	policy *Policy
+	file   *file
+	reload time.Duration
+	silent bool
+}
+
+func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, writer interceptor.Writer, reader interceptor.Reader) (interceptor.Writer, interceptor.Reader, error) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	if _, exists := i.states[connection]; exists {
+		return nil, nil, errors.New("connection already exists")
+	}
+	i.states[connection] = &state{writer: writer}
+
+	return writer, reader, nil
+}
+
+func (i *Interceptor) InterceptSocketReader(reader interceptor.Reader) interceptor.Reader {
+	return interceptor.ReaderFunc(func(conn interceptor.Connection) (messageType websocket.MessageType, m message.Message, err error) {
+		messageType, m, err = reader.Read(conn)
+		if err != nil {
+			return messageType, m, err
+		}
+
+		state, err := i.getState(conn)
+		if err != nil {
+			return messageType, m, nil
+		}
+
+		request, decision := i.Authorize(conn, m, ActionSend)
+		if decision.Allowed {
+			return messageType, m, nil
+		}
+
+		if !i.silent {
+			if err := i.deny(conn, state, m, request, decision); err != nil {
+				fmt.Println("error while sending policy denial:", err.Error())
+			}
+		}
+
+		return messageType, nil, fmt.Errorf("%w: %s %s by %q: %s", ErrDenied, request.Action, request.Protocol, request.Principal, decision.Reason)
+	})
+}
+
+func (i *Interceptor) InterceptSocketWriter(writer interceptor.Writer) interceptor.Writer {
+	return interceptor.WriterFunc(func(conn interceptor.Connection, messageType websocket.MessageType, m message.Message) error {
+		if _, err := i.getState(conn); err != nil || protocolMap.Has(m.Message().Header.Protocol) {
+			return writer.Write(conn, messageType, m)
+		}
+
+		request, decision := i.Authorize(conn, m, ActionReceive)
+		if !decision.Allowed {
+			return fmt.Errorf("%w: %s %s by %q: %s", ErrDenied, request.Action, request.Protocol, request.Principal, decision.Reason)
+		}
+
+		return writer.Write(conn, messageType, m)
+	})
+}
+
+// Authorize evaluates the action of the connection's peer on the message
+// against the current policy
+func (i *Interceptor) Authorize(connection interceptor.Connection, m message.Message, action Action) (Request, Decision) {
+	policy := i.Policy()
+
+	principal, _ := interceptor.IdentityOf(connection)
+	request := Request{
+		Principal: principal,
+		Roles:     interceptor.RolesOf(connection),
+		Protocol:  m.Message().Header.Protocol,
+		Action:    action,
+		Resource:  resourceOf(policy, m.Message()),
+	}
+
+	return request, policy.Evaluate(request)
+}
+
+// deny answers a denied message with a Denied frame
+func (i *Interceptor) deny(connection interceptor.Connection, state *state, m message.Message, request Request, decision Decision) error {
+	msg, err := message.CreateMessage(i.ID, interceptor.SenderOf(connection, m), &Denied{
+		DeniedProtocol: request.Protocol,
+		Action:         request.Action,
+		Resource:       request.Resource,
+		Reason:         decision.Reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	return state.writer.Write(connection, websocket.MessageText, msg)
+}
+
+// resourceOf reads the resource of the frame from the payload field the policy
+// names for its protocol
+func resourceOf(policy *Policy, frame *message.BaseMessage) string {
+	field, exists := policy.resourceField(frame.Header.Protocol)
+	if !exists || len(frame.Payload) == 0 {
+		return ""
+	}
+
+	var payload map[string]any
+	if err := frame.DecodePayload(&payload); err != nil {
+		return ""
+	}
+
+	switch value := payload[field].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// Policy returns the policy currently enforced
+func (i *Interceptor) Policy() *Policy {
+	i.Mutex.RLock()
+	defer i.Mutex.RUnlock()
+
+	return i.policy
+}
+
+// SetPolicy replaces the enforced policy. Messages already being authorised
+// are evaluated against the previous one.
+func (i *Interceptor) SetPolicy(policy *Policy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	i.policy = policy
+	return nil
+}
+
+// Reload loads the policy file again and enforces it. It is called
+// periodically when a reload interval is configured, and can be called
+// directly, for example on SIGHUP.
+func (i *Interceptor) Reload() error {
+	if i.file == nil {
+		return errors.New("no policy file configured")
+	}
+
+	if _, err := i.file.changed(); err != nil {
+		return err
+	}
+
+	return i.load()
+}
+
+func (i *Interceptor) load() error {
+	policy, err := Load(i.file.path)
+	if err != nil {
+		return err
+	}
+
+	return i.SetPolicy(policy)
+}
+
+// watch reloads the policy file whenever it is modified, until the
+// interceptor's context is done
+func (i *Interceptor) watch() {
+	ticker := time.NewTicker(i.reload)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-i.Ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := i.file.changed()
+			if err != nil {
+				fmt.Println("error while checking policy file:", err.Error())
+				continue
+			}
+			if !changed {
+				continue
+			}
+
+			if err := i.load(); err != nil {
+				fmt.Println("error while reloading policy:", err.Error())
+			}
+		}
+	}
+}
+
+func (i *Interceptor) getState(connection interceptor.Connection) (*state, error) {
+	i.Mutex.RLock()
+	defer i.Mutex.RUnlock()
+
+	state, exists := i.states[connection]
+	if !exists {
+		return nil, ErrConnectionNotFound
+	}
+
+	return state, nil
+}
+
+func (i *Interceptor) UnBindSocketConnection(connection interceptor.Connection) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	delete(i.states, connection)
+}
+
+func (i *Interceptor) Close() error {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	i.states = make(map[interceptor.Connection]*state)
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// recorder is a writer keeping every message written through it
+type recorder struct {
+	written chan message.Message
+}
+
+func (r *recorder) Write(_ interceptor.Connection, _ websocket.MessageType, m message.Message) error {
+	r.written <- m
+	return nil
+}
+
+func bind(t *testing.T, ctx context.Context, options ...Option) (*Interceptor, interceptor.Connection, *recorder) {
+	t.Helper()
+
+	i, err := CreateInterceptorFactory(options...).NewInterceptor(ctx, "server")
+	if err != nil {
+		t.Fatalf("NewInterceptor failed: %v", err)
+	}
+
+	conn := interceptor.WrapConn(nil, nil)
+	writer := &recorder{written: make(chan message.Message, 1)}
+	if _, _, err := i.BindSocketConnection(conn, writer, nil); err != nil {
+		t.Fatalf("BindSocketConnection failed: %v", err)
+	}
+
+	return i.(*Interceptor), conn, writer
+}
+
+func read(i *Interceptor, conn interceptor.Connection, frame message.Message) (message.Message, error) {
+	reader := i.InterceptSocketReader(interceptor.ReaderFunc(func(interceptor.Connection) (websocket.MessageType, message.Message, error) {
+		return websocket.MessageText, frame, nil
+	}))
+
+	_, m, err := reader.Read(conn)
+	return m, err
+}
+
+func joinRoom(t *testing.T, roomID string) message.Message {
+	t.Helper()
+
+	frame, err := message.Decode(message.JSON, []byte(`{"source_id":"bob","destination_id":"server","protocol":"join_room","payload":{"room_id":"`+roomID+`"}}`))
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	return frame
+}
+
+func TestInterceptor_Reader(t *testing.T) {
+	i, conn, writer := bind(t, context.Background(), WithPolicy(&Policy{Rules: []Rule{
+		{Effect: EffectAllow, Roles: []string{"group-x"}, Protocols: []string{"join_room"}, Resources: []string{"room-y"}},
+	}}))
+
+	if err := interceptor.BindIdentity(conn, "bob"); err != nil {
+		t.Fatalf("BindIdentity failed: %v", err)
+	}
+	if err := interceptor.BindRoles(conn, "group-x"); err != nil {
+		t.Fatalf("BindRoles failed: %v", err)
+	}
+
+	if _, err := read(i, conn, joinRoom(t, "room-y")); err != nil {
+		t.Errorf("allowed message rejected: %v", err)
+	}
+
+	m, err := read(i, conn, joinRoom(t, "room-z"))
+	if !errors.Is(err, ErrDenied) || m != nil {
+		t.Fatalf("expected ErrDenied without message, got %v, %v", m, err)
+	}
+
+	select {
+	case frame := <-writer.written:
+		denied := &Denied{}
+		if err := frame.Message().DecodePayload(denied); err != nil {
+			t.Fatalf("DecodePayload failed: %v", err)
+		}
+		if frame.Message().Header.Protocol != ProtocolDenied || frame.Message().ReceiverID != "bob" {
+			t.Errorf("denial header mismatch: got %+v", frame.Message().Header)
+		}
+		if denied.DeniedProtocol != "join_room" || denied.Action != ActionSend || denied.Resource != "room-z" {
+			t.Errorf("denial mismatch: got %+v", denied)
+		}
+	default:
+		t.Fatal("no denial sent")
+	}
+}
+
+func TestInterceptor_Writer(t *testing.T) {
+	i, conn, _ := bind(t, context.Background(), WithPolicy(&Policy{Default: EffectAllow, Rules: []Rule{
+		{Effect: EffectDeny, Protocols: []string{"chat_destination"}, Actions: []Action{ActionReceive}},
+	}}))
+
+	writer := i.InterceptSocketWriter(interceptor.WriterFunc(func(interceptor.Connection, websocket.MessageType, message.Message) error {
+		return nil
+	}))
+
+	if err := writer.Write(conn, websocket.MessageText, message.CreateMessageFromData("server", "bob", "chat_destination", nil)); !errors.Is(err, ErrDenied) {
+		t.Errorf("expected ErrDenied, got %v", err)
+	}
+	if err := writer.Write(conn, websocket.MessageText, message.CreateMessageFromData("server", "bob", "chat_source", nil)); err != nil {
+		t.Errorf("allowed message rejected: %v", err)
+	}
+}
+
+func TestInterceptor_Reload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := write(t, "policy.yaml", "rules:\n  - effect: allow\n    protocols: [join_room]\n")
+	i, conn, _ := bind(t, ctx, WithPolicyFile(path, 10*time.Millisecond), WithoutDeniedFrames())
+
+	if _, err := read(i, conn, joinRoom(t, "room-y")); err != nil {
+		t.Fatalf("allowed message rejected: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("rules: [{effect: deny, protocols: [join_room]}]\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := read(i, conn, joinRoom(t, "room-y")); errors.Is(err, ErrDenied) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("policy not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A broken policy leaves the current one in place
+	if err := os.WriteFile(path, []byte("rules: [{effect: maybe}]\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := i.Reload(); err == nil {
+		t.Error("broken policy reloaded")
+	}
+	if _, err := read(i, conn, joinRoom(t, "room-y")); !errors.Is(err, ErrDenied) {
+		t.Errorf("expected ErrDenied from previous policy, got %v", err)
+	}
+}
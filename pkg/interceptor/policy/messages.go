@@ -0,0 +1,52 @@
+package policy
+
+import (
+	"encoding/json"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+var ProtocolDenied message.Protocol = "policy_denied"
+
+var protocolMap = message.CreateProtocolRegistry()
+
+func init() {
+	message.MustRegister[Denied](protocolMap)
+}
+
+// Denied is sent back to a peer whose message was rejected by the policy, so
+// that it learns why its message never reached its destination
+type Denied struct {
+	message.BaseMessage                  // NOTE: EMPTY PAYLOAD
+	DeniedProtocol      message.Protocol `json:"denied_protocol"`
+	Action              Action           `json:"action"`
+	Resource            string           `json:"resource,omitempty"`
+	Reason              string           `json:"reason"`
+}
+
+func (payload *Denied) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *Denied) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+func (payload *Denied) Protocol() message.Protocol {
+	return ProtocolDenied
+}
+
+func (payload *Denied) Validate() error {
+	if payload.DeniedProtocol == "" || payload.Action == "" {
+		return message.ErrorNotValid
+	}
+
+	return nil
+}
+
+// Process does nothing; Denied frames are handed to the application, which
+// decides how to surface them
+func (payload *Denied) Process(_ interceptor.Interceptor, _ interceptor.Connection) error {
+	return payload.Validate()
+}
@@ -0,0 +1,244 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// Effect is the outcome of a rule
+type Effect string
+
+const (
+	EffectAllow Effect = "allow"
+	EffectDeny  Effect = "deny"
+)
+
+// Action is what a peer does with a message of a protocol
+type Action string
+
+const (
+	// ActionSend is a peer sending a message to the server
+	ActionSend Action = "send"
+	// ActionReceive is the server writing a message to a peer
+	ActionReceive Action = "receive"
+)
+
+// defaultResources names the payload field holding the resource of the
+// protocols shipped with this module
+var defaultResources = map[message.Protocol]string{
+	"create_room":      "room_id",
+	"join_room":        "room_id",
+	"leave_room":       "room_id",
+	"chat_source":      "room_id",
+	"chat_destination": "room_id",
+	"client_joined":    "room_id",
+	"client_left":      "room_id",
+}
+
+// Rule grants or denies actions on protocols and resources to principals and
+// roles. Every list holds patterns in which "*" matches any sequence of
+// characters; an empty list matches everything. A rule listing both
+// principals and roles applies to peers matching either.
+type Rule struct {
+	Effect     Effect   `json:"effect" yaml:"effect"`
+	Principals []string `json:"principals,omitempty" yaml:"principals,omitempty"`
+	Roles      []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+	Protocols  []string `json:"protocols,omitempty" yaml:"protocols,omitempty"`
+	Actions    []Action `json:"actions,omitempty" yaml:"actions,omitempty"`
+	Resources  []string `json:"resources,omitempty" yaml:"resources,omitempty"`
+}
+
+// Policy is a set of rules. Deny rules take precedence over allow rules;
+// requests matching no rule get the default effect, which is EffectDeny unless
+// set otherwise.
+type Policy struct {
+	Default Effect `json:"default,omitempty" yaml:"default,omitempty"`
+	// Roles grants roles to principals, in addition to the roles bound to
+	// their connection
+	Roles map[string][]string `json:"roles,omitempty" yaml:"roles,omitempty"`
+	// Resources names the payload field holding the resource of a protocol,
+	// in addition to the room protocols, whose resource is their room_id
+	Resources map[message.Protocol]string `json:"resources,omitempty" yaml:"resources,omitempty"`
+	Rules     []Rule                      `json:"rules" yaml:"rules"`
+}
+
+// Request is an action of a peer to be authorised. Peers of unauthenticated
+// connections have no principal and no roles; they only match rules without
+// principals and roles.
+type Request struct {
+	Principal string
+	Roles     []string
+	Protocol  message.Protocol
+	Action    Action
+	Resource  string
+}
+
+// Decision is the result of evaluating a request
+type Decision struct {
+	Allowed bool
+	Reason  string
+}
+
+// Load reads a policy from a JSON or YAML file, chosen by its extension
+func Load(name string) (*Policy, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return Parse(data, json.Unmarshal)
+	case ".yaml", ".yml":
+		return Parse(data, yaml.Unmarshal)
+	default:
+		return nil, fmt.Errorf("unsupported policy file format: %s", name)
+	}
+}
+
+// Parse decodes a policy with the given unmarshal function, such as
+// json.Unmarshal or yaml.Unmarshal, and validates it
+func Parse(data []byte, unmarshal func([]byte, any) error) (*Policy, error) {
+	policy := &Policy{}
+	if err := unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// Validate checks the effects and actions of the policy
+func (policy *Policy) Validate() error {
+	switch policy.Default {
+	case "", EffectAllow, EffectDeny:
+	default:
+		return fmt.Errorf("invalid default effect %q", policy.Default)
+	}
+
+	for n, rule := range policy.Rules {
+		if rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+			return fmt.Errorf("rule %d: invalid effect %q", n, rule.Effect)
+		}
+
+		for _, action := range rule.Actions {
+			if action != ActionSend && action != ActionReceive {
+				return fmt.Errorf("rule %d: invalid action %q", n, action)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Evaluate decides whether the request is allowed
+func (policy *Policy) Evaluate(request Request) Decision {
+	roles := append(slices.Clone(request.Roles), policy.Roles[request.Principal]...)
+	if request.Principal == "" {
+		roles = nil
+	}
+
+	allowed := -1
+	for n, rule := range policy.Rules {
+		if !rule.matches(request, roles) {
+			continue
+		}
+
+		if rule.Effect == EffectDeny {
+			return Decision{Allowed: false, Reason: fmt.Sprintf("denied by rule %d", n)}
+		}
+		if allowed < 0 {
+			allowed = n
+		}
+	}
+
+	if allowed >= 0 {
+		return Decision{Allowed: true, Reason: fmt.Sprintf("allowed by rule %d", allowed)}
+	}
+
+	if policy.Default == EffectAllow {
+		return Decision{Allowed: true, Reason: "allowed by default"}
+	}
+
+	return Decision{Allowed: false, Reason: "no rule allows the request"}
+}
+
+// resourceField returns the payload field holding the resource of protocol
+func (policy *Policy) resourceField(protocol message.Protocol) (string, bool) {
+	if field, exists := policy.Resources[protocol]; exists {
+		return field, field != ""
+	}
+
+	field, exists := defaultResources[protocol]
+	return field, exists
+}
+
+func (rule *Rule) matches(request Request, roles []string) bool {
+	if len(rule.Principals) > 0 || len(rule.Roles) > 0 {
+		if request.Principal == "" {
+			return false
+		}
+
+		if !matchAny(rule.Principals, request.Principal) && !slices.ContainsFunc(roles, func(role string) bool {
+			return matchAny(rule.Roles, role)
+		}) {
+			return false
+		}
+	}
+
+	if len(rule.Actions) > 0 && !slices.Contains(rule.Actions, request.Action) {
+		return false
+	}
+
+	if len(rule.Protocols) > 0 && !matchAny(rule.Protocols, string(request.Protocol)) {
+		return false
+	}
+
+	if len(rule.Resources) > 0 && (request.Resource == "" || !matchAny(rule.Resources, request.Resource)) {
+		return false
+	}
+
+	return true
+}
+
+// matchAny reports whether value matches any of the patterns
+func matchAny(patterns []string, value string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		return match(pattern, value)
+	})
+}
+
+// match reports whether value matches pattern, in which "*" matches any
+// sequence of characters, including the separators of room IDs and URIs
+func match(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(value, part)
+		if index < 0 {
+			return false
+		}
+		value = value[index+len(part):]
+	}
+
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
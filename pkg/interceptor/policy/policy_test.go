@@ -0,0 +1,120 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const policyYAML = `
+roles:
+  alice: [operator]
+rules:
+  - effect: allow
+    roles: [operator]
+    protocols: [encrypt-update-session]
+    actions: [send]
+  - effect: allow
+    roles: [group-x]
+    protocols: [join_room, chat_source]
+    resources: [room-y]
+  - effect: allow
+    protocols: [ping, pong]
+  - effect: deny
+    principals: [mallory]
+`
+
+const policyJSON = `{
+	"roles": {"alice": ["operator"]},
+	"rules": [
+		{"effect": "allow", "roles": ["operator"], "protocols": ["encrypt-update-session"], "actions": ["send"]},
+		{"effect": "allow", "roles": ["group-x"], "protocols": ["join_room", "chat_source"], "resources": ["room-y"]},
+		{"effect": "allow", "protocols": ["ping", "pong"]},
+		{"effect": "deny", "principals": ["mallory"]}
+	]
+}`
+
+func write(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	return path
+}
+
+func TestEvaluate(t *testing.T) {
+	for _, name := range []string{"policy.yaml", "policy.json"} {
+		content := policyYAML
+		if filepath.Ext(name) == ".json" {
+			content = policyJSON
+		}
+
+		policy, err := Load(write(t, name, content))
+		if err != nil {
+			t.Fatalf("%s: Load failed: %v", name, err)
+		}
+
+		tests := []struct {
+			name    string
+			request Request
+			allowed bool
+		}{
+			{"operator by policy role", Request{Principal: "alice", Protocol: "encrypt-update-session", Action: ActionSend}, true},
+			{"operator by connection role", Request{Principal: "bob", Roles: []string{"operator"}, Protocol: "encrypt-update-session", Action: ActionSend}, true},
+			{"non operator", Request{Principal: "bob", Protocol: "encrypt-update-session", Action: ActionSend}, false},
+			{"operator receiving", Request{Principal: "alice", Protocol: "encrypt-update-session", Action: ActionReceive}, false},
+			{"group member joining room", Request{Principal: "bob", Roles: []string{"group-x"}, Protocol: "join_room", Action: ActionSend, Resource: "room-y"}, true},
+			{"group member joining other room", Request{Principal: "bob", Roles: []string{"group-x"}, Protocol: "join_room", Action: ActionSend, Resource: "room-z"}, false},
+			{"non member joining room", Request{Principal: "carol", Protocol: "join_room", Action: ActionSend, Resource: "room-y"}, false},
+			{"anonymous ping", Request{Protocol: "ping", Action: ActionSend}, true},
+			{"anonymous with role", Request{Roles: []string{"operator"}, Protocol: "encrypt-update-session", Action: ActionSend}, false},
+			{"deny overrides allow", Request{Principal: "mallory", Protocol: "ping", Action: ActionSend}, false},
+			{"unknown protocol", Request{Principal: "alice", Protocol: "app", Action: ActionSend}, false},
+		}
+
+		for _, tt := range tests {
+			if decision := policy.Evaluate(tt.request); decision.Allowed != tt.allowed {
+				t.Errorf("%s: %s: allowed mismatch: got %v, want %v (%s)", name, tt.name, decision.Allowed, tt.allowed, decision.Reason)
+			}
+		}
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"effect.yaml":  "rules:\n  - effect: maybe\n",
+		"action.yaml":  "rules:\n  - effect: allow\n    actions: [delete]\n",
+		"default.json": `{"default": "sometimes", "rules": []}`,
+		"policy.toml":  "",
+	}
+
+	for name, content := range tests {
+		if _, err := Load(write(t, name, content)); err == nil {
+			t.Errorf("%s: invalid policy loaded", name)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, value string
+		matched        bool
+	}{
+		{"room-y", "room-y", true},
+		{"room-*", "room-y", true},
+		{"room-*", "lobby", false},
+		{"*", "", true},
+		{"spiffe://example.org/*", "spiffe://example.org/ns/a/sa/b", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxcyyb", false},
+	}
+
+	for _, tt := range tests {
+		if matched := match(tt.pattern, tt.value); matched != tt.matched {
+			t.Errorf("match(%q, %q) mismatch: got %v, want %v", tt.pattern, tt.value, matched, tt.matched)
+		}
+	}
+}
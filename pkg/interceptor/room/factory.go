@@ -1 +1,43 @@
 package room
+
+import (
+	"context"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+)
+
+// Option defines a function type that configures an Interceptor instance
+type Option = func(*Interceptor) error
+
+// InterceptorFactory creates room interceptors with configured options
+type InterceptorFactory struct {
+	opts []Option
+}
+
+// CreateInterceptorFactory constructs a new factory with the provided options
+func CreateInterceptorFactory(options ...Option) *InterceptorFactory {
+	return &InterceptorFactory{
+		opts: options,
+	}
+}
+
+// NewInterceptor creates and configures a new room interceptor
+// Implements the interceptor.Factory interface
+func (factory *InterceptorFactory) NewInterceptor(ctx context.Context, id string) (interceptor.Interceptor, error) {
+	roomInterceptor := &Interceptor{
+		NoOpInterceptor: interceptor.NoOpInterceptor{
+			ID:  id,
+			Ctx: ctx,
+		},
+		rooms:  make(map[string]*room),
+		states: make(map[interceptor.Connection]*state),
+	}
+
+	for _, option := range factory.opts {
+		if err := option(roomInterceptor); err != nil {
+			return nil, err
+		}
+	}
+
+	return roomInterceptor, nil
+}
@@ -32,48 +32,60 @@ func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, wr
 
 func (i *Interceptor) InterceptSocketReader(reader interceptor.Reader) interceptor.Reader {
 	return interceptor.ReaderFunc(func(connection interceptor.Connection) (websocket.MessageType, message.Message, error) {
-		messageType, data, err := reader.Read(connection)
+		messageType, m, err := reader.Read(connection)
 		if err != nil {
-			return messageType, data, err
+			return messageType, m, err
 		}
 
-		msg, ok := data.(*interceptor.BaseMessage)
-		if !ok || (msg.Protocol != interceptor.IProtocol && msg.MainType != MainType) {
-			return messageType, data, nil
+		if !i.bound(connection) {
+			return messageType, m, nil
 		}
 
-		i.Mutex.Lock()
-		defer i.Mutex.Unlock()
-
-		payload, err := PayloadUnmarshal(msg.SubType, msg.Payload)
+		payload, err := interceptor.Decode(protocolMap, m)
 		if err != nil {
-			return messageType, data, nil
+			return messageType, m, nil
 		}
 
-		if _, exists := i.states[connection]; exists {
+		// Process acquires the interceptor lock itself
+		if err := payload.Process(i, connection); err != nil {
+			fmt.Println("error while processing room message:", err.Error())
+		}
 
-			if err := payload.Process(msg.Header, i, connection); err != nil {
-				return messageType, data, nil
-			}
+		if !isRequest(payload.Protocol()) {
+			return messageType, m, nil
 		}
 
-		return messageType, data, nil
+		return messageType, m, interceptor.ErrMessageConsumed
 	})
 }
 
+// bound reports whether the connection has been bound to this interceptor
+func (i *Interceptor) bound(connection interceptor.Connection) bool {
+	i.Mutex.RLock()
+	defer i.Mutex.RUnlock()
+
+	_, exists := i.states[connection]
+	return exists
+}
+
 func (i *Interceptor) UnBindSocketConnection(connection interceptor.Connection) {
 	i.Mutex.Lock()
 	defer i.Mutex.Unlock()
 
-	if _, exists := i.states[connection]; exists {
-		delete(i.states, connection)
+	if _, exists := i.states[connection]; !exists {
+		return
 	}
+	delete(i.states, connection)
 
-	// for _, room := range i.rooms {
-	// 	if room.owner == connection {
-	// 		room.cancel()
-	// 	}
-	// }
+	// The rooms the connection was in learn that it left
+	for _, room := range i.rooms {
+		if !room.has(connection) {
+			continue
+		}
+		if err := room.remove(connection, true); err != nil {
+			fmt.Println("error while removing connection from room:", err.Error())
+		}
+	}
 }
 
 func (i *Interceptor) Close() error {
@@ -92,7 +104,7 @@ func (i *Interceptor) Close() error {
 // ================================================================================================================== //
 // ================================================================================================================== //
 
-func (payload *CreateRoom) Process(header message.Header, _interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+func (payload *CreateRoom) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
 	if err := payload.Validate(); err != nil {
 		return err
 	}
@@ -110,7 +122,7 @@ func (payload *CreateRoom) Process(header message.Header, _interceptor intercept
 		return errors.New("connection not registered yet")
 	}
 
-	connState.id = header.SenderID
+	connState.id = interceptor.SenderOf(connection, payload)
 
 	r, exists := i.rooms[payload.RoomID]
 	if exists {
@@ -128,7 +140,7 @@ func (payload *CreateRoom) Process(header message.Header, _interceptor intercept
 	return nil
 }
 
-func (payload *JoinRoom) Process(header message.Header, _interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+func (payload *JoinRoom) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
 	if err := payload.Validate(); err != nil {
 		return err
 	}
@@ -146,7 +158,7 @@ func (payload *JoinRoom) Process(header message.Header, _interceptor interceptor
 		return errors.New("connection not registered yet")
 	}
 
-	state.id = header.SenderID
+	state.id = interceptor.SenderOf(connection, payload)
 
 	r, exists := i.rooms[payload.RoomID]
 	if !exists {
@@ -157,7 +169,7 @@ func (payload *JoinRoom) Process(header message.Header, _interceptor interceptor
 	return r.add(connection, state)
 }
 
-func (payload *LeaveRoom) Process(header message.Header, _interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+func (payload *LeaveRoom) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
 	if err := payload.Validate(); err != nil {
 		return err
 	}
@@ -181,12 +193,12 @@ func (payload *LeaveRoom) Process(header message.Header, _interceptor intercepto
 		return errors.New("connection not registered yet")
 	}
 
-	state.id = header.SenderID
+	state.id = interceptor.SenderOf(connection, payload)
 
-	return r.remove(connection)
+	return r.remove(connection, false)
 }
 
-func (payload *ChatSource) Process(header message.Header, _interceptor interceptor.Interceptor, connection interceptor.Connection) error {
+func (payload *ChatSource) Process(_interceptor interceptor.Interceptor, connection interceptor.Connection) error {
 	if err := payload.Validate(); err != nil {
 		return err
 	}
@@ -210,8 +222,8 @@ func (payload *ChatSource) Process(header message.Header, _interceptor intercept
 		return errors.New("connection not registered yet")
 	}
 
-	state.id = header.SenderID
+	state.id = interceptor.SenderOf(connection, payload)
 
 	p := &ChatDest{RoomID: payload.RoomID, MessageID: payload.MessageID, Content: payload.Content, Timestamp: payload.Timestamp}
-	return r.send(header.SenderID, p, payload.RecipientID...)
+	return r.send(state.id, p, payload.RecipientID...)
 }
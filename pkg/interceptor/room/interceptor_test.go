@@ -0,0 +1,224 @@
+package room
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// conn is a connection whose messages are written through a recorder. It
+// carries a name as pointers to zero-sized values may compare equal.
+type conn struct{ name string }
+
+func (c *conn) Write(_ context.Context, _ websocket.MessageType, _ []byte) error { return nil }
+
+func (c *conn) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	<-ctx.Done()
+	return websocket.MessageText, nil, ctx.Err()
+}
+
+// recorder is a writer keeping the messages written to every connection
+type recorder struct {
+	written map[interceptor.Connection][]message.Message
+	mux     sync.Mutex
+}
+
+func (r *recorder) Write(connection interceptor.Connection, _ websocket.MessageType, msg message.Message) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.written[connection] = append(r.written[connection], msg)
+	return nil
+}
+
+// take returns the protocols of the messages written to the connection since
+// the last call
+func (r *recorder) take(connection interceptor.Connection) []message.Protocol {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var protocols []message.Protocol
+	for _, msg := range r.written[connection] {
+		protocols = append(protocols, msg.Message().Header.Protocol)
+	}
+	delete(r.written, connection)
+
+	return protocols
+}
+
+func setup(t *testing.T, clients int) (*Interceptor, *recorder, []*conn) {
+	t.Helper()
+
+	i, err := CreateInterceptorFactory().NewInterceptor(context.Background(), "server")
+	if err != nil {
+		t.Fatalf("NewInterceptor failed: %v", err)
+	}
+
+	r := &recorder{written: make(map[interceptor.Connection][]message.Message)}
+	conns := make([]*conn, clients)
+	for n := range conns {
+		conns[n] = &conn{name: strconv.Itoa(n)}
+		if _, _, err := i.BindSocketConnection(conns[n], r, nil); err != nil {
+			t.Fatalf("BindSocketConnection failed: %v", err)
+		}
+	}
+
+	return i.(*Interceptor), r, conns
+}
+
+// read passes the payload from the sender through the reader of the
+// interceptor and returns the reader's error
+func read(t *testing.T, i *Interceptor, connection interceptor.Connection, senderID string, payload message.Message) error {
+	t.Helper()
+
+	msg, err := message.CreateMessage(senderID, "server", payload)
+	if err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+
+	reader := i.InterceptSocketReader(interceptor.ReaderFunc(func(_ interceptor.Connection) (websocket.MessageType, message.Message, error) {
+		return websocket.MessageText, msg, nil
+	}))
+	_, _, err = reader.Read(connection)
+
+	return err
+}
+
+func chat(content string, recipients ...string) *ChatSource {
+	return &ChatSource{RoomID: "lobby", MessageID: content, RecipientID: recipients, Content: json.RawMessage(`"` + content + `"`), Timestamp: time.Now()}
+}
+
+func expect(t *testing.T, r *recorder, connection interceptor.Connection, want ...message.Protocol) {
+	t.Helper()
+
+	if got := r.take(connection); !slices.Equal(got, want) {
+		t.Errorf("written protocols mismatch: got %v, want %v", got, want)
+	}
+}
+
+func TestRoom(t *testing.T) {
+	i, r, conns := setup(t, 3)
+	alice, bob, mallory := conns[0], conns[1], conns[2]
+
+	// Requests are consumed
+	if err := read(t, i, alice, "alice", &CreateRoom{RoomID: "lobby", ClientsToAllow: []string{"alice", "bob"}}); !errors.Is(err, interceptor.ErrMessageConsumed) {
+		t.Fatalf("expected ErrMessageConsumed, got %v", err)
+	}
+	expect(t, r, alice, ProtocolSuccess)
+
+	if err := read(t, i, bob, "bob", &JoinRoom{RoomID: "lobby"}); !errors.Is(err, interceptor.ErrMessageConsumed) {
+		t.Fatalf("expected ErrMessageConsumed, got %v", err)
+	}
+	expect(t, r, alice, ProtocolClientJoined)
+	expect(t, r, bob, ProtocolClientJoined, ProtocolSuccess)
+
+	// Clients not allowed in the room cannot join
+	_ = read(t, i, mallory, "mallory", &JoinRoom{RoomID: "lobby"})
+	expect(t, r, alice)
+	expect(t, r, mallory)
+
+	// Broadcasts reach every participant, the sender included
+	if err := read(t, i, alice, "alice", chat("hello")); !errors.Is(err, interceptor.ErrMessageConsumed) {
+		t.Fatalf("expected ErrMessageConsumed, got %v", err)
+	}
+	expect(t, r, alice, ProtocolChatDest)
+	expect(t, r, bob, ProtocolChatDest)
+
+	// Direct messages only reach their recipients, relayed from the sender
+	_ = read(t, i, bob, "bob", chat("direct", "alice"))
+	expect(t, r, bob)
+
+	r.mux.Lock()
+	dest := r.written[alice][0].Message()
+	r.mux.Unlock()
+	var payload ChatDest
+	if err := dest.DecodePayload(&payload); err != nil {
+		t.Fatalf("DecodePayload failed: %v", err)
+	}
+	if dest.SenderID != "bob" || dest.ReceiverID != "alice" || string(payload.Content) != `"direct"` {
+		t.Errorf("relayed message mismatch: got %+v with %s", dest.Header, payload.Content)
+	}
+	expect(t, r, alice, ProtocolChatDest)
+
+	// Leaving notifies every participant, the leaver included
+	_ = read(t, i, bob, "bob", &LeaveRoom{RoomID: "lobby"})
+	expect(t, r, alice, ProtocolClientLeft)
+	expect(t, r, bob, ProtocolClientLeft, ProtocolSuccess)
+
+	_ = read(t, i, alice, "alice", chat("after"))
+	expect(t, r, alice, ProtocolChatDest)
+	expect(t, r, bob)
+}
+
+func TestRoom_Disconnect(t *testing.T) {
+	i, r, conns := setup(t, 2)
+	alice, bob := conns[0], conns[1]
+
+	_ = read(t, i, alice, "alice", &CreateRoom{RoomID: "lobby", ClientsToAllow: []string{"alice", "bob"}})
+	_ = read(t, i, bob, "bob", &JoinRoom{RoomID: "lobby"})
+	r.take(alice)
+	r.take(bob)
+
+	// The participants left learn of a disconnect, the disconnected client is
+	// not written to
+	i.UnBindSocketConnection(bob)
+	expect(t, r, alice, ProtocolClientLeft)
+	expect(t, r, bob)
+
+	_ = read(t, i, alice, "alice", chat("after"))
+	expect(t, r, alice, ProtocolChatDest)
+	expect(t, r, bob)
+
+	// Unbinding again is a no-op
+	i.UnBindSocketConnection(bob)
+	expect(t, r, alice)
+}
+
+func TestRoom_PassThrough(t *testing.T) {
+	i, r, conns := setup(t, 1)
+
+	// Notifications are addressed to the application and passed on
+	notifications := []message.Message{
+		&ChatDest{RoomID: "lobby", MessageID: "1", Content: json.RawMessage(`"hello"`)},
+		&ClientJoined{RoomID: "lobby", ClientID: "bob"},
+		&ClientLeft{RoomID: "lobby", ClientID: "bob"},
+		&Success{SuccessMessage: "done"},
+	}
+	for _, notification := range notifications {
+		if err := read(t, i, conns[0], "server", notification); err != nil {
+			t.Errorf("%s not passed on: %v", notification.Protocol(), err)
+		}
+	}
+
+	// Connections not bound to the interceptor are left alone
+	if err := read(t, i, &conn{name: "unbound"}, "alice", &CreateRoom{RoomID: "lobby"}); err != nil {
+		t.Errorf("request of an unbound connection processed: %v", err)
+	}
+	expect(t, r, conns[0])
+}
+
+func TestErrorMessages(t *testing.T) {
+	cause := errors.New("room does not exists")
+	for _, payload := range []interceptor.Message{
+		CreateRoomErrorMessage("lobby", cause),
+		JoinRoomErrorMessage("lobby", cause),
+		LeaveRoomErrorMessage("lobby", cause),
+		ChatRoomErrorMessage("1", "lobby", cause),
+	} {
+		text := payload.(*Error).ErrorMessage
+		if !strings.HasPrefix(text, "Failed to ") || !strings.HasSuffix(text, "lobby: "+cause.Error()) {
+			t.Errorf("error message mismatch: got %q", text)
+		}
+	}
+}
@@ -10,64 +10,48 @@ import (
 )
 
 var (
-	MainType interceptor.MainType = "room"
-
-	CreateRoomSubType       interceptor.SubType = "create_room"
-	JoinRoomSubType         interceptor.SubType = "join_room"
-	LeaveRoomSubType        interceptor.SubType = "leave_room"
-	ChatSourceRoomSubType   interceptor.SubType = "chat_source"
-	ChatDestRoomSubType     interceptor.SubType = "chat_destination"
-	ClientJoinedRoomSubType interceptor.SubType = "client_joined"
-	ClientLeftRoomSubType   interceptor.SubType = "client_left"
-	SuccessRoomSubType      interceptor.SubType = "success"
-	ErrorRoomSubType        interceptor.SubType = "error"
-
-	subTypeMap = map[interceptor.SubType]interceptor.Payload{
-		CreateRoomSubType:       &CreateRoom{},
-		JoinRoomSubType:         &JoinRoom{},
-		LeaveRoomSubType:        &LeaveRoom{},
-		ChatSourceRoomSubType:   &ChatSource{},
-		ChatDestRoomSubType:     &ChatDest{},
-		ClientJoinedRoomSubType: &ClientJoined{},
-		ClientLeftRoomSubType:   &ClientLeft{},
-		SuccessRoomSubType:      &Success{},
-		ErrorRoomSubType:        &Error{},
-	}
+	ProtocolCreateRoom   message.Protocol = "create_room"
+	ProtocolJoinRoom     message.Protocol = "join_room"
+	ProtocolLeaveRoom    message.Protocol = "leave_room"
+	ProtocolChatSource   message.Protocol = "chat_source"
+	ProtocolChatDest     message.Protocol = "chat_destination"
+	ProtocolClientJoined message.Protocol = "client_joined"
+	ProtocolClientLeft   message.Protocol = "client_left"
+	ProtocolSuccess      message.Protocol = "room_success"
+	ProtocolError        message.Protocol = "room_error"
 )
 
-func PayloadUnmarshal(sub interceptor.SubType, p json.RawMessage) (interceptor.Payload, error) {
-	if payload, exists := subTypeMap[sub]; exists {
-		if err := payload.Unmarshal(p); err != nil {
-			return nil, err
-		}
-		return payload, nil
-	}
-
-	return nil, errors.New("processor does not exist for given type")
-}
-
-func CreateMessage(senderID string, receiverID string, payload interceptor.Payload) (*interceptor.BaseMessage, error) {
-	data, err := payload.Marshal()
-	if err != nil {
-		return nil, err
+var protocolMap = message.CreateProtocolRegistry()
+
+func init() {
+	message.MustRegister[CreateRoom](protocolMap)
+	message.MustRegister[JoinRoom](protocolMap)
+	message.MustRegister[LeaveRoom](protocolMap)
+	message.MustRegister[ChatSource](protocolMap)
+	message.MustRegister[ChatDest](protocolMap)
+	message.MustRegister[ClientJoined](protocolMap)
+	message.MustRegister[ClientLeft](protocolMap)
+	message.MustRegister[Success](protocolMap)
+	message.MustRegister[Error](protocolMap)
+}
+
+// isRequest reports whether the protocol is a request handled by the room
+// interceptor. Every other room protocol is a notification addressed to the
+// application and is passed on after processing.
+func isRequest(protocol message.Protocol) bool {
+	switch protocol {
+	case ProtocolCreateRoom, ProtocolJoinRoom, ProtocolLeaveRoom, ProtocolChatSource:
+		return true
+	default:
+		return false
 	}
-
-	return &interceptor.BaseMessage{
-		Header: interceptor.Header{
-			SenderID:   senderID,
-			ReceiverID: receiverID,
-			Protocol:   interceptor.IProtocol,
-			MainType:   MainType,
-			SubType:    payload.Type(),
-		},
-		Payload: data,
-	}, nil
 }
 
 type CreateRoom struct {
-	RoomID         string        `json:"room_id"`
-	CloseTime      time.Duration `json:"close_time"`
-	ClientsToAllow []string      `json:"clients_to_allow"`
+	message.BaseMessage               // NOTE: EMPTY PAYLOAD
+	RoomID              string        `json:"room_id"`
+	CloseTime           time.Duration `json:"close_time"`
+	ClientsToAllow      []string      `json:"clients_to_allow"`
 }
 
 func (payload *CreateRoom) Marshal() ([]byte, error) {
@@ -85,13 +69,14 @@ func (payload *CreateRoom) Validate() error {
 	return nil
 }
 
-func (payload *CreateRoom) Type() interceptor.SubType {
-	return CreateRoomSubType
+func (payload *CreateRoom) Protocol() message.Protocol {
+	return ProtocolCreateRoom
 }
 
 // JoinRoom is sent by clients to server to join an existing room
 type JoinRoom struct {
-	RoomID string `json:"room_id"`
+	message.BaseMessage        // NOTE: EMPTY PAYLOAD
+	RoomID              string `json:"room_id"`
 }
 
 func (payload *JoinRoom) Marshal() ([]byte, error) {
@@ -109,13 +94,14 @@ func (payload *JoinRoom) Validate() error {
 	return nil
 }
 
-func (payload *JoinRoom) Type() interceptor.SubType {
-	return JoinRoomSubType
+func (payload *JoinRoom) Protocol() message.Protocol {
+	return ProtocolJoinRoom
 }
 
 // LeaveRoom is sent by clients to server to leave a room
 type LeaveRoom struct {
-	RoomID string `json:"room_id"`
+	message.BaseMessage        // NOTE: EMPTY PAYLOAD
+	RoomID              string `json:"room_id"`
 }
 
 func (payload *LeaveRoom) Marshal() ([]byte, error) {
@@ -133,16 +119,17 @@ func (payload *LeaveRoom) Validate() error {
 	return nil
 }
 
-func (payload *LeaveRoom) Type() interceptor.SubType {
-	return LeaveRoomSubType
+func (payload *LeaveRoom) Protocol() message.Protocol {
+	return ProtocolLeaveRoom
 }
 
 type ChatSource struct {
-	RoomID      string          `json:"room_id"`
-	MessageID   string          `json:"message_id"`
-	RecipientID []string        `json:"recipient_id,omitempty"` // Empty for broadcast to room
-	Content     json.RawMessage `json:"content"`
-	Timestamp   time.Time       `json:"timestamp"`
+	message.BaseMessage                 // NOTE: EMPTY PAYLOAD
+	RoomID              string          `json:"room_id"`
+	MessageID           string          `json:"message_id"`
+	RecipientID         []string        `json:"recipient_id,omitempty"` // Empty for broadcast to room
+	Content             json.RawMessage `json:"content"`
+	Timestamp           time.Time       `json:"timestamp"`
 }
 
 func (payload *ChatSource) Marshal() ([]byte, error) {
@@ -160,15 +147,16 @@ func (payload *ChatSource) Validate() error {
 	return nil
 }
 
-func (payload *ChatSource) Type() interceptor.SubType {
-	return ChatSourceRoomSubType
+func (payload *ChatSource) Protocol() message.Protocol {
+	return ProtocolChatSource
 }
 
 type ChatDest struct {
-	RoomID    string          `json:"room_id"`
-	MessageID string          `json:"message_id"`
-	Content   json.RawMessage `json:"content"`
-	Timestamp time.Time       `json:"timestamp"`
+	message.BaseMessage                 // NOTE: EMPTY PAYLOAD
+	RoomID              string          `json:"room_id"`
+	MessageID           string          `json:"message_id"`
+	Content             json.RawMessage `json:"content"`
+	Timestamp           time.Time       `json:"timestamp"`
 }
 
 func (payload *ChatDest) Marshal() ([]byte, error) {
@@ -186,19 +174,21 @@ func (payload *ChatDest) Validate() error {
 	return nil
 }
 
-func (payload *ChatDest) Process(_ message.Header, _ interceptor.Interceptor, _ interceptor.Connection) error {
+func (payload *ChatDest) Process(_ interceptor.Interceptor, _ interceptor.Connection) error {
 	return nil
 }
 
-func (payload *ChatDest) Type() interceptor.SubType {
-	return ChatDestRoomSubType
+func (payload *ChatDest) Protocol() message.Protocol {
+	return ProtocolChatDest
 }
 
-// ClientJoined is broadcast to room members when a new client joins
+// ClientJoined is broadcast to room members when a new client joins. The
+// joiner receives one for every member already in the room.
 type ClientJoined struct {
-	ClientID string    `json:"client_id"`
-	RoomID   string    `json:"room_id"`
-	JoinedAt time.Time `json:"joined_at"`
+	message.BaseMessage           // NOTE: EMPTY PAYLOAD
+	ClientID            string    `json:"client_id"`
+	RoomID              string    `json:"room_id"`
+	JoinedAt            time.Time `json:"joined_at"`
 }
 
 func (payload *ClientJoined) Marshal() ([]byte, error) {
@@ -216,19 +206,20 @@ func (payload *ClientJoined) Validate() error {
 	return nil
 }
 
-func (payload *ClientJoined) Process(_ message.Header, _ interceptor.Interceptor, _ interceptor.Connection) error {
+func (payload *ClientJoined) Process(_ interceptor.Interceptor, _ interceptor.Connection) error {
 	return nil
 }
 
-func (payload *ClientJoined) Type() interceptor.SubType {
-	return ClientJoinedRoomSubType
+func (payload *ClientJoined) Protocol() message.Protocol {
+	return ProtocolClientJoined
 }
 
 // ClientLeft is broadcast to room members when a client leaves
 type ClientLeft struct {
-	ClientID string    `json:"client_id"`
-	RoomID   string    `json:"room_id"`
-	LeftAt   time.Time `json:"left_at"`
+	message.BaseMessage           // NOTE: EMPTY PAYLOAD
+	ClientID            string    `json:"client_id"`
+	RoomID              string    `json:"room_id"`
+	LeftAt              time.Time `json:"left_at"`
 }
 
 func (payload *ClientLeft) Marshal() ([]byte, error) {
@@ -246,17 +237,18 @@ func (payload *ClientLeft) Validate() error {
 	return nil
 }
 
-func (payload *ClientLeft) Process(_ message.Header, _ interceptor.Interceptor, _ interceptor.Connection) error {
+func (payload *ClientLeft) Process(_ interceptor.Interceptor, _ interceptor.Connection) error {
 	return nil
 }
 
-func (payload *ClientLeft) Type() interceptor.SubType {
-	return ClientLeftRoomSubType
+func (payload *ClientLeft) Protocol() message.Protocol {
+	return ProtocolClientLeft
 }
 
 // Success is sent to clients when a room operation succeeds
 type Success struct {
-	SuccessMessage string `json:"success_message"`
+	message.BaseMessage        // NOTE: EMPTY PAYLOAD
+	SuccessMessage      string `json:"success_message"`
 }
 
 func (payload *Success) Marshal() ([]byte, error) {
@@ -271,29 +263,30 @@ func (payload *Success) Validate() error {
 	return nil
 }
 
-func (payload *Success) Process(_ message.Header, _ interceptor.Interceptor, _ interceptor.Connection) error {
+func (payload *Success) Process(_ interceptor.Interceptor, _ interceptor.Connection) error {
 	return nil
 }
 
-func (payload *Success) Type() interceptor.SubType {
-	return SuccessRoomSubType
+func (payload *Success) Protocol() message.Protocol {
+	return ProtocolSuccess
 }
 
 // Specific success message creators
 
-func JoinRoomSuccessMessage(roomID string) interceptor.Payload {
+func JoinRoomSuccessMessage(roomID string) interceptor.Message {
 	return &Success{SuccessMessage: "Joined room " + roomID + " successfully"}
 }
-func LeaveRoomSuccessMessage(roomID string) interceptor.Payload {
+func LeaveRoomSuccessMessage(roomID string) interceptor.Message {
 	return &Success{SuccessMessage: "Left room " + roomID + " successfully"}
 }
 
-func ChatRoomSuccessMessage(messageID, roomID string) interceptor.Payload {
+func ChatRoomSuccessMessage(messageID, roomID string) interceptor.Message {
 	return &Success{SuccessMessage: "message " + messageID + " " + roomID + " successfully"}
 }
 
 type Error struct {
-	ErrorMessage string `json:"error_message"`
+	message.BaseMessage        // NOTE: EMPTY PAYLOAD
+	ErrorMessage        string `json:"error_message"`
 }
 
 func (payload *Error) Marshal() ([]byte, error) {
@@ -308,26 +301,26 @@ func (payload *Error) Validate() error {
 	return nil
 }
 
-func (payload *Error) Process(_ message.Header, _ interceptor.Interceptor, _ interceptor.Connection) error {
+func (payload *Error) Process(_ interceptor.Interceptor, _ interceptor.Connection) error {
 	return nil
 }
 
-func (payload *Error) Type() interceptor.SubType {
-	return ErrorRoomSubType
+func (payload *Error) Protocol() message.Protocol {
+	return ProtocolError
 }
 
-func CreateRoomErrorMessage(roomID string) interceptor.Payload {
-	return &Error{ErrorMessage: "RoomMessage " + roomID + " created successfully"}
+func CreateRoomErrorMessage(roomID string, err error) interceptor.Message {
+	return &Error{ErrorMessage: "Failed to create room " + roomID + ": " + err.Error()}
 }
 
-func JoinRoomErrorMessage(roomID string) interceptor.Payload {
-	return &Error{ErrorMessage: "Joined room " + roomID + " successfully"}
+func JoinRoomErrorMessage(roomID string, err error) interceptor.Message {
+	return &Error{ErrorMessage: "Failed to join room " + roomID + ": " + err.Error()}
 }
 
-func LeaveRoomErrorMessage(roomID string) interceptor.Payload {
-	return &Error{ErrorMessage: "Left room " + roomID + " successfully"}
+func LeaveRoomErrorMessage(roomID string, err error) interceptor.Message {
+	return &Error{ErrorMessage: "Failed to leave room " + roomID + ": " + err.Error()}
 }
 
-func ChatRoomErrorMessage(messageID, roomID string) interceptor.Payload {
-	return &Error{ErrorMessage: "message " + messageID + " " + roomID + " successfully"}
+func ChatRoomErrorMessage(messageID, roomID string, err error) interceptor.Message {
+	return &Error{ErrorMessage: "Failed to send message " + messageID + " to room " + roomID + ": " + err.Error()}
 }
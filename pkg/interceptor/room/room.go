@@ -9,6 +9,7 @@ import (
 	"github.com/coder/websocket"
 
 	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
 	"github.com/harshabose/skyline_sonata/serve/pkg/utils"
 )
 
@@ -71,25 +72,37 @@ func (room *room) add(connection interceptor.Connection, state *state) error {
 
 	room.participants[connection] = state
 
+	// Participants learn of each other, the joiner of those already there
 	for _, client := range room.participants {
 		if client.id != state.id {
 			payload := &ClientJoined{ClientID: state.id, RoomID: room.id, JoinedAt: time.Now()}
-			if err := room.send("server", payload, client.id); err != nil {
+			if err := room.broadcast("server", payload, client.id); err != nil {
+				merr.Add(err)
+			}
+
+			present := &ClientJoined{ClientID: client.id, RoomID: room.id, JoinedAt: time.Now()}
+			if err := room.broadcast("server", present, state.id); err != nil {
 				merr.Add(err)
 			}
 		}
 	}
 
-	merr.Add(room.send("server", JoinRoomSuccessMessage(room.id), state.id))
+	merr.Add(room.broadcast("server", JoinRoomSuccessMessage(room.id), state.id))
 	room.lastActivity = time.Now()
 
 	return merr.ErrorOrNil()
 }
 
-func (room *room) send(from string, payload interceptor.Payload, to ...string) error {
+func (room *room) send(from string, payload interceptor.Message, to ...string) error {
 	room.mux.Lock()
 	defer room.mux.Unlock()
 
+	return room.broadcast(from, payload, to...)
+}
+
+// broadcast delivers the payload to the given participants, or to every
+// allowed participant when none are given. The caller must hold room.mux.
+func (room *room) broadcast(from string, payload interceptor.Message, to ...string) error {
 	merr := utils.NewMultiError()
 
 	if len(to) == 0 || to == nil {
@@ -97,9 +110,10 @@ func (room *room) send(from string, payload interceptor.Payload, to ...string) e
 	}
 
 	for _, id := range to {
-		msg, err := CreateMessage(from, id, payload)
+		msg, err := message.CreateMessage(from, id, payload)
 		if err != nil {
 			merr.Add(err)
+			continue
 		}
 
 		if err := room.sendTo(id, msg); err != nil {
@@ -110,7 +124,7 @@ func (room *room) send(from string, payload interceptor.Payload, to ...string) e
 	return merr.ErrorOrNil()
 }
 
-func (room *room) sendTo(id string, msg *interceptor.BaseMessage) error {
+func (room *room) sendTo(id string, msg message.Message) error {
 	for conn, state := range room.participants {
 		if state.id == id {
 			return state.writer.Write(conn, websocket.MessageText, msg)
@@ -120,7 +134,18 @@ func (room *room) sendTo(id string, msg *interceptor.BaseMessage) error {
 	return errors.New("connection does not exists")
 }
 
-func (room *room) remove(connection interceptor.Connection) error {
+// has reports whether the connection takes part in the room
+func (room *room) has(connection interceptor.Connection) bool {
+	room.mux.Lock()
+	defer room.mux.Unlock()
+
+	_, exists := room.participants[connection]
+	return exists
+}
+
+// remove takes the connection out of the room and tells the participants it
+// left. A disconnected connection is not written to anymore.
+func (room *room) remove(connection interceptor.Connection, disconnected bool) error {
 	room.mux.Lock()
 	defer room.mux.Unlock()
 
@@ -136,12 +161,18 @@ func (room *room) remove(connection interceptor.Connection) error {
 		return errors.New("participant does not exists")
 	}
 
+	if disconnected {
+		delete(room.participants, connection)
+	}
+
 	for _, client := range room.participants {
 		payload := &ClientLeft{ClientID: state.id, RoomID: room.id, LeftAt: time.Now()}
-		merr.Add(room.send("server", payload, client.id))
+		merr.Add(room.broadcast("server", payload, client.id))
 	}
 
-	merr.Add(room.send("server", LeaveRoomSuccessMessage(room.id), state.id))
+	if !disconnected {
+		merr.Add(room.broadcast("server", LeaveRoomSuccessMessage(room.id), state.id))
+	}
 
 	delete(room.participants, connection)
 	room.lastActivity = time.Now()
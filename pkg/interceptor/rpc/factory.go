@@ -0,0 +1,78 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+)
+
+// Option defines a function type that configures an Interceptor instance
+type Option = func(*Interceptor) error
+
+// InterceptorFactory creates rpc interceptors with a predefined set of options.
+// As interceptors are created by the registry, the application gets hold of
+// them through OnNewInterceptor to make calls.
+type InterceptorFactory struct {
+	opts      []Option
+	callbacks []func(id string, i *Interceptor)
+}
+
+// WithMethod registers a method callable by the remote side under name
+func WithMethod(name string, method Method) Option {
+	return func(interceptor *Interceptor) error {
+		return interceptor.Register(name, method)
+	}
+}
+
+// WithTimeout bounds calls made with a context without deadline. Zero waits
+// for the response until the connection closes.
+func WithTimeout(timeout time.Duration) Option {
+	return func(interceptor *Interceptor) error {
+		if timeout < 0 {
+			return errors.New("timeout must not be negative")
+		}
+		interceptor.timeout = timeout
+		return nil
+	}
+}
+
+// CreateInterceptorFactory constructs a new factory that will create rpc
+// interceptors with the provided options
+func CreateInterceptorFactory(options ...Option) *InterceptorFactory {
+	return &InterceptorFactory{
+		opts: options,
+	}
+}
+
+// OnNewInterceptor registers a callback invoked with every interceptor the
+// factory creates, along with the id it was created for
+func (factory *InterceptorFactory) OnNewInterceptor(callback func(id string, i *Interceptor)) {
+	factory.callbacks = append(factory.callbacks, callback)
+}
+
+// NewInterceptor creates and configures a new rpc interceptor instance.
+// This method implements the interceptor.Factory interface.
+func (factory *InterceptorFactory) NewInterceptor(ctx context.Context, id string) (interceptor.Interceptor, error) {
+	rpcInterceptor := &Interceptor{
+		NoOpInterceptor: interceptor.NoOpInterceptor{
+			ID:  id,
+			Ctx: ctx,
+		},
+		states:  make(map[interceptor.Connection]*state),
+		methods: make(map[string]Method),
+	}
+
+	for _, option := range factory.opts {
+		if err := option(rpcInterceptor); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, callback := range factory.callbacks {
+		callback(id, rpcInterceptor)
+	}
+
+	return rpcInterceptor, nil
+}
@@ -0,0 +1,334 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/google/uuid"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+var (
+	ErrConnectionNotFound = errors.New("connection not registered")
+	ErrConnectionClosed   = errors.New("connection closed before the call completed")
+	ErrMethodExists       = errors.New("method already registered")
+	ErrInvalidInterceptor = errors.New("inappropriate interceptor for the payload")
+)
+
+// Interceptor implements request/response calls on top of the message
+// stream. Either side of a connection can Call methods registered on the
+// other; requests and responses are matched by a correlation ID carried in
+// the payload, so any number of calls can be in flight at once.
+type Interceptor struct {
+	interceptor.NoOpInterceptor
+	states  map[interceptor.Connection]*state
+	methods map[string]Method
+	timeout time.Duration // Deadline applied to calls whose context has none
+}
+
+// Register adds a method callable by the remote side under name
+func (i *Interceptor) Register(name string, method Method) error {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	if _, exists := i.methods[name]; exists {
+		return fmt.Errorf("%w: %s", ErrMethodExists, name)
+	}
+	i.methods[name] = method
+
+	return nil
+}
+
+func (i *Interceptor) method(name string) (Method, bool) {
+	i.Mutex.RLock()
+	defer i.Mutex.RUnlock()
+
+	method, exists := i.methods[name]
+	return method, exists
+}
+
+func (i *Interceptor) BindSocketConnection(connection interceptor.Connection, writer interceptor.Writer, reader interceptor.Reader) (interceptor.Writer, interceptor.Reader, error) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	if _, exists := i.states[connection]; exists {
+		return nil, nil, errors.New("connection already exists")
+	}
+
+	ctx, cancel := context.WithCancel(i.Ctx)
+
+	i.states[connection] = &state{
+		peerid:  "unknown", // unknown until the first rpc message
+		writer:  writer,    // full-stack writer, so that calls go through every interceptor
+		pending: make(map[string]chan *Response),
+		running: make(map[string]context.CancelFunc),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	return writer, reader, nil
+}
+
+func (i *Interceptor) InterceptSocketReader(reader interceptor.Reader) interceptor.Reader {
+	return interceptor.ReaderFunc(func(conn interceptor.Connection) (messageType websocket.MessageType, m message.Message, err error) {
+		messageType, m, err = reader.Read(conn)
+		if err != nil {
+			return messageType, m, err
+		}
+
+		if _, err := i.getState(conn); err != nil {
+			return messageType, m, nil
+		}
+
+		payload, err := interceptor.Decode(protocolMap, m)
+		if err != nil {
+			return messageType, m, nil
+		}
+
+		if err := payload.Process(i, conn); err != nil {
+			fmt.Println("error while processing rpc message:", err.Error())
+		}
+
+		return messageType, m, interceptor.ErrMessageConsumed
+	})
+}
+
+func (i *Interceptor) UnBindSocketConnection(connection interceptor.Connection) {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	if state, exists := i.states[connection]; exists {
+		state.cancel()
+		delete(i.states, connection)
+	}
+}
+
+func (i *Interceptor) Close() error {
+	i.Mutex.Lock()
+	defer i.Mutex.Unlock()
+
+	for _, state := range i.states {
+		state.cancel()
+	}
+	i.states = make(map[interceptor.Connection]*state)
+
+	return nil
+}
+
+func (i *Interceptor) getState(connection interceptor.Connection) (*state, error) {
+	i.Mutex.RLock()
+	defer i.Mutex.RUnlock()
+
+	state, exists := i.states[connection]
+	if !exists {
+		return nil, ErrConnectionNotFound
+	}
+
+	return state, nil
+}
+
+// Call invokes method on the remote side of the connection and waits for its
+// result. The call fails with the context's error when the context is done
+// first, in which case the remote side is asked to cancel the method, and with
+// an *Error when the method failed remotely. Params are encoded with the
+// connection's codec; nil sends no parameters.
+func (i *Interceptor) Call(ctx context.Context, connection interceptor.Connection, method string, params any) (Result, error) {
+	state, err := i.getState(connection)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok && i.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.timeout)
+		defer cancel()
+	}
+
+	codec := interceptor.CodecOf(connection)
+
+	request := &Request{
+		ID:     uuid.NewString(),
+		Method: method,
+	}
+	if params != nil {
+		if request.Params, err = codec.Marshal(params); err != nil {
+			return Result{}, fmt.Errorf("error while encoding params: %w", err)
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		request.Deadline = deadline
+	}
+
+	responses := state.await(request.ID)
+	defer state.forget(request.ID)
+
+	if err := i.send(connection, state, codec, request); err != nil {
+		return Result{}, err
+	}
+
+	select {
+	case response := <-responses:
+		if response.Error != nil {
+			// The remote side may see the deadline pass before this side does
+			if response.Error.Code == CodeCancelled {
+				if err := ctx.Err(); err != nil {
+					return Result{}, err
+				}
+				if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+					return Result{}, context.DeadlineExceeded
+				}
+			}
+			return Result{}, response.Error
+		}
+		return Result{data: response.Result, codec: response.Codec()}, nil
+	case <-ctx.Done():
+		if err := i.send(connection, state, codec, &Cancel{ID: request.ID}); err != nil {
+			fmt.Println("error while cancelling rpc call:", err.Error())
+		}
+		return Result{}, ctx.Err()
+	case <-state.ctx.Done():
+		return Result{}, ErrConnectionClosed
+	}
+}
+
+func (i *Interceptor) send(connection interceptor.Connection, state *state, codec message.Codec, payload message.Message) error {
+	msg, err := message.CreateMessageWithCodec(codec, i.ID, state.peer(), payload)
+	if err != nil {
+		return err
+	}
+
+	return state.writer.Write(connection, websocket.MessageText, msg)
+}
+
+// serve runs the method of an incoming request and writes its response. It
+// runs on its own goroutine so that slow methods do not block the reader.
+func (i *Interceptor) serve(connection interceptor.Connection, state *state, request *Request, method Method) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if request.Deadline.IsZero() {
+		ctx, cancel = context.WithCancel(state.ctx)
+	} else {
+		ctx, cancel = context.WithDeadline(state.ctx, request.Deadline)
+	}
+
+	if !state.start(request.ID, cancel) {
+		cancel()
+		fmt.Println("error while serving rpc request: duplicate id", request.ID)
+		return
+	}
+	defer state.stop(request.ID)
+
+	codec := request.Codec()
+	response := &Response{ID: request.ID}
+
+	result, err := invoke(ctx, connection, method, Params{data: request.Params, codec: codec})
+	if err == nil && result != nil {
+		response.Result, err = codec.Marshal(result)
+	}
+	if err != nil {
+		response.Error = toError(ctx, err)
+	}
+
+	if err := i.send(connection, state, codec, response); err != nil {
+		fmt.Println("error while sending rpc response:", err.Error())
+	}
+}
+
+// invoke runs the method, turning a panic into an error
+func invoke(ctx context.Context, connection interceptor.Connection, method Method, params Params) (result any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("method panicked: %v", r)
+		}
+	}()
+
+	return method(ctx, connection, params)
+}
+
+func toError(ctx context.Context, err error) *Error {
+	var rpcErr *Error
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return &Error{Code: CodeCancelled, Message: err.Error()}
+	}
+
+	return &Error{Code: CodeInternal, Message: err.Error()}
+}
+
+func (payload *Request) Process(i interceptor.Interceptor, connection interceptor.Connection) error {
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
+	rpc, ok := i.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	state, err := rpc.getState(connection)
+	if err != nil {
+		return err
+	}
+	state.setPeer(interceptor.SenderOf(connection, payload))
+
+	method, exists := rpc.method(payload.Method)
+	if !exists {
+		return rpc.send(connection, state, payload.Codec(), &Response{
+			ID:    payload.ID,
+			Error: &Error{Code: CodeMethodNotFound, Message: "method not found: " + payload.Method},
+		})
+	}
+
+	go rpc.serve(connection, state, payload, method)
+
+	return nil
+}
+
+func (payload *Response) Process(i interceptor.Interceptor, connection interceptor.Connection) error {
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
+	rpc, ok := i.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	state, err := rpc.getState(connection)
+	if err != nil {
+		return err
+	}
+	state.setPeer(interceptor.SenderOf(connection, payload))
+	state.resolve(payload)
+
+	return nil
+}
+
+func (payload *Cancel) Process(i interceptor.Interceptor, connection interceptor.Connection) error {
+	if err := payload.Validate(); err != nil {
+		return err
+	}
+
+	rpc, ok := i.(*Interceptor)
+	if !ok {
+		return ErrInvalidInterceptor
+	}
+
+	state, err := rpc.getState(connection)
+	if err != nil {
+		return err
+	}
+	state.stop(payload.ID)
+
+	return nil
+}
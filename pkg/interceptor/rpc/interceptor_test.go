@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor/interceptortest"
+)
+
+func create(t *testing.T, options ...Option) *Interceptor {
+	t.Helper()
+
+	i, err := CreateInterceptorFactory(options...).NewInterceptor(context.Background(), "test")
+	if err != nil {
+		t.Fatalf("NewInterceptor failed: %v", err)
+	}
+
+	return i.(*Interceptor)
+}
+
+type sum struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+func TestCall(t *testing.T) {
+	server := create(t, WithMethod("sum", Handle(func(_ context.Context, _ interceptor.Connection, params sum) (int, error) {
+		return params.A + params.B, nil
+	})))
+	client := create(t)
+	c, _ := interceptortest.Connect(t, client, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	result, err := Invoke[int](ctx, client, c.Conn, "sum", sum{A: 2, B: 3})
+	if err != nil {
+		t.Fatalf("Invoke failed: %v", err)
+	}
+	if result != 5 {
+		t.Errorf("result mismatch: got %v, want %v", result, 5)
+	}
+}
+
+func TestCall_Errors(t *testing.T) {
+	server := create(t, WithMethod("fail", func(context.Context, interceptor.Connection, Params) (any, error) {
+		return nil, &Error{Code: 42, Message: "failed"}
+	}))
+	client := create(t)
+	c, _ := interceptortest.Connect(t, client, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var rpcErr *Error
+	if _, err := client.Call(ctx, c.Conn, "fail", nil); !errors.As(err, &rpcErr) || rpcErr.Code != 42 {
+		t.Errorf("expected error code 42, got %v", err)
+	}
+	if _, err := client.Call(ctx, c.Conn, "missing", nil); !errors.As(err, &rpcErr) || rpcErr.Code != CodeMethodNotFound {
+		t.Errorf("expected CodeMethodNotFound, got %v", err)
+	}
+}
+
+func TestCall_Cancel(t *testing.T) {
+	cancelled := make(chan struct{})
+	server := create(t, WithMethod("block", func(ctx context.Context, _ interceptor.Connection, _ Params) (any, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	}))
+	client := create(t)
+	c, _ := interceptortest.Connect(t, client, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.Call(ctx, c.Conn, "block", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("remote method was not cancelled")
+	}
+}
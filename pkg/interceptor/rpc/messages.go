@@ -0,0 +1,128 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+var (
+	ProtocolRequest  message.Protocol = "rpc_request"
+	ProtocolResponse message.Protocol = "rpc_response"
+	ProtocolCancel   message.Protocol = "rpc_cancel"
+)
+
+var protocolMap = message.CreateProtocolRegistry()
+
+func init() {
+	message.MustRegister[Request](protocolMap)
+	message.MustRegister[Response](protocolMap)
+	message.MustRegister[Cancel](protocolMap)
+}
+
+// Error codes carried by Error. They follow the JSON-RPC 2.0 reserved codes;
+// applications are free to use any other code for their own errors.
+const (
+	CodeInvalidParams  = -32602
+	CodeMethodNotFound = -32601
+	CodeInternal       = -32603
+	CodeCancelled      = -32800
+)
+
+// Error is the structured error returned by a remote method. Methods return
+// an *Error to control the code and data sent to the caller; any other error
+// is sent as CodeInternal with its message.
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"` // Encoded with the connection's codec
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", err.Code, err.Message)
+}
+
+// Request calls a method on the remote side. ID correlates the request with
+// its Response; Deadline, when set, bounds the execution of the method.
+type Request struct {
+	message.BaseMessage                 // NOTE: EMPTY PAYLOAD
+	ID                  string          `json:"id"`
+	Method              string          `json:"method"`
+	Params              json.RawMessage `json:"params,omitempty"` // Encoded with the connection's codec
+	Deadline            time.Time       `json:"deadline"`
+}
+
+func (payload *Request) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *Request) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+func (payload *Request) Protocol() message.Protocol {
+	return ProtocolRequest
+}
+
+func (payload *Request) Validate() error {
+	if payload.ID == "" || payload.Method == "" {
+		return message.ErrorNotValid
+	}
+	return nil
+}
+
+// Response carries either the result or the error of the Request with the
+// same ID
+type Response struct {
+	message.BaseMessage                 // NOTE: EMPTY PAYLOAD
+	ID                  string          `json:"id"`
+	Result              json.RawMessage `json:"result,omitempty"` // Encoded with the connection's codec
+	Error               *Error          `json:"error,omitempty"`
+}
+
+func (payload *Response) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *Response) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+func (payload *Response) Protocol() message.Protocol {
+	return ProtocolResponse
+}
+
+func (payload *Response) Validate() error {
+	if payload.ID == "" {
+		return message.ErrorNotValid
+	}
+	return nil
+}
+
+// Cancel tells the remote side that the caller gave up on the Request with
+// the same ID, so that the running method can be cancelled
+type Cancel struct {
+	message.BaseMessage        // NOTE: EMPTY PAYLOAD
+	ID                  string `json:"id"`
+}
+
+func (payload *Cancel) Marshal() ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+func (payload *Cancel) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, payload)
+}
+
+func (payload *Cancel) Protocol() message.Protocol {
+	return ProtocolCancel
+}
+
+func (payload *Cancel) Validate() error {
+	if payload.ID == "" {
+		return message.ErrorNotValid
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// Method handles calls to a registered method. The context is cancelled when
+// the caller's deadline passes, the caller cancels the call or the connection
+// closes. Returning an *Error sends it to the caller as is.
+type Method func(ctx context.Context, connection interceptor.Connection, params Params) (any, error)
+
+// Params are the encoded parameters of a request
+type Params struct {
+	data  json.RawMessage
+	codec message.Codec
+}
+
+// Decode decodes the parameters into v. Requests without parameters leave v
+// untouched.
+func (params Params) Decode(v any) error {
+	if len(params.data) == 0 {
+		return nil
+	}
+
+	return params.codec.Unmarshal(params.data, v)
+}
+
+// Result is the encoded result of a call
+type Result struct {
+	data  json.RawMessage
+	codec message.Codec
+}
+
+// Decode decodes the result into v. Methods returning nil leave v untouched.
+func (result Result) Decode(v any) error {
+	if len(result.data) == 0 {
+		return nil
+	}
+
+	return result.codec.Unmarshal(result.data, v)
+}
+
+// Handle adapts a typed function to a Method. Parameters that cannot be
+// decoded into P are answered with CodeInvalidParams.
+func Handle[P, R any](fn func(ctx context.Context, connection interceptor.Connection, params P) (R, error)) Method {
+	return func(ctx context.Context, connection interceptor.Connection, params Params) (any, error) {
+		var p P
+		if err := params.Decode(&p); err != nil {
+			return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+		}
+
+		return fn(ctx, connection, p)
+	}
+}
+
+// Invoke calls method on the remote side of the connection and decodes the
+// result into R. See Interceptor.Call.
+func Invoke[R any](ctx context.Context, i *Interceptor, connection interceptor.Connection, method string, params any) (R, error) {
+	var r R
+
+	result, err := i.Call(ctx, connection, method, params)
+	if err != nil {
+		return r, err
+	}
+
+	if err := result.Decode(&r); err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
@@ -0,0 +1,92 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+)
+
+// state keeps the calls in flight on a single connection: the calls made by
+// this side waiting for their response, and the methods running for calls
+// made by the remote side.
+type state struct {
+	peerid  string
+	writer  interceptor.Writer
+	pending map[string]chan *Response     // Outgoing calls by correlation ID
+	running map[string]context.CancelFunc // Incoming calls by correlation ID
+	mux     sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (state *state) peer() string {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+
+	return state.peerid
+}
+
+func (state *state) setPeer(id string) {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+
+	state.peerid = id
+}
+
+// await registers an outgoing call and returns the channel its response is
+// delivered on
+func (state *state) await(id string) chan *Response {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+
+	responses := make(chan *Response, 1)
+	state.pending[id] = responses
+
+	return responses
+}
+
+func (state *state) forget(id string) {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+
+	delete(state.pending, id)
+}
+
+// resolve delivers a response to the call waiting for it. Responses to calls
+// that already gave up are dropped.
+func (state *state) resolve(response *Response) bool {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+
+	responses, exists := state.pending[response.ID]
+	if !exists {
+		return false
+	}
+	delete(state.pending, response.ID)
+	responses <- response
+
+	return true
+}
+
+func (state *state) start(id string, cancel context.CancelFunc) bool {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+
+	if _, exists := state.running[id]; exists {
+		return false
+	}
+	state.running[id] = cancel
+
+	return true
+}
+
+func (state *state) stop(id string) {
+	state.mux.Lock()
+	defer state.mux.Unlock()
+
+	if cancel, exists := state.running[id]; exists {
+		cancel()
+		delete(state.running, id)
+	}
+}
@@ -0,0 +1,139 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes messages for the wire. Each codec is identified by the
+// WebSocket subprotocol it is negotiated with; connections that did not
+// negotiate a subprotocol use JSON. Codecs encode structs through their json
+// tags, so message types work with every codec without changes.
+type Codec interface {
+	// Name is the WebSocket subprotocol the codec is negotiated with
+	Name() string
+	// Binary reports whether the codec output must be sent in binary frames
+	Binary() bool
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSON        Codec = jsonCodec{}
+	CBOR        Codec = createCBORCodec()
+	MessagePack Codec = msgpackCodec{}
+
+	codecs = struct {
+		registered map[string]Codec
+		mux        sync.RWMutex
+	}{
+		registered: map[string]Codec{
+			JSON.Name():        JSON,
+			CBOR.Name():        CBOR,
+			MessagePack.Name(): MessagePack,
+		},
+	}
+)
+
+// RegisterCodec makes a custom codec available for subprotocol negotiation
+// and to LookupCodec. Registering the same codec twice is a no-op; a
+// different codec under an existing name is rejected.
+func RegisterCodec(codec Codec) error {
+	codecs.mux.Lock()
+	defer codecs.mux.Unlock()
+
+	if registered, exists := codecs.registered[codec.Name()]; exists {
+		if registered != codec {
+			return fmt.Errorf("codec %s already registered", codec.Name())
+		}
+		return nil
+	}
+	codecs.registered[codec.Name()] = codec
+
+	return nil
+}
+
+// LookupCodec returns the codec registered for the subprotocol name
+func LookupCodec(name string) (Codec, bool) {
+	codecs.mux.RLock()
+	defer codecs.mux.RUnlock()
+
+	codec, exists := codecs.registered[name]
+	return codec, exists
+}
+
+// CodecNames returns the subprotocol names of the given codecs, in order
+func CodecNames(codecs ...Codec) []string {
+	names := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		names = append(names, codec.Name())
+	}
+
+	return names
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return "json" }
+func (jsonCodec) Binary() bool                       { return false }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type cborCodec struct {
+	encoder cbor.EncMode
+	decoder cbor.DecMode
+}
+
+func createCBORCodec() Codec {
+	encoder, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+
+	decoder, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any(nil))}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+
+	return &cborCodec{encoder: encoder, decoder: decoder}
+}
+
+func (*cborCodec) Name() string { return "cbor" }
+func (*cborCodec) Binary() bool { return true }
+
+func (codec *cborCodec) Marshal(v any) ([]byte, error) {
+	return codec.encoder.Marshal(v)
+}
+
+func (codec *cborCodec) Unmarshal(data []byte, v any) error {
+	return codec.decoder.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) Binary() bool { return true }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
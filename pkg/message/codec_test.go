@@ -0,0 +1,98 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type binaryMessage struct {
+	BaseMessage
+	Data      []byte    `json:"data"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (m *binaryMessage) Marshal() ([]byte, error)    { return JSON.Marshal(m) }
+func (m *binaryMessage) Unmarshal(data []byte) error { return JSON.Unmarshal(data, m) }
+func (m *binaryMessage) Protocol() Protocol          { return "binary" }
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	registry := CreateProtocolRegistry()
+	MustRegister[binaryMessage](registry)
+
+	payload := &binaryMessage{Data: []byte{0x00, 0xff, 0x10}, Timestamp: time.Now()}
+
+	for _, codec := range []Codec{JSON, CBOR, MessagePack} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			frame, err := CreateMessage("sender", "receiver", payload)
+			if err != nil {
+				t.Fatalf("CreateMessage failed: %v", err)
+			}
+
+			data, err := Encode(codec, frame)
+			if err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+
+			decoded, err := Decode(codec, data)
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if decoded.Header != frame.Header {
+				t.Errorf("header mismatch: got %+v, want %+v", decoded.Header, frame.Header)
+			}
+
+			msg, err := ProtocolDecode(registry, decoded)
+			if err != nil {
+				t.Fatalf("ProtocolDecode failed: %v", err)
+			}
+
+			got := msg.(*binaryMessage)
+			if !bytes.Equal(got.Data, payload.Data) {
+				t.Errorf("Data mismatch: got %v, want %v", got.Data, payload.Data)
+			}
+			if !got.Timestamp.Equal(payload.Timestamp) {
+				t.Errorf("Timestamp mismatch: got %v, want %v", got.Timestamp, payload.Timestamp)
+			}
+			if got.Codec() != codec || got.SenderID != "sender" {
+				t.Errorf("message not stamped with frame codec and header")
+			}
+		})
+	}
+}
+
+func TestEncode_Transcode(t *testing.T) {
+	frame, err := CreateMessage("sender", "receiver", &testMessage{Value: "hello"})
+	if err != nil {
+		t.Fatalf("CreateMessage failed: %v", err)
+	}
+
+	data, err := Encode(CBOR, frame)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	// A frame read from a CBOR connection forwarded to a MessagePack one
+	received, err := Decode(CBOR, data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	data, err = Encode(MessagePack, received)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	forwarded, err := Decode(MessagePack, data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	msg := &testMessage{}
+	if err := forwarded.DecodePayload(msg); err != nil {
+		t.Fatalf("DecodePayload failed: %v", err)
+	}
+	if msg.Value != "hello" {
+		t.Errorf("Value mismatch: got %q, want %q", msg.Value, "hello")
+	}
+}
@@ -3,5 +3,7 @@ package message
 import "errors"
 
 var (
-	ErrorNotValid = errors.New("not valid")
+	ErrorNotValid        = errors.New("not valid")
+	ErrorProtocolExists  = errors.New("protocol already registered")
+	ErrorProtocolUnknown = errors.New("protocol not registered")
 )
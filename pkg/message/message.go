@@ -2,24 +2,23 @@ package message
 
 import (
 	"encoding/json"
-	"errors"
-
-	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"fmt"
 )
 
 type Protocol string
 
 var NoneProtocol Protocol = "none"
 
-type ProtocolRegistry map[Protocol]Message
-
+// Message is the data side of every protocol message. It only knows how to
+// encode, decode and validate itself; acting on a message is left to the
+// layer dispatching it (see interceptor.Message), which keeps this package
+// free of dependencies on the interceptors.
 type Message interface {
 	Marshal() ([]byte, error)
 	Unmarshal([]byte) error
 	Protocol() Protocol
 	Message() *BaseMessage
 	Validate() error
-	Process(interceptor.Interceptor, interceptor.Connection) error
 }
 
 type Header struct {
@@ -38,17 +37,86 @@ func (header *Header) Validate() error {
 
 type BaseMessage struct {
 	Header
-	Payload json.RawMessage `json:"payload,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"` // Encoded with the frame's codec
+
+	payload Message // Payload the frame was created from, if any
+	codec   Codec   // Codec Payload is encoded with; nil means JSON
 }
 
 func (msg *BaseMessage) Marshal() ([]byte, error) {
-	return json.Marshal(msg)
+	return Encode(JSON, msg)
 }
 
 func (msg *BaseMessage) Unmarshal(data []byte) error {
+	msg.codec = nil
 	return json.Unmarshal(data, msg)
 }
 
+// Codec returns the codec the payload of the frame is encoded with
+func (msg *BaseMessage) Codec() Codec {
+	if msg.codec == nil {
+		return JSON
+	}
+
+	return msg.codec
+}
+
+// DecodePayload decodes the payload of the frame into the given message or
+// any other value the codec can decode into
+func (msg *BaseMessage) DecodePayload(into any) error {
+	return msg.Codec().Unmarshal(msg.Payload, into)
+}
+
+// encodePayload returns the payload encoded with codec. Frames created by
+// CreateMessage re-encode the message they were created from; frames read
+// from another connection are transcoded on a best effort basis.
+func (msg *BaseMessage) encodePayload(codec Codec) (json.RawMessage, error) {
+	if len(msg.Payload) == 0 || msg.Codec().Name() == codec.Name() {
+		return msg.Payload, nil
+	}
+
+	if msg.payload != nil {
+		return codec.Marshal(msg.payload)
+	}
+
+	var value any
+	if err := msg.Codec().Unmarshal(msg.Payload, &value); err != nil {
+		return nil, fmt.Errorf("error while transcoding payload from %s: %w", msg.Codec().Name(), err)
+	}
+
+	return codec.Marshal(value)
+}
+
+// Encode encodes the message with codec. The payload of a frame is encoded
+// with the same codec, so that the whole frame uses a single encoding.
+func Encode(codec Codec, msg Message) ([]byte, error) {
+	frame, ok := msg.(*BaseMessage)
+	if !ok {
+		return codec.Marshal(msg)
+	}
+
+	payload, err := frame.encodePayload(codec)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := *frame
+	encoded.Payload = payload
+
+	return codec.Marshal(&encoded)
+}
+
+// Decode decodes a frame encoded with codec
+func Decode(codec Codec, data []byte) (*BaseMessage, error) {
+	msg := &BaseMessage{}
+	if err := codec.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	msg.codec = codec
+
+	return msg, nil
+}
+
 func (msg *BaseMessage) Protocol() Protocol {
 	return NoneProtocol
 }
@@ -61,10 +129,6 @@ func (msg *BaseMessage) Validate() error {
 	return msg.Header.Validate()
 }
 
-func (msg *BaseMessage) Process(interceptor.Interceptor, interceptor.Connection) error {
-	return nil
-}
-
 func CreateMessage(senderID, receiverID string, payload Message) (*BaseMessage, error) {
 	var (
 		data     json.RawMessage = nil
@@ -87,6 +151,28 @@ func CreateMessage(senderID, receiverID string, payload Message) (*BaseMessage,
 			Protocol:   protocol,
 		},
 		Payload: data,
+		payload: payload,
+	}, nil
+}
+
+// CreateMessageWithCodec is like CreateMessage but encodes the payload with
+// the given codec right away. It is meant for payloads that carry data already
+// encoded with the codec of the connection they are written to.
+func CreateMessageWithCodec(codec Codec, senderID, receiverID string, payload Message) (*BaseMessage, error) {
+	data, err := codec.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BaseMessage{
+		Header: Header{
+			SenderID:   senderID,
+			ReceiverID: receiverID,
+			Protocol:   payload.Protocol(),
+		},
+		Payload: data,
+		payload: payload,
+		codec:   codec,
 	}, nil
 }
 
@@ -100,16 +186,3 @@ func CreateMessageFromData(senderID, receiverID string, protocol Protocol, paylo
 		Payload: payload,
 	}
 }
-
-func ProtocolUnmarshal(registry ProtocolRegistry, protocol Protocol, data json.RawMessage) (Message, error) {
-	msg, exists := registry[protocol]
-	if !exists {
-		return nil, errors.New("protocol no match")
-	}
-
-	if err := msg.Unmarshal(data); err != nil {
-		return nil, err
-	}
-
-	return msg, nil
-}
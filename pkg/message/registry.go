@@ -0,0 +1,136 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Constructor returns a new, empty message ready to be unmarshalled into
+type Constructor = func() Message
+
+// ProtocolRegistry maps protocols to the constructors of their messages. Every
+// lookup creates a fresh message, so concurrent decodes never share state and
+// no fields leak from one message into the next. It is safe for concurrent use.
+type ProtocolRegistry struct {
+	constructors map[Protocol]Constructor
+	mux          sync.RWMutex
+}
+
+func CreateProtocolRegistry() *ProtocolRegistry {
+	return &ProtocolRegistry{
+		constructors: make(map[Protocol]Constructor),
+	}
+}
+
+// Register adds the constructor for protocol. Registering a protocol twice
+// returns ErrorProtocolExists.
+func (registry *ProtocolRegistry) Register(protocol Protocol, constructor Constructor) error {
+	if constructor == nil {
+		return fmt.Errorf("nil constructor for protocol %s", protocol)
+	}
+
+	registry.mux.Lock()
+	defer registry.mux.Unlock()
+
+	if _, exists := registry.constructors[protocol]; exists {
+		return fmt.Errorf("%w: %s", ErrorProtocolExists, protocol)
+	}
+	registry.constructors[protocol] = constructor
+
+	return nil
+}
+
+// Register adds message type T to the registry under the protocol reported by
+// its Protocol method, e.g. Register[Ping](registry).
+func Register[T any, PT interface {
+	*T
+	Message
+}](registry *ProtocolRegistry) error {
+	protocol := PT(new(T)).Protocol()
+
+	return registry.Register(protocol, func() Message {
+		return PT(new(T))
+	})
+}
+
+// MustRegister is like Register but panics on error. It is meant for package
+// level registries populated in init.
+func MustRegister[T any, PT interface {
+	*T
+	Message
+}](registry *ProtocolRegistry) {
+	if err := Register[T, PT](registry); err != nil {
+		panic(err)
+	}
+}
+
+// Has reports whether protocol is registered
+func (registry *ProtocolRegistry) Has(protocol Protocol) bool {
+	registry.mux.RLock()
+	defer registry.mux.RUnlock()
+
+	_, exists := registry.constructors[protocol]
+	return exists
+}
+
+// New returns a fresh message for protocol
+func (registry *ProtocolRegistry) New(protocol Protocol) (Message, error) {
+	registry.mux.RLock()
+	constructor, exists := registry.constructors[protocol]
+	registry.mux.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrorProtocolUnknown, protocol)
+	}
+
+	return constructor(), nil
+}
+
+// Protocols returns the registered protocols in sorted order
+func (registry *ProtocolRegistry) Protocols() []Protocol {
+	registry.mux.RLock()
+	defer registry.mux.RUnlock()
+
+	protocols := make([]Protocol, 0, len(registry.constructors))
+	for protocol := range registry.constructors {
+		protocols = append(protocols, protocol)
+	}
+	slices.Sort(protocols)
+
+	return protocols
+}
+
+// ProtocolUnmarshal decodes data into a fresh message of the given protocol
+func ProtocolUnmarshal(registry *ProtocolRegistry, protocol Protocol, data json.RawMessage) (Message, error) {
+	msg, err := registry.New(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := msg.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// ProtocolDecode decodes the payload of a frame into a fresh message of the
+// frame's protocol. The message is stamped with the frame's header and codec.
+func ProtocolDecode(registry *ProtocolRegistry, frame *BaseMessage) (Message, error) {
+	msg, err := registry.New(frame.Header.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := frame.DecodePayload(msg); err != nil {
+		return nil, err
+	}
+
+	base := msg.Message()
+	base.Header = frame.Header
+	base.codec = frame.codec
+
+	return msg, nil
+}
@@ -0,0 +1,83 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+)
+
+type testMessage struct {
+	BaseMessage
+	Value string `json:"value"`
+}
+
+func (m *testMessage) Marshal() ([]byte, error)    { return json.Marshal(m) }
+func (m *testMessage) Unmarshal(data []byte) error { return json.Unmarshal(data, m) }
+func (m *testMessage) Protocol() Protocol          { return "test" }
+
+func TestRegister_Duplicate(t *testing.T) {
+	registry := CreateProtocolRegistry()
+
+	if err := Register[testMessage](registry); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if err := Register[testMessage](registry); !errors.Is(err, ErrorProtocolExists) {
+		t.Errorf("expected ErrorProtocolExists, got %v", err)
+	}
+
+	if got := registry.Protocols(); !slices.Equal(got, []Protocol{"test"}) {
+		t.Errorf("Protocols mismatch: got %v", got)
+	}
+}
+
+func TestProtocolUnmarshal_FreshInstances(t *testing.T) {
+	registry := CreateProtocolRegistry()
+	MustRegister[testMessage](registry)
+
+	first, err := ProtocolUnmarshal(registry, "test", json.RawMessage(`{"value":"first"}`))
+	if err != nil {
+		t.Fatalf("ProtocolUnmarshal failed: %v", err)
+	}
+	second, err := ProtocolUnmarshal(registry, "test", json.RawMessage(`{}`))
+	if err != nil {
+		t.Fatalf("ProtocolUnmarshal failed: %v", err)
+	}
+
+	if first.(*testMessage).Value != "first" {
+		t.Errorf("first message overwritten: got %q", first.(*testMessage).Value)
+	}
+	if second.(*testMessage).Value != "" {
+		t.Errorf("field leaked into second message: got %q", second.(*testMessage).Value)
+	}
+
+	if _, err := ProtocolUnmarshal(registry, "other", nil); !errors.Is(err, ErrorProtocolUnknown) {
+		t.Errorf("expected ErrorProtocolUnknown, got %v", err)
+	}
+}
+
+func TestProtocolUnmarshal_Concurrent(t *testing.T) {
+	registry := CreateProtocolRegistry()
+	MustRegister[testMessage](registry)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, _ := json.Marshal(map[string]int{"n": i})
+			data, _ := json.Marshal(map[string]string{"value": string(value)})
+
+			msg, err := ProtocolUnmarshal(registry, "test", data)
+			if err != nil {
+				t.Errorf("ProtocolUnmarshal failed: %v", err)
+				return
+			}
+			if got := msg.(*testMessage).Value; got != string(value) {
+				t.Errorf("value mismatch: got %q, want %q", got, value)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -1,16 +1,166 @@
 package socket
 
-import "github.com/coder/websocket"
+import (
+	"errors"
+	"fmt"
+	"sync"
 
+	"github.com/coder/websocket"
+	"github.com/google/uuid"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+	"github.com/harshabose/skyline_sonata/serve/pkg/utils"
+)
+
+// ErrPeerNotFound is returned when no live connection has claimed a peer ID
+var ErrPeerNotFound = errors.New("peer not found")
+
+// clients indexes live clients by their connection ID
 type clients = map[string]*client
 
+// client holds a live connection together with the fully intercepted writer
+// used to reach it from outside the interceptor chain.
 type client struct {
-	id         string
-	connection *websocket.Conn
+	id         string // connection ID assigned by the socket on accept
+	peerID     string // bound identity, or the claimed Header.SenderID; empty until the first message
+	connection *interceptor.Conn
+	writer     interceptor.Writer
+	mux        sync.RWMutex
 }
 
-func createClient(connection *websocket.Conn) *client {
+func createClient(connection *interceptor.Conn, writer interceptor.Writer) *client {
 	return &client{
+		id:         uuid.NewString(),
 		connection: connection,
+		writer:     writer,
+	}
+}
+
+func (client *client) getPeerID() string {
+	client.mux.RLock()
+	defer client.mux.RUnlock()
+
+	return client.peerID
+}
+
+// Filter selects the connections a broadcast is delivered to. A nil Filter
+// selects every connection.
+type Filter = func(peerID string, connection interceptor.Connection) bool
+
+// register adds the client to the connection index
+func (socket *Socket) register(client *client) {
+	socket.mux.Lock()
+	defer socket.mux.Unlock()
+
+	socket.clients[client.id] = client
+}
+
+// unregister removes the client from both indexes. The peer index is only
+// cleared if it still points at this client, as a newer connection may have
+// claimed the same peer ID since.
+func (socket *Socket) unregister(client *client) {
+	socket.mux.Lock()
+	defer socket.mux.Unlock()
+
+	delete(socket.clients, client.id)
+
+	peerID := client.getPeerID()
+	if current, exists := socket.peers[peerID]; exists && current == client {
+		delete(socket.peers, peerID)
+	}
+}
+
+// claim updates the peer index when a client's messages carry a new sender ID.
+// The most recent claim for a peer ID wins, except over a client whose
+// connection is authenticated: its peer ID can only be taken over by another
+// connection authenticated as the same principal.
+func (socket *Socket) claim(client *client, peerID string) {
+	if peerID == "" || client.getPeerID() == peerID {
+		return
+	}
+
+	socket.mux.Lock()
+	defer socket.mux.Unlock()
+
+	if current, exists := socket.peers[peerID]; exists && current != client {
+		if _, authenticated := interceptor.IdentityOf(current.connection); authenticated {
+			if principal, _ := interceptor.IdentityOf(client.connection); principal != peerID {
+				return
+			}
+		}
+	}
+
+	client.mux.Lock()
+	previous := client.peerID
+	client.peerID = peerID
+	client.mux.Unlock()
+
+	if current, exists := socket.peers[previous]; exists && current == client {
+		delete(socket.peers, previous)
+	}
+	socket.peers[peerID] = client
+}
+
+// Connections returns a snapshot of every live connection of this socket
+func (socket *Socket) Connections() []interceptor.Connection {
+	socket.mux.RLock()
+	defer socket.mux.RUnlock()
+
+	connections := make([]interceptor.Connection, 0, len(socket.clients))
+	for _, client := range socket.clients {
+		connections = append(connections, client.connection)
+	}
+
+	return connections
+}
+
+// Lookup returns the live connection of the peer with the given ID
+func (socket *Socket) Lookup(peerID string) (interceptor.Connection, bool) {
+	client, exists := socket.lookup(peerID)
+	if !exists {
+		return nil, false
 	}
+
+	return client.connection, true
+}
+
+func (socket *Socket) lookup(peerID string) (*client, bool) {
+	socket.mux.RLock()
+	defer socket.mux.RUnlock()
+
+	client, exists := socket.peers[peerID]
+	return client, exists
+}
+
+// SendTo writes the message to the peer with the given ID through the full
+// interceptor chain of its connection
+func (socket *Socket) SendTo(peerID string, message message.Message) error {
+	client, exists := socket.lookup(peerID)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrPeerNotFound, peerID)
+	}
+
+	return client.writer.Write(client.connection, websocket.MessageText, message)
+}
+
+// Broadcast writes the message to every connection selected by the filter.
+// Delivery continues past failing connections; their errors are collected
+// and returned together.
+func (socket *Socket) Broadcast(message message.Message, filter Filter) error {
+	socket.mux.RLock()
+	targets := make([]*client, 0, len(socket.clients))
+	for _, client := range socket.clients {
+		if filter == nil || filter(client.getPeerID(), client.connection) {
+			targets = append(targets, client)
+		}
+	}
+	socket.mux.RUnlock()
+
+	merr := utils.NewMultiError()
+	for _, client := range targets {
+		merr.Add(client.writer.Write(client.connection, websocket.MessageText, message))
+	}
+
+	return merr.ErrorOrNil()
 }
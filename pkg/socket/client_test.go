@@ -0,0 +1,164 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// principalHeader carries the principal the authenticator binds
+const principalHeader = "X-Principal"
+
+// authenticator binds the principal of the upgrade request's principal
+// header and consumes messages of the "consumed" protocol
+type authenticator struct {
+	interceptor.NoOpInterceptor
+}
+
+func (a *authenticator) NewInterceptor(_ context.Context, _ string) (interceptor.Interceptor, error) {
+	return a, nil
+}
+
+func (a *authenticator) BindSocketConnection(connection interceptor.Connection, writer interceptor.Writer, reader interceptor.Reader) (interceptor.Writer, interceptor.Reader, error) {
+	if request, ok := interceptor.RequestOf(connection); ok && request.Header.Get(principalHeader) != "" {
+		if err := interceptor.BindIdentity(connection, request.Header.Get(principalHeader)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return writer, reader, nil
+}
+
+func (a *authenticator) InterceptSocketReader(reader interceptor.Reader) interceptor.Reader {
+	return interceptor.ReaderFunc(func(connection interceptor.Connection) (websocket.MessageType, message.Message, error) {
+		messageType, msg, err := reader.Read(connection)
+		if err == nil && msg.Message().Header.Protocol == "consumed" {
+			return messageType, msg, interceptor.ErrMessageConsumed
+		}
+
+		return messageType, msg, err
+	})
+}
+
+func authenticated(principal string) *websocket.DialOptions {
+	header := http.Header{}
+	header.Set(principalHeader, principal)
+	return &websocket.DialOptions{HTTPHeader: header}
+}
+
+// expect reads the next message from the connection and checks its protocol
+func expect(t *testing.T, conn *websocket.Conn, protocol message.Protocol) {
+	t.Helper()
+
+	_, data, err := conn.Read(context.Background())
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	msg, err := message.Decode(message.JSON, data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if msg.Header.Protocol != protocol {
+		t.Errorf("protocol mismatch: got %q, want %q", msg.Header.Protocol, protocol)
+	}
+}
+
+func TestSocket_SendTo(t *testing.T) {
+	handler, messages := handled()
+	s, url := serve(t, registryOf(), WithHandler(handler))
+
+	alice := dial(t, url, nil)
+	send(t, alice, "alice", "app")
+	receive(t, messages)
+
+	if _, exists := s.Lookup("alice"); !exists {
+		t.Fatal("alice not found")
+	}
+	if err := s.SendTo("alice", message.CreateMessageFromData("server", "alice", "direct", nil)); err != nil {
+		t.Fatalf("SendTo failed: %v", err)
+	}
+	expect(t, alice, "direct")
+
+	if err := s.SendTo("bob", message.CreateMessageFromData("server", "bob", "direct", nil)); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("expected ErrPeerNotFound, got %v", err)
+	}
+
+	// A later claim of the same peer ID wins between unauthenticated clients
+	other := dial(t, url, nil)
+	send(t, other, "alice", "app")
+	receive(t, messages)
+
+	if err := s.SendTo("alice", message.CreateMessageFromData("server", "alice", "direct", nil)); err != nil {
+		t.Fatalf("SendTo failed: %v", err)
+	}
+	expect(t, other, "direct")
+}
+
+func TestSocket_Broadcast(t *testing.T) {
+	handler, messages := handled()
+	s, url := serve(t, registryOf(), WithHandler(handler))
+
+	alice, bob := dial(t, url, nil), dial(t, url, nil)
+	send(t, alice, "alice", "app")
+	send(t, bob, "bob", "app")
+	receive(t, messages)
+	receive(t, messages)
+
+	onlyBob := func(peerID string, _ interceptor.Connection) bool { return peerID == "bob" }
+	if err := s.Broadcast(message.CreateMessageFromData("server", "bob", "filtered", nil), onlyBob); err != nil {
+		t.Fatalf("Broadcast failed: %v", err)
+	}
+	if err := s.Broadcast(message.CreateMessageFromData("server", "all", "everyone", nil), nil); err != nil {
+		t.Fatalf("Broadcast failed: %v", err)
+	}
+
+	expect(t, bob, "filtered")
+	expect(t, bob, "everyone")
+	expect(t, alice, "everyone")
+}
+
+func TestSocket_ClaimHijack(t *testing.T) {
+	handler, messages := handled()
+	s, url := serve(t, registryOf(&authenticator{}), WithHandler(handler))
+
+	// Authenticated clients are registered under their identity from their
+	// first frame on, whatever sender ID it claims
+	alice := dial(t, url, authenticated("alice"))
+	send(t, alice, "someone", "consumed")
+	waitFor(t, "alice to be registered", func() bool {
+		_, exists := s.Lookup("alice")
+		return exists
+	})
+
+	mallory := dial(t, url, nil)
+	send(t, mallory, "carol", "consumed")
+	send(t, mallory, "alice", "app")
+	receive(t, messages)
+
+	connection, _ := s.Lookup("alice")
+	if principal, _ := interceptor.IdentityOf(connection); principal != "alice" {
+		t.Errorf("alice hijacked by an unauthenticated client")
+	}
+	if _, exists := s.Lookup("someone"); exists {
+		t.Error("authenticated client registered under its claimed sender ID")
+	}
+	if _, exists := s.Lookup("carol"); exists {
+		t.Error("consumed frame claimed a peer ID")
+	}
+
+	// Another connection authenticated as alice takes over
+	again := dial(t, url, authenticated("alice"))
+	send(t, again, "alice", "app")
+	receive(t, messages)
+
+	if err := s.SendTo("alice", message.CreateMessageFromData("server", "alice", "direct", nil)); err != nil {
+		t.Fatalf("SendTo failed: %v", err)
+	}
+	expect(t, again, "direct")
+}
@@ -0,0 +1,146 @@
+package socket
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// endpoint is a websocket path mounted on the socket's router. Each endpoint
+// owns its interceptor chain, accept options and message handler, so that
+// different paths can run different stacks (e.g. encryption only on control).
+type endpoint struct {
+	path          string
+	registry      *interceptor.Registry
+	interceptor   interceptor.Interceptor
+	handler       Handler
+	acceptOptions *websocket.AcceptOptions
+}
+
+// EndpointOption configures a single websocket endpoint
+type EndpointOption = func(*endpoint) error
+
+// WithEndpointInterceptorRegistry sets the registry the endpoint's interceptor
+// chain is built from. Without it, the endpoint runs no interceptors.
+func WithEndpointInterceptorRegistry(registry *interceptor.Registry) EndpointOption {
+	return func(endpoint *endpoint) error {
+		endpoint.registry = registry
+		return nil
+	}
+}
+
+// WithEndpointHandler sets the handler receiving the endpoint's application messages
+func WithEndpointHandler(handler Handler) EndpointOption {
+	return func(endpoint *endpoint) error {
+		endpoint.handler = handler
+		return nil
+	}
+}
+
+// WithEndpointAcceptOptions replaces the accept options derived from the
+// socket settings (origins, compression) for this endpoint only
+func WithEndpointAcceptOptions(options *websocket.AcceptOptions) EndpointOption {
+	return func(endpoint *endpoint) error {
+		endpoint.acceptOptions = options
+		return nil
+	}
+}
+
+// WithEndpointCodecs replaces the codecs offered by the endpoint, in order of
+// preference. See WithCodecs.
+func WithEndpointCodecs(codecs ...message.Codec) EndpointOption {
+	return func(endpoint *endpoint) error {
+		for _, codec := range codecs {
+			if err := message.RegisterCodec(codec); err != nil {
+				return err
+			}
+		}
+		endpoint.acceptOptions.Subprotocols = message.CodecNames(codecs...)
+		return nil
+	}
+}
+
+// WithEndpoint mounts an additional websocket endpoint on the given path when
+// the socket is created. See HandleWebSocket.
+func WithEndpoint(path string, options ...EndpointOption) Option {
+	return func(socket *Socket) error {
+		socket.pending = append(socket.pending, func() error {
+			return socket.HandleWebSocket(path, options...)
+		})
+		return nil
+	}
+}
+
+// WithHTTPHandler mounts a plain HTTP handler (health checks, metrics, ...) on
+// the socket's router when the socket is created. See Handle.
+func WithHTTPHandler(pattern string, handler http.Handler) Option {
+	return func(socket *Socket) error {
+		socket.pending = append(socket.pending, func() error {
+			socket.Handle(pattern, handler)
+			return nil
+		})
+		return nil
+	}
+}
+
+// HandleWebSocket mounts a websocket endpoint on path. The endpoint gets its own
+// interceptor chain built from its registry, its own accept options (a copy of
+// the socket defaults unless replaced) and its own message handler. Connections
+// of every endpoint share the socket's connection registry and shutdown.
+func (socket *Socket) HandleWebSocket(path string, options ...EndpointOption) error {
+	defaults := *socket.socketAcceptOptions
+	endpoint := &endpoint{
+		path:          path,
+		handler:       noOpHandler{},
+		acceptOptions: &defaults,
+	}
+
+	for _, option := range options {
+		if err := option(endpoint); err != nil {
+			return err
+		}
+	}
+
+	if endpoint.handler == nil {
+		endpoint.handler = noOpHandler{}
+	}
+
+	chain, err := buildInterceptor(socket, endpoint.registry)
+	if err != nil {
+		return fmt.Errorf("error while building interceptors for %s: %w", path, err)
+	}
+	endpoint.interceptor = chain
+
+	socket.mux.Lock()
+	defer socket.mux.Unlock()
+
+	if _, exists := socket.endpoints[path]; exists {
+		_ = chain.Close()
+		return fmt.Errorf("endpoint %s already exists", path)
+	}
+	socket.endpoints[path] = endpoint
+
+	socket.router.HandleFunc(path, socket.settings.wrap(func(w http.ResponseWriter, r *http.Request) {
+		socket.baseHandler(endpoint, w, r)
+	}))
+
+	return nil
+}
+
+// Handle mounts a plain HTTP handler on the socket's router, next to the
+// websocket endpoints
+func (socket *Socket) Handle(pattern string, handler http.Handler) {
+	socket.router.Handle(pattern, handler)
+}
+
+func buildInterceptor(socket *Socket, registry *interceptor.Registry) (interceptor.Interceptor, error) {
+	if registry == nil {
+		return &interceptor.NoOpInterceptor{}, nil
+	}
+
+	return registry.Build(socket.ctx, socket.id)
+}
@@ -0,0 +1,56 @@
+package socket
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEndpoints(t *testing.T) {
+	defaults, control := newProbe(nil), newProbe(nil)
+	defaultHandler, defaultMessages := handled()
+	controlHandler, controlMessages := handled()
+
+	health := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	s, url := serve(t, registryOf(defaults),
+		WithHandler(defaultHandler),
+		WithEndpoint("/control", WithEndpointInterceptorRegistry(registryOf(control)), WithEndpointHandler(controlHandler)),
+		WithHTTPHandler("/health", health),
+	)
+
+	send(t, dial(t, url+"/", nil), "alice", "app")
+	if msg := receive(t, defaultMessages); msg.Message().SenderID != "alice" {
+		t.Errorf("sender mismatch: got %q, want %q", msg.Message().SenderID, "alice")
+	}
+
+	send(t, dial(t, url+"/control", nil), "bob", "app")
+	if msg := receive(t, controlMessages); msg.Message().SenderID != "bob" {
+		t.Errorf("sender mismatch: got %q, want %q", msg.Message().SenderID, "bob")
+	}
+
+	// Each endpoint runs its own chain only
+	if len(defaults.bound) != 1 || len(control.bound) != 1 {
+		t.Errorf("bound connections mismatch: got %d and %d, want 1 and 1", len(defaults.bound), len(control.bound))
+	}
+	if len(defaultMessages) != 0 || len(controlMessages) != 0 {
+		t.Error("message delivered to the handler of another endpoint")
+	}
+
+	// Connections of every endpoint share the registry
+	if _, exists := s.Lookup("bob"); !exists {
+		t.Error("bob not found")
+	}
+
+	response, err := http.Get("http" + strings.TrimPrefix(url, "ws") + "/health")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("status mismatch: got %d, want %d", response.StatusCode, http.StatusOK)
+	}
+
+	if err := s.HandleWebSocket("/control"); err == nil {
+		t.Error("duplicate endpoint accepted")
+	}
+}
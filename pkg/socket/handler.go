@@ -0,0 +1,33 @@
+package socket
+
+import (
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// Handler processes application messages that made it through the complete
+// interceptor chain of a connection. Protocol messages consumed by interceptors
+// (ping/pong, key exchange, ...) never reach the handler.
+type Handler interface {
+	// Handle is called from the connection's read loop for every application
+	// message. Returning an error does not close the connection.
+	Handle(connection interceptor.Connection, messageType websocket.MessageType, message message.Message) error
+}
+
+// HandlerFunc is a function type that implements the Handler interface
+type HandlerFunc func(connection interceptor.Connection, messageType websocket.MessageType, message message.Message) error
+
+// Handle implements the Handler interface for HandlerFunc
+func (f HandlerFunc) Handle(connection interceptor.Connection, messageType websocket.MessageType, message message.Message) error {
+	return f(connection, messageType, message)
+}
+
+// noOpHandler silently discards application messages. It is used when no
+// handler is registered so that interceptors still see every inbound message.
+type noOpHandler struct{}
+
+func (noOpHandler) Handle(_ interceptor.Connection, _ websocket.MessageType, _ message.Message) error {
+	return nil
+}
@@ -0,0 +1,97 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// systemd passes activated sockets starting at this file descriptor
+const listenFDsStart = 3
+
+// ErrNoSystemdListeners is returned when the process was not started through
+// systemd socket activation
+var ErrNoSystemdListeners = errors.New("no systemd socket activation listeners")
+
+// UnixListener listens on a Unix domain socket at path. A stale socket file
+// left behind by a previous run is removed first; any other existing file is
+// an error. The socket file is removed again when the listener is closed.
+func UnixListener(path string) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	case err == nil:
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	return net.Listen("unix", path)
+}
+
+// SystemdListeners returns the listeners passed to the process through
+// systemd socket activation (LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES).
+// The listeners are keyed by their FileDescriptorName; unnamed sockets use
+// the systemd default name "unknown" suffixed by their index. Names must be
+// unique, as sockets sharing a name could not be told apart. The
+// environment variables are unset so that child processes do not inherit
+// the sockets.
+func SystemdListeners() (map[string]net.Listener, error) {
+	return systemdListeners(listenFDsStart)
+}
+
+func systemdListeners(start int) (map[string]net.Listener, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, ErrNoSystemdListeners
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, ErrNoSystemdListeners
+	}
+
+	fdNames := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	names := make([]string, count)
+	for i := range names {
+		names[i] = "unknown" + strconv.Itoa(i)
+		if i < len(fdNames) && fdNames[i] != "" {
+			names[i] = fdNames[i]
+		}
+
+		if slices.Contains(names[:i], names[i]) {
+			return nil, fmt.Errorf("duplicate systemd socket name %s", names[i])
+		}
+	}
+
+	listeners := make(map[string]net.Listener, count)
+	for i, name := range names {
+		file := os.NewFile(uintptr(start+i), name)
+		listener, err := net.FileListener(file)
+		_ = file.Close() // FileListener duplicates the descriptor
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("error while using systemd socket %s: %w", name, err)
+		}
+
+		listeners[name] = listener
+	}
+
+	return listeners, nil
+}
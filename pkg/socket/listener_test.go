@@ -0,0 +1,130 @@
+//go:build unix
+
+package socket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/coder/websocket"
+)
+
+// overUnix returns dial options reaching the websocket server on the Unix
+// domain socket at path
+func overUnix(path string) *websocket.DialOptions {
+	transport := &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}}
+
+	return &websocket.DialOptions{HTTPClient: &http.Client{Transport: transport}}
+}
+
+func TestUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socket")
+
+	// A stale socket file of a previous run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	listener, err := UnixListener(path)
+	if err != nil {
+		t.Fatalf("UnixListener failed: %v", err)
+	}
+
+	handler, messages := handled()
+	s := socketOf(t, WithHandler(handler))
+	go func() { _ = s.Serve(listener) }()
+
+	conn := dial(t, "ws://socket", overUnix(path))
+	send(t, conn, "alice", "app")
+	receive(t, messages)
+
+	regular := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(regular, nil, 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := UnixListener(regular); err == nil {
+		t.Error("regular file replaced by a socket")
+	}
+}
+
+// activate passes the listener to systemdListeners as if systemd had, and
+// returns the first descriptor to read from
+func activate(t *testing.T, listener net.Listener, names string) int {
+	t.Helper()
+
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	// systemdListeners takes ownership of the descriptor
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatalf("Dup failed: %v", err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", names)
+
+	return fd
+}
+
+func TestSystemdListeners(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	listeners, err := systemdListeners(activate(t, listener, "web"))
+	if err != nil {
+		t.Fatalf("systemdListeners failed: %v", err)
+	}
+	if len(listeners) != 1 || listeners["web"] == nil {
+		t.Fatalf("listeners mismatch: got %v, want web", listeners)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("environment not unset")
+	}
+
+	handler, messages := handled()
+	s := socketOf(t, WithHandler(handler))
+	go func() { _ = s.Serve(listeners["web"]) }()
+
+	conn := dial(t, "ws://"+listener.Addr().String(), nil)
+	send(t, conn, "alice", "app")
+	receive(t, messages)
+}
+
+func TestSystemdListeners_Errors(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	if _, err := SystemdListeners(); !errors.Is(err, ErrNoSystemdListeners) {
+		t.Errorf("expected ErrNoSystemdListeners for another process, got %v", err)
+	}
+
+	// Duplicate names are refused before any descriptor is used
+	for _, names := range []string{"web:web", ":unknown0"} {
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		t.Setenv("LISTEN_FDS", "2")
+		t.Setenv("LISTEN_FDNAMES", names)
+
+		if _, err := systemdListeners(-1); err == nil {
+			t.Errorf("duplicate names %q accepted", names)
+		}
+	}
+}
@@ -1,3 +1,201 @@
 package socket
 
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/coder/websocket"
+	"golang.org/x/time/rate"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
 type Option = func(*Socket) error
+
+// WithHandler registers the handler that receives every application message
+// read from connections of the default endpoint. Additional endpoints take
+// their own handler through WithEndpointHandler.
+func WithHandler(handler Handler) Option {
+	return func(socket *Socket) error {
+		socket.handler = handler
+		return nil
+	}
+}
+
+// WithShutdownTimeout bounds how long Shutdown waits for in-flight writes to
+// drain and for peers to complete the close handshake
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(socket *Socket) error {
+		socket.settings.ShutdownTimeout = timeout
+		return nil
+	}
+}
+
+// WithCloseStatus sets the status code and reason of the close frame sent to
+// every peer on Shutdown
+func WithCloseStatus(code websocket.StatusCode, reason string) Option {
+	return func(socket *Socket) error {
+		socket.settings.CloseStatus = code
+		socket.settings.CloseReason = reason
+		return nil
+	}
+}
+
+// WithAddress sets the TCP address used by ListenAndServe and ListenAndServeTLS
+func WithAddress(addr string) Option {
+	return func(socket *Socket) error {
+		socket.settings.Addr = addr
+		return nil
+	}
+}
+
+// WithTLSCertFiles configures TLS from PEM encoded certificate and key files
+func WithTLSCertFiles(certFile, keyFile string) Option {
+	return func(socket *Socket) error {
+		socket.settings.TLSCertFile = certFile
+		socket.settings.TLSKeyFile = keyFile
+		return nil
+	}
+}
+
+// WithTLSConfig configures TLS from an in-memory config. The config must carry
+// certificates unless WithTLSCertFiles is used as well.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(socket *Socket) error {
+		socket.settings.TLSConfig = config
+		return nil
+	}
+}
+
+// WithClientCertificates asks TLS clients for a certificate. With
+// tls.RequireAndVerifyClientCert connections without a certificate signed by
+// clientCAs are refused during the handshake; with tls.VerifyClientCertIfGiven
+// only certificates that are presented are verified. Verified certificates
+// become connection identities through the mtls interceptor.
+func WithClientCertificates(clientAuth tls.ClientAuthType, clientCAs *x509.CertPool) Option {
+	return func(socket *Socket) error {
+		if clientAuth >= tls.VerifyClientCertIfGiven && clientCAs == nil {
+			return errors.New("client certificate verification requires client CAs")
+		}
+		socket.settings.ClientAuth = clientAuth
+		socket.settings.ClientCAs = clientCAs
+		return nil
+	}
+}
+
+// WithBasePath sets the path the default websocket endpoint is mounted on
+func WithBasePath(path string) Option {
+	return func(socket *Socket) error {
+		socket.settings.BasePath = path
+		return nil
+	}
+}
+
+// WithCORS enables cross-origin upgrades from the given origin host patterns
+// (e.g. "example.com", "*.example.com"). A single "*" allows every origin and
+// disables origin verification; only use it when another layer authenticates
+// connections.
+func WithCORS(origins ...string) Option {
+	return func(socket *Socket) error {
+		socket.settings.EnableCORS = true
+		socket.settings.CORSAllowOrigins = origins
+		return nil
+	}
+}
+
+// WithCORSMethods sets the methods advertised in Access-Control-Allow-Methods
+func WithCORSMethods(methods ...string) Option {
+	return func(socket *Socket) error {
+		socket.settings.CORSAllowMethods = methods
+		return nil
+	}
+}
+
+// WithCORSHeaders sets the headers advertised in Access-Control-Allow-Headers
+func WithCORSHeaders(headers ...string) Option {
+	return func(socket *Socket) error {
+		socket.settings.CORSAllowHeaders = headers
+		return nil
+	}
+}
+
+// WithCompression enables permessage-deflate with the given mode. Messages
+// smaller than threshold bytes are sent uncompressed; 0 uses the websocket
+// package default.
+func WithCompression(mode websocket.CompressionMode, threshold int) Option {
+	return func(socket *Socket) error {
+		socket.settings.EnableCompression = mode != websocket.CompressionDisabled
+		socket.settings.CompressionMode = mode
+		socket.settings.CompressionThreshold = threshold
+		return nil
+	}
+}
+
+// WithMaxConnections caps the number of concurrent connections. Upgrades over
+// the cap are rejected with HTTP 503. Zero means no cap.
+func WithMaxConnections(max int) Option {
+	return func(socket *Socket) error {
+		if max < 0 {
+			return errors.New("max connections cannot be negative")
+		}
+		socket.settings.MaxConnections = max
+		return nil
+	}
+}
+
+// WithMessageSizeLimit sets the maximum size in bytes of a single inbound
+// message. Larger messages close the connection with StatusMessageTooBig.
+func WithMessageSizeLimit(limit int64) Option {
+	return func(socket *Socket) error {
+		socket.settings.MessageSizeLimit = limit
+		return nil
+	}
+}
+
+// WithCodecs sets the codecs connections can negotiate through the WebSocket
+// subprotocol, in order of preference. Connections that do not request one of
+// them use JSON. Custom codecs are registered with message.RegisterCodec.
+func WithCodecs(codecs ...message.Codec) Option {
+	return func(socket *Socket) error {
+		for _, codec := range codecs {
+			if err := message.RegisterCodec(codec); err != nil {
+				return err
+			}
+		}
+		socket.settings.Codecs = codecs
+		return nil
+	}
+}
+
+// WithPing enables websocket level keepalive pings every interval. A
+// connection whose pong does not arrive within wait is closed.
+func WithPing(interval, wait time.Duration) Option {
+	return func(socket *Socket) error {
+		socket.settings.PingInterval = interval
+		socket.settings.PongWait = wait
+		return nil
+	}
+}
+
+// WithWriteWait bounds the time a single write may take before the
+// connection is considered broken
+func WithWriteWait(wait time.Duration) Option {
+	return func(socket *Socket) error {
+		if wait <= 0 {
+			return errors.New("write wait must be positive")
+		}
+		socket.settings.WriteWait = wait
+		return nil
+	}
+}
+
+// WithRateLimiter gates the upgrade handler with the limiter. Upgrade
+// requests exceeding the limit are rejected with HTTP 429.
+func WithRateLimiter(limiter *rate.Limiter) Option {
+	return func(socket *Socket) error {
+		socket.settings.RateLimiter = limiter
+		return nil
+	}
+}
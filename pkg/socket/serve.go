@@ -0,0 +1,70 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ErrTLSNotConfigured is returned when TLS serving is requested without
+// certificate files or a TLS config carrying certificates
+var ErrTLSNotConfigured = errors.New("tls not configured")
+
+// ListenAndServe serves plain HTTP on settings.Addr until Shutdown is called.
+// Use it for local development or behind a TLS-terminating proxy.
+func (socket *Socket) ListenAndServe() error {
+	return served(socket.server.ListenAndServe())
+}
+
+// ListenAndServeTLS serves HTTPS on settings.Addr until Shutdown is called.
+// Certificates are taken from settings.TLSCertFile and settings.TLSKeyFile
+// when set; otherwise the in-memory settings.TLSConfig must provide them
+// through Certificates or GetCertificate.
+func (socket *Socket) ListenAndServeTLS() error {
+	if err := socket.checkTLS(); err != nil {
+		return err
+	}
+
+	return served(socket.server.ListenAndServeTLS(socket.settings.TLSCertFile, socket.settings.TLSKeyFile))
+}
+
+// Serve serves plain HTTP on a caller-supplied listener until Shutdown is
+// called. This covers Unix domain sockets (see UnixListener), systemd socket
+// activation (see SystemdListeners) and any listener the caller already owns.
+func (socket *Socket) Serve(listener net.Listener) error {
+	return served(socket.server.Serve(listener))
+}
+
+// ServeTLS is like Serve but terminates TLS on the listener, with
+// certificates configured as for ListenAndServeTLS.
+func (socket *Socket) ServeTLS(listener net.Listener) error {
+	if err := socket.checkTLS(); err != nil {
+		return err
+	}
+
+	return served(socket.server.ServeTLS(listener, socket.settings.TLSCertFile, socket.settings.TLSKeyFile))
+}
+
+func (socket *Socket) checkTLS() error {
+	if socket.settings.TLSCertFile != "" && socket.settings.TLSKeyFile != "" {
+		return nil
+	}
+
+	config := socket.settings.TLSConfig
+	if config != nil && (len(config.Certificates) > 0 || config.GetCertificate != nil || config.GetConfigForClient != nil) {
+		return nil
+	}
+
+	return ErrTLSNotConfigured
+}
+
+// served maps the error returned by the http.Server serve methods. Stopping
+// through Shutdown is not an error.
+func served(err error) error {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error while serving HTTP server: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package socket
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// certificate returns a self-signed certificate for 127.0.0.1 together with
+// a pool trusting it
+func certificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "server"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// socketOf creates a socket without serving it. It is shut down when the
+// test ends.
+func socketOf(t *testing.T, options ...Option) *Socket {
+	t.Helper()
+
+	api, err := CreateAPI(WithInterceptorRegistry(registryOf()))
+	if err != nil {
+		t.Fatalf("CreateAPI failed: %v", err)
+	}
+
+	s, err := api.CreateWebSocket(context.Background(), "server", options...)
+	if err != nil {
+		t.Fatalf("CreateWebSocket failed: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+
+	return s
+}
+
+func TestServeTLS(t *testing.T) {
+	cert, pool := certificate(t)
+	handler, messages := handled()
+	s := socketOf(t, WithHandler(handler), WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go func() { _ = s.ServeTLS(listener) }()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	conn := dial(t, "wss://"+listener.Addr().String(), &websocket.DialOptions{HTTPClient: client})
+	send(t, conn, "alice", "app")
+	receive(t, messages)
+
+	// Plain websocket upgrades are refused on the TLS listener
+	if _, _, err := websocket.Dial(context.Background(), "ws://"+listener.Addr().String(), nil); err == nil {
+		t.Error("plain upgrade accepted on TLS listener")
+	}
+}
+
+func TestServeTLS_NotConfigured(t *testing.T) {
+	s := socketOf(t)
+
+	if err := s.ListenAndServeTLS(); !errors.Is(err, ErrTLSNotConfigured) {
+		t.Errorf("expected ErrTLSNotConfigured, got %v", err)
+	}
+	if err := s.ServeTLS(nil); !errors.Is(err, ErrTLSNotConfigured) {
+		t.Errorf("expected ErrTLSNotConfigured, got %v", err)
+	}
+}
+
+func TestServe_Shutdown(t *testing.T) {
+	s := socketOf(t, WithAddress("127.0.0.1:0"))
+
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe() }()
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if err := receive(t, served); err != nil {
+		t.Errorf("stopping through Shutdown reported as %v", err)
+	}
+}
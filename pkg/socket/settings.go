@@ -2,10 +2,17 @@ package socket
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"time"
 
+	"github.com/coder/websocket"
 	"golang.org/x/time/rate"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
 )
 
 type apiSettings struct {
@@ -17,17 +24,22 @@ func registerDefaultAPISettings(settings *apiSettings) error {
 
 type settings struct {
 	// Server settings
+	Addr              string // TCP address to listen on for ListenAndServe and ListenAndServeTLS
 	ReadTimeout       time.Duration
 	WriteTimeout      time.Duration
 	IdleTimeout       time.Duration
 	ReadHeaderTimeout time.Duration
 	MaxHeaderBytes    int
 	ShutdownTimeout   time.Duration
+	CloseStatus       websocket.StatusCode // Status code sent to peers on shutdown
+	CloseReason       string               // Reason sent to peers on shutdown
 
 	// TLS configuration
 	TLSConfig   *tls.Config
 	TLSCertFile string
 	TLSKeyFile  string
+	ClientAuth  tls.ClientAuthType // Client certificate policy; see WithClientCertificates
+	ClientCAs   *x509.CertPool     // Roots client certificates are verified against
 
 	// Connection settings
 	MaxConnections    int
@@ -38,6 +50,7 @@ type settings struct {
 	PongWait         time.Duration
 	WriteWait        time.Duration
 	MessageSizeLimit int64
+	Codecs           []message.Codec // Codecs offered through subprotocol negotiation
 
 	// Router settings
 	BasePath         string
@@ -47,12 +60,15 @@ type settings struct {
 	CORSAllowHeaders []string
 
 	// Middleware
-	EnableLogging     bool
-	EnableCompression bool
-	RateLimiter       *rate.Limiter
+	EnableLogging        bool
+	EnableCompression    bool
+	CompressionMode      websocket.CompressionMode // permessage-deflate mode used when EnableCompression is set
+	CompressionThreshold int                       // Minimum message size to compress; 0 uses the websocket default
+	RateLimiter          *rate.Limiter
 }
 
 func (s *settings) apply(socket *Socket) {
+	socket.server.Addr = s.Addr
 	socket.server.ReadTimeout = s.ReadTimeout
 	socket.server.WriteTimeout = s.WriteTimeout
 	socket.server.IdleTimeout = s.IdleTimeout
@@ -60,9 +76,20 @@ func (s *settings) apply(socket *Socket) {
 	socket.server.MaxHeaderBytes = s.MaxHeaderBytes
 
 	socket.server.TLSConfig = s.TLSConfig
+	if s.ClientAuth != tls.NoClientCert {
+		config := &tls.Config{}
+		if s.TLSConfig != nil {
+			config = s.TLSConfig.Clone()
+		}
+		config.ClientAuth = s.ClientAuth
+		config.ClientCAs = s.ClientCAs
+		socket.server.TLSConfig = config
+	}
+
+	socket.socketAcceptOptions.Subprotocols = message.CodecNames(s.Codecs...)
 
 	if s.EnableCORS {
-		// s.applyCORS()
+		s.applyOrigins(socket.socketAcceptOptions)
 	}
 
 	if s.EnableLogging {
@@ -70,14 +97,105 @@ func (s *settings) apply(socket *Socket) {
 	}
 
 	if s.EnableCompression {
+		socket.socketAcceptOptions.CompressionMode = s.CompressionMode
+		socket.socketAcceptOptions.CompressionThreshold = s.CompressionThreshold
+	}
+}
+
+// wrap applies the socket wide HTTP middleware to a websocket endpoint handler
+func (s *settings) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	if s.EnableCORS {
+		handler = s.applyCORS(handler)
+	}
+
+	if s.RateLimiter != nil {
+		handler = s.applyRateLimiter(handler)
+	}
+
+	return handler
+}
 
+// applyOrigins authorises cross-origin upgrades from CORSAllowOrigins. The
+// patterns are host patterns as understood by websocket.AcceptOptions; a "*"
+// pattern disables origin verification altogether.
+func (s *settings) applyOrigins(options *websocket.AcceptOptions) {
+	for _, origin := range s.CORSAllowOrigins {
+		if origin == "*" {
+			options.InsecureSkipVerify = true
+			options.OriginPatterns = nil
+			return
+		}
 	}
+
+	options.OriginPatterns = s.CORSAllowOrigins
+}
+
+// applyCORS wraps the handler to answer preflight requests and to add the
+// CORS response headers for allowed origins.
+func (s *settings) applyCORS(handler http.HandlerFunc) http.HandlerFunc {
+	methods := strings.Join(s.CORSAllowMethods, ", ")
+	headers := strings.Join(s.CORSAllowHeaders, ", ")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && s.isOriginAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			if methods != "" {
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+			}
+			if headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func (s *settings) isOriginAllowed(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range s.CORSAllowOrigins {
+		if pattern == "*" {
+			return true
+		}
+		if matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(u.Host)); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
 }
 
-func (s *settings) applyCORS(handler *http.HandlerFunc) {
+// applyRateLimiter wraps the handler so that upgrade requests exceeding the
+// rate limit are rejected with HTTP 429.
+func (s *settings) applyRateLimiter(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.RateLimiter.Allow() {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
 
+		handler(w, r)
+	}
 }
 
 func registerDefaultSettings(settings *settings) error {
+	settings.ShutdownTimeout = 10 * time.Second
+	settings.CloseStatus = websocket.StatusGoingAway
+	settings.CloseReason = "server shutting down"
+	settings.WriteWait = 100 * time.Millisecond
+	settings.CompressionMode = websocket.CompressionNoContextTakeover
+	settings.Codecs = []message.Codec{message.JSON, message.CBOR, message.MessagePack}
+
 	return nil
 }
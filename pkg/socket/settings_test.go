@@ -0,0 +1,101 @@
+package socket
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/coder/websocket"
+	"golang.org/x/time/rate"
+)
+
+func withOrigin(origin string) *websocket.DialOptions {
+	header := http.Header{}
+	header.Set("Origin", origin)
+	return &websocket.DialOptions{HTTPHeader: header}
+}
+
+// refused dials the socket and returns the HTTP status the upgrade was
+// refused with
+func refused(t *testing.T, url string, options *websocket.DialOptions) int {
+	t.Helper()
+
+	conn, response, err := websocket.Dial(context.Background(), url, options)
+	if err == nil {
+		_ = conn.CloseNow()
+		t.Fatal("upgrade accepted")
+	}
+	if response == nil {
+		t.Fatalf("upgrade failed without response: %v", err)
+	}
+
+	return response.StatusCode
+}
+
+func TestSettings_Origins(t *testing.T) {
+	_, url := serve(t, registryOf(), WithCORS("*.example.com"), WithCORSMethods("GET"))
+
+	dial(t, url, withOrigin("https://app.example.com"))
+	if status := refused(t, url, withOrigin("https://evil.test")); status != http.StatusForbidden {
+		t.Errorf("status mismatch: got %d, want %d", status, http.StatusForbidden)
+	}
+
+	request, _ := http.NewRequest(http.MethodOptions, "http"+strings.TrimPrefix(url, "ws"), nil)
+	request.Header.Set("Origin", "https://app.example.com")
+	request.Header.Set("Access-Control-Request-Method", "GET")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent {
+		t.Errorf("status mismatch: got %d, want %d", response.StatusCode, http.StatusNoContent)
+	}
+	if origin := response.Header.Get("Access-Control-Allow-Origin"); origin != "https://app.example.com" {
+		t.Errorf("allowed origin mismatch: got %q, want %q", origin, "https://app.example.com")
+	}
+}
+
+func TestSettings_MaxConnections(t *testing.T) {
+	handler, messages := handled()
+	s, url := serve(t, registryOf(), WithHandler(handler), WithMaxConnections(1))
+
+	conn := dial(t, url, nil)
+	send(t, conn, "alice", "app")
+	receive(t, messages)
+
+	if status := refused(t, url, nil); status != http.StatusServiceUnavailable {
+		t.Errorf("status mismatch: got %d, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	// The slot is released once the connection closed
+	_ = conn.Close(websocket.StatusNormalClosure, "")
+	waitFor(t, "connection to be removed", func() bool { return len(s.Connections()) == 0 })
+	waitFor(t, "slot to be released", func() bool { return s.active.Load() == 0 })
+	dial(t, url, nil)
+}
+
+func TestSettings_RateLimiter(t *testing.T) {
+	_, url := serve(t, registryOf(), WithRateLimiter(rate.NewLimiter(0, 1)))
+
+	dial(t, url, nil)
+	if status := refused(t, url, nil); status != http.StatusTooManyRequests {
+		t.Errorf("status mismatch: got %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestSettings_MessageSizeLimit(t *testing.T) {
+	handler, messages := handled()
+	_, url := serve(t, registryOf(), WithHandler(handler), WithMessageSizeLimit(128))
+
+	conn := dial(t, url, nil)
+	send(t, conn, "alice", "app")
+	receive(t, messages)
+
+	send(t, conn, strings.Repeat("a", 256), "app")
+	if _, _, err := conn.Read(context.Background()); websocket.CloseStatus(err) != websocket.StatusMessageTooBig {
+		t.Errorf("expected StatusMessageTooBig, got %v", err)
+	}
+}
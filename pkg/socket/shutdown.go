@@ -0,0 +1,163 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/utils"
+)
+
+// ErrSocketClosed is returned for writes attempted after Shutdown has started
+var ErrSocketClosed = errors.New("socket is shutting down")
+
+// acquire registers a new connection handler. It fails once the socket is
+// shutting down so that no new upgrades are accepted.
+func (socket *Socket) acquire() bool {
+	socket.mux.RLock()
+	defer socket.mux.RUnlock()
+
+	if socket.closing {
+		return false
+	}
+
+	socket.handlers.Add(1)
+	return true
+}
+
+// acquireWrite registers an in-flight write. It fails once the socket is
+// shutting down, as in-flight writes are being drained.
+func (socket *Socket) acquireWrite() bool {
+	socket.mux.RLock()
+	defer socket.mux.RUnlock()
+
+	if socket.closing {
+		return false
+	}
+
+	socket.writes.Add(1)
+	return true
+}
+
+// Shutdown gracefully stops the socket. It stops accepting new upgrades, waits
+// for in-flight writes to drain, sends every peer a close frame with the
+// configured status code and finally closes the interceptor chain of every
+// endpoint.
+//
+// The whole procedure is bounded by settings.ShutdownTimeout and by ctx,
+// whichever expires first. Connections still open at that point are closed
+// without a handshake. All errors encountered are collected and returned
+// together.
+func (socket *Socket) Shutdown(ctx context.Context) error {
+	socket.mux.Lock()
+	if socket.closing {
+		socket.mux.Unlock()
+		return ErrSocketClosed
+	}
+	socket.closing = true
+	socket.mux.Unlock()
+
+	if socket.settings.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, socket.settings.ShutdownTimeout)
+		defer cancel()
+	}
+
+	merr := utils.NewMultiError()
+
+	// Hijacked websocket connections are not tracked by http.Server, so this
+	// only closes the listeners and idle HTTP connections.
+	merr.Add(socket.server.Shutdown(ctx))
+
+	if err := wait(ctx, &socket.writes); err != nil {
+		merr.Add(fmt.Errorf("in-flight writes did not drain: %w", err))
+	}
+
+	merr.Add(socket.closeClients(ctx))
+
+	if err := wait(ctx, &socket.handlers); err != nil {
+		merr.Add(fmt.Errorf("connections did not close: %w", err))
+		for _, client := range socket.snapshot() {
+			_ = client.connection.CloseNow()
+		}
+	}
+
+	socket.mux.RLock()
+	for _, endpoint := range socket.endpoints {
+		merr.Add(endpoint.interceptor.Close())
+	}
+	socket.mux.RUnlock()
+
+	return merr.ErrorOrNil()
+}
+
+// closeClients performs the close handshake with every live client
+// concurrently. Clients that do not complete the handshake before ctx
+// expires are closed without it.
+func (socket *Socket) closeClients(ctx context.Context) error {
+	var (
+		wg   sync.WaitGroup
+		mux  sync.Mutex
+		merr = utils.NewMultiError()
+	)
+
+	for _, client := range socket.snapshot() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- client.connection.Close(socket.settings.CloseStatus, socket.settings.CloseReason)
+			}()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				_ = client.connection.CloseNow()
+				err = ctx.Err()
+			}
+
+			if err != nil {
+				mux.Lock()
+				merr.Add(fmt.Errorf("error while closing connection %s: %w", client.id, err))
+				mux.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return merr.ErrorOrNil()
+}
+
+// snapshot returns the live clients at the time of the call
+func (socket *Socket) snapshot() []*client {
+	socket.mux.RLock()
+	defer socket.mux.RUnlock()
+
+	clients := make([]*client, 0, len(socket.clients))
+	for _, client := range socket.clients {
+		clients = append(clients, client)
+	}
+
+	return clients
+}
+
+// wait blocks until the wait group is done or ctx expires
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
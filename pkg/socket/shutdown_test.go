@@ -0,0 +1,80 @@
+package socket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// slowMessage blocks its encoding, and so the write it is part of, until
+// released
+type slowMessage struct {
+	message.BaseMessage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *slowMessage) MarshalJSON() ([]byte, error) {
+	close(m.started)
+	<-m.release
+	return json.Marshal(&m.BaseMessage)
+}
+
+func TestShutdown(t *testing.T) {
+	handler, messages := handled()
+	s, url := serve(t, registryOf(), WithHandler(handler), WithWriteWait(5*time.Second), WithCloseStatus(websocket.StatusServiceRestart, "restarting"))
+
+	alice, bob := dial(t, url, nil), dial(t, url, nil)
+	send(t, alice, "alice", "app")
+	send(t, bob, "bob", "app")
+	receive(t, messages)
+	receive(t, messages)
+
+	slow := &slowMessage{
+		BaseMessage: *message.CreateMessageFromData("server", "alice", "slow", nil),
+		started:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	written := make(chan error, 1)
+	go func() { written <- s.SendTo("alice", slow) }()
+	<-slow.started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	// Shutdown waits for the in-flight write before closing connections
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the in-flight write drained: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(slow.release)
+
+	if err := receive(t, written); err != nil {
+		t.Errorf("in-flight write failed: %v", err)
+	}
+	expect(t, alice, "slow")
+
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		_, _, err := conn.Read(context.Background())
+		if status := websocket.CloseStatus(err); status != websocket.StatusServiceRestart {
+			t.Errorf("close status mismatch: got %v, want %v", status, websocket.StatusServiceRestart)
+		}
+	}
+
+	if err := receive(t, shutdown); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if err := s.Shutdown(context.Background()); !errors.Is(err, ErrSocketClosed) {
+		t.Errorf("expected ErrSocketClosed, got %v", err)
+	}
+	if err := s.Write(nil, websocket.MessageText, message.CreateMessageFromData("server", "alice", "late", nil)); !errors.Is(err, ErrSocketClosed) {
+		t.Errorf("expected ErrSocketClosed, got %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
@@ -14,6 +15,10 @@ import (
 	"github.com/harshabose/skyline_sonata/serve/pkg/message"
 )
 
+// ErrConnectionClosed wraps errors from the underlying websocket read. Once it
+// is returned, no further messages can be read from the connection.
+var ErrConnectionClosed = errors.New("connection closed")
+
 type API struct {
 	settings            *apiSettings
 	interceptorRegistry *interceptor.Registry
@@ -52,16 +57,13 @@ func (api *API) CreateWebSocket(ctx context.Context, id string, options ...Optio
 		id:                  id,
 		settings:            &settings{},
 		socketAcceptOptions: &websocket.AcceptOptions{},
+		registry:            api.interceptorRegistry,
+		endpoints:           make(map[string]*endpoint),
+		clients:             make(clients),
+		peers:               make(map[string]*client),
 		ctx:                 ctx,
 	}
 
-	interceptors, err := api.interceptorRegistry.Build(ctx, id)
-	if err != nil {
-		return nil, err
-	}
-
-	socket.interceptor = interceptors
-
 	if err := registerDefaultSettings(socket.settings); err != nil {
 		return nil, err
 	}
@@ -72,7 +74,7 @@ func (api *API) CreateWebSocket(ctx context.Context, id string, options ...Optio
 		}
 	}
 
-	return socket.setup(), nil
+	return socket.setup()
 }
 
 type Socket struct {
@@ -80,66 +82,207 @@ type Socket struct {
 	settings            *settings
 	server              *http.Server
 	router              *http.ServeMux
-	handlerFunc         *http.HandlerFunc
-	socketAcceptOptions *websocket.AcceptOptions
-	interceptor         interceptor.Interceptor
+	handler             Handler                  // handler of the default endpoint
+	socketAcceptOptions *websocket.AcceptOptions // defaults for every endpoint
+	registry            *interceptor.Registry    // registry of the default endpoint
+	endpoints           map[string]*endpoint     // websocket endpoints by path; guarded by mux
+	pending             []func() error           // routes added through options, mounted in setup
+	clients             clients                  // live clients by connection ID
+	peers               map[string]*client       // live clients by bound identity or claimed peer ID
+	closing             bool                     // set once Shutdown starts; guarded by mux
+	active              atomic.Int64             // accepted connections, checked against settings.MaxConnections
+	handlers            sync.WaitGroup           // running connection handlers
+	writes              sync.WaitGroup           // in-flight writes
 	mux                 sync.RWMutex
 	ctx                 context.Context
 }
 
-func (socket *Socket) setup() *Socket {
+// setup creates the server and mounts the default endpoint at settings.BasePath
+// (backed by the API's interceptor registry and the WithHandler handler),
+// followed by every route added through options.
+func (socket *Socket) setup() (*Socket, error) {
 	socket.router = http.NewServeMux()
-	socket.server = &http.Server{}
-	socket.handlerFunc = socket.baseHandler
+	socket.server = &http.Server{Handler: socket.router}
 
 	socket.settings.apply(socket)
 
-	return socket
-}
+	basePath := socket.settings.BasePath
+	if basePath == "" {
+		basePath = "/"
+	}
 
-func (socket *Socket) serve() error {
-	defer socket.close()
+	if err := socket.HandleWebSocket(basePath, WithEndpointInterceptorRegistry(socket.registry), WithEndpointHandler(socket.handler)); err != nil {
+		return nil, err
+	}
 
-	for {
-		select {
-		case <-socket.ctx.Done():
-			return nil
-		default:
-			if err := socket.server.ListenAndServeTLS(socket.settings.TLSCertFile, socket.settings.TLSKeyFile); err != nil {
-				fmt.Println(errors.New("error while serving HTTP server"))
-				fmt.Println("trying again...")
-			}
+	for _, mount := range socket.pending {
+		if err := mount(); err != nil {
+			return nil, err
 		}
 	}
+	socket.pending = nil
+
+	return socket, nil
 }
 
-func (socket *Socket) baseHandler(w http.ResponseWriter, r *http.Request) {
-	connection, err := websocket.Accept(w, r, socket.socketAcceptOptions)
+func (socket *Socket) baseHandler(endpoint *endpoint, w http.ResponseWriter, r *http.Request) {
+	if !socket.acquire() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer socket.handlers.Done()
+
+	if active := socket.active.Add(1); socket.settings.MaxConnections > 0 && active > int64(socket.settings.MaxConnections) {
+		socket.active.Add(-1)
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer socket.active.Add(-1)
+
+	conn, err := websocket.Accept(w, r, endpoint.acceptOptions)
 	if err != nil {
 		fmt.Println(errors.New("error while accepting socket connection"))
+		return
 	}
+	defer func() { _ = conn.CloseNow() }()
 
-	if _, _, err := socket.interceptor.BindSocketConnection(connection, socket, socket); err != nil {
+	connection := interceptor.WrapConn(conn, r)
+
+	if socket.settings.MessageSizeLimit > 0 {
+		connection.SetReadLimit(socket.settings.MessageSizeLimit)
+	}
+
+	if _, _, err := endpoint.interceptor.BindSocketConnection(connection, socket, socket); err != nil {
+		// Interceptors bound before the failing one keep their state otherwise
+		endpoint.interceptor.UnBindSocketConnection(connection)
 		fmt.Println("error while handling client:", err.Error())
 		return
 	}
 
-	// READ MESSAGE LOOP HERE
+	writer := endpoint.interceptor.InterceptSocketWriter(socket)
+	reader := endpoint.interceptor.InterceptSocketReader(socket)
+
+	client := createClient(connection, writer)
+	socket.register(client)
+
+	defer func() {
+		socket.unregister(client)
+		endpoint.interceptor.UnBindSocketConnection(connection)
+		endpoint.interceptor.UnInterceptSocketReader(reader)
+		endpoint.interceptor.UnInterceptSocketWriter(writer)
+	}()
+
+	// The read loop has to be running before Init, as interceptors like encrypt
+	// block in Init until their handshake messages are read from the connection.
+	done := make(chan error, 1)
+	go func() {
+		done <- socket.loop(endpoint, client, reader)
+	}()
+
+	if socket.settings.PingInterval > 0 {
+		ctx, cancel := context.WithCancel(socket.ctx)
+		defer cancel()
+		go socket.keepalive(ctx, conn)
+	}
 
-	if err := socket.interceptor.Init(connection); err != nil {
-		return
+	if err := endpoint.interceptor.Init(connection); err != nil {
+		fmt.Println("error while initialising client:", err.Error())
+		_ = connection.Close(websocket.StatusInternalError, "initialisation failed")
+	}
+
+	if err := <-done; err != nil {
+		fmt.Println("error while reading from client:", err.Error())
 	}
 }
 
-func (socket *Socket) close() {
+// keepalive sends a websocket ping every settings.PingInterval and closes the
+// connection if the pong does not arrive within settings.PongWait. Pongs are
+// only received while the read loop is running.
+func (socket *Socket) keepalive(ctx context.Context, connection *websocket.Conn) {
+	ticker := time.NewTicker(socket.settings.PingInterval)
+	defer ticker.Stop()
 
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wait := socket.settings.PongWait
+			if wait <= 0 {
+				wait = socket.settings.PingInterval
+			}
+
+			pingCtx, cancel := context.WithTimeout(ctx, wait)
+			err := connection.Ping(pingCtx)
+			cancel()
+
+			if err != nil {
+				if ctx.Err() == nil {
+					_ = connection.Close(websocket.StatusPolicyViolation, "pong timeout")
+				}
+				return
+			}
+		}
+	}
+}
+
+// loop reads messages from the fully intercepted reader until the connection
+// closes, handing every application message to the endpoint's handler.
+// Authenticated clients are kept in the registry under their bound identity
+// as soon as it is bound; others under the sender ID of their last
+// application message, as consumed or failed frames may be forged.
+// A normal closure or socket shutdown is not reported as an error.
+func (socket *Socket) loop(endpoint *endpoint, client *client, reader interceptor.Reader) error {
+	for {
+		messageType, msg, err := reader.Read(client.connection)
+		if principal, authenticated := interceptor.IdentityOf(client.connection); authenticated {
+			socket.claim(client, principal)
+		} else if err == nil {
+			socket.claim(client, msg.Message().SenderID)
+		}
+
+		if err != nil {
+			if errors.Is(err, interceptor.ErrMessageConsumed) {
+				continue
+			}
+
+			if !errors.Is(err, ErrConnectionClosed) {
+				fmt.Println("error while reading message:", err.Error())
+				continue
+			}
+
+			switch websocket.CloseStatus(err) {
+			case websocket.StatusNormalClosure, websocket.StatusGoingAway:
+				return nil
+			}
+			if socket.ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		if err := endpoint.handler.Handle(client.connection, messageType, msg); err != nil {
+			fmt.Println("error while handling message:", err.Error())
+		}
+	}
 }
 
-func (socket *Socket) Write(connection interceptor.Connection, messageType websocket.MessageType, message message.Message) error {
-	ctx, cancel := context.WithTimeout(socket.ctx, 100*time.Millisecond)
+func (socket *Socket) Write(connection interceptor.Connection, messageType websocket.MessageType, msg message.Message) error {
+	if !socket.acquireWrite() {
+		return ErrSocketClosed
+	}
+	defer socket.writes.Done()
+
+	ctx, cancel := context.WithTimeout(socket.ctx, socket.settings.WriteWait)
 	defer cancel()
 
-	data, err := message.Marshal()
+	codec := interceptor.CodecOf(connection)
+	if codec.Binary() {
+		messageType = websocket.MessageBinary
+	}
+
+	data, err := message.Encode(codec, msg)
 	if err != nil {
 		return err
 	}
@@ -147,17 +290,17 @@ func (socket *Socket) Write(connection interceptor.Connection, messageType webso
 	return connection.Write(ctx, messageType, data)
 }
 
+// Read blocks until the next message arrives on the connection. Unlike Write, it
+// is not bounded by a timeout: cancelling a read closes the underlying websocket,
+// so reads only stop when the connection or the socket's context is closed.
 func (socket *Socket) Read(connection interceptor.Connection) (websocket.MessageType, message.Message, error) {
-	ctx, cancel := context.WithTimeout(socket.ctx, 100*time.Millisecond)
-	defer cancel()
-
-	messageType, data, err := connection.Read(ctx)
+	messageType, data, err := connection.Read(socket.ctx)
 	if err != nil {
-		return websocket.MessageText, nil, err
+		return websocket.MessageText, nil, fmt.Errorf("%w: %w", ErrConnectionClosed, err)
 	}
 
-	msg := &message.BaseMessage{}
-	if err := msg.Unmarshal(data); err != nil {
+	msg, err := message.Decode(interceptor.CodecOf(connection), data)
+	if err != nil {
 		return websocket.MessageText, nil, err
 	}
 
@@ -0,0 +1,190 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/harshabose/skyline_sonata/serve/pkg/interceptor"
+	"github.com/harshabose/skyline_sonata/serve/pkg/message"
+)
+
+// probe is an interceptor recording the connections bound to and unbound
+// from it. Binding fails with fail when set.
+type probe struct {
+	interceptor.NoOpInterceptor
+	fail    error
+	bound   chan interceptor.Connection
+	unbound chan interceptor.Connection
+}
+
+func newProbe(fail error) *probe {
+	return &probe{
+		fail:    fail,
+		bound:   make(chan interceptor.Connection, 16),
+		unbound: make(chan interceptor.Connection, 16),
+	}
+}
+
+func (p *probe) NewInterceptor(_ context.Context, _ string) (interceptor.Interceptor, error) {
+	return p, nil
+}
+
+func (p *probe) BindSocketConnection(connection interceptor.Connection, writer interceptor.Writer, reader interceptor.Reader) (interceptor.Writer, interceptor.Reader, error) {
+	if p.fail != nil {
+		return nil, nil, p.fail
+	}
+
+	p.bound <- connection
+	return writer, reader, nil
+}
+
+func (p *probe) UnBindSocketConnection(connection interceptor.Connection) {
+	p.unbound <- connection
+}
+
+func registryOf(factories ...interceptor.Factory) *interceptor.Registry {
+	registry := &interceptor.Registry{}
+	for _, factory := range factories {
+		registry.Register(factory)
+	}
+
+	return registry
+}
+
+// serve starts a socket on a local TCP listener and returns it with its URL.
+// The socket is shut down when the test ends.
+func serve(t *testing.T, registry *interceptor.Registry, options ...Option) (*Socket, string) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	api, err := CreateAPI(WithInterceptorRegistry(registry))
+	if err != nil {
+		t.Fatalf("CreateAPI failed: %v", err)
+	}
+
+	s, err := api.CreateWebSocket(ctx, "server", options...)
+	if err != nil {
+		t.Fatalf("CreateWebSocket failed: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go func() { _ = s.Serve(listener) }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+
+	return s, "ws://" + listener.Addr().String()
+}
+
+func dial(t *testing.T, url string, options *websocket.DialOptions) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.Dial(context.Background(), url, options)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.CloseNow() })
+
+	return conn
+}
+
+// send writes a message of the protocol from the sender as a JSON frame
+func send(t *testing.T, conn *websocket.Conn, senderID string, protocol message.Protocol) {
+	t.Helper()
+
+	data, err := message.Encode(message.JSON, message.CreateMessageFromData(senderID, "server", protocol, nil))
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if err := conn.Write(context.Background(), websocket.MessageText, data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+// handled returns a handler passing every message it receives to the channel
+func handled() (Handler, chan message.Message) {
+	messages := make(chan message.Message, 16)
+	return HandlerFunc(func(_ interceptor.Connection, _ websocket.MessageType, msg message.Message) error {
+		messages <- msg
+		return nil
+	}), messages
+}
+
+func receive[T any](t *testing.T, values chan T) T {
+	t.Helper()
+
+	select {
+	case value := <-values:
+		return value
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	var zero T
+	return zero
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSocket_Dispatch(t *testing.T) {
+	p := newProbe(nil)
+	handler, messages := handled()
+	s, url := serve(t, registryOf(p), WithHandler(handler))
+
+	conn := dial(t, url, nil)
+	bound := receive(t, p.bound)
+
+	send(t, conn, "alice", "app")
+	if msg := receive(t, messages); msg.Message().SenderID != "alice" {
+		t.Errorf("sender mismatch: got %q, want %q", msg.Message().SenderID, "alice")
+	}
+	if connections := s.Connections(); len(connections) != 1 || connections[0] != bound {
+		t.Errorf("connections mismatch: got %v, want [%v]", connections, bound)
+	}
+
+	if err := conn.Close(websocket.StatusNormalClosure, ""); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if unbound := receive(t, p.unbound); unbound != bound {
+		t.Errorf("unbound connection mismatch: got %v, want %v", unbound, bound)
+	}
+	waitFor(t, "connection to be removed", func() bool { return len(s.Connections()) == 0 })
+}
+
+func TestSocket_BindFailure(t *testing.T) {
+	first, failing := newProbe(nil), newProbe(errors.New("rejected"))
+	handler, messages := handled()
+	s, url := serve(t, registryOf(first, failing), WithHandler(handler))
+
+	conn := dial(t, url, nil)
+	bound := receive(t, first.bound)
+
+	// Interceptors bound before the failing one are unbound again
+	if unbound := receive(t, first.unbound); unbound != bound {
+		t.Errorf("unbound connection mismatch: got %v, want %v", unbound, bound)
+	}
+	if _, _, err := conn.Read(context.Background()); err == nil {
+		t.Error("connection not closed after failed bind")
+	}
+	if len(s.Connections()) != 0 || len(messages) != 0 {
+		t.Error("connection registered after failed bind")
+	}
+}